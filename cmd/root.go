@@ -1,14 +1,17 @@
 package cmd
 
 import (
+	"context"
 	"io"
 	"log"
 	"os"
 	"os/signal"
+	"path"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/urjitbhatia/goyaad/pkg/goyaad"
@@ -23,9 +26,44 @@ var raddr = ":11301"
 var statsAddr = ":8125"
 var dataDir string
 var restore bool
+var wal bool
+var walSync string
+var checkpointInterval string
+var checkpointSize int64
+var snapshotKeep int
+var manifestMode string
+var recoveryMode string
 var spokeSpan string
 var rpc bool
 var s3Bucket string
+var s3Prefix string
+var s3Endpoint string
+var s3Region string
+var s3PathStyle bool
+var s3Keep int
+var restoreFromS3 string
+var persisterKind string
+var kvSync string
+var rateLimit float64
+var rateBurst int
+var windows string
+var staging bool
+var misfire string
+var clockJumpThreshold string
+var forwardJump string
+var backwardJump string
+var maxSpokeSpan string
+var maxSpokeJobs int
+var storageMode string
+var spillHorizon string
+var memoryBudget int64
+var pastSpokeBudget int64
+var bodyArenaSize int
+var maxJobs int64
+var maxBytes int64
+var globalMaxJobs int64
+var globalMaxBytes int64
+var shards int
 
 func init() {
 	// Global persistent flags
@@ -36,13 +74,64 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&statsAddr, "statsAddr", "s", statsAddr, "Stats addr (host:port)")
 	rootCmd.PersistentFlags().StringVarP(&spokeSpan, "spokeSpan", "S", "10s", "Spoke span (golang duration string format)")
 
+	rootCmd.PersistentFlags().StringVar(&maxSpokeSpan, "max-spoke-span", "", `Widest spoke (golang duration string format).
+	If wider than spokeSpan, spokes are wide far in the future and split as they get closer or fill up`)
+	rootCmd.PersistentFlags().IntVar(&maxSpokeJobs, "max-spoke-jobs", 10000, "Adaptive spokes holding more jobs than this are split")
+
 	rootCmd.PersistentFlags().BoolVarP(&rpc, "rpc", "R", false, "Expose an rpc server")
 
 	dataDir, _ = os.Getwd()
-	rootCmd.Flags().StringVarP(&dataDir, "dataDir", "d", dataDir, `Data dir location - persits state here when SIGUSR1 is received.
+	rootCmd.Flags().StringVarP(&dataDir, "dataDir", "d", dataDir, `Data dir location - persits state here when SIGUSR1, SIGTERM or SIGINT is received.
 	Restores from this location at start if journal files are present.`)
 	rootCmd.Flags().BoolVarP(&restore, "restore", "r", false, "Restore existing data if possible (from dataDir)")
+	rootCmd.Flags().BoolVar(&wal, "wal", false, "Log every change to a write-ahead log in dataDir so that a crash loses no acknowledged jobs (implies --restore, so that it is replayed)")
+	rootCmd.Flags().StringVar(&walSync, "wal-sync", "always", `When the write-ahead log is synced to disk: "always", "never" (left to the OS)
+or an interval (golang duration string format, e.g. "100ms")`)
+	rootCmd.Flags().StringVar(&checkpointInterval, "checkpoint-interval", "", `Write a snapshot in the background this often (golang duration string format),
+dropping the write-ahead log it covers. Empty disables periodic checkpoints`)
+	rootCmd.Flags().Int64Var(&checkpointSize, "checkpoint-size", 0, "Write a snapshot in the background once the write-ahead log takes more bytes (0 disables)")
+	rootCmd.Flags().IntVar(&snapshotKeep, "snapshot-keep", persistence.DefaultSnapshotsKept, "Snapshots kept in dataDir, restores fall back to older ones if the newest is corrupt")
+	rootCmd.Flags().StringVar(&manifestMode, "manifest", "strict", `What restores do with a snapshot that doesn't match its manifest: "strict" (treated as corrupt)
+	or "permissive" (restored with a warning)`)
+	rootCmd.Flags().StringVar(&recoveryMode, "recovery", "strict", `What restores do with corrupt records: "strict" (startup fails unless the newest snapshot is intact),
+	"skip" (the newest snapshot is restored without them) or "quarantine" (like skip, and they are copied next to the snapshot)`)
+	rootCmd.Flags().StringVar(&persisterKind, "persister", "journal", `Where jobs are persisted in dataDir: "journal" (snapshots of all jobs, written on stop and at checkpoints)
+	or "kv" (an embedded key-value store keyed by trigger time that every put, cancel and consume goes to, implies --restore)`)
+	rootCmd.Flags().StringVar(&kvSync, "kv-sync", "always", `When the kv persister syncs changes to disk: "always", "never" (left to the OS)
+	or an interval (golang duration string format, e.g. "100ms")`)
 	rootCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "b", "", "S3 Bucket where backups will be stored")
+	rootCmd.Flags().StringVar(&s3Prefix, "s3-prefix", "", `Prepended to the keys of the backups (e.g. "goyaad/prod/")`)
+	rootCmd.Flags().StringVar(&s3Endpoint, "s3-endpoint", "", "S3 compatible endpoint to back up to instead of AWS (e.g. http://localhost:9000)")
+	rootCmd.Flags().StringVar(&s3Region, "s3-region", "", "Region of the S3 bucket, from the environment if empty")
+	rootCmd.Flags().BoolVar(&s3PathStyle, "s3-path-style", false, "Address the S3 bucket in the path instead of the host name, as most S3 compatible stores need")
+	rootCmd.Flags().IntVar(&s3Keep, "s3-keep", 0, "Backups kept in S3, older ones are deleted after an upload (0 keeps all)")
+	rootCmd.Flags().StringVar(&restoreFromS3, "restore-from-s3", "", `Fetch a backup from S3 into dataDir and restore from it: "latest" or the name of a snapshot
+	(e.g. "jobs-20190102T150405.000000000Z.snapshot"). Implies --restore`)
+	rootCmd.Flags().Lookup("restore-from-s3").NoOptDefVal = "latest"
+	rootCmd.Flags().Float64Var(&rateLimit, "rate-limit", 0, "Max jobs handed out per second (0 means unlimited)")
+	rootCmd.Flags().IntVar(&rateBurst, "rate-burst", 1, "Max jobs handed out at once when rate limited")
+	rootCmd.Flags().StringVar(&storageMode, "storage", "memory", `Where job bodies live: "memory", "lazy" (far future spokes and big backlogs spill to disk)
+	or "mapped" (always on disk). Bodies on disk go to dataDir/segments`)
+	rootCmd.Flags().StringVar(&spillHorizon, "spill-horizon", "1h", "Lazy storage spills spokes further away than this (golang duration string format)")
+	rootCmd.Flags().Int64Var(&memoryBudget, "memory-budget", 0, "Lazy storage spills the furthest spokes while job bodies in memory take more bytes (0 means unlimited)")
+	rootCmd.Flags().Int64Var(&pastSpokeBudget, "backlog-budget", 0, "Lazy storage spills ready jobs while the ready backlog's bodies take more bytes (0 means unlimited)")
+	rootCmd.Flags().IntVar(&bodyArenaSize, "body-arena-size", 0, "Pack small job bodies per spoke into slabs of this many bytes (0 disables packing)")
+	rootCmd.Flags().Int64Var(&maxJobs, "max-jobs", 0, "Max pending jobs per tube, puts over the limit get OUT_OF_MEMORY (0 means unlimited)")
+	rootCmd.Flags().Int64Var(&maxBytes, "max-bytes", 0, "Max approximate bytes used by pending jobs per tube (0 means unlimited)")
+	rootCmd.Flags().Int64Var(&globalMaxJobs, "global-max-jobs", 0, "Max pending jobs across all tubes (0 means unlimited)")
+	rootCmd.Flags().Int64Var(&globalMaxBytes, "global-max-bytes", 0, "Max approximate bytes used by pending jobs across all tubes (0 means unlimited)")
+	rootCmd.Flags().StringVar(&windows, "windows", "", `Allowed delivery windows separated by ';' (e.g. "Mon-Fri 08:00-21:00 Europe/Berlin").
+	Jobs that come due outside are moved to the next window start`)
+	rootCmd.Flags().StringVar(&misfire, "misfire", "fire", `What happens to jobs delivered late, like after downtime, unless put with their own policy:
+	"fire", "skip:<threshold>" (drop jobs later than threshold) or "latest[:<threshold>]" (of late jobs with the same key, fire only the latest)`)
+	rootCmd.Flags().StringVar(&clockJumpThreshold, "clock-jump-threshold", "2s", "Smallest wall clock jump (golang duration string format) the jump policies apply to, negative disables them")
+	rootCmd.Flags().StringVar(&forwardJump, "forward-jump", "fire", `What happens when the wall clock jumps forward: "fire" (jobs come due by the wall clock),
+	"shift" (pending schedules move along with the jump) or "pause" (no jobs are handed out until resume-delivery)`)
+	rootCmd.Flags().StringVar(&backwardJump, "backward-jump", "fire", `What happens when the wall clock jumps back: "fire", "shift" or "pause"`)
+	rootCmd.Flags().IntVar(&shards, "shards", 1, `Partition jobs across this many independent hubs so that puts and reserves contend less.
+	Sharded hubs have no batches or consumer groups and need the journal persister without --wal`)
+	rootCmd.Flags().BoolVar(&staging, "staging", false, `Staging only: let clients offset the server clock with the time-travel command
+	to run through schedules ahead of time`)
 }
 
 var rootCmd = &cobra.Command{
@@ -60,12 +149,171 @@ func runServer() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	var mss time.Duration
+	if maxSpokeSpan != "" {
+		mss, err = time.ParseDuration(maxSpokeSpan)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	w, err := goyaad.ParseWindows(windows)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sm, err := goyaad.ParseStorageMode(storageMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mf, err := goyaad.ParseMisfire(misfire)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cjt, err := time.ParseDuration(clockJumpThreshold)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fj, err := goyaad.ParseJumpPolicy(forwardJump)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bj, err := goyaad.ParseJumpPolicy(backwardJump)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sh, err := time.ParseDuration(spillHorizon)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var cpi time.Duration
+	if checkpointInterval != "" {
+		cpi, err = time.ParseDuration(checkpointInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	mm, err := persistence.ParseManifestMode(manifestMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rm, err := persistence.ParseRecoveryMode(recoveryMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var s3Backup *persistence.S3Backup
+	if s3Bucket != "" {
+		s3Backup, err = persistence.NewS3Backup(&persistence.S3Opts{
+			Bucket:    s3Bucket,
+			Prefix:    s3Prefix,
+			Endpoint:  s3Endpoint,
+			Region:    s3Region,
+			PathStyle: s3PathStyle,
+			Keep:      s3Keep,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if shards > 1 && (wal || persisterKind != "journal") {
+		log.Fatal("--shards needs the journal persister and doesn't keep a WAL")
+	}
+	var restoreFrom string
+	if restoreFromS3 != "" {
+		if s3Backup == nil {
+			log.Fatal("--restore-from-s3 needs --s3-bucket")
+		}
+		if persisterKind != "journal" {
+			log.Fatal("--restore-from-s3 needs the journal persister")
+		}
+		name := restoreFromS3
+		if name == "latest" {
+			name = ""
+		}
+		restoreFrom, err = s3Backup.Download(context.Background(), name, dataDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		restore = true
+	}
+	// Segments only live as long as the process - jobs are recovered from the journal
+	segmentDir := path.Join(dataDir, "segments")
+	if err := os.RemoveAll(segmentDir); err != nil {
+		log.Fatal(err)
+	}
 	opts := &goyaad.HubOpts{
-		AttemptRestore: restore,
-		SpokeSpan:      ss,
-		Persister:      persistence.NewJournalPersister(dataDir, s3Bucket)}
+		AttemptRestore:     restore,
+		SpokeSpan:          ss,
+		MaxSpokeSpan:       mss,
+		MaxSpokeJobs:       maxSpokeJobs,
+		RateLimit:          rateLimit,
+		RateBurst:          rateBurst,
+		Windows:            w,
+		Misfire:            mf,
+		ClockJumpThreshold: cjt,
+		ForwardJump:        fj,
+		BackwardJump:       bj,
+		StorageMode:        sm,
+		StorageDir:         segmentDir,
+		SpillHorizon:       sh,
+		MemoryBudget:       memoryBudget,
+		PastSpokeBudget:    pastSpokeBudget,
+		BodyArenaSize:      bodyArenaSize,
+		CheckpointInterval: cpi,
+		CheckpointSize:     checkpointSize,
+		MaxJobs:            maxJobs,
+		MaxBytes:           maxBytes,
+		SharedAdmissions: []*goyaad.Admission{
+			goyaad.NewAdmission(globalMaxJobs, globalMaxBytes),
+		},
+	}
+	if wal {
+		policy, interval, err := persistence.ParseSync(walSync)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.WAL, err = persistence.OpenWAL(dataDir, policy, interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch persisterKind {
+	case "journal":
+		opts.Persister = persistence.NewJournalPersisterWithOpts(dataDir, &persistence.JournalOpts{
+			Keep:        snapshotKeep,
+			Manifest:    mm,
+			Recovery:    rm,
+			RestoreFrom: restoreFrom,
+			WAL:         opts.WAL,
+		})
+		if s3Backup != nil {
+			opts.Backup = s3Backup
+		}
+	case "kv":
+		if s3Backup != nil {
+			logrus.Warn("S3 backups are only taken with the journal persister")
+		}
+		policy, interval, err := persistence.ParseSync(kvSync)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Persister = persistence.NewKVPersister(dataDir, &persistence.KVOpts{Sync: policy, SyncInterval: interval})
+	default:
+		log.Fatalf("unknown persister: %s", persisterKind)
+	}
+	if staging {
+		logrus.Warn("Staging mode: clients can offset the server clock")
+		opts.Clock = goyaad.NewOffsetClock(goyaad.SystemClock)
+	}
 
-	hub := goyaad.NewHub(opts)
+	var hub protocol.Hub
+	if shards > 1 {
+		sh, err := goyaad.NewShardedHub(&goyaad.ShardedHubOpts{HubOpts: *opts, Shards: shards})
+		if err != nil {
+			log.Fatal(err)
+		}
+		hub = sh
+	} else {
+		hub = goyaad.NewHub(opts)
+	}
 	var rpcSRV io.Closer
 	var beanSRV io.Closer
 	wg := sync.WaitGroup{}
@@ -78,13 +326,25 @@ func runServer() {
 		beanSRV = protocol.ServeBeanstalkd(hub, baddr)
 	}()
 
+	// Servers answer that they are restoring until the hub is ready
+	go func() {
+		<-hub.Ready()
+		err := hub.RestoreErr()
+		if err != nil && rm == persistence.RecoverStrict && !os.IsNotExist(errors.Cause(err)) {
+			// Strict recovery doesn't serve a partial restore
+			log.Fatal(err)
+		}
+		logrus.Info("Hub ready, serving jobs")
+	}()
+
 	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGUSR1)
+	signal.Notify(sigc, syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT)
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		<-sigc
+		sig := <-sigc
+		logrus.WithField("signal", sig).Info("Received signal, shutting down")
 		logrus.Info("Stopping bean protocol server")
 		beanSRV.Close()
 		logrus.Info("Stopping bean protocol server - Done")
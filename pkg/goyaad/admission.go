@@ -0,0 +1,141 @@
+package goyaad
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+)
+
+// ErrOutOfMemory is returned when adding a job would take a hub over its memory limits
+var ErrOutOfMemory = errors.New("hub is over its memory limits")
+
+// Approximate memory a pending job takes besides its body - the job, its heap entry and lookup entry.
+// BenchmarkJobMemory measures it without a body arena, with 100 byte bodies.
+const jobOverhead = 216
+
+// Admission tracks the approximate memory used by pending jobs against optional limits.
+// A hub always has its own admission; admissions shared between hubs enforce global limits.
+type Admission struct {
+	maxJobs  int64
+	maxBytes int64
+	jobs     int64 // updated atomically
+	bytes    int64 // updated atomically
+}
+
+// AdmissionUsage is a point in time view of an admission
+type AdmissionUsage struct {
+	Jobs     int64 // Pending jobs
+	Bytes    int64 // Approximate bytes used by pending jobs
+	MaxJobs  int64 // Max pending jobs, 0 means unlimited
+	MaxBytes int64 // Max bytes used by pending jobs, 0 means unlimited
+}
+
+// NewAdmission creates an admission with the given limits, 0 means unlimited
+func NewAdmission(maxJobs, maxBytes int64) *Admission {
+	return &Admission{maxJobs: maxJobs, maxBytes: maxBytes}
+}
+
+// Usage returns the current usage and limits
+func (a *Admission) Usage() AdmissionUsage {
+	return AdmissionUsage{
+		Jobs:     atomic.LoadInt64(&a.jobs),
+		Bytes:    atomic.LoadInt64(&a.bytes),
+		MaxJobs:  a.maxJobs,
+		MaxBytes: a.maxBytes,
+	}
+}
+
+// reserve takes room for one more job of the given size. If the job doesn't fit in the limits
+// it gives the room back and returns false. Taking the room first keeps concurrent adds from
+// all fitting in the same room.
+func (a *Admission) reserve(bytes int64) bool {
+	jobs := atomic.AddInt64(&a.jobs, 1)
+	used := atomic.AddInt64(&a.bytes, bytes)
+	if (a.maxJobs > 0 && jobs > a.maxJobs) || (a.maxBytes > 0 && used > a.maxBytes) {
+		a.unreserve(bytes)
+		return false
+	}
+	return true
+}
+
+// unreserve gives back the room reserve took
+func (a *Admission) unreserve(bytes int64) {
+	atomic.AddInt64(&a.jobs, -1)
+	atomic.AddInt64(&a.bytes, -bytes)
+}
+
+// add accounts for jobs coming or going and for body bytes moving in or out of memory
+func (a *Admission) add(jobs, bodyBytes int64) {
+	atomic.AddInt64(&a.jobs, jobs)
+	atomic.AddInt64(&a.bytes, bodyBytes+jobs*jobOverhead)
+}
+
+// reservation returns the room j takes in the admissions. Bodies mapped hubs spill right away don't count.
+func (h *Hub) reservation(j *Job) int64 {
+	size := int64(jobOverhead)
+	if h.storageMode != StorageMapped {
+		size += int64(len(j.body))
+	}
+	return size
+}
+
+// reserve takes room for j in the limits of this hub and the limits it shares. If j doesn't fit
+// in all of them, the room is given back and ErrOutOfMemory returned.
+func (h *Hub) reserve(j *Job) error {
+	size := h.reservation(j)
+	if !h.admission.reserve(size) {
+		return h.reject(j, "tube")
+	}
+	for i, a := range h.sharedAdmissions {
+		if !a.reserve(size) {
+			h.admission.unreserve(size)
+			for _, r := range h.sharedAdmissions[:i] {
+				r.unreserve(size)
+			}
+			return h.reject(j, "global")
+		}
+	}
+	return nil
+}
+
+// unreserve gives back the room reserve took for a job that wasn't added after all
+func (h *Hub) unreserve(j *Job) {
+	size := h.reservation(j)
+	h.admission.unreserve(size)
+	for _, a := range h.sharedAdmissions {
+		a.unreserve(size)
+	}
+}
+
+// claim accounts for a job that was added to a spoke with the room reserve took for it.
+// Only the body of a mapped job is left, until it is spilled.
+func (h *Hub) claim(j *Job) {
+	body := int64(len(j.body))
+	atomic.AddInt64(&h.bodyBytes, body)
+	if size := h.reservation(j); size < body+jobOverhead {
+		h.admission.add(0, body+jobOverhead-size)
+		for _, a := range h.sharedAdmissions {
+			a.add(0, body+jobOverhead-size)
+		}
+	}
+}
+
+func (h *Hub) reject(j *Job, limit string) error {
+	logrus.WithFields(logrus.Fields{
+		"jobID": j.id,
+		"limit": limit,
+	}).Debug("Hub: rejected job over memory limits")
+	go metrics.Incr("hub.addjob.rejected." + limit)
+	return ErrOutOfMemory
+}
+
+// account records jobs coming or going and job body bytes moving in or out of memory
+func (h *Hub) account(jobs, bodyBytes int64) {
+	atomic.AddInt64(&h.bodyBytes, bodyBytes)
+	h.admission.add(jobs, bodyBytes)
+	for _, a := range h.sharedAdmissions {
+		a.add(jobs, bodyBytes)
+	}
+}
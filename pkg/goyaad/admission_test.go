@@ -0,0 +1,123 @@
+package goyaad_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test memory admission", func() {
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+	})
+
+	newHub := func(opts HubOpts) *Hub {
+		opts.SpokeSpan = time.Second
+		opts.Persister = persister
+		return NewHub(&opts)
+	}
+
+	It("rejects jobs over the max pending jobs and admits them again once jobs leave", func() {
+		h := newHub(HubOpts{MaxJobs: 2})
+		ready := NewJobAutoID(time.Now().Add(-time.Second), []byte("ready"))
+		later := NewJobAutoID(time.Now().Add(time.Hour), []byte("later"))
+		Expect(h.AddJob(ready)).To(BeNil())
+		Expect(h.AddJob(later)).To(BeNil())
+		Expect(h.AddJob(NewJobAutoID(time.Now(), nil))).To(Equal(ErrOutOfMemory))
+		Expect(h.PendingJobsCount()).To(Equal(2))
+
+		usage := h.Stats().Memory
+		Expect(usage.Jobs).To(Equal(int64(2)))
+		Expect(usage.MaxJobs).To(Equal(int64(2)))
+		Expect(usage.Bytes).To(BeNumerically(">", 10))
+
+		Expect(h.Next().ID()).To(Equal(ready.ID()))
+		Expect(h.CancelJob(later.ID())).To(BeNil())
+		Expect(h.Stats().Memory.Jobs).To(BeZero())
+		Expect(h.Stats().Memory.Bytes).To(BeZero())
+		Expect(h.AddJob(NewJobAutoID(time.Now(), nil))).To(BeNil())
+	})
+
+	It("rejects jobs over the max bytes", func() {
+		h := newHub(HubOpts{MaxBytes: 4096})
+		Expect(h.AddJob(NewJobAutoID(time.Now().Add(time.Hour), make([]byte, 3000)))).To(BeNil())
+		Expect(h.AddJob(NewJobAutoID(time.Now().Add(time.Hour), make([]byte, 3000)))).To(Equal(ErrOutOfMemory))
+		Expect(h.AddJob(NewJobAutoID(time.Now().Add(time.Hour), make([]byte, 100)))).To(BeNil())
+	})
+
+	It("never lets concurrent adds past the limits", func() {
+		global := NewAdmission(50, 0)
+		h := newHub(HubOpts{MaxJobs: 60, SharedAdmissions: []*Admission{global}})
+		var accepted int64
+		wg := sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < 50; k++ {
+					if h.AddJob(NewJobAutoID(time.Now().Add(time.Hour), nil)) == nil {
+						atomic.AddInt64(&accepted, 1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		Expect(accepted).To(Equal(int64(50)))
+		Expect(h.Stats().Memory.Jobs).To(Equal(int64(50)))
+		Expect(global.Usage().Jobs).To(Equal(int64(50)))
+	})
+
+	It("counts held back batch callbacks against the limits", func() {
+		h := newHub(HubOpts{MaxJobs: 2})
+		id := h.OpenBatch()
+		j := NewJobAutoID(time.Now().Add(time.Hour), nil)
+		j.SetBatch(id)
+		Expect(h.AddJob(j)).To(BeNil())
+		Expect(h.SealBatch(id, NewJobAutoID(time.Now(), nil))).To(BeNil())
+		Expect(h.Stats().Memory.Jobs).To(Equal(int64(2)))
+		Expect(h.SealBatch(h.OpenBatch(), NewJobAutoID(time.Now(), nil))).To(Equal(ErrOutOfMemory))
+
+		// The released callback takes the room it held
+		Expect(h.CancelJob(j.ID())).To(BeNil())
+		Expect(h.Stats().Memory.Jobs).To(Equal(int64(1)))
+		Expect(h.PendingJobsCount()).To(Equal(1))
+	})
+
+	It("enforces limits shared between hubs", func() {
+		global := NewAdmission(3, 0)
+		a := newHub(HubOpts{SharedAdmissions: []*Admission{global}})
+		b := newHub(HubOpts{SharedAdmissions: []*Admission{global}})
+
+		Expect(a.AddJob(NewJobAutoID(time.Now().Add(time.Hour), nil))).To(BeNil())
+		Expect(a.AddJob(NewJobAutoID(time.Now().Add(time.Hour), nil))).To(BeNil())
+		Expect(b.AddJob(NewJobAutoID(time.Now().Add(time.Hour), nil))).To(BeNil())
+		Expect(b.AddJob(NewJobAutoID(time.Now().Add(time.Hour), nil))).To(Equal(ErrOutOfMemory))
+
+		Expect(global.Usage().Jobs).To(Equal(int64(3)))
+		Expect(b.Stats().Memory.Jobs).To(Equal(int64(1)))
+		Expect(b.Stats().SharedMemory).To(HaveLen(1))
+	})
+
+	It("applies tube limits across all shards of a sharded hub", func() {
+		sh, err := NewShardedHub(&ShardedHubOpts{
+			HubOpts: HubOpts{SpokeSpan: time.Second, Persister: persister, MaxJobs: 10},
+			Shards:  4,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		accepted := 0
+		for i := 0; i < 20; i++ {
+			if sh.AddJob(NewJobAutoID(time.Now().Add(time.Hour), nil)) == nil {
+				accepted++
+			}
+		}
+		Expect(accepted).To(Equal(10))
+		Expect(sh.Stats().Memory.Jobs).To(Equal(int64(10)))
+	})
+})
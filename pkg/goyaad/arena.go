@@ -0,0 +1,37 @@
+package goyaad
+
+// Bodies bigger than this fraction of a slab get their own allocation
+const arenaMaxBodyFraction = 4
+
+// bodyArena packs small job bodies into shared slabs, trading a per body allocation for one per slab.
+// A slab is freed by the garbage collector once no body in it is referenced anymore, so a body handed
+// out to a consumer keeps its whole slab alive until the consumer drops it.
+type bodyArena struct {
+	slabSize int
+	slab     []byte // Slab being filled
+}
+
+// copy returns b copied into the arena, or b itself if it is too big to share a slab
+func (a *bodyArena) copy(b []byte) []byte {
+	if len(b) == 0 || len(b) > a.slabSize/arenaMaxBodyFraction {
+		return b
+	}
+	if cap(a.slab)-len(a.slab) < len(b) {
+		a.slab = make([]byte, 0, a.slabSize)
+	}
+	start := len(a.slab)
+	a.slab = append(a.slab, b...)
+	// Cap the body so that appending to it can't spill into its neighbours
+	return a.slab[start:len(a.slab):len(a.slab)]
+}
+
+// packBody copies the body of j into the arena of spoke s. Must be called with s locked.
+func (h *Hub) packBody(j *Job, s *Spoke) {
+	if h.arenaSlabSize <= 0 || j.ref != nil {
+		return
+	}
+	if s.arena == nil {
+		s.arena = &bodyArena{slabSize: h.arenaSlabSize}
+	}
+	j.body = s.arena.copy(j.body)
+}
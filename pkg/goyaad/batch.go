@@ -0,0 +1,365 @@
+package goyaad
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+// ErrBatchNotFound is returned when an operation refers to an unknown batch
+var ErrBatchNotFound = errors.New("batch not found")
+
+// ErrBatchSealed is returned when a job is added to a batch that already has a callback
+var ErrBatchSealed = errors.New("batch is sealed")
+
+// Batch tracks a group of jobs and holds a callback job that is released
+// once every member job has been consumed or cancelled
+type Batch struct {
+	id       string
+	total    int
+	done     int
+	sealed   bool
+	released bool
+	callback *Job // Held back until all members are done
+	reserved bool // The callback has room reserved in the memory limits
+	counted  bool // Restored from a snapshot record that counts the restored members already
+}
+
+// BatchProgress is a point in time view of a batch
+type BatchProgress struct {
+	ID       string
+	Total    int
+	Pending  int
+	Done     int
+	Sealed   bool
+	Released bool
+}
+
+func newBatch(id string) *Batch {
+	return &Batch{id: id}
+}
+
+// pending returns the number of member jobs that are not done yet
+func (b *Batch) pending() int {
+	return b.total - b.done
+}
+
+// releasable returns the callback job if the batch is sealed and settled, and whether room was reserved for it
+func (b *Batch) releasable() (*Job, bool) {
+	if !b.sealed || b.released || b.pending() > 0 {
+		return nil, false
+	}
+	b.released = true
+	c := b.callback
+	b.callback = nil
+	return c, b.reserved
+}
+
+// progress returns the batch progress
+func (b *Batch) progress() BatchProgress {
+	return BatchProgress{
+		ID:       b.id,
+		Total:    b.total,
+		Pending:  b.pending(),
+		Done:     b.done,
+		Sealed:   b.sealed,
+		Released: b.released,
+	}
+}
+
+// record returns the state of the batch as a record to persist: total, done and sealed
+func (b *Batch) record() persistence.Record {
+	data := make([]byte, 2*binary.MaxVarintLen64+1)
+	n := binary.PutUvarint(data, uint64(b.total))
+	n += binary.PutUvarint(data[n:], uint64(b.done))
+	if b.sealed {
+		data[n] = 1
+	}
+	return persistence.Record{Kind: persistence.RecordBatch, ID: b.id, Data: data[:n+1]}
+}
+
+// batchOf reads a batch back from its record
+func batchOf(r persistence.Record) (*Batch, error) {
+	total, n := binary.Uvarint(r.Data)
+	if n <= 0 {
+		return nil, errors.Errorf("Hub: batch %s has a bad record", r.ID)
+	}
+	done, m := binary.Uvarint(r.Data[n:])
+	if m <= 0 || len(r.Data) != n+m+1 || done > total {
+		return nil, errors.Errorf("Hub: batch %s has a bad record", r.ID)
+	}
+	b := newBatch(r.ID)
+	b.total = int(total)
+	b.done = int(done)
+	b.sealed = r.Data[n+m] == 1
+	return b, nil
+}
+
+// OpenBatch creates a new batch and returns its id. Jobs join the batch
+// by calling SetBatch before they are added to the hub.
+func (h *Hub) OpenBatch() string {
+	id := uuid.NewV4().String()
+	b := newBatch(id)
+
+	h.gate.RLock()
+	defer h.gate.RUnlock()
+	h.batchLock.Lock()
+	h.batches[id] = b
+	r := b.record()
+	h.storeState(r)
+	h.batchLock.Unlock()
+
+	// Batches without members yet aren't in any job - replaying the WAL brings them back
+	h.logRecord(r)
+	go metrics.Incr("hub.batch.open")
+	return id
+}
+
+// SealBatch registers the callback job of a batch. No more jobs can join the batch after
+// it is sealed. The callback is added to the hub once all member jobs are done.
+// Callbacks are rejected with ErrOutOfMemory if they don't fit in the memory limits, they take their room while held back.
+func (h *Hub) SealBatch(batchID string, callback *Job) error {
+	if err := h.reserve(callback); err != nil {
+		return err
+	}
+	h.gate.RLock()
+	defer h.gate.RUnlock()
+	h.batchLock.Lock()
+	b, ok := h.batches[batchID]
+	if !ok {
+		h.batchLock.Unlock()
+		h.unreserve(callback)
+		return ErrBatchNotFound
+	}
+	if b.sealed {
+		h.batchLock.Unlock()
+		h.unreserve(callback)
+		return ErrBatchSealed
+	}
+	callback.options().batchID = batchID
+	callback.options().batchCallback = true
+	b.callback = callback
+	b.sealed = true
+	b.reserved = true
+	h.storeState(b.record())
+	pending := b.pending()
+	c, reserved := b.releasable()
+	h.batchLock.Unlock()
+
+	// Held back callbacks aren't in any spoke - replaying the WAL brings them back
+	h.logChange(persistence.RecordAdd, callback)
+
+	logrus.WithFields(logrus.Fields{
+		"batchID":    batchID,
+		"callbackID": callback.id,
+		"pending":    pending,
+	}).Debug("Sealed batch")
+	go metrics.Incr("hub.batch.seal")
+
+	if c != nil {
+		return h.releaseBatchCallback(c, reserved)
+	}
+	return nil
+}
+
+// BatchProgress returns the progress of the batch with the given id
+func (h *Hub) BatchProgress(batchID string) (BatchProgress, error) {
+	h.batchLock.Lock()
+	defer h.batchLock.Unlock()
+
+	b, ok := h.batches[batchID]
+	if !ok {
+		return BatchProgress{}, ErrBatchNotFound
+	}
+	return b.progress(), nil
+}
+
+// joinBatch counts j as a member of its batch
+func (h *Hub) joinBatch(j *Job) error {
+	h.batchLock.Lock()
+	defer h.batchLock.Unlock()
+
+	b, ok := h.batches[j.BatchID()]
+	if !ok {
+		return ErrBatchNotFound
+	}
+	if b.sealed {
+		return ErrBatchSealed
+	}
+	b.total++
+	h.storeState(b.record())
+	return nil
+}
+
+// leaveBatch undoes joinBatch for a job that could not be added
+func (h *Hub) leaveBatch(j *Job) {
+	if j.BatchID() == "" {
+		return
+	}
+	h.batchLock.Lock()
+	defer h.batchLock.Unlock()
+
+	if b, ok := h.batches[j.BatchID()]; ok {
+		b.total--
+		h.storeState(b.record())
+	}
+}
+
+// settleBatch marks j as done in its batch and releases the batch callback if
+// it was the last pending member. A consumed callback job forgets its batch.
+func (h *Hub) settleBatch(j *Job) {
+	if j.BatchID() == "" {
+		return
+	}
+
+	h.batchLock.Lock()
+	b, ok := h.batches[j.BatchID()]
+	if !ok {
+		h.batchLock.Unlock()
+		return
+	}
+	if j.IsBatchCallback() {
+		delete(h.batches, j.BatchID())
+		h.dropState(persistence.RecordBatch, j.BatchID())
+		h.batchLock.Unlock()
+		go metrics.Incr("hub.batch.finished")
+		return
+	}
+	b.done++
+	h.storeState(b.record())
+	c, reserved := b.releasable()
+	h.batchLock.Unlock()
+
+	if c != nil {
+		if err := h.releaseBatchCallback(c, reserved); err != nil {
+			logrus.WithError(err).WithField("batchID", j.BatchID()).Error("Hub: failed to release batch callback")
+		}
+	}
+}
+
+// releaseBatchCallback hands the callback job over to the spokes, with the room SealBatch reserved for it if reserved is set
+func (h *Hub) releaseBatchCallback(c *Job, reserved bool) error {
+	logrus.WithFields(logrus.Fields{
+		"batchID":    c.BatchID(),
+		"callbackID": c.id,
+	}).Debug("Releasing batch callback")
+	go metrics.Incr("hub.batch.release")
+	err := h.add(c, reserved)
+	if err != nil && reserved {
+		h.unreserve(c)
+	}
+	return err
+}
+
+// restoreBatchRecord restores the state of a batch from its record. Records of a snapshot count
+// the members of the batch, records replayed from the WAL only bring back batches the snapshot doesn't have.
+func (h *Hub) restoreBatchRecord(r persistence.Record, fromSnapshot bool) error {
+	rb, err := batchOf(r)
+	if err != nil {
+		return err
+	}
+
+	h.batchLock.Lock()
+	defer h.batchLock.Unlock()
+
+	b, ok := h.batches[r.ID]
+	if !ok {
+		rb.counted = fromSnapshot
+		h.batches[r.ID] = rb
+		return nil
+	}
+	if !fromSnapshot {
+		return nil
+	}
+	// Members restored before the record are part of its total
+	b.total = rb.total
+	b.done = rb.done
+	b.sealed = b.sealed || rb.sealed
+	b.counted = true
+	return nil
+}
+
+// uncountBatches lets the members replayed from the WAL count toward their batch:
+// they joined after the snapshot the batch records are from
+func (h *Hub) uncountBatches() {
+	h.batchLock.Lock()
+	defer h.batchLock.Unlock()
+
+	for _, b := range h.batches {
+		b.counted = false
+	}
+}
+
+// batchRecords returns the state of every batch as records to persist
+func (h *Hub) batchRecords() []persistence.Record {
+	h.batchLock.Lock()
+	defer h.batchLock.Unlock()
+
+	records := make([]persistence.Record, 0, len(h.batches))
+	for _, b := range h.batches {
+		records = append(records, b.record())
+	}
+	return records
+}
+
+// restoreBatch rebuilds batch membership from a restored job.
+// Members of batches restored from a record are counted by the record already.
+func (h *Hub) restoreBatch(j *Job) {
+	if j.BatchID() == "" {
+		return
+	}
+
+	h.batchLock.Lock()
+	defer h.batchLock.Unlock()
+
+	b, ok := h.batches[j.BatchID()]
+	if !ok {
+		b = newBatch(j.BatchID())
+		h.batches[j.BatchID()] = b
+	}
+	if j.IsBatchCallback() {
+		b.sealed = true
+		b.callback = j
+		return
+	}
+	if !b.counted {
+		b.total++
+	}
+}
+
+// releaseSettledBatches releases the callbacks of restored batches whose members are all done
+func (h *Hub) releaseSettledBatches() {
+	h.batchLock.Lock()
+	callbacks := []*Job{}
+	for _, b := range h.batches {
+		// Restored callbacks have no room reserved
+		if c, _ := b.releasable(); c != nil {
+			callbacks = append(callbacks, c)
+		}
+	}
+	h.batchLock.Unlock()
+
+	for _, c := range callbacks {
+		if err := h.releaseBatchCallback(c, false); err != nil {
+			logrus.WithError(err).WithField("batchID", c.BatchID()).Error("Hub: failed to release batch callback")
+		}
+	}
+}
+
+// heldBatchCallbacks returns the callback jobs that are waiting for their batch to settle
+func (h *Hub) heldBatchCallbacks() []*Job {
+	h.batchLock.Lock()
+	defer h.batchLock.Unlock()
+
+	callbacks := []*Job{}
+	for _, b := range h.batches {
+		if b.callback != nil {
+			callbacks = append(callbacks, b.callback)
+		}
+	}
+	return callbacks
+}
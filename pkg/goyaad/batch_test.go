@@ -0,0 +1,171 @@
+package goyaad_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test batches", func() {
+	var h *Hub
+
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+		h = NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persister, AttemptRestore: false})
+	})
+
+	It("rejects jobs for unknown batches", func() {
+		j := NewJobAutoID(time.Now(), nil)
+		j.SetBatch("nope")
+		Expect(h.AddJob(j)).To(Equal(ErrBatchNotFound))
+		Expect(h.PendingJobsCount()).To(Equal(0))
+	})
+
+	It("releases the callback once all jobs are consumed or cancelled", func() {
+		id := h.OpenBatch()
+
+		members := []*Job{}
+		for i := 0; i < 3; i++ {
+			j := NewJobAutoID(time.Now().Add(-time.Second), []byte("member"))
+			j.SetBatch(id)
+			Expect(h.AddJob(j)).To(BeNil())
+			members = append(members, j)
+		}
+		cancelled := NewJobAutoID(time.Now().Add(time.Hour), []byte("member"))
+		cancelled.SetBatch(id)
+		Expect(h.AddJob(cancelled)).To(BeNil())
+
+		callback := NewJobAutoID(time.Now(), []byte("callback"))
+		Expect(h.SealBatch(id, callback)).To(BeNil())
+		Expect(h.SealBatch(id, NewJobAutoID(time.Now(), nil))).To(Equal(ErrBatchSealed))
+
+		late := NewJobAutoID(time.Now(), nil)
+		late.SetBatch(id)
+		Expect(h.AddJob(late)).To(Equal(ErrBatchSealed))
+
+		p, err := h.BatchProgress(id)
+		Expect(err).To(BeNil())
+		Expect(p.Total).To(Equal(4))
+		Expect(p.Pending).To(Equal(4))
+		Expect(p.Sealed).To(BeTrue())
+
+		for range members {
+			j := h.Next()
+			Expect(j).NotTo(BeNil())
+			Expect(j.IsBatchCallback()).To(BeFalse())
+		}
+		// Callback is held while a member is pending
+		Expect(h.Next()).To(BeNil())
+
+		Expect(h.CancelJob(cancelled.ID())).To(BeNil())
+		p, err = h.BatchProgress(id)
+		Expect(err).To(BeNil())
+		Expect(p.Done).To(Equal(4))
+		Expect(p.Released).To(BeTrue())
+
+		Eventually(h.Next).Should(WithTransform(func(j *Job) string {
+			if j == nil {
+				return ""
+			}
+			return j.ID()
+		}, Equal(callback.ID())))
+
+		// A consumed callback finishes the batch
+		_, err = h.BatchProgress(id)
+		Expect(err).To(Equal(ErrBatchNotFound))
+	})
+
+	It("releases the callback right away for a settled batch", func() {
+		id := h.OpenBatch()
+		callback := NewJobAutoID(time.Now().Add(-time.Millisecond), []byte("callback"))
+		Expect(h.SealBatch(id, callback)).To(BeNil())
+
+		j := h.Next()
+		Expect(j).NotTo(BeNil())
+		Expect(j.ID()).To(Equal(callback.ID()))
+	})
+
+	It("restores batch membership and held callbacks", func(done Done) {
+		defer close(done)
+
+		id := h.OpenBatch()
+		member := NewJobAutoID(time.Now().Add(-time.Second), []byte("member"))
+		member.SetBatch(id)
+		Expect(h.AddJob(member)).To(BeNil())
+		callback := NewJobAutoID(time.Now(), []byte("callback"))
+		Expect(h.SealBatch(id, callback)).To(BeNil())
+
+		for e := range h.Persist() {
+			Fail("Persist failed due to error: " + e.Error())
+		}
+
+		restored := NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persister, AttemptRestore: false})
+		Expect(restored.Restore()).To(BeNil())
+		Expect(restored.PendingJobsCount()).To(Equal(1))
+
+		p, err := restored.BatchProgress(id)
+		Expect(err).To(BeNil())
+		Expect(p.Pending).To(Equal(1))
+		Expect(p.Sealed).To(BeTrue())
+
+		j := restored.Next()
+		Expect(j).NotTo(BeNil())
+		Expect(j.ID()).To(Equal(member.ID()))
+		Expect(j.BatchID()).To(Equal(id))
+
+		j = restored.Next()
+		Expect(j).NotTo(BeNil())
+		Expect(j.ID()).To(Equal(callback.ID()))
+		Expect(j.IsBatchCallback()).To(BeTrue())
+	}, 5)
+
+	It("restores batch progress and open batches", func(done Done) {
+		defer close(done)
+
+		id := h.OpenBatch()
+		members := []*Job{}
+		for i := 0; i < 3; i++ {
+			j := NewJobAutoID(time.Now().Add(time.Duration(i-2)*time.Hour), []byte("member"))
+			j.SetBatch(id)
+			Expect(h.AddJob(j)).To(BeNil())
+			members = append(members, j)
+		}
+		Expect(h.Next().ID()).To(Equal(members[0].ID()))
+		Expect(h.CancelJob(members[2].ID())).To(BeNil())
+		callback := NewJobAutoID(time.Now(), []byte("callback"))
+		Expect(h.SealBatch(id, callback)).To(BeNil())
+		empty := h.OpenBatch()
+
+		for e := range h.Persist() {
+			Fail("Persist failed due to error: " + e.Error())
+		}
+
+		restored := NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persister, AttemptRestore: false})
+		Expect(restored.Restore()).To(BeNil())
+
+		p, err := restored.BatchProgress(id)
+		Expect(err).To(BeNil())
+		Expect(p.Total).To(Equal(3))
+		Expect(p.Done).To(Equal(2))
+		Expect(p.Pending).To(Equal(1))
+		Expect(p.Sealed).To(BeTrue())
+
+		p, err = restored.BatchProgress(empty)
+		Expect(err).To(BeNil())
+		Expect(p.Total).To(Equal(0))
+		Expect(p.Sealed).To(BeFalse())
+		j := NewJobAutoID(time.Now().Add(time.Hour), nil)
+		j.SetBatch(empty)
+		Expect(restored.AddJob(j)).To(BeNil())
+
+		Expect(restored.Next().ID()).To(Equal(members[1].ID()))
+		j = restored.Next()
+		Expect(j).NotTo(BeNil())
+		Expect(j.ID()).To(Equal(callback.ID()))
+	}, 5)
+})
@@ -0,0 +1,193 @@
+package goyaad
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+// How often the checkpointer looks at the WAL size and the time since the last checkpoint
+const checkpointCheckInterval = time.Second
+
+// How long the checkpointer waits after a failed checkpoint
+const checkpointRetryDelay = 10 * time.Second
+
+// ErrNoPersister is returned when a snapshot is asked of a hub that has nowhere to write it
+var ErrNoPersister = errors.New("hub has no persister")
+
+// noBackup is handed out for snapshots that aren't backed up
+var noBackup = func() <-chan error {
+	ec := make(chan error)
+	close(ec)
+	return ec
+}()
+
+// CheckpointStats describes a finished checkpoint
+type CheckpointStats struct {
+	Path     string        // Where the snapshot was written, if the persister tells
+	Jobs     int           // Jobs in the snapshot
+	Bytes    int64         // Encoded bytes of the jobs in the snapshot
+	Paused   time.Duration // How long the hub was locked to freeze its spokes
+	Duration time.Duration // How long the whole checkpoint took
+}
+
+// Checkpoint writes a snapshot of all jobs and drops the WAL segments it covers.
+// The hub is only locked while it freezes its spokes, the snapshot is written while
+// jobs are added and handed out as usual. The snapshot is backed up in the background.
+func (h *Hub) Checkpoint() (CheckpointStats, error) {
+	var last error
+	errCount := 0
+	stats, _ := h.writeSnapshot(context.Background(), func(err error) {
+		errCount++
+		last = err
+	})
+	if errCount > 0 {
+		return stats, errors.Wrapf(last, "Hub:Checkpoint failed with %d errors", errCount)
+	}
+	return stats, nil
+}
+
+// writeSnapshot writes a snapshot to the persister and hands the errors it runs into to report.
+// The snapshot ends with a checkpoint record of when it was frozen. The WAL is only truncated and
+// the snapshot only backed up if there were no errors. The returned channel carries the backup error.
+func (h *Hub) writeSnapshot(ctx context.Context, report func(error)) (CheckpointStats, <-chan error) {
+	if h.persister == nil {
+		report(ErrNoPersister)
+		return CheckpointStats{}, noBackup
+	}
+	if !h.IsReady() {
+		// Half restored jobs would replace the snapshot they come from
+		report(ErrRestoring)
+		return CheckpointStats{}, noBackup
+	}
+	if err := h.life.persistErr(); err != nil {
+		logrus.WithError(h.life.err).Error("Hub: not writing a snapshot after a failed restore")
+		report(err)
+		return CheckpointStats{}, noBackup
+	}
+	h.checkpointLock.Lock()
+	defer h.checkpointLock.Unlock()
+
+	if h.jobStore != nil {
+		return h.syncJobStore(report), noBackup
+	}
+	start := time.Now()
+	snap, err := h.freeze()
+	if err != nil {
+		go metrics.Incr("hub.checkpoint.error")
+		report(err)
+		return CheckpointStats{}, noBackup
+	}
+	logrus.WithField("paused", snap.paused).Info("Hub: froze spokes for a snapshot")
+
+	stats := CheckpointStats{Paused: snap.paused}
+	errCount := 0
+	for _, r := range snap.state {
+		if err := h.persister.Write(ctx, r); err != nil {
+			errCount++
+			report(err)
+		}
+	}
+	h.each(snap, func(jobs []*Job) {
+		for _, j := range jobs {
+			r, err := j.Record()
+			if err == nil {
+				err = h.persister.Write(ctx, r)
+			}
+			if err != nil {
+				errCount++
+				report(err)
+				continue
+			}
+			stats.Jobs++
+			stats.Bytes += int64(len(r.Data))
+		}
+	})
+	err = h.persister.Write(ctx, persistence.CheckpointRecord(start, snap.cut))
+	if err == nil {
+		err = h.persister.Commit(ctx)
+	}
+	if err != nil {
+		errCount++
+		report(err)
+	}
+	if r, ok := h.persister.(persistence.SnapshotReporter); ok {
+		stats.Path = r.SnapshotPath()
+	}
+	if errCount > 0 {
+		// The WAL still has every change since the last good snapshot, and
+		// the last backup is kept rather than one of a broken snapshot
+		go metrics.Incr("hub.checkpoint.error")
+		return stats, noBackup
+	}
+
+	if h.wal != nil {
+		if err := h.wal.Truncate(snap.cut); err != nil {
+			logrus.WithError(err).Error("Hub:Checkpoint cannot truncate the WAL")
+		}
+	}
+	stats.Duration = time.Since(start)
+	atomic.StoreInt64(&h.checkpointAt, time.Now().UnixNano())
+
+	logrus.WithFields(logrus.Fields{
+		"path":     stats.Path,
+		"jobs":     stats.Jobs,
+		"bytes":    stats.Bytes,
+		"paused":   stats.Paused,
+		"duration": stats.Duration,
+	}).Info("Hub: snapshot written")
+	go metrics.Incr("hub.checkpoint.ok")
+	go metrics.Time("hub.checkpoint.duration", start)
+	go metrics.Gauge("hub.checkpoint.pause", stats.Paused.Seconds())
+	go metrics.GaugeInt("hub.checkpoint.jobs", stats.Jobs)
+	go metrics.Gauge("hub.checkpoint.bytes", float64(stats.Bytes))
+	return stats, h.backupAsync(stats.Path)
+}
+
+// checkpointer writes checkpoints once the hub is restored, every checkpoint interval
+// or once the WAL grows past the checkpoint size, until the hub is stopped
+func (h *Hub) checkpointer() {
+	select {
+	case <-h.life.stop:
+		return
+	case <-h.life.ready:
+	}
+
+	started := time.Now()
+	last := started       // Last attempt
+	var retryAt time.Time // Failed checkpoints aren't tried again right away
+	t := time.NewTicker(checkpointCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.life.stop:
+			return
+		case now := <-t.C:
+			lag := now.Sub(started)
+			if at := atomic.LoadInt64(&h.checkpointAt); at != 0 {
+				lag = now.Sub(time.Unix(0, at))
+			}
+			go metrics.Gauge("hub.checkpoint.lag", lag.Seconds())
+
+			due := h.checkpointInterval > 0 && now.Sub(last) >= h.checkpointInterval
+			if h.wal != nil && h.checkpointSize > 0 {
+				size := h.wal.Size()
+				go metrics.Gauge("hub.wal.bytes", float64(size))
+				due = due || size >= h.checkpointSize
+			}
+			if !due || now.Before(retryAt) {
+				continue
+			}
+			last = now
+			if _, err := h.Checkpoint(); err != nil {
+				logrus.WithError(err).Error("Hub: checkpoint failed")
+				retryAt = time.Now().Add(checkpointRetryDelay)
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package goyaad_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test checkpoints", func() {
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+		Expect(os.RemoveAll(path.Join(dataDir, "wal"))).To(BeNil())
+	})
+
+	openWAL := func() *persistence.WAL {
+		wal, err := persistence.OpenWAL(dataDir, persistence.SyncNever, 0)
+		Expect(err).NotTo(HaveOccurred())
+		return wal
+	}
+
+	It("compacts the WAL and recovers from the checkpoint after a crash", func() {
+		wal := openWAL()
+		h := NewHub(&HubOpts{
+			SpokeSpan:    time.Second,
+			MaxSpokeSpan: time.Hour,
+			StorageMode:  StorageMapped,
+			StorageDir:   path.Join(dataDir, "segments"),
+			Persister:    persister,
+			WAL:          wal,
+		})
+		// Hubs with a WAL always restore
+		Eventually(h.Ready()).Should(BeClosed())
+		for i := 0; i < 100; i++ {
+			Expect(h.AddJob(NewJob(fmt.Sprintf("before-%d", i), time.Now().Add(time.Hour), []byte("body")))).To(BeNil())
+		}
+		logged := wal.Size()
+		Expect(h.CancelJob("before-0")).To(BeNil())
+
+		stats, err := h.Checkpoint()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.Jobs).To(Equal(99))
+		Expect(stats.Bytes).To(BeNumerically(">", 0))
+		Expect(wal.Size()).To(BeNumerically("<", logged))
+		Expect(h.Stats().CheckpointAt).NotTo(BeZero())
+
+		Expect(h.AddJob(NewJob("after", time.Now().Add(time.Hour), []byte("body")))).To(BeNil())
+		// Crash - no Stop
+
+		restored := NewHub(&HubOpts{
+			SpokeSpan:      time.Second,
+			Persister:      persistence.NewJournalPersister(dataDir),
+			AttemptRestore: true,
+			WAL:            openWAL(),
+		})
+		Eventually(restored.Ready()).Should(BeClosed())
+		Expect(restored.PendingJobsCount()).To(Equal(100))
+		j, err := restored.FindJob("before-99")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.Body()).To(Equal([]byte("body")))
+		_, err = restored.FindJob("before-0")
+		Expect(err).To(Equal(ErrJobNotFound))
+		restored.Stop(false)
+	})
+
+	It("doesn't replace the persisted jobs after a failed restore", func() {
+		newHub := func() *Hub {
+			wal := openWAL()
+			h := NewHub(&HubOpts{
+				SpokeSpan: time.Second,
+				Persister: persistence.NewJournalPersisterWithOpts(dataDir, &persistence.JournalOpts{
+					Recovery: persistence.RecoverSkip,
+					WAL:      wal,
+				}),
+				WAL: wal,
+			})
+			Eventually(h.Ready()).Should(BeClosed())
+			return h
+		}
+
+		h := newHub()
+		for i := 0; i < 3; i++ {
+			Expect(h.AddJob(NewJob(fmt.Sprintf("snapshot-%d", i), time.Now().Add(time.Hour), nil))).To(BeNil())
+		}
+		_, err := h.Checkpoint()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(h.AddJob(NewJob("wal", time.Now().Add(time.Hour), nil))).To(BeNil())
+		h.Stop(false)
+
+		manifests, err := filepath.Glob(path.Join(dataDir, "journal", "jobs-*.snapshot.manifest"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifests).To(HaveLen(1))
+		manifest, err := ioutil.ReadFile(manifests[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Remove(manifests[0])).To(BeNil())
+
+		h = newHub()
+		Expect(h.RestoreErr()).To(HaveOccurred())
+		_, err = h.Checkpoint()
+		Expect(errors.Cause(err)).To(Equal(ErrRestoreFailed))
+		for range h.Persist() {
+		}
+		h.Stop(true)
+
+		// The snapshot and the WAL are left as they were
+		Expect(ioutil.WriteFile(manifests[0], manifest, 0644)).To(BeNil())
+		h = newHub()
+		Expect(h.RestoreErr()).NotTo(HaveOccurred())
+		Expect(h.PendingJobsCount()).To(Equal(4))
+		h.Stop(false)
+	})
+
+	It("checkpoints in the background while jobs keep coming", func(done Done) {
+		defer close(done)
+
+		h := NewHub(&HubOpts{
+			SpokeSpan:      time.Second,
+			Persister:      persister,
+			WAL:            openWAL(),
+			CheckpointSize: 1,
+		})
+		Eventually(h.Ready()).Should(BeClosed())
+		stop := make(chan struct{})
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				Expect(h.AddJob(NewJobAutoID(time.Now().Add(-time.Second), nil))).To(BeNil())
+				h.Next()
+			}
+		}()
+		// Only a checkpoint writes a snapshot before the hub stops
+		Eventually(func() ([]string, error) {
+			return filepath.Glob(path.Join(dataDir, "journal", "jobs-*.snapshot"))
+		}, 3).ShouldNot(BeEmpty())
+		close(stop)
+		wg.Wait()
+		Eventually(func() time.Time { return h.Stats().CheckpointAt }).ShouldNot(BeZero())
+		h.Stop(true)
+	}, 5)
+})
@@ -0,0 +1,120 @@
+package goyaad
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+)
+
+// ErrClockNotAdjustable is returned when offsetting the clock of a hub that doesn't run on an OffsetClock
+var ErrClockNotAdjustable = errors.New("hub clock can't be offset")
+
+// Clock tells hubs and spokes what time it is. Trigger times, spoke states and rate limits
+// follow the clock; tickers and timeouts still run in real time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the wall clock, used when no other clock is given
+var SystemClock Clock = systemClock{}
+
+// ManualClock only moves when told to. Tests use it to step through schedules without sleeping.
+type ManualClock struct {
+	now  time.Time
+	lock *sync.Mutex
+}
+
+// NewManualClock creates a manual clock stopped at now
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now, lock: &sync.Mutex{}}
+}
+
+// Now returns the time the clock is stopped at
+func (c *ManualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set stops the clock at now
+func (c *ManualClock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+}
+
+// OffsetClock runs at the pace of a base clock, shifted by an adjustable offset.
+// Staging servers use it to time travel through schedules.
+type OffsetClock struct {
+	base   Clock
+	offset int64 // nanoseconds, updated atomically
+}
+
+// NewOffsetClock creates a clock that starts out in sync with base
+func NewOffsetClock(base Clock) *OffsetClock {
+	return &OffsetClock{base: base}
+}
+
+// Now returns the time of the base clock shifted by the offset
+func (c *OffsetClock) Now() time.Time {
+	return c.base.Now().Add(c.Offset())
+}
+
+// Offset returns how far the clock is ahead of its base clock, negative if behind
+func (c *OffsetClock) Offset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.offset))
+}
+
+// SetOffset sets how far the clock is ahead of its base clock
+func (c *OffsetClock) SetOffset(d time.Duration) {
+	atomic.StoreInt64(&c.offset, int64(d))
+}
+
+// Now returns the time on the hub's clock
+func (h *Hub) Now() time.Time {
+	return h.clock.Now()
+}
+
+// SetClockOffset moves the hub's clock to offset from its base clock and returns the new time.
+// Jobs that the jump makes ready are handed out by the next calls to Next.
+// Only hubs that run on an OffsetClock can be offset.
+func (h *Hub) SetClockOffset(offset time.Duration) (time.Time, error) {
+	c, ok := h.clock.(*OffsetClock)
+	if !ok {
+		return time.Time{}, ErrClockNotAdjustable
+	}
+	c.SetOffset(offset)
+	h.waiters.broadcast()
+	now := c.Now()
+	logrus.WithFields(logrus.Fields{
+		"offset": offset,
+		"now":    now,
+	}).Warn("Hub: clock offset changed")
+	go metrics.Incr("hub.clock.offset")
+	return now, nil
+}
+
+// clockOffset returns the offset of the hub's clock, 0 unless it runs on an OffsetClock
+func (h *Hub) clockOffset() time.Duration {
+	if c, ok := h.clock.(*OffsetClock); ok {
+		return c.Offset()
+	}
+	return 0
+}
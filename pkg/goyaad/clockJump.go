@@ -0,0 +1,200 @@
+package goyaad
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+// JumpPolicy decides what a hub does when the wall clock jumps, like when NTP steps it
+type JumpPolicy int
+
+const (
+	// JumpFire keeps schedules on the wall clock: a forward jump fires the jobs it skipped over
+	// at once and a backward jump holds jobs back until the wall clock catches up again
+	JumpFire JumpPolicy = iota
+	// JumpShift moves the schedules of jobs that aren't ready yet by the jump so that they
+	// fire after the same amount of real time
+	JumpShift
+	// JumpPause stops handing out jobs until an operator calls ResumeDelivery
+	JumpPause
+)
+
+// Default size of a wall clock jump that triggers the jump policies
+const defaultJumpThreshold = 2 * time.Second
+
+// How often the hub compares the wall clock against the monotonic clock
+const jumpCheckInterval = time.Second
+
+var jumpPolicies = map[string]JumpPolicy{
+	"fire":  JumpFire,
+	"shift": JumpShift,
+	"pause": JumpPause,
+}
+
+// ParseJumpPolicy parses "fire", "shift" or "pause"
+func ParseJumpPolicy(s string) (JumpPolicy, error) {
+	p, ok := jumpPolicies[strings.ToLower(s)]
+	if !ok {
+		return JumpFire, errors.Errorf("Unknown clock jump policy %q", s)
+	}
+	return p, nil
+}
+
+func (p JumpPolicy) String() string {
+	for name, policy := range jumpPolicies {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// jumpDetector measures how far the wall clock moved against a monotonic clock between readings
+type jumpDetector struct {
+	wall    func() time.Time     // Reads the wall clock
+	elapsed func() time.Duration // Reads the monotonic clock, as the time elapsed since some fixed point
+
+	lastWall    time.Time
+	lastElapsed time.Duration
+}
+
+// newJumpDetector creates a detector that takes its first readings from wall and elapsed
+func newJumpDetector(wall func() time.Time, elapsed func() time.Duration) *jumpDetector {
+	return &jumpDetector{wall: wall, elapsed: elapsed, lastWall: wall(), lastElapsed: elapsed()}
+}
+
+// newSystemJumpDetector watches the system wall clock against the monotonic clock of the process
+func newSystemJumpDetector() *jumpDetector {
+	start := time.Now()
+	return newJumpDetector(func() time.Time {
+		// Round(0) strips the monotonic reading so that Sub compares wall clocks
+		return time.Now().Round(0)
+	}, func() time.Duration {
+		return time.Since(start)
+	})
+}
+
+// observe returns how far the wall clock jumped since the last reading, negative if it went back
+func (d *jumpDetector) observe() time.Duration {
+	wall, elapsed := d.wall(), d.elapsed()
+	jump := wall.Sub(d.lastWall) - (elapsed - d.lastElapsed)
+	d.lastWall, d.lastElapsed = wall, elapsed
+	return jump
+}
+
+// followsWallClock returns true if the hub's clock moves with the system wall clock
+func (h *Hub) followsWallClock() bool {
+	if c, ok := h.clock.(*OffsetClock); ok {
+		return c.base == SystemClock
+	}
+	return h.clock == SystemClock
+}
+
+// jumpWatcher looks for wall clock jumps until the hub is stopped
+func (h *Hub) jumpWatcher() {
+	t := time.NewTicker(jumpCheckInterval)
+	defer t.Stop()
+	d := newSystemJumpDetector()
+	for {
+		select {
+		case <-h.life.stop:
+			return
+		case <-t.C:
+			if jump := d.observe(); jump > h.jumpThreshold || jump < -h.jumpThreshold {
+				h.HandleClockJump(jump)
+			}
+		}
+	}
+}
+
+// HandleClockJump applies the jump policy for the direction of a wall clock jump, negative if the
+// clock went back. The hub calls it for the jumps it detects. Callers that learn about clock steps
+// some other way can call it too.
+func (h *Hub) HandleClockJump(jump time.Duration) {
+	direction, policy := "forward", h.forwardJump
+	if jump < 0 {
+		direction, policy = "backward", h.backwardJump
+	}
+	atomic.AddUint64(&h.clockJumps, 1)
+	logrus.WithFields(logrus.Fields{
+		"jump":   jump,
+		"policy": policy,
+	}).Warnf("Hub: wall clock jumped %s", direction)
+	go metrics.Incr("hub.clock.jump." + direction)
+	go metrics.Gauge("hub.clock.jump.seconds", jump.Seconds())
+
+	switch policy {
+	case JumpShift:
+		h.gate.RLock()
+		h.lock.Lock()
+		shifted := h.shiftSchedules(jump)
+		h.lock.Unlock()
+		h.gate.RUnlock()
+		logrus.WithField("jobs", shifted).Warn("Hub: shifted pending schedules by the clock jump")
+	case JumpPause:
+		h.lock.Lock()
+		h.paused = true
+		h.lock.Unlock()
+		logrus.Warn("Hub: delivery paused until it is resumed")
+		go metrics.Incr("hub.delivery.paused")
+	}
+	h.waiters.broadcast()
+}
+
+// ResumeDelivery hands out jobs again after a clock jump paused delivery
+func (h *Hub) ResumeDelivery() {
+	h.lock.Lock()
+	paused := h.paused
+	h.paused = false
+	h.lock.Unlock()
+	if paused {
+		logrus.Warn("Hub: delivery resumed")
+		go metrics.Incr("hub.delivery.resumed")
+	}
+	h.waiters.broadcast()
+}
+
+// shiftSchedules moves the trigger times of the jobs in future spokes by d and files them into
+// spokes again. Ready jobs in the past spoke are left alone. Returns the number of jobs moved.
+// Must be called with the hub locked.
+func (h *Hub) shiftSchedules(d time.Duration) int {
+	jobs := []*Job{}
+	for _, s := range h.spokeMap {
+		s.Lock()
+		s.preserve()
+		for _, e := range s.jobQueue {
+			jobs = append(jobs, e.job)
+		}
+		s.Unlock()
+	}
+	h.spokeMap = make(map[SpokeBound]*Spoke)
+	h.spokeIndex = nil
+	*h.spokes = PriorityQueue{}
+	h.currentSpoke = nil
+
+	h.pastSpoke.Lock()
+	defer h.pastSpoke.Unlock()
+	now := h.clock.Now()
+	for _, j := range jobs {
+		j.triggerAt += int64(d)
+		h.keys.add(j)
+		h.logChange(persistence.RecordReschedule, j)
+		if j.stateAt(now) == Past {
+			h.pastSpoke.AddJob(j)
+			continue
+		}
+		bound, s, ok := h.spokeFor(j)
+		if !ok {
+			s = h.newSpoke(bound.start, bound.end)
+			h.addSpoke(s)
+		}
+		s.AddJob(j)
+	}
+	return len(jobs)
+}
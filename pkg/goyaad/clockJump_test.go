@@ -0,0 +1,159 @@
+package goyaad_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test clock jumps", func() {
+	var clock *ManualClock
+	var start time.Time
+
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+		start = time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+		clock = NewManualClock(start)
+	})
+
+	newHub := func(forward, backward JumpPolicy) *Hub {
+		return NewHub(&HubOpts{
+			SpokeSpan:    time.Minute,
+			MaxSpokeSpan: time.Hour,
+			Persister:    persister,
+			Clock:        clock,
+			ForwardJump:  forward,
+			BackwardJump: backward,
+		})
+	}
+
+	It("parses jump policies", func() {
+		for name, p := range map[string]JumpPolicy{"fire": JumpFire, "shift": JumpShift, "Pause": JumpPause} {
+			parsed, err := ParseJumpPolicy(name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(Equal(p))
+		}
+		_, err := ParseJumpPolicy("ignore")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("detects wall clock jumps against the monotonic clock", func() {
+		var elapsed time.Duration
+		observe := NewJumpDetector(clock.Now, func() time.Duration { return elapsed })
+		steps := []struct {
+			wall, elapsed, jump time.Duration
+		}{
+			{time.Second, time.Second, 0},
+			// Wall clock moved 6s while only 1s passed
+			{6 * time.Second, time.Second, 5 * time.Second},
+			// Wall clock moved back 2s while 1s passed
+			{-2 * time.Second, time.Second, -3 * time.Second},
+			{time.Second, time.Second, 0},
+			{0, 10 * time.Second, -10 * time.Second},
+		}
+		for _, s := range steps {
+			clock.Advance(s.wall)
+			elapsed += s.elapsed
+			Expect(observe()).To(Equal(s.jump))
+		}
+	})
+
+	It("fires the jobs a forward jump skipped over by default", func() {
+		h := newHub(JumpFire, JumpFire)
+		for i := 1; i <= 3; i++ {
+			Expect(h.AddJob(NewJobAutoID(start.Add(time.Duration(i)*time.Minute), nil))).To(BeNil())
+		}
+
+		clock.Advance(10 * time.Minute)
+		h.HandleClockJump(10 * time.Minute)
+		Expect(h.Stats().ClockJumps).To(Equal(uint64(1)))
+		for i := 0; i < 3; i++ {
+			Expect(h.Next()).NotTo(BeNil())
+		}
+	})
+
+	It("shifts pending schedules along with the jump", func() {
+		h := newHub(JumpShift, JumpShift)
+		ready := NewJob("ready", start.Add(-time.Minute), nil)
+		soon := NewJob("soon", start.Add(time.Minute), nil)
+		later := NewJob("later", start.Add(3*time.Hour), nil)
+		for _, j := range []*Job{ready, soon, later} {
+			Expect(h.AddJob(j)).To(BeNil())
+		}
+
+		// Forward - nothing but the job that was ready already fires early
+		clock.Advance(10 * time.Minute)
+		h.HandleClockJump(10 * time.Minute)
+		Expect(h.Next().ID()).To(Equal("ready"))
+		Expect(h.Next()).To(BeNil())
+		Expect(h.PendingJobsCount()).To(Equal(2))
+		j, err := h.FindJob("later")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.TriggerAt()).To(BeTemporally("==", start.Add(3*time.Hour+10*time.Minute)))
+
+		clock.Advance(time.Minute)
+		Expect(h.Next().ID()).To(Equal("soon"))
+
+		// Backward - the remaining job doesn't get held back
+		clock.Advance(-time.Hour)
+		h.HandleClockJump(-time.Hour)
+		j, err = h.FindJob("later")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.TriggerAt()).To(BeTemporally("==", start.Add(2*time.Hour+10*time.Minute)))
+		// Still as far away in real time as before the jump
+		clock.Advance(2*time.Hour + 58*time.Minute)
+		Expect(h.Next()).To(BeNil())
+		clock.Advance(time.Minute)
+		Expect(h.Next().ID()).To(Equal("later"))
+		Expect(h.Stats().ClockJumps).To(Equal(uint64(2)))
+	})
+
+	It("pauses delivery until it is resumed", func(done Done) {
+		defer close(done)
+
+		h := newHub(JumpFire, JumpPause)
+		Expect(h.AddJob(NewJob("ready", start.Add(-time.Minute), nil))).To(BeNil())
+
+		clock.Advance(-time.Minute)
+		h.HandleClockJump(-time.Minute)
+		Expect(h.Next()).To(BeNil())
+		Expect(h.Stats().DeliveryPaused).To(BeTrue())
+
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(20 * time.Millisecond)
+			h.ResumeDelivery()
+		}()
+		j, err := h.NextWait(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.ID()).To(Equal("ready"))
+		Expect(h.Stats().DeliveryPaused).To(BeFalse())
+	}, 1)
+
+	It("pauses delivery to consumer groups", func() {
+		h := newHub(JumpFire, JumpPause)
+		h.AddGroup("a")
+		h.AddGroup("b")
+		Expect(h.AddJob(NewJob("ready", start.Add(-time.Minute), nil))).To(BeNil())
+		j, err := h.NextFor("a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.ID()).To(Equal("ready"))
+
+		// b's copy already fired but isn't handed out while paused
+		h.HandleClockJump(-time.Minute)
+		j, err = h.NextFor("b")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j).To(BeNil())
+
+		h.ResumeDelivery()
+		j, err = h.NextFor("b")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.ID()).To(Equal("ready"))
+	})
+})
@@ -0,0 +1,71 @@
+package goyaad_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test clocks", func() {
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+	})
+
+	It("moves manual and offset clocks only when told to", func() {
+		start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+		manual := NewManualClock(start)
+		Expect(manual.Now()).To(Equal(start))
+		manual.Advance(time.Hour)
+		Expect(manual.Now()).To(Equal(start.Add(time.Hour)))
+
+		offset := NewOffsetClock(manual)
+		Expect(offset.Now()).To(Equal(manual.Now()))
+		offset.SetOffset(-2 * time.Hour)
+		Expect(offset.Now()).To(Equal(start.Add(-time.Hour)))
+		Expect(offset.Offset()).To(Equal(-2 * time.Hour))
+
+		manual.Set(start)
+		Expect(offset.Now()).To(Equal(start.Add(-2 * time.Hour)))
+	})
+
+	It("steps a hub through a week of schedules without sleeping", func() {
+		clock := NewManualClock(time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC))
+		h := NewHub(&HubOpts{SpokeSpan: time.Minute, MaxSpokeSpan: time.Hour, Persister: persister, Clock: clock})
+
+		jobs := []*Job{}
+		for day := 1; day <= 7; day++ {
+			j := NewJobAutoID(clock.Now().Add(time.Duration(day)*24*time.Hour), nil)
+			Expect(h.AddJob(j)).To(BeNil())
+			jobs = append(jobs, j)
+		}
+
+		for _, j := range jobs {
+			Expect(h.Next()).To(BeNil())
+			clock.Advance(24 * time.Hour)
+			Expect(h.Next().ID()).To(Equal(j.ID()))
+		}
+		Expect(h.PendingJobsCount()).To(BeZero())
+	})
+
+	It("time travels hubs that run on an offset clock", func() {
+		h := NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persister, Clock: NewOffsetClock(SystemClock)})
+		j := NewJobAutoID(h.Now().Add(72*time.Hour), nil)
+		Expect(h.AddJob(j)).To(BeNil())
+		Expect(h.Next()).To(BeNil())
+
+		now, err := h.SetClockOffset(72*time.Hour + time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(now).To(BeTemporally("~", time.Now().Add(72*time.Hour+time.Minute), time.Second))
+		Expect(h.Next().ID()).To(Equal(j.ID()))
+		Expect(h.Stats().ClockOffset).To(Equal(72*time.Hour + time.Minute))
+
+		fixed := NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persister})
+		_, err = fixed.SetClockOffset(time.Hour)
+		Expect(err).To(Equal(ErrClockNotAdjustable))
+	})
+})
@@ -0,0 +1,463 @@
+package goyaad
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+// ErrGroupNotFound is returned when reading for a consumer group that was never added
+var ErrGroupNotFound = errors.New("consumer group not found")
+
+// consumerGroup is an independent subscriber to the jobs fired by a hub.
+// Every group sees each fired job exactly once, on its own cursor.
+type consumerGroup struct {
+	name  string
+	queue []*Job // Fired jobs this group hasn't consumed yet, in fire order
+}
+
+// groupSlot is a place in the queue of a restored group, filled once its job is restored
+type groupSlot struct {
+	group *consumerGroup
+	index int
+}
+
+// record returns the group as a record to persist: whether it is registered and the ids of the jobs in its queue
+func (g *consumerGroup) record(registered bool) persistence.Record {
+	size := 1 + binary.MaxVarintLen64
+	for _, j := range g.queue {
+		size += binary.MaxVarintLen64 + len(j.id)
+	}
+	data := make([]byte, size)
+	if registered {
+		data[0] = 1
+	}
+	n := 1 + binary.PutUvarint(data[1:], uint64(len(g.queue)))
+	for _, j := range g.queue {
+		n += binary.PutUvarint(data[n:], uint64(len(j.id)))
+		n += copy(data[n:], j.id)
+	}
+	return persistence.Record{Kind: persistence.RecordGroup, ID: g.name, Data: data[:n]}
+}
+
+// groupOf reads a group back from its record: whether it is registered and the ids of the jobs in its queue
+func groupOf(r persistence.Record) (bool, []string, error) {
+	bad := errors.Errorf("Hub: group %s has a bad record", r.ID)
+	if len(r.Data) < 2 {
+		return false, nil, bad
+	}
+	count, n := binary.Uvarint(r.Data[1:])
+	if n <= 0 || count > uint64(len(r.Data)) {
+		return false, nil, bad
+	}
+	ids := make([]string, 0, count)
+	at := 1 + n
+	for i := uint64(0); i < count; i++ {
+		l, n := binary.Uvarint(r.Data[at:])
+		if n <= 0 || uint64(len(r.Data)-at-n) < l {
+			return false, nil, bad
+		}
+		at += n
+		ids = append(ids, string(r.Data[at:at+int(l)]))
+		at += int(l)
+	}
+	return r.Data[0] == 1, ids, nil
+}
+
+func (g *consumerGroup) pop() *Job {
+	if len(g.queue) == 0 {
+		return nil
+	}
+	j := g.queue[0]
+	g.queue[0] = nil
+	g.queue = g.queue[1:]
+	return j
+}
+
+// take removes the job with the given id from the queue, nil if the group isn't waiting for it
+func (g *consumerGroup) take(jobID string) *Job {
+	for i, j := range g.queue {
+		if j.id == jobID {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			return j
+		}
+	}
+	return nil
+}
+
+// AddGroup registers a consumer group with the hub. Only jobs that fire after
+// the group exists are delivered to it. Adding an existing group is a noop.
+func (h *Hub) AddGroup(name string) {
+	h.gate.RLock()
+	defer h.gate.RUnlock()
+	h.groupLock.Lock()
+	if _, ok := h.groups[name]; ok {
+		h.groupLock.Unlock()
+		return
+	}
+	g := &consumerGroup{name: name}
+	h.groups[name] = g
+	h.storeState(g.record(true))
+	go metrics.GaugeInt("hub.group.count", len(h.groups))
+	h.groupLock.Unlock()
+
+	h.logRecord(g.record(true))
+	logrus.WithField("group", name).Info("Hub: added consumer group")
+}
+
+// RemoveGroup unregisters a consumer group. Jobs it hadn't consumed yet no longer wait for it.
+func (h *Hub) RemoveGroup(name string) error {
+	h.gate.RLock()
+	defer h.gate.RUnlock()
+	done, err := h.removeGroup(name)
+	if err != nil {
+		return err
+	}
+	h.logRecord((&consumerGroup{name: name}).record(false))
+
+	logrus.WithField("group", name).Info("Hub: removed consumer group")
+	for _, j := range done {
+		h.finish(j)
+	}
+	return nil
+}
+
+// removeGroup unregisters a consumer group and returns the jobs that no group is waiting for anymore
+func (h *Hub) removeGroup(name string) ([]*Job, error) {
+	h.groupLock.Lock()
+	defer h.groupLock.Unlock()
+
+	g, ok := h.groups[name]
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+	delete(h.groups, name)
+	h.dropState(persistence.RecordGroup, name)
+	done := []*Job{}
+	for j := g.pop(); j != nil; j = g.pop() {
+		if h.ackGroupDelivery(j) {
+			done = append(done, j)
+		}
+	}
+	go metrics.GaugeInt("hub.group.count", len(h.groups))
+	return done, nil
+}
+
+// Groups returns the names of the registered consumer groups
+func (h *Hub) Groups() []string {
+	h.groupLock.Lock()
+	defer h.groupLock.Unlock()
+
+	names := make([]string, 0, len(h.groups))
+	for n := range h.groups {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NextFor returns the next ready job for the given consumer group or nil.
+// A job is removed from the hub once every group registered when it fired has consumed it.
+// An empty group name reads directly from the hub, like Next.
+func (h *Hub) NextFor(group string) (*Job, error) {
+	if group == "" {
+		return h.Next(), nil
+	}
+	h.gate.RLock()
+	defer h.gate.RUnlock()
+
+	h.lock.Lock()
+	paused := h.paused
+	h.lock.Unlock()
+
+	h.groupLock.Lock()
+	g, ok := h.groups[group]
+	if !ok {
+		h.groupLock.Unlock()
+		return nil, ErrGroupNotFound
+	}
+	if paused {
+		// Waiting for an operator to resume delivery after a clock jump, fired jobs included
+		h.groupLock.Unlock()
+		return nil, nil
+	}
+	if j := g.pop(); j != nil {
+		done := h.ackGroupDelivery(j)
+		h.groupLock.Unlock()
+		h.delivered(group, j, done)
+		return j, nil
+	}
+	h.groupLock.Unlock()
+
+	// Nothing waiting for this group - fire the next job to every group
+	j := h.nextInWindow()
+	if j == nil {
+		return nil, nil
+	}
+
+	h.groupLock.Lock()
+	if len(h.groups) == 0 {
+		// All groups went away while firing - nobody else is waiting for this job
+		h.groupLock.Unlock()
+		h.finish(j)
+		return j, nil
+	}
+	h.fanout[j.id] = len(h.groups)
+	for _, gg := range h.groups {
+		gg.queue = append(gg.queue, j)
+	}
+	go metrics.Incr("hub.group.fanout")
+	// Readers of the other groups may be waiting for this job
+	defer h.waiters.broadcast()
+
+	// Other readers could have fired jobs for this group in the meantime - keep fire order
+	j = g.pop()
+	done := j != nil && h.ackGroupDelivery(j)
+	h.groupLock.Unlock()
+
+	if j != nil {
+		h.delivered(group, j, done)
+	}
+	return j, nil
+}
+
+// delivered records that group consumed j. The job is finished if no other group is waiting for it.
+func (h *Hub) delivered(group string, j *Job, done bool) {
+	if done {
+		h.finish(j)
+		return
+	}
+	r := persistence.Record{Kind: persistence.RecordDeliver, ID: j.id, Data: []byte(group)}
+	h.storeState(r)
+	h.logRecord(r)
+}
+
+// ackGroupDelivery records that one group consumed j and returns true if no
+// group is waiting for it anymore. Must be called with the group lock held.
+func (h *Hub) ackGroupDelivery(j *Job) bool {
+	h.fanout[j.id]--
+	if h.fanout[j.id] > 0 {
+		return false
+	}
+	delete(h.fanout, j.id)
+	return true
+}
+
+// dropFromGroups takes the fired job with the given id out of the group queues, nil if no group is waiting for it
+func (h *Hub) dropFromGroups(jobID string) *Job {
+	h.groupLock.Lock()
+	defer h.groupLock.Unlock()
+
+	if _, ok := h.fanout[jobID]; !ok {
+		return nil
+	}
+	delete(h.fanout, jobID)
+	var dropped *Job
+	for _, g := range h.groups {
+		queue := g.queue[:0]
+		for _, j := range g.queue {
+			if j.id == jobID {
+				dropped = j
+				continue
+			}
+			queue = append(queue, j)
+		}
+		g.queue = queue
+	}
+	return dropped
+}
+
+// groupBacklog returns the fired jobs that are still waiting for at least one group
+func (h *Hub) groupBacklog() []*Job {
+	h.groupLock.Lock()
+	defer h.groupLock.Unlock()
+
+	seen := make(map[string]bool, len(h.fanout))
+	jobs := []*Job{}
+	for _, g := range h.groups {
+		for _, j := range g.queue {
+			if seen[j.id] {
+				continue
+			}
+			seen[j.id] = true
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs
+}
+
+// groupBacklogLen returns the number of fired jobs still waiting for at least one group
+func (h *Hub) groupBacklogLen() int {
+	h.groupLock.Lock()
+	defer h.groupLock.Unlock()
+
+	return len(h.fanout)
+}
+
+// groupRecords returns every group with the jobs it hasn't consumed yet as records to persist
+func (h *Hub) groupRecords() []persistence.Record {
+	h.groupLock.Lock()
+	defer h.groupLock.Unlock()
+
+	records := make([]persistence.Record, 0, len(h.groups))
+	for _, g := range h.groups {
+		records = append(records, g.record(true))
+	}
+	return records
+}
+
+// restoreGroupRecord restores a consumer group from its record. The queue of the group is filled
+// as its jobs are restored, the records of a snapshot come before its jobs.
+func (h *Hub) restoreGroupRecord(r persistence.Record) error {
+	registered, ids, err := groupOf(r)
+	if err != nil {
+		return err
+	}
+	if !registered {
+		done, err := h.removeGroup(r.ID)
+		if err != nil {
+			// Removed before the snapshot was written, like when the hub stopped before the WAL was reset
+			return nil
+		}
+		for _, j := range done {
+			h.settleBatch(j)
+		}
+		return nil
+	}
+
+	h.groupLock.Lock()
+	defer h.groupLock.Unlock()
+
+	if _, ok := h.groups[r.ID]; ok {
+		return nil
+	}
+	g := &consumerGroup{name: r.ID, queue: make([]*Job, len(ids))}
+	h.groups[r.ID] = g
+	if len(ids) > 0 && h.groupSlots == nil {
+		h.groupSlots = map[string][]groupSlot{}
+	}
+	for i, id := range ids {
+		h.groupSlots[id] = append(h.groupSlots[id], groupSlot{group: g, index: i})
+	}
+	return nil
+}
+
+// replayDelivery applies a logged delivery of a job to a group. A job that fired after the last
+// snapshot is still in its spoke: it is taken out and queued for the other groups.
+func (h *Hub) replayDelivery(group, jobID string) error {
+	h.groupLock.Lock()
+	g, ok := h.groups[group]
+	if !ok {
+		h.groupLock.Unlock()
+		return errors.Errorf("Hub: delivery of job %s to unknown group %s", jobID, group)
+	}
+	if _, fired := h.fanout[jobID]; fired {
+		j := g.take(jobID)
+		done := j != nil && h.ackGroupDelivery(j)
+		h.groupLock.Unlock()
+		if done {
+			h.settleBatch(j)
+		}
+		return nil
+	}
+	h.groupLock.Unlock()
+
+	j := h.removeJob(jobID, true)
+	if j == nil {
+		return nil
+	}
+	h.groupLock.Lock()
+	queued := h.queueForOthers(j, []string{group})
+	h.groupLock.Unlock()
+
+	if !queued {
+		h.settleBatch(j)
+	}
+	return nil
+}
+
+// queueForOthers queues a fired job for the registered groups that didn't consume it yet.
+// It returns false if there are none. Must be called with the group lock held.
+func (h *Hub) queueForOthers(j *Job, consumed []string) bool {
+	others := 0
+	for name, g := range h.groups {
+		if !containsString(consumed, name) {
+			g.queue = append(g.queue, j)
+			others++
+		}
+	}
+	if others == 0 {
+		return false
+	}
+	h.fanout[j.id] = others
+	return true
+}
+
+func containsString(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreDelivery records that group consumed the fired job with the given id, read back from a job store
+// before its jobs. The job is queued for the other groups once it is restored.
+func (h *Hub) restoreDelivery(group, jobID string) {
+	h.groupLock.Lock()
+	defer h.groupLock.Unlock()
+
+	if h.groupDelivered == nil {
+		h.groupDelivered = map[string][]string{}
+	}
+	h.groupDelivered[jobID] = append(h.groupDelivered[jobID], group)
+}
+
+// restoreToGroups puts a restored job back into the queues of the groups that hadn't consumed it yet.
+// It returns false if no group was waiting for it.
+func (h *Hub) restoreToGroups(j *Job) bool {
+	h.groupLock.Lock()
+	defer h.groupLock.Unlock()
+
+	if consumed, ok := h.groupDelivered[j.id]; ok {
+		delete(h.groupDelivered, j.id)
+		return h.queueForOthers(j, consumed)
+	}
+	slots, ok := h.groupSlots[j.id]
+	if !ok {
+		return false
+	}
+	delete(h.groupSlots, j.id)
+	for _, s := range slots {
+		s.group.queue[s.index] = j
+	}
+	h.fanout[j.id] = len(slots)
+	return true
+}
+
+// compactGroups drops the places in restored group queues whose jobs weren't restored
+func (h *Hub) compactGroups() {
+	h.groupLock.Lock()
+	defer h.groupLock.Unlock()
+
+	if len(h.groupSlots) > 0 {
+		logrus.Warnf("Hub:Restore %d jobs consumer groups were waiting for weren't restored", len(h.groupSlots))
+	}
+	h.groupSlots = nil
+	h.groupDelivered = nil
+	for _, g := range h.groups {
+		queue := g.queue[:0]
+		for _, j := range g.queue {
+			if j != nil {
+				queue = append(queue, j)
+			}
+		}
+		g.queue = queue
+	}
+	go metrics.GaugeInt("hub.group.count", len(h.groups))
+}
@@ -0,0 +1,136 @@
+package goyaad_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test consumer groups", func() {
+	var h *Hub
+
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+		h = NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persister, AttemptRestore: false})
+	})
+
+	nextID := func(group string) string {
+		j, err := h.NextFor(group)
+		Expect(err).To(BeNil())
+		if j == nil {
+			return ""
+		}
+		return j.ID()
+	}
+
+	It("fails for unknown groups", func() {
+		_, err := h.NextFor("billing")
+		Expect(err).To(Equal(ErrGroupNotFound))
+		Expect(h.RemoveGroup("billing")).To(Equal(ErrGroupNotFound))
+	})
+
+	It("delivers every job once to each group", func() {
+		h.AddGroup("billing")
+		h.AddGroup("audit")
+		h.AddGroup("audit")
+		Expect(h.Groups()).To(Equal([]string{"audit", "billing"}))
+
+		jobs := []*Job{}
+		for i := 0; i < 5; i++ {
+			j := NewJobAutoID(time.Now().Add(-time.Duration(10-i)*time.Millisecond), nil)
+			Expect(h.AddJob(j)).To(BeNil())
+			jobs = append(jobs, j)
+		}
+
+		// billing races ahead, audit follows on its own cursor
+		for _, j := range jobs {
+			Expect(nextID("billing")).To(Equal(j.ID()))
+		}
+		Expect(nextID("billing")).To(BeEmpty())
+		Expect(h.PendingJobsCount()).To(Equal(5))
+
+		for _, j := range jobs {
+			Expect(nextID("audit")).To(Equal(j.ID()))
+		}
+		Expect(nextID("audit")).To(BeEmpty())
+		Expect(h.PendingJobsCount()).To(Equal(0))
+	})
+
+	It("only delivers jobs fired after a group was added", func() {
+		h.AddGroup("billing")
+		first := NewJobAutoID(time.Now().Add(-time.Second), nil)
+		second := NewJobAutoID(time.Now().Add(-time.Millisecond), nil)
+		Expect(h.AddJob(first)).To(BeNil())
+		Expect(h.AddJob(second)).To(BeNil())
+
+		Expect(nextID("billing")).To(Equal(first.ID()))
+
+		h.AddGroup("notifications")
+		Expect(nextID("notifications")).To(Equal(second.ID()))
+		Expect(nextID("billing")).To(Equal(second.ID()))
+		Expect(h.PendingJobsCount()).To(Equal(0))
+	})
+
+	It("stops waiting for removed groups", func() {
+		h.AddGroup("billing")
+		h.AddGroup("audit")
+		Expect(h.AddJob(NewJobAutoID(time.Now().Add(-time.Second), nil))).To(BeNil())
+
+		Expect(nextID("billing")).NotTo(BeEmpty())
+		Expect(h.PendingJobsCount()).To(Equal(1))
+
+		Expect(h.RemoveGroup("audit")).To(BeNil())
+		Expect(h.PendingJobsCount()).To(Equal(0))
+	})
+
+	It("restores groups and the jobs they haven't consumed yet", func(done Done) {
+		defer close(done)
+
+		for _, g := range []string{"billing", "audit", "notifications"} {
+			h.AddGroup(g)
+		}
+		jobs := []*Job{}
+		for i := 0; i < 3; i++ {
+			j := NewJobAutoID(time.Now().Add(-time.Duration(10-i)*time.Millisecond), []byte("body"))
+			Expect(h.AddJob(j)).To(BeNil())
+			jobs = append(jobs, j)
+		}
+		later := NewJobAutoID(time.Now().Add(time.Hour), nil)
+		Expect(h.AddJob(later)).To(BeNil())
+
+		for _, j := range jobs {
+			Expect(nextID("billing")).To(Equal(j.ID()))
+		}
+		Expect(nextID("audit")).To(Equal(jobs[0].ID()))
+		Expect(h.PendingJobsCount()).To(Equal(4))
+
+		for e := range h.Persist() {
+			Fail("Persist failed due to error: " + e.Error())
+		}
+
+		h = NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persister, AttemptRestore: false})
+		Expect(h.Restore()).To(BeNil())
+		Expect(h.Groups()).To(Equal([]string{"audit", "billing", "notifications"}))
+		Expect(h.PendingJobsCount()).To(Equal(4))
+
+		// Fired jobs aren't fired again, each group picks up where it left off
+		Expect(nextID("billing")).To(BeEmpty())
+		for _, j := range jobs[1:] {
+			Expect(nextID("audit")).To(Equal(j.ID()))
+		}
+		for _, j := range jobs {
+			j2, err := h.NextFor("notifications")
+			Expect(err).To(BeNil())
+			Expect(j2.ID()).To(Equal(j.ID()))
+			Expect(j2.Body()).To(Equal([]byte("body")))
+		}
+		Expect(h.PendingJobsCount()).To(Equal(1))
+		_, err := h.FindJob(later.ID())
+		Expect(err).To(BeNil())
+	}, 5)
+})
@@ -0,0 +1,9 @@
+package goyaad
+
+import "time"
+
+// NewJumpDetector lets the tests drive a jump detector with their own clocks. The returned
+// func reports how far the wall clock jumped since it was last called.
+func NewJumpDetector(wall func() time.Time, elapsed func() time.Duration) func() time.Duration {
+	return newJumpDetector(wall, elapsed).observe
+}
@@ -2,8 +2,11 @@ package goyaad
 
 import (
 	"container/heap"
+	"context"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,11 +19,79 @@ const (
 	hundredYears = time.Hour * 24 * 365 * 100
 )
 
+// ErrJobNotFound is returned when looking up a job the hub doesn't hold
+var ErrJobNotFound = errors.New("job not found")
+
 // HubOpts define customizations for Hub initialization
 type HubOpts struct {
-	Persister      persistence.Persister // persister to store/restore from disk
-	AttemptRestore bool                  // If true, hub will try to restore from disk on start
-	SpokeSpan      time.Duration         // How wide should the spokes be
+	Persister persistence.Persister // persister to store/restore from disk
+	WAL       *persistence.WAL      // Records changes between snapshots, replayed on restore. The hub closes it when it stops.
+	Backup    persistence.Backup    // If set, copies the snapshot persisted on stop somewhere else, like S3
+
+	CheckpointInterval time.Duration // If positive, a snapshot is written in the background this often
+	CheckpointSize     int64         // If positive, a snapshot is written in the background once the WAL takes more bytes
+	AttemptRestore     bool          // If true, hub will try to restore from disk on start. Hubs with a WAL or job store always do
+	SpokeSpan          time.Duration // How wide should the spokes be, the narrowest spoke if spans are adaptive
+	MaxSpokeSpan       time.Duration // If wider than SpokeSpan, spoke spans adapt to job distance and density up to this
+	MaxSpokeJobs       int           // Adaptive spokes holding more jobs are split, defaults to 10000
+	RateLimit          float64       // Max jobs handed out per second, 0 means unlimited
+	RateBurst          int           // Max jobs handed out at once when rate limited
+	Windows            []Window      // Allowed delivery windows for jobs without their own
+	Clock              Clock         // Decides when jobs are ready, the system clock if nil
+	Misfire            Misfire       // What happens to late jobs without their own policy, they fire by default
+
+	ClockJumpThreshold time.Duration // Smallest wall clock jump the jump policies apply to, defaults to 2s, negative disables
+	ForwardJump        JumpPolicy    // What happens when the wall clock jumps forward
+	BackwardJump       JumpPolicy    // What happens when the wall clock jumps back
+
+	StorageMode     StorageMode   // Where job bodies live, in memory by default
+	StorageDir      string        // Where segment files for bodies on disk go, the system temp dir if empty
+	SpillHorizon    time.Duration // Lazy storage spills spokes that start further away than this, defaults to an hour
+	MemoryBudget    int64         // Lazy storage spills the furthest spokes while bodies in memory take more bytes
+	PastSpokeBudget int64         // Lazy storage spills the latest ready jobs while the past spoke's bodies take more bytes
+	BodyArenaSize   int           // If positive, small job bodies are packed per spoke into slabs of this many bytes
+
+	MaxJobs          int64        // Max pending jobs, 0 means unlimited
+	MaxBytes         int64        // Max approximate bytes used by pending jobs, 0 means unlimited
+	SharedAdmissions []*Admission // Limits shared with other hubs, like process wide limits
+
+	waiters *waitSignal // Shared by the shards of a sharded hub so that readers wake up for jobs of any shard
+}
+
+// HubStats is a point in time view of the hub's state
+type HubStats struct {
+	PendingJobs      int     // All jobs the hub is responsible for
+	ReadyBacklog     int     // Ready jobs waiting in the past spoke
+	CurrentSpokeJobs int     // Jobs in the current spoke
+	Spokes           int     // Number of spokes, excluding the past spoke
+	RemovedJobs      uint64  // Jobs removed by cancellation
+	RateLimit        float64 // Max jobs handed out per second, 0 means unlimited
+	RateBurst        int     // Max jobs handed out at once when rate limited
+	RateTokens       int     // Jobs that can be handed out right now without throttling
+	Throttled        bool    // True if the last attempt to hand out a job was throttled
+	ThrottledCount   uint64  // Number of times delivery was throttled
+
+	SpokeJobs SpokeDistribution // How jobs are spread over the spokes
+
+	BodyBytes   int64 // Bytes of job bodies held in memory
+	SpilledJobs int64 // Jobs whose bodies are on disk
+	SpillBytes  int64 // Bytes used by segment files on disk
+
+	Memory       AdmissionUsage   // Approximate memory used by pending jobs against the hub's limits
+	SharedMemory []AdmissionUsage // Usage of the limits shared with other hubs, in the order given in HubOpts
+
+	Now         time.Time     // Time on the hub's clock
+	ClockOffset time.Duration // How far the hub's clock was moved from its base clock
+
+	Restoring bool                      // True until the hub finished restoring jobs from disk
+	Recovery  persistence.RecoveryStats // What happened to the records of the snapshot restored from
+
+	MisfiredJobs uint64 // Late jobs dropped by their misfire policy
+
+	ClockJumps     uint64 // Wall clock jumps the jump policies were applied to
+	DeliveryPaused bool   // True while delivery waits to be resumed after a clock jump
+
+	CheckpointAt time.Time // When the last checkpoint finished, zero if none did
 }
 
 // Hub is a time ordered collection of spokes
@@ -29,53 +100,213 @@ type Hub struct {
 	spokeMap  map[SpokeBound]*Spoke // quick lookup map
 	spokes    *PriorityQueue
 
+	maxSpokeSpan time.Duration // widest adaptive spoke
+	maxSpokeJobs int           // adaptive spokes holding more jobs are split
+	spokeIndex   []*Spoke      // spokes ordered by start, only kept when spans are adaptive
+
 	pastSpoke    *Spoke // Permanently pinned to the past
 	currentSpoke *Spoke // The current spoke
 
 	removedJobsCount uint64
 	lock             *sync.Mutex
 
+	limiter        *tokenBucket // delivery rate limiter, nil when unlimited
+	throttled      bool
+	throttledCount uint64
+
+	windows []Window // allowed delivery windows for jobs without their own
+	misfire Misfire  // misfire policy for jobs without their own
+
+	keys          *keyIndex // pending keyed jobs, for the latest misfire policy
+	misfiredCount uint64    // updated atomically
+
+	jumpThreshold time.Duration
+	forwardJump   JumpPolicy
+	backwardJump  JumpPolicy
+	clockJumps    uint64 // updated atomically
+	paused        bool   // no jobs are handed out while true, guarded by lock
+	clock         Clock
+	waiters       *waitSignal // wakes up readers blocked in NextWait
+
+	storageMode     StorageMode
+	store           bodyStore // bodies on disk, nil when bodies are in memory
+	spillHorizon    time.Duration
+	memoryBudget    int64
+	pastSpokeBudget int64
+	bodyBytes       int64 // bodies in memory, updated atomically
+	spilledJobs     int64 // jobs with bodies on disk, updated atomically
+	arenaSlabSize   int   // slab size of the per spoke body arenas, 0 when bodies aren't packed
+
+	admission        *Admission   // memory used by this hub's jobs
+	sharedAdmissions []*Admission // limits shared with other hubs
+
+	batches   map[string]*Batch // open and sealed batches by id
+	batchLock *sync.Mutex
+
+	groups         map[string]*consumerGroup // consumer groups by name
+	fanout         map[string]int            // number of groups yet to consume a fired job, by job id
+	groupSlots     map[string][]groupSlot    // places in restored group queues, by the id of the job to restore there
+	groupDelivered map[string][]string       // groups that consumed a fired job, by job id, restored from a job store
+	groupLock      *sync.Mutex
+
 	persister persistence.Persister
+	backup    persistence.Backup
+	wal       *persistence.WAL          // nil when changes aren't logged
+	jobStore  persistence.JobStore      // nil when the persister only takes snapshots
+	recovery  persistence.RecoveryStats // of the last restore, guarded by lock
+
+	gate               *sync.RWMutex // held shared by changes, exclusively while a checkpoint copies the jobs
+	checkpointLock     *sync.Mutex   // one snapshot at a time, spokes are frozen for at most one
+	checkpointInterval time.Duration
+	checkpointSize     int64
+	checkpointAt       int64         // unix nanos of the last checkpoint, updated atomically
+	backupDone         chan struct{} // closed once the last backup started is done, guarded by checkpointLock
+	life               *lifecycle    // background goroutines and the restore barrier
 }
 
 // NewHub creates a new hub where adjacent spokes lie at the given
 // spokeSpan duration boundary.
 func NewHub(opts *HubOpts) *Hub {
+	clock := opts.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	now := clock.Now()
+	waiters := opts.waiters
+	if waiters == nil {
+		waiters = newWaitSignal()
+	}
 	h := &Hub{
-		spokeSpan:        opts.SpokeSpan,
-		spokeMap:         make(map[SpokeBound]*Spoke),
-		spokes:           &PriorityQueue{},
-		pastSpoke:        NewSpoke(time.Now().Add(-1*hundredYears), time.Now().Add(hundredYears)),
-		currentSpoke:     nil,
-		removedJobsCount: 0,
-		lock:             &sync.Mutex{},
-		persister:        opts.Persister,
+		spokeSpan:          opts.SpokeSpan,
+		maxSpokeSpan:       opts.MaxSpokeSpan,
+		maxSpokeJobs:       opts.MaxSpokeJobs,
+		spokeMap:           make(map[SpokeBound]*Spoke),
+		spokes:             &PriorityQueue{},
+		pastSpoke:          NewSpokeWithClock(now.Add(-1*hundredYears), now.Add(hundredYears), clock),
+		currentSpoke:       nil,
+		removedJobsCount:   0,
+		lock:               &sync.Mutex{},
+		batches:            make(map[string]*Batch),
+		batchLock:          &sync.Mutex{},
+		groups:             make(map[string]*consumerGroup),
+		fanout:             make(map[string]int),
+		groupLock:          &sync.Mutex{},
+		persister:          opts.Persister,
+		backup:             opts.Backup,
+		wal:                opts.WAL,
+		jobStore:           asJobStore(opts.Persister),
+		gate:               &sync.RWMutex{},
+		checkpointLock:     &sync.Mutex{},
+		checkpointInterval: opts.CheckpointInterval,
+		checkpointSize:     opts.CheckpointSize,
+		windows:            opts.Windows,
+		misfire:            opts.Misfire,
+		keys:               newKeyIndex(),
+		jumpThreshold:      opts.ClockJumpThreshold,
+		forwardJump:        opts.ForwardJump,
+		backwardJump:       opts.BackwardJump,
+		clock:              clock,
+		waiters:            waiters,
+		storageMode:        opts.StorageMode,
+		spillHorizon:       opts.SpillHorizon,
+		memoryBudget:       opts.MemoryBudget,
+		pastSpokeBudget:    opts.PastSpokeBudget,
+		arenaSlabSize:      opts.BodyArenaSize,
+		admission:          NewAdmission(opts.MaxJobs, opts.MaxBytes),
+		sharedAdmissions:   opts.SharedAdmissions,
+		life:               newLifecycle(),
 	}
 	heap.Init(h.spokes)
+	if opts.RateLimit > 0 {
+		h.limiter = newTokenBucket(opts.RateLimit, opts.RateBurst, now)
+	}
+	if h.maxSpokeJobs <= 0 {
+		h.maxSpokeJobs = defaultMaxSpokeJobs
+	}
+	if h.jumpThreshold == 0 {
+		h.jumpThreshold = defaultJumpThreshold
+	}
+	if h.spillHorizon <= 0 {
+		h.spillHorizon = defaultSpillHorizon
+	}
+	switch {
+	case h.storageMode == StorageInMemory:
+	case h.jobStore != nil:
+		// Every body is in the job store already
+		h.store = &storedBodies{jobs: h.jobStore}
+	default:
+		dir := opts.StorageDir
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "goyaad")
+		}
+		store, err := newSegmentStore(dir, defaultSegmentSize)
+		if err != nil {
+			logrus.WithError(err).Error("Hub: cannot open segment store, keeping job bodies in memory")
+			h.storageMode = StorageInMemory
+			break
+		}
+		h.store = store
+	}
 
 	logrus.WithFields(logrus.Fields{
 		"spokeSpan":      opts.SpokeSpan,
+		"maxSpokeSpan":   opts.MaxSpokeSpan,
 		"attemptRestore": opts.AttemptRestore,
+		"rateLimit":      opts.RateLimit,
+		"rateBurst":      opts.RateBurst,
+		"storageMode":    h.storageMode,
+		"maxJobs":        opts.MaxJobs,
+		"maxBytes":       opts.MaxBytes,
+		"misfire":        opts.Misfire,
+		"forwardJump":    opts.ForwardJump,
+		"backwardJump":   opts.BackwardJump,
+		"wal":            opts.WAL != nil,
+		"jobStore":       h.jobStore != nil,
+		"checkpoint":     opts.CheckpointInterval,
 	}).Info("Created hub")
 
-	go func() {
-		if opts.AttemptRestore {
-			logrus.Info("Hub: Entering restore mode")
-			err := h.Restore()
-			if err != nil {
-				logrus.Error("Hub: Restore error", err)
-			}
+	restore := opts.AttemptRestore
+	if !restore && (h.wal != nil || h.jobStore != nil) {
+		// Both hold jobs that were acknowledged to clients, dropping them would lose those jobs
+		logrus.Info("Hub: restoring anyway, the WAL or job store of the last run has acknowledged jobs")
+		restore = true
+	}
 
-			logrus.Info("Hub: Initial restore finished. Resuming")
-		}
-	}()
-	go h.StatusPrinter()
+	if restore {
+		h.life.restore("Hub", h.Restore)
+	} else {
+		h.life.skipRestore()
+	}
+	h.life.run(h.StatusPrinter)
+	if h.adaptive() {
+		h.life.run(h.rebalancer)
+	}
+	if h.storageMode == StorageLazy {
+		h.life.run(h.tierer)
+	}
+	if h.jumpThreshold > 0 && h.followsWallClock() {
+		h.life.run(h.jumpWatcher)
+	}
+	if h.persister != nil && (h.checkpointInterval > 0 || h.checkpointSize > 0) {
+		h.life.run(h.checkpointer)
+	}
+	describeSnapshots(h.persister, h.spokeSpan)
 
 	return h
 }
 
-// Stop the hub gracefully and if persist is true, then persist all jobs to disk for later recovery
+// Stop the hub gracefully and if persist is true, then persist all jobs to disk for later recovery.
+// Stop waits for the background goroutines of the hub to return. A restore still running is cut short
+// and nothing is persisted then, so that the jobs not restored yet stay on disk. The same goes for a failed restore.
 func (h *Hub) Stop(persist bool) {
+	if restored := h.life.shutdown(); persist && !restored {
+		logrus.Warn("Hub:Stop restore didn't finish, leaving persisted jobs as they are")
+		persist = false
+	}
+	if err := h.life.persistErr(); persist && err != nil {
+		logrus.WithError(h.life.err).Warn("Hub:Stop restore failed, leaving persisted jobs as they are")
+		persist = false
+	}
 	if persist {
 		logrus.Infof("Hub:Stop Starting persistence for pid: %d", os.Getpid())
 		errC := h.Persist()
@@ -85,15 +316,24 @@ func (h *Hub) Stop(persist bool) {
 		}
 		logrus.Infof("Hub:Stop Finished persistence with %d errors", errCount)
 	}
+	if h.wal != nil {
+		if err := h.wal.Close(); err != nil {
+			logrus.WithError(err).Error("Hub:Stop cannot close the WAL")
+		}
+	}
+	h.closeJobStore()
+	h.closeStore()
 	logrus.Infof("Hub:Stop stopped")
 }
 
 // PendingJobsCount return the number of jobs currently pending
+// Fired jobs that some consumer group hasn't consumed yet are still pending
 func (h *Hub) PendingJobsCount() int {
 	count := h.pastSpoke.PendingJobsLen()
 	for _, v := range h.spokeMap {
 		count += v.PendingJobsLen()
 	}
+	count += h.groupBacklogLen()
 
 	return count
 }
@@ -101,6 +341,17 @@ func (h *Hub) PendingJobsCount() int {
 // CancelJob cancels a job if found. Calls are noop for unknown jobs
 func (h *Hub) CancelJob(jobID string) error {
 	go metrics.Incr("hub.cancel.req")
+	h.gate.RLock()
+	defer h.gate.RUnlock()
+	j, err := h.cancelJob(jobID)
+	if j != nil {
+		h.logChange(persistence.RecordCancel, j)
+		h.settleBatch(j)
+	}
+	return err
+}
+
+func (h *Hub) cancelJob(jobID string) (*Job, error) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
@@ -110,13 +361,16 @@ func (h *Hub) CancelJob(jobID string) error {
 	if err != nil {
 		logrus.Debug("cancel found no owner spoke: ", jobID)
 		// return nil - cancel if job not found is idempotent
-		return nil
+		return nil, nil
 	}
 	logrus.Debug("cancel found owner spoke: ", jobID)
-	err = s.CancelJob(jobID)
+	j, err := s.cancelJob(jobID)
+	if j != nil {
+		h.discard(j)
+	}
 	h.removedJobsCount++
 	go metrics.Incr("hub.cancel.ok")
-	return err
+	return j, err
 }
 
 // FindOwnerSpoke returns the spoke that owns this job
@@ -139,16 +393,94 @@ func (h *Hub) FindOwnerSpoke(jobID string) (*Spoke, error) {
 	return nil, errors.New("Cannot find job owner spoke")
 }
 
+// FindJob returns the pending job with the given id
+func (h *Hub) FindJob(jobID string) (*Job, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, err := h.FindOwnerSpoke(jobID)
+	if err != nil {
+		return nil, ErrJobNotFound
+	}
+	j, ok := s.FindJob(jobID)
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return j, nil
+}
+
+// newSpoke creates a spoke on the clock of this hub
+func (h *Hub) newSpoke(start, end time.Time) *Spoke {
+	return NewSpokeWithClock(start, end, h.clock)
+}
+
 // addSpoke adds spoke s to this hub
 func (h *Hub) addSpoke(s *Spoke) {
 	h.spokeMap[s.SpokeBound] = s
+	h.indexSpoke(s)
 	heap.Push(h.spokes, s.AsPriorityItem())
 }
 
 // Next returns the next job that is ready now or returns nil.
+// Next bypasses consumer groups - once a hub has groups, consumers should use NextFor.
 func (h *Hub) Next() *Job {
 	defer metrics.Time("hub.next.search.duration", time.Now())
+	h.gate.RLock()
+	defer h.gate.RUnlock()
+
+	j := h.nextInWindow()
+	if j != nil {
+		h.finish(j)
+	}
+	return j
+}
+
+// nextInWindow returns the next ready job that is allowed to be delivered now.
+// Ready jobs that misfired are dropped and ready jobs that came due outside of their
+// delivery windows are moved to the next window start
+func (h *Hub) nextInWindow() *Job {
+	for {
+		j := h.next()
+		if j == nil {
+			return nil
+		}
+
+		now := h.clock.Now()
+		if h.misfired(j, now) {
+			h.skipMisfire(j, now)
+			h.finish(j)
+			continue
+		}
+
+		windows := j.Windows()
+		if len(windows) == 0 {
+			windows = h.windows
+		}
+		if inWindows(windows, now) {
+			return j
+		}
+
+		dueAt := j.TriggerAt()
+		// Strictly after now - a window start that isn't open (a DST gap) would otherwise spin
+		j.triggerAt = nextWindowStart(windows, now.Add(time.Nanosecond)).UnixNano()
+		j.options().windowMoves++
+		logrus.WithFields(logrus.Fields{
+			"jobID":     j.id,
+			"dueAt":     dueAt,
+			"triggerAt": j.TriggerAt(),
+			"moves":     j.opts.windowMoves,
+		}).Info("Hub: job came due outside its delivery windows, moved to the next window start")
+		go metrics.Incr("hub.job.window.moved")
+
+		if err := h.addJob(j); err != nil {
+			logrus.WithError(err).WithField("jobID", j.id).Error("Hub: failed to move job to its next window")
+			continue
+		}
+		h.logChange(persistence.RecordReschedule, j)
+	}
+}
 
+func (h *Hub) next() *Job {
 	h.lock.Lock()
 
 	// since we have the lock, send some metrics
@@ -161,6 +493,75 @@ func (h *Hub) Next() *Job {
 	go metrics.GaugeInt("hub.job.pastspoke.count", h.pastSpoke.PendingJobsLen())
 	defer pastLocker.Unlock()
 
+	if h.paused {
+		// Waiting for an operator to resume delivery after a clock jump
+		return nil
+	}
+
+	if h.limiter != nil && !h.limiter.ready(h.clock.Now()) {
+		// Over the delivery rate - ready jobs wait in order for the next token
+		h.throttled = true
+		h.throttledCount++
+		go metrics.Incr("hub.next.throttled")
+		return nil
+	}
+
+	j := h.nextReady()
+	if j != nil {
+		h.checkout(j)
+	}
+	if j != nil && h.limiter != nil {
+		h.limiter.take()
+		h.throttled = false
+	}
+	return j
+}
+
+// peek returns the trigger time of the job Next would hand out now, without removing it.
+// Delivery windows and rate limits are not considered.
+func (h *Hub) peek() (time.Time, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	pastLocker := h.pastSpoke.GetLocker()
+	pastLocker.Lock()
+	defer pastLocker.Unlock()
+
+	if h.paused {
+		return time.Time{}, false
+	}
+	h.retireExpiredSpokes()
+	if j := h.pastSpoke.peek(); j != nil {
+		return j.TriggerAt(), true
+	}
+
+	s := h.currentSpoke
+	if s == nil {
+		heap.Init(h.spokes)
+		if h.spokes.Len() == 0 {
+			return time.Time{}, false
+		}
+		s = h.spokes.AtIdx(0).value.(*Spoke)
+		if s.AsTemporalState() == Future {
+			return time.Time{}, false
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if j := s.peek(); j != nil {
+		return j.TriggerAt(), true
+	}
+	return time.Time{}, false
+}
+
+// nextReady pops the next ready job from the spokes.
+// Must be called with the hub and the past spoke locked.
+func (h *Hub) nextReady() *Job {
+	// Spokes that already ended hand their jobs over to the past spoke so that
+	// a delivery backlog stays in trigger order
+	h.retireExpiredSpokes()
+
 	// Find a job in past spoke
 	j := h.pastSpoke.Next()
 	if j != nil {
@@ -169,18 +570,6 @@ func (h *Hub) Next() *Job {
 	}
 	// Checked past spoke
 
-	// Find a job in current spoke
-	// If current is empty and now expired, prune it...
-	if h.currentSpoke != nil {
-		if h.currentSpoke.PendingJobsLen() == 0 && h.currentSpoke.AsTemporalState() == Past {
-			logrus.Info("pruning the current spoke")
-			// This routine could be unfortunate - it found a currentspoke that was expired
-			// so it has the pay the price finding the next candidate
-			delete(h.spokeMap, h.currentSpoke.SpokeBound)
-			h.currentSpoke = nil
-		}
-	}
-
 	// No currently assigned spoke
 	if h.currentSpoke == nil {
 		// Fix the heap
@@ -231,6 +620,42 @@ func (h *Hub) Next() *Job {
 	return j
 }
 
+// retireExpiredSpokes moves the jobs of spokes that ended into the past spoke and drops those spokes.
+// Must be called with the hub and the past spoke locked.
+func (h *Hub) retireExpiredSpokes() {
+	if h.currentSpoke != nil {
+		if h.currentSpoke.AsTemporalState() != Past {
+			// Spokes don't overlap - nothing after the current spoke can have ended
+			return
+		}
+		logrus.Debug("retiring the current spoke")
+		h.retireSpoke(h.currentSpoke)
+		h.currentSpoke = nil
+	}
+
+	for h.spokes.Len() > 0 {
+		s := h.spokes.AtIdx(0).value.(*Spoke)
+		if s.AsTemporalState() != Past {
+			return
+		}
+		heap.Pop(h.spokes)
+		h.retireSpoke(s)
+	}
+}
+
+// retireSpoke moves all jobs of s into the past spoke and forgets s
+func (h *Hub) retireSpoke(s *Spoke) {
+	s.Lock()
+	moved := s.moveJobsTo(h.pastSpoke)
+	s.Unlock()
+
+	h.forgetSpoke(s)
+	if moved > 0 {
+		logrus.Debugf("Moved %d jobs from expired spoke %s to the past spoke", moved, s.ID())
+		go metrics.Incr("hub.spoke.retired")
+	}
+}
+
 func (h *Hub) mergeQueues(pq *PriorityQueue) {
 	for pq.Len() > 0 {
 		i := heap.Pop(pq)
@@ -242,9 +667,10 @@ func (h *Hub) mergeQueues(pq *PriorityQueue) {
 // returns the number of spokes pruned
 func (h *Hub) Prune() int {
 	pruned := 0
-	for k, v := range h.spokeMap {
-		if v.IsExpired() && v.PendingJobsLen() == 0 {
-			delete(h.spokeMap, k)
+	now := h.clock.Now()
+	for _, v := range h.spokeMap {
+		if v.expiredAt(now) && v.PendingJobsLen() == 0 {
+			h.forgetSpoke(v)
 		}
 		pruned++
 	}
@@ -252,12 +678,53 @@ func (h *Hub) Prune() int {
 	return pruned
 }
 
-// AddJob to this hub. Hub should never reject a job - this method will panic if that happens
+// AddJob to this hub. Jobs are rejected with ErrOutOfMemory if they don't fit in the memory limits.
+// Jobs that belong to a batch are rejected if the batch is unknown or already sealed.
+// If the job asked for jitter or spread, the hub picks its concrete trigger time here
+// and j.TriggerAt() reports the chosen time once AddJob returns.
+// Hubs with a WAL record the job before adding it and reject it if it can't be recorded.
 func (h *Hub) AddJob(j *Job) error {
+	if err := h.reserve(j); err != nil {
+		return err
+	}
+	placeJob(j)
+
+	h.gate.RLock()
+	defer h.gate.RUnlock()
+
+	if j.BatchID() != "" {
+		if err := h.joinBatch(j); err != nil {
+			h.unreserve(j)
+			return err
+		}
+	}
+	if err := h.logWAL(persistence.RecordAdd, j); err != nil {
+		h.leaveBatch(j)
+		h.unreserve(j)
+		return err
+	}
+	err := h.add(j, true)
+	if err != nil {
+		h.logChange(persistence.RecordCancel, j)
+		h.leaveBatch(j)
+		h.unreserve(j)
+	}
+	return err
+}
+
+// addJob adds a job the hub didn't reserve room for, like restored jobs
+func (h *Hub) addJob(j *Job) error {
+	return h.add(j, false)
+}
+
+// add puts j in its spoke. If reserved is set, j takes the room AddJob or SealBatch reserved for it.
+func (h *Hub) add(j *Job, reserved bool) error {
+	// Deferred first so that waiters wake up once the hub is unlocked
+	defer h.waiters.broadcast()
 	defer metrics.Time("hub.job.add.duration", time.Now())
 	go metrics.GaugeInt("hub.job.size", len(j.body))
 
-	switch j.AsTemporalState() {
+	switch j.stateAt(h.clock.Now()) {
 	case Past:
 		logrus.Tracef("Adding job: %s to past spoke", j.id)
 		pastLocker := h.pastSpoke.GetLocker()
@@ -270,6 +737,7 @@ func (h *Hub) AddJob(j *Job) error {
 			logrus.WithError(err).Error("Past spoke rejected job. This should never happen")
 			return err
 		}
+		h.admit(j, h.pastSpoke, reserved)
 		go metrics.Incr("hub.addjob.past")
 	case Future:
 		logrus.Tracef("Adding job: %s to future spoke", j.id)
@@ -289,14 +757,14 @@ func (h *Hub) AddJob(j *Job) error {
 					logrus.WithError(err).Error("Current spoke rejected job. This should never happen")
 					return err
 				}
+				h.admit(j, h.currentSpoke, reserved)
 				return nil
 			}
 		}
 
 		// Search for a spoke that can take ownership of this job
 		// Reads are still going to be ordered anyways
-		jobBound := j.AsBound(h.spokeSpan)
-		candidate, ok := h.spokeMap[jobBound]
+		jobBound, candidate, ok := h.spokeFor(j)
 		if ok {
 			// Found a candidate that can take this job
 			logrus.Debugf("Adding job: %s to candidate spoke", j.id)
@@ -305,18 +773,21 @@ func (h *Hub) AddJob(j *Job) error {
 				logrus.WithError(err).Error("Hub should always accept a job. No spoke accepted")
 				return err
 			}
+			h.admit(j, candidate, reserved)
+			h.splitIfFull(candidate)
 			// Accepted, all done...
 			return nil
 		}
 
 		// Time to create a new spoke for this job
 		logrus.Debugf("Adding job: %s to a new spoke", j.id)
-		s := NewSpoke(jobBound.start, jobBound.end)
+		s := h.newSpoke(jobBound.start, jobBound.end)
 		err := s.AddJob(j)
 		if err != nil {
 			logrus.WithError(err).Error("Hub should always accept a job. No spoke accepted")
 			return err
 		}
+		h.admit(j, s, reserved)
 
 		// h is still locked here so it's ok
 		h.addSpoke(s)
@@ -351,94 +822,330 @@ func (h *Hub) Status() {
 		go metrics.GaugeInt("hub.job.currentspoke.count", h.currentSpoke.PendingJobsLen())
 	}
 
+	if h.limiter != nil {
+		logrus.Infof("Delivery throttled: %v (%d times)", h.throttled, h.throttledCount)
+		go metrics.GaugeInt("hub.throttled", boolToInt(h.throttled))
+		go metrics.Gauge("hub.throttled.count", float64(h.throttledCount))
+	}
+	go metrics.GaugeInt("hub.job.backlog", h.pastSpoke.PendingJobsLen())
+
+	if h.store != nil {
+		logrus.Infof("Hub has %d jobs with bodies on disk", atomic.LoadInt64(&h.spilledJobs))
+		go metrics.Gauge("hub.storage.spilled.count", float64(atomic.LoadInt64(&h.spilledJobs)))
+	}
+	go metrics.Gauge("hub.storage.memory.bytes", float64(atomic.LoadInt64(&h.bodyBytes)))
+
 	logrus.Infof("Assigned current spoke: %v", h.currentSpoke == nil)
 	logrus.Info("-------------------------------------------------------------")
 }
 
+// Stats returns a point in time view of the hub
+func (h *Hub) Stats() HubStats {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	stats := HubStats{
+		PendingJobs:    h.PendingJobsCount(),
+		ReadyBacklog:   h.pastSpoke.PendingJobsLen(),
+		Spokes:         len(h.spokeMap),
+		RemovedJobs:    h.removedJobsCount,
+		SpokeJobs:      newSpokeDistribution(h.spokeSizes()),
+		BodyBytes:      atomic.LoadInt64(&h.bodyBytes),
+		SpilledJobs:    atomic.LoadInt64(&h.spilledJobs),
+		Memory:         h.admission.Usage(),
+		Now:            h.clock.Now(),
+		ClockOffset:    h.clockOffset(),
+		Restoring:      !h.life.isReady(),
+		Recovery:       h.recovery,
+		MisfiredJobs:   atomic.LoadUint64(&h.misfiredCount),
+		ClockJumps:     atomic.LoadUint64(&h.clockJumps),
+		DeliveryPaused: h.paused,
+	}
+	for _, a := range h.sharedAdmissions {
+		stats.SharedMemory = append(stats.SharedMemory, a.Usage())
+	}
+	if h.store != nil {
+		stats.SpillBytes = h.store.diskSize()
+	}
+	if at := atomic.LoadInt64(&h.checkpointAt); at != 0 {
+		stats.CheckpointAt = time.Unix(0, at)
+	}
+	if h.currentSpoke != nil {
+		stats.CurrentSpokeJobs = h.currentSpoke.PendingJobsLen()
+	}
+	if h.limiter != nil {
+		h.limiter.refill(h.clock.Now())
+		stats.RateLimit = h.limiter.rate
+		stats.RateBurst = int(h.limiter.burst)
+		stats.RateTokens = h.limiter.available()
+		stats.Throttled = h.throttled
+		stats.ThrottledCount = h.throttledCount
+	}
+	return stats
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 // StatusPrinter starts a status printer that prints hub stats over some time interval
+// It returns once the hub is stopped.
 func (h *Hub) StatusPrinter() {
 	t := time.NewTicker(time.Second * 10)
-	for range t.C {
-		h.Status()
+	defer t.Stop()
+	for {
+		select {
+		case <-h.life.stop:
+			return
+		case <-t.C:
+			h.Status()
+		}
 	}
 }
 
-// Persist locks the hub and starts persisting data to disk
+// Persist writes a snapshot of all jobs to disk and backs it up. Jobs can still be added and handed out
+// while the snapshot is written. The returned channel carries the errors and is closed once the backup is done.
 func (h *Hub) Persist() chan error {
-	h.lock.Lock()
+	ec := make(chan error)
+	go func() {
+		defer close(ec)
+		_, backedUp := h.writeSnapshot(context.Background(), func(err error) {
+			ec <- err
+		})
+		if err := <-backedUp; err != nil {
+			ec <- err
+		}
+	}()
+	return ec
+}
 
-	logrus.Warn("Starting disk offload")
-	logrus.Warnf("Total spokes: %d Total jobs: %d", h.spokes.Len(), h.PendingJobsCount())
+// Restore loads any jobs saved to disk at the given path
+func (h *Hub) Restore() error {
+	counts, err := readRecords(h.persister, h.life, h.restoreJob, func(id string) error {
+		return h.replayRecord(persistence.Record{Kind: persistence.RecordCancel, ID: id})
+	}, h.restoreState)
+	if err != nil && (h.wal == nil || !os.IsNotExist(errors.Cause(err))) {
+		return err
+	}
+	// Without a snapshot yet, the WAL has every change since the first start
+	checkManifest(h.persister, h.spokeSpan)
+	logrus.Infof("Hub:Restore recovered %d entries", counts.recovered)
+	if h.life.stopping() {
+		return errRestoreStopped
+	}
+	rs := recoveryStats(h.persister)
+	h.lock.Lock()
+	h.recovery = rs
+	h.lock.Unlock()
+	h.uncountBatches()
+	h.compactGroups()
+	var walErr error
+	if h.wal != nil {
+		walErr = h.replayWAL()
+	}
+	h.releaseSettledBatches()
 
-	wg := &sync.WaitGroup{}
-	wg.Add(h.spokes.Len())
+	if err := restoreErr(counts.decodeErrs, counts.addErrs); err != nil {
+		return err
+	}
+	return walErr
+}
 
-	ec := make(chan error)
+// restoreCounts tallies what happened to the records read back on restore
+type restoreCounts struct {
+	recovered  int
+	decodeErrs int
+	addErrs    int
+}
 
+// readRecords reads the persisted snapshot back, handing its jobs to add, the ids of the jobs it cancels
+// to cancel and its batch, consumer group and delivery records to state, if set. The read is cut short once l is stopping.
+func readRecords(p persistence.Persister, l *lifecycle, add func(*Job) error, cancel func(string) error,
+	state func(persistence.Record) error) (restoreCounts, error) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
 	go func() {
-		defer h.lock.Unlock()
-		defer close(ec)
-
-		for i := 0; i < h.spokes.Len(); i++ {
-			s := h.spokes.AtIdx(i).value.(*Spoke)
-			func() {
-				defer wg.Done()
-				errC := s.Persist(h.persister)
-				for e := range errC {
-					ec <- e
-				}
-			}()
+		select {
+		case <-l.stop:
+			stop()
+		case <-ctx.Done():
 		}
+	}()
 
-		// Save past spoke
-		errC := h.pastSpoke.Persist(h.persister)
-		for e := range errC {
-			ec <- e
+	records, err := p.Read(ctx)
+	if err != nil {
+		return restoreCounts{}, err
+	}
+	counts := restoreCounts{}
+	for res := range records {
+		if res.Err != nil {
+			counts.decodeErrs++
+			logrus.Error(res.Err)
+			continue
 		}
-
-		// Save current spoke
-		if h.currentSpoke != nil {
-			errC := h.currentSpoke.Persist(h.persister)
-			for e := range errC {
-				ec <- e
+		r := res.Record
+		switch r.Kind {
+		case persistence.RecordAdd:
+			j := new(Job)
+			if err := j.UnmarshalBinary(r.Data); err != nil {
+				counts.decodeErrs++
+				logrus.Error(err)
+				rejectRecord(p, r.Data, err)
+				continue
+			}
+			if err := add(j); err != nil {
+				counts.addErrs++
+				logrus.Error(err)
+				continue
+			}
+			counts.recovered++
+		case persistence.RecordCancel:
+			if err := cancel(r.ID); err != nil {
+				counts.addErrs++
+				logrus.Error(err)
+			}
+		case persistence.RecordBatch, persistence.RecordGroup, persistence.RecordDeliver:
+			if state == nil {
+				continue
 			}
+			if err := state(r); err != nil {
+				counts.addErrs++
+				logrus.Error(err)
+			}
+		case persistence.RecordCheckpoint:
+			logrus.WithField("at", r.TriggerAt).Debug("Hub:Restore read a checkpoint")
 		}
+	}
+	return counts, nil
+}
 
-		wg.Wait()
-		h.persister.Finalize()
-		h.persister.UploadToS3()
-	}()
+// backupSnapshot hands a complete snapshot to the backup hook, if there is one
+func backupSnapshot(ctx context.Context, b persistence.Backup, snapshot string) error {
+	if b == nil || snapshot == "" {
+		return nil
+	}
+	if err := b.Backup(ctx, snapshot); err != nil {
+		go metrics.Incr("hub.backup.error")
+		logrus.WithError(err).Error("Hub: cannot back up the snapshot")
+		return err
+	}
+	go metrics.Incr("hub.backup.ok")
+	return nil
+}
 
+// backupAsync backs up a snapshot in the background, after the backups started before it.
+// The returned channel carries the backup error, if any, and is closed once done.
+// Must be called with the checkpoint lock held.
+func (h *Hub) backupAsync(snapshot string) <-chan error {
+	ec := make(chan error, 1)
+	prev, done := h.backupDone, make(chan struct{})
+	h.backupDone = done
+	go func() {
+		defer close(ec)
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		if err := backupSnapshot(context.Background(), h.backup, snapshot); err != nil {
+			ec <- err
+		}
+	}()
 	return ec
 }
 
-// Restore loads any jobs saved to disk at the given path
-func (h *Hub) Restore() error {
-	jobs, err := h.persister.Recover()
-	if err != nil {
-		return err
+// restoreState restores the batches, consumer groups and deliveries of a snapshot or job store
+func (h *Hub) restoreState(r persistence.Record) error {
+	switch r.Kind {
+	case persistence.RecordGroup:
+		return h.restoreGroupRecord(r)
+	case persistence.RecordDeliver:
+		h.restoreDelivery(string(r.Data), r.ID)
+		return nil
 	}
+	return h.restoreBatchRecord(r, true)
+}
 
-	errDecodeCount := 0
-	errAddCount := 0
-	recoverCount := 0
-	for e := range jobs {
-		j := new(Job)
-		err := j.GobDecode(e)
-		if err != nil {
-			errDecodeCount++
-			logrus.Error(err)
-			continue
+// restoreJob adds a persisted job back to the hub.
+// Jobs the skip misfire policy drops are counted as misfired instead.
+// Fired jobs go back to the consumer groups that hadn't consumed them yet.
+func (h *Hub) restoreJob(j *Job) error {
+	if h.restoreToGroups(j) {
+		if !j.IsBatchCallback() {
+			// Released callbacks are done with their batch
+			h.restoreBatch(j)
 		}
-		if err = h.AddJob(j); err != nil {
-			errAddCount++
-			logrus.Error(err)
-			continue
+		return nil
+	}
+	if now := h.clock.Now(); h.misfireOf(j).Policy == MisfireSkip && h.misfired(j, now) {
+		h.skipMisfire(j, now)
+		if err := h.storeJob(persistence.RecordConsume, j); err != nil {
+			logrus.WithError(err).WithField("jobID", j.id).Error("Hub:Restore cannot drop misfired job from the job store")
 		}
-		recoverCount++
+		return nil
+	}
+	h.restoreBatch(j)
+	if j.IsBatchCallback() {
+		// Callbacks are released once their batch settles
+		return nil
+	}
+	return h.addJob(j)
+}
+
+// rejectRecord hands a recovered record the hub can't decode back to persisters that take them
+func rejectRecord(p persistence.Persister, buf []byte, err error) {
+	if r, ok := p.(persistence.RecoveryReporter); ok {
+		r.Reject(buf, err)
+	}
+}
+
+// recoveryStats reports what happened to the records of the snapshot restored from
+func recoveryStats(p persistence.Persister) persistence.RecoveryStats {
+	r, ok := p.(persistence.RecoveryReporter)
+	if !ok {
+		return persistence.RecoveryStats{}
 	}
-	logrus.Infof("Hub:Restore recovered %d entries", recoverCount)
+	rs := r.RecoveryStats()
+	logrus.WithFields(logrus.Fields{
+		"recovered":   rs.Recovered,
+		"skipped":     rs.Skipped,
+		"quarantined": rs.Quarantined,
+		"quarantine":  rs.Quarantine,
+	}).Info("Hub:Restore recovery done")
+	go metrics.GaugeInt("hub.restore.recovered", rs.Recovered)
+	go metrics.GaugeInt("hub.restore.skipped", rs.Skipped)
+	go metrics.GaugeInt("hub.restore.quarantined", rs.Quarantined)
+	return rs
+}
+
+// describeSnapshots tells persisters that write manifests about the hub the snapshots come from
+func describeSnapshots(p persistence.Persister, spokeSpan time.Duration) {
+	if m, ok := p.(persistence.ManifestKeeper); ok {
+		m.Describe(spokeSpan)
+	}
+}
+
+// checkManifest logs how the hub the recovered snapshot came from differs from this one
+func checkManifest(p persistence.Persister, spokeSpan time.Duration) {
+	m, ok := p.(persistence.ManifestKeeper)
+	if !ok || m.RecoveredManifest() == nil {
+		return
+	}
+	mf := m.RecoveredManifest()
+	logrus.WithFields(logrus.Fields{
+		"created": mf.CreatedAt,
+		"jobs":    mf.Jobs,
+		"bytes":   mf.Bytes,
+	}).Info("Hub:Restore verified snapshot manifest")
+	if mf.SpokeSpan != 0 && mf.SpokeSpan != spokeSpan {
+		logrus.Warnf("Hub:Restore snapshot was taken with a spoke span of %s, jobs are placed in spokes of %s",
+			mf.SpokeSpan, spokeSpan)
+	}
+}
 
+func restoreErr(errDecodeCount, errAddCount int) error {
 	if errAddCount == 0 && errDecodeCount == 0 {
 		return nil
 	}
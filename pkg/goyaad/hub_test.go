@@ -1,6 +1,7 @@
 package goyaad_test
 
 import (
+	"context"
 	"math/rand"
 	"os"
 	"path"
@@ -97,6 +98,99 @@ var _ = Describe("Test hub", func() {
 
 	}, 1.500)
 
+	It("rate limits delivery and keeps the backlog in order", func(done Done) {
+		defer close(done)
+
+		h := NewHub(&HubOpts{
+			SpokeSpan:      time.Millisecond * 10,
+			Persister:      persister,
+			AttemptRestore: false,
+			RateLimit:      20,
+			RateBurst:      2})
+
+		jobs := []*Job{}
+		for i := 0; i < 5; i++ {
+			j := NewJobAutoID(time.Now().Add(-time.Duration(5-i)*time.Millisecond), nil)
+			Expect(h.AddJob(j)).To(BeNil())
+			jobs = append(jobs, j)
+		}
+
+		// Burst goes out right away
+		Expect(h.Next().ID()).To(Equal(jobs[0].ID()))
+		Expect(h.Next().ID()).To(Equal(jobs[1].ID()))
+		Expect(h.Next()).To(BeNil())
+
+		stats := h.Stats()
+		Expect(stats.Throttled).To(BeTrue())
+		Expect(stats.ThrottledCount).To(BeNumerically(">=", 1))
+		Expect(stats.ReadyBacklog).To(Equal(3))
+		Expect(stats.RateLimit).To(Equal(float64(20)))
+
+		// The rest trickles out in order at the configured rate
+		for _, expected := range jobs[2:] {
+			Eventually(h.Next, "1s", "5ms").Should(WithTransform(func(j *Job) string {
+				if j == nil {
+					return ""
+				}
+				return j.ID()
+			}, Equal(expected.ID())))
+		}
+		Expect(h.Stats().Throttled).To(BeFalse())
+	}, 2)
+
+	It("moves jobs of expired spokes to the past spoke in order", func(done Done) {
+		defer close(done)
+
+		clock := NewManualClock(time.Now())
+		h := NewHub(&HubOpts{SpokeSpan: time.Millisecond * 5, Persister: persister, AttemptRestore: false, Clock: clock})
+		early := NewJobAutoID(clock.Now().Add(time.Millisecond*5), nil)
+		Expect(h.AddJob(early)).To(BeNil())
+
+		// Let the spoke of the early job end before anybody reads it
+		clock.Advance(time.Millisecond * 20)
+		late := NewJobAutoID(clock.Now().Add(-time.Millisecond), nil)
+		Expect(h.AddJob(late)).To(BeNil())
+
+		Expect(h.Next().ID()).To(Equal(early.ID()))
+		Expect(h.Next().ID()).To(Equal(late.ID()))
+		Expect(h.PendingJobsCount()).To(Equal(0))
+	}, 1)
+
+	It("chooses trigger times for jittered and spread jobs when adding them", func() {
+		h := NewHub(&HubOpts{SpokeSpan: time.Minute, Persister: persister, AttemptRestore: false})
+		at := time.Now().Add(time.Hour)
+
+		for i := 0; i < 100; i++ {
+			j := NewJobAutoID(at, nil)
+			j.SetJitter(time.Minute * 5)
+			Expect(h.AddJob(j)).To(BeNil())
+			Expect(j.TriggerAt()).To(BeTemporally("~", at, time.Minute*5))
+
+			found, err := h.FindJob(j.ID())
+			Expect(err).To(BeNil())
+			Expect(found.TriggerAt()).To(Equal(j.TriggerAt()))
+		}
+
+		// Spread jobs cover the whole window evenly
+		buckets := make([]int, 10)
+		for i := 0; i < 1000; i++ {
+			j := NewJobAutoID(at, nil)
+			j.SetSpread(time.Hour)
+			Expect(h.AddJob(j)).To(BeNil())
+			offset := j.TriggerAt().Sub(at)
+			Expect(offset).To(BeNumerically(">=", 0))
+			Expect(offset).To(BeNumerically("<", time.Hour))
+			buckets[int(offset/(time.Minute*6))]++
+		}
+		for _, b := range buckets {
+			Expect(b).To(BeNumerically("~", 100, 10))
+		}
+		Expect(h.PendingJobsCount()).To(Equal(1100))
+
+		_, err := h.FindJob("unknown")
+		Expect(err).To(Equal(ErrJobNotFound))
+	})
+
 	It("Persists and recovers from disk", func(done Done) {
 		defer close(done)
 
@@ -141,11 +235,14 @@ var _ = Describe("Test hub", func() {
 			Fail("Persist failed due to error: " + e.Error())
 		}
 
-		entries, err := persister.Recover()
+		records, err := persister.Read(context.Background())
 		Expect(err).To(BeNil())
 		counter := 0
-		for range entries {
-			counter++
+		for res := range records {
+			Expect(res.Err).To(BeNil())
+			if res.Record.Kind == persistence.RecordAdd {
+				counter++
+			}
 		}
 
 		Expect(counter).To(Equal(h.PendingJobsCount()))
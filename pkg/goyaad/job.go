@@ -1,24 +1,47 @@
 package goyaad
 
 import (
-	"bytes"
-	"encoding/gob"
 	"fmt"
-	"io"
 	"time"
 
-	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
 )
 
 // Job is the basic unit of work in yaad
 type Job struct {
 	id        string
-	triggerAt time.Time
+	triggerAt int64 // Unix nanoseconds
 	body      []byte
 
 	pri int32
 	ttr time.Duration
+
+	opts *jobOpts // Options most jobs don't use, nil until one is set
+	ref  *bodyRef // Where the body is on disk if it was spilled
+}
+
+// jobOpts holds the job options that are rarely set so that plain jobs don't pay for them
+type jobOpts struct {
+	batchID       string // Batch this job belongs to, if any
+	batchCallback bool   // True if this job is the callback of its batch
+
+	jitter time.Duration // Trigger anywhere within +/- jitter, resolved when the job is added
+	spread time.Duration // Trigger anywhere within [triggerAt, triggerAt+spread), resolved when the job is added
+
+	windows     []Window // Allowed delivery windows, overrides the hub's windows
+	windowMoves int32    // Number of times the job was moved to the next window start
+
+	key     string  // Groups jobs that stand for the same thing, like the runs of a recurring job
+	misfire Misfire // What happens if the job is delivered late, overrides the hub's policy
+}
+
+// options returns the options of j, allocating them on first use
+func (j *Job) options() *jobOpts {
+	if j.opts == nil {
+		j.opts = &jobOpts{}
+	}
+	return j.opts
 }
 
 // Impl Job
@@ -27,7 +50,7 @@ type Job struct {
 func NewJob(id string, triggerAt time.Time, b []byte) *Job {
 	return &Job{
 		id:        id,
-		triggerAt: triggerAt,
+		triggerAt: triggerAt.UnixNano(),
 		body:      b,
 	}
 }
@@ -36,18 +59,23 @@ func NewJob(id string, triggerAt time.Time, b []byte) *Job {
 func NewJobAutoID(triggerAt time.Time, b []byte) *Job {
 	return &Job{
 		id:        fmt.Sprintf("%d", NextID()),
-		triggerAt: triggerAt,
+		triggerAt: triggerAt.UnixNano(),
 		body:      b,
 	}
 }
 
-// AsTemporalState returns the job's temporal classification at the point in time
+// AsTemporalState returns the job's temporal classification against the system clock
 func (j *Job) AsTemporalState() TemporalState {
-	now := time.Now()
+	return j.stateAt(time.Now())
+}
+
+// stateAt returns the job's temporal classification at the given time
+func (j *Job) stateAt(t time.Time) TemporalState {
+	now := t.UnixNano()
 	switch {
-	case now.After(j.triggerAt):
+	case now > j.triggerAt:
 		return Past
-	case j.triggerAt.After(now):
+	case j.triggerAt > now:
 		return Future
 	default:
 		return Past
@@ -60,29 +88,126 @@ func (j *Job) SetOpts(pri int32, ttr time.Duration) {
 	j.ttr = ttr
 }
 
+// SetJitter asks the hub to move the trigger time randomly within +/- jitter when the job is added
+func (j *Job) SetJitter(jitter time.Duration) {
+	j.options().jitter = jitter
+}
+
+// SetSpread asks the hub to spread jobs evenly over the window starting at the trigger time.
+// The concrete trigger time is chosen when the job is added.
+func (j *Job) SetSpread(spread time.Duration) {
+	j.options().spread = spread
+}
+
+// SetWindows restricts delivery of this job to the given windows.
+// These windows take precedence over the windows of the hub
+func (j *Job) SetWindows(windows []Window) {
+	j.options().windows = windows
+}
+
+// Windows returns the delivery windows of this job
+func (j *Job) Windows() []Window {
+	if j.opts == nil {
+		return nil
+	}
+	return j.opts.windows
+}
+
+// WindowMoves returns the number of times the job came due outside its
+// delivery windows and was moved to the next window start
+func (j *Job) WindowMoves() int32 {
+	if j.opts == nil {
+		return 0
+	}
+	return j.opts.windowMoves
+}
+
+// SetKey groups this job with the other jobs that share the key.
+// The MisfireLatest policy fires only the latest of the late jobs with the same key.
+func (j *Job) SetKey(key string) {
+	j.options().key = key
+}
+
+// Key returns the key of this job or an empty string
+func (j *Job) Key() string {
+	if j.opts == nil {
+		return ""
+	}
+	return j.opts.key
+}
+
+// SetMisfire sets what happens if this job is delivered late.
+// It takes precedence over the misfire policy of the hub
+func (j *Job) SetMisfire(m Misfire) {
+	j.options().misfire = m
+}
+
+// Misfire returns the misfire policy of this job
+func (j *Job) Misfire() Misfire {
+	if j.opts == nil {
+		return Misfire{}
+	}
+	return j.opts.misfire
+}
+
+// SetBatch makes this job a member of the batch with the given id
+func (j *Job) SetBatch(batchID string) {
+	j.options().batchID = batchID
+}
+
+// BatchID returns the id of the batch this job belongs to or an empty string
+func (j *Job) BatchID() string {
+	if j.opts == nil {
+		return ""
+	}
+	return j.opts.batchID
+}
+
+// IsBatchCallback returns true if this job is the callback job of its batch
+func (j *Job) IsBatchCallback() bool {
+	return j.opts != nil && j.opts.batchCallback
+}
+
+// Pri returns the job's priority
+func (j *Job) Pri() int32 {
+	return j.pri
+}
+
+// TTR returns the job's time to run
+func (j *Job) TTR() time.Duration {
+	return j.ttr
+}
+
 // ID returns the id of the job
 func (j *Job) ID() string {
 	return j.id
 }
 
-// Body returns the job of the job
+// Body returns the job of the job. Bodies spilled to disk are read back on every call.
 func (j *Job) Body() []byte {
+	if j.body == nil && j.ref != nil {
+		body, err := j.ref.store.get(j.ref)
+		if err != nil {
+			logrus.WithError(err).WithField("jobID", j.id).Error("Job: cannot read spilled body")
+		}
+		return body
+	}
 	return j.body
 }
 
 // TriggerAt returns the job's trigger time
 func (j *Job) TriggerAt() time.Time {
-	return j.triggerAt
+	return time.Unix(0, j.triggerAt)
 }
 
-// IsReady returns true if job is ready to be worked on
+// IsReady returns true if job is ready to be worked on according to the system clock
 func (j *Job) IsReady() bool {
-	return time.Now().After(j.triggerAt)
+	return time.Now().UnixNano() > j.triggerAt
 }
 
 // AsBound returns spokeBound for a hypothetical spoke that should hold this job
 func (j *Job) AsBound(spokeSpan time.Duration) SpokeBound {
-	start := j.triggerAt.Truncate(spokeSpan)
+	start := j.TriggerAt().Truncate(spokeSpan)
 	end := start.Add(spokeSpan)
 
 	return SpokeBound{start: start, end: end}
@@ -90,79 +215,14 @@ func (j *Job) AsBound(spokeSpan time.Duration) SpokeBound {
 
 // AsPriorityItem returns this job as a prioritizable item
 func (j *Job) AsPriorityItem() *Item {
-	return &Item{index: 0, priority: j.triggerAt, value: j}
+	return &Item{index: 0, priority: j.TriggerAt(), value: j}
 }
 
-// GobEncode encodes a job into a binary buffer
-func (j *Job) GobEncode() (data []byte, err error) {
-	// We have a file for this Namespace
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-
-	// id
-	err = enc.Encode(j.id)
+// Record returns the job as a record to persist
+func (j *Job) Record() (persistence.Record, error) {
+	data, err := j.MarshalBinary()
 	if err != nil {
-		return nil, err
-	}
-	//pri
-	err = enc.Encode(j.pri)
-	if err != nil {
-		return nil, err
-	}
-	//trigger at
-	err = enc.Encode(j.triggerAt.UnixNano())
-	if err != nil {
-		return nil, err
-	}
-	//ttr
-	err = enc.Encode(j.ttr)
-	if err != nil {
-		return nil, err
-	}
-	//body
-	err = enc.Encode(j.body)
-	if err != nil {
-		return nil, err
-	}
-
-	if err != nil {
-		err = errors.Wrap(err, "Job: Failed to encode job for persistence")
-		logrus.Error(err)
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
-// GobDecode encodes a job into a binary buffer
-func (j *Job) GobDecode(data []byte) error {
-	dec := gob.NewDecoder(bytes.NewReader(data))
-
-	// id
-	err := dec.Decode(&j.id)
-	if err != nil {
-		return err
-	}
-	// pri
-	err = dec.Decode(&j.pri)
-	if err != nil {
-		return err
-	}
-	//trigger at
-	var triggerAtUnixNano int64
-	err = dec.Decode(&triggerAtUnixNano)
-	if err != nil {
-		return err
-	}
-	j.triggerAt = time.Unix(0, triggerAtUnixNano)
-	//ttr
-	err = dec.Decode(&j.ttr)
-	if err != nil {
-		return err
-	}
-	//body
-	err = dec.Decode(&j.body)
-	if err == io.EOF {
-		return nil
+		return persistence.Record{}, err
 	}
-	return err
+	return persistence.Record{Kind: persistence.RecordAdd, ID: j.id, TriggerAt: j.TriggerAt(), Data: data}, nil
 }
@@ -0,0 +1,279 @@
+package goyaad
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Jobs are encoded as a magic byte, a format version and the fields of that version.
+// Gob streams never start with the magic byte followed by a byte below 0x80, so older
+// gob encoded jobs are told apart and still decoded.
+const (
+	jobMagic = 0xff
+	// JobFormatVersion is the version of the binary job format jobs are encoded in
+	JobFormatVersion = 1
+)
+
+// Flags of the optional fields of a version 1 job
+const (
+	jobHasBatch   = 1 << iota // batch id and whether the job is its callback
+	jobHasWindows             // delivery windows and how often the job moved to the next one
+	jobHasMisfire             // key and misfire policy
+)
+
+// ErrJobFormat is returned when decoding a job that isn't in a format this server reads
+var ErrJobFormat = errors.New("unknown job format")
+
+// MarshalBinary encodes a job in the current binary format:
+// id, trigger time, priority, ttr, flagged optional fields and the length prefixed body.
+// Lengths and numbers are varints.
+func (j *Job) MarshalBinary() ([]byte, error) {
+	body := j.Body()
+	buf := make([]byte, 0, 2+len(j.id)+len(body)+6*binary.MaxVarintLen64)
+	buf = append(buf, jobMagic, JobFormatVersion)
+	buf = appendString(buf, j.id)
+	buf = appendVarint(buf, j.triggerAt)
+	buf = appendVarint(buf, int64(j.pri))
+	buf = appendVarint(buf, int64(j.ttr))
+
+	var flags byte
+	o := j.opts
+	if o != nil {
+		if o.batchID != "" || o.batchCallback {
+			flags |= jobHasBatch
+		}
+		if len(o.windows) > 0 || o.windowMoves != 0 {
+			flags |= jobHasWindows
+		}
+		if o.key != "" || o.misfire.Policy != MisfireDefault || o.misfire.After != 0 {
+			flags |= jobHasMisfire
+		}
+	}
+	buf = append(buf, flags)
+	if flags&jobHasBatch != 0 {
+		buf = appendString(buf, o.batchID)
+		buf = appendBool(buf, o.batchCallback)
+	}
+	if flags&jobHasWindows != 0 {
+		buf = appendUvarint(buf, uint64(len(o.windows)))
+		for _, w := range o.windows {
+			buf = appendString(buf, w.String())
+		}
+		buf = appendVarint(buf, int64(o.windowMoves))
+	}
+	if flags&jobHasMisfire != 0 {
+		buf = appendString(buf, o.key)
+		buf = appendVarint(buf, int64(o.misfire.Policy))
+		buf = appendVarint(buf, int64(o.misfire.After))
+	}
+
+	buf = appendUvarint(buf, uint64(len(body)))
+	return append(buf, body...), nil
+}
+
+// UnmarshalBinary decodes a job encoded by MarshalBinary, or by the gob encoding jobs used before
+func (j *Job) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 || data[0] != jobMagic || data[1] >= 0x80 {
+		return j.decodeGob(data)
+	}
+	if data[1] != JobFormatVersion {
+		return errors.Wrapf(ErrJobFormat, "version %d, this server reads version %d", data[1], JobFormatVersion)
+	}
+
+	r := &jobReader{buf: data[2:]}
+	j.id = r.string()
+	j.triggerAt = r.varint()
+	j.pri = int32(r.varint())
+	j.ttr = time.Duration(r.varint())
+	flags := r.byte()
+	if flags&jobHasBatch != 0 {
+		o := j.options()
+		o.batchID = r.string()
+		o.batchCallback = r.byte() != 0
+	}
+	if flags&jobHasWindows != 0 {
+		o := j.options()
+		n := r.uvarint()
+		if n > uint64(len(r.buf)) {
+			r.fail()
+		}
+		for i := uint64(0); i < n; i++ {
+			s := r.string()
+			if r.err != nil {
+				return r.err
+			}
+			w, err := ParseWindow(s)
+			if err != nil {
+				return err
+			}
+			o.windows = append(o.windows, w)
+		}
+		o.windowMoves = int32(r.varint())
+	}
+	if flags&jobHasMisfire != 0 {
+		o := j.options()
+		o.key = r.string()
+		o.misfire.Policy = MisfirePolicy(r.varint())
+		o.misfire.After = time.Duration(r.varint())
+	}
+	if body := r.bytes(); len(body) > 0 {
+		j.body = append([]byte(nil), body...)
+	}
+	if r.err == nil && len(r.buf) > 0 {
+		return errors.Wrapf(ErrJobFormat, "%d bytes past the end of the job", len(r.buf))
+	}
+	return r.err
+}
+
+// GobEncode encodes a job into a binary buffer, like MarshalBinary
+func (j *Job) GobEncode() ([]byte, error) {
+	return j.MarshalBinary()
+}
+
+// GobDecode decodes a job from a binary buffer, like UnmarshalBinary
+func (j *Job) GobDecode(data []byte) error {
+	return j.UnmarshalBinary(data)
+}
+
+// decodeGob decodes a job encoded with gob, one value per field, the way jobs were encoded before
+// the binary format. Older records end early: at the body, the batch or the windows.
+func (j *Job) decodeGob(data []byte) error {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	for _, v := range []interface{}{&j.id, &j.pri, &j.triggerAt, &j.ttr} {
+		if err := dec.Decode(v); err != nil {
+			return err
+		}
+	}
+	var batchID string
+	var batchCallback bool
+	var windows []string
+	var windowMoves int32
+	var key string
+	var policy int
+	var after time.Duration
+	fields := [][]interface{}{
+		{&j.body},
+		{&batchID, &batchCallback},
+		{&windows, &windowMoves},
+		{&key, &policy, &after},
+	}
+	for _, group := range fields {
+		if err := dec.Decode(group[0]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		for _, v := range group[1:] {
+			if err := dec.Decode(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	if batchID != "" || batchCallback {
+		j.options().batchID = batchID
+		j.options().batchCallback = batchCallback
+	}
+	if len(windows) > 0 || windowMoves != 0 {
+		o := j.options()
+		o.windowMoves = windowMoves
+		for _, w := range windows {
+			pw, err := ParseWindow(w)
+			if err != nil {
+				return err
+			}
+			o.windows = append(o.windows, pw)
+		}
+	}
+	if key != "" || policy != int(MisfireDefault) {
+		j.options().key = key
+		j.options().misfire = Misfire{Policy: MisfirePolicy(policy), After: after}
+	}
+	return nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(appendUvarint(buf, uint64(len(s))), s...)
+}
+
+func appendBool(buf []byte, b bool) []byte {
+	if b {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+// jobReader reads the fields of a binary job. The first error sticks and later reads return zero values.
+type jobReader struct {
+	buf []byte
+	err error
+}
+
+func (r *jobReader) fail() {
+	if r.err == nil {
+		r.err = errors.Wrap(ErrJobFormat, "job cut short")
+	}
+	r.buf = nil
+}
+
+func (r *jobReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *jobReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *jobReader) byte() byte {
+	if len(r.buf) == 0 {
+		r.fail()
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+// bytes reads a length prefixed field, the result aliases the buffer
+func (r *jobReader) bytes() []byte {
+	n := r.uvarint()
+	if n > uint64(len(r.buf)) {
+		r.fail()
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *jobReader) string() string {
+	return string(r.bytes())
+}
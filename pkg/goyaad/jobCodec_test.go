@@ -0,0 +1,211 @@
+package goyaad_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+)
+
+// codecFixtures are the jobs of the golden files in testdata/job_golden
+func codecFixtures() map[string]*Job {
+	at := time.Unix(1600000000, 123456789)
+	plain := NewJob("plain", at, []byte("hello"))
+	plain.SetOpts(3, 30*time.Second)
+	options := NewJob("options", at, []byte("with options"))
+	options.SetBatch("batch-1")
+	w, err := ParseWindow("Mon-Fri 08:00-21:00")
+	Expect(err).NotTo(HaveOccurred())
+	options.SetWindows([]Window{w})
+	options.SetKey("nightly")
+	options.SetMisfire(Misfire{Policy: MisfireSkip, After: time.Minute})
+	return map[string]*Job{
+		"plain":   plain,
+		"empty":   NewJob("empty", at, nil),
+		"options": options,
+	}
+}
+
+// gobEncodeJob encodes a job with gob, one value per field, the way jobs were encoded before the binary format
+func gobEncodeJob(j *Job) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	windows := make([]string, len(j.Windows()))
+	for i, w := range j.Windows() {
+		windows[i] = w.String()
+	}
+	m := j.Misfire()
+	for _, v := range []interface{}{
+		j.ID(), j.Pri(), j.TriggerAt().UnixNano(), j.TTR(), j.Body(),
+		j.BatchID(), j.IsBatchCallback(), windows, j.WindowMoves(),
+		j.Key(), int(m.Policy), m.After,
+	} {
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func expectSameJob(got, want *Job) {
+	Expect(got.ID()).To(Equal(want.ID()))
+	Expect(got.TriggerAt().UnixNano()).To(Equal(want.TriggerAt().UnixNano()))
+	Expect(got.Pri()).To(Equal(want.Pri()))
+	Expect(got.TTR()).To(Equal(want.TTR()))
+	Expect(got.Body()).To(Equal(want.Body()))
+	Expect(got.BatchID()).To(Equal(want.BatchID()))
+	Expect(got.IsBatchCallback()).To(Equal(want.IsBatchCallback()))
+	Expect(got.Windows()).To(HaveLen(len(want.Windows())))
+	for i, w := range want.Windows() {
+		Expect(got.Windows()[i].String()).To(Equal(w.String()))
+	}
+	Expect(got.WindowMoves()).To(Equal(want.WindowMoves()))
+	Expect(got.Key()).To(Equal(want.Key()))
+	Expect(got.Misfire()).To(Equal(want.Misfire()))
+}
+
+var _ = Describe("Test job encoding", func() {
+	wd, _ := os.Getwd()
+	goldenDir := path.Join(wd, "../../testdata/job_golden")
+
+	golden := func(name string) []byte {
+		buf, err := ioutil.ReadFile(path.Join(goldenDir, name))
+		Expect(err).NotTo(HaveOccurred())
+		return buf
+	}
+
+	It("encodes jobs like the golden records", func() {
+		for name, j := range codecFixtures() {
+			buf, err := j.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf).To(Equal(golden(name+".v1")), name)
+		}
+	})
+
+	It("decodes the golden records of every format", func() {
+		for name, want := range codecFixtures() {
+			for _, format := range []string{".v1", ".gob"} {
+				j := &Job{}
+				Expect(j.UnmarshalBinary(golden(name+format))).To(Succeed(), name+format)
+				expectSameJob(j, want)
+			}
+		}
+	})
+
+	It("migrates gob records to the binary format", func() {
+		for name, want := range codecFixtures() {
+			j := &Job{}
+			Expect(j.UnmarshalBinary(golden(name + ".gob"))).To(Succeed())
+			buf, err := j.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf).To(Equal(golden(name+".v1")), name)
+			Expect(len(buf)).To(BeNumerically("<", len(golden(name+".gob"))))
+			expectSameJob(j, want)
+		}
+	})
+
+	It("decodes gob records that end early", func() {
+		buf := new(bytes.Buffer)
+		enc := gob.NewEncoder(buf)
+		for _, v := range []interface{}{"old", int32(1), int64(42), time.Second, []byte("body")} {
+			Expect(enc.Encode(v)).To(Succeed())
+		}
+		j := &Job{}
+		Expect(j.UnmarshalBinary(buf.Bytes())).To(Succeed())
+		Expect(j.ID()).To(Equal("old"))
+		Expect(j.Body()).To(Equal([]byte("body")))
+		Expect(j.BatchID()).To(BeEmpty())
+	})
+
+	It("refuses versions it doesn't know", func() {
+		buf := golden("plain.v1")
+		buf[1] = JobFormatVersion + 1
+		err := (&Job{}).UnmarshalBinary(buf)
+		Expect(errors.Cause(err)).To(Equal(ErrJobFormat))
+		Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("version %d", JobFormatVersion+1)))
+	})
+
+	It("refuses truncated and padded records", func() {
+		buf := golden("options.v1")
+		for _, cut := range []int{3, len(buf) / 2, len(buf) - 1} {
+			err := (&Job{}).UnmarshalBinary(buf[:cut])
+			Expect(errors.Cause(err)).To(Equal(ErrJobFormat), fmt.Sprintf("cut at %d", cut))
+		}
+		err := (&Job{}).UnmarshalBinary(append(append([]byte{}, buf...), 0))
+		Expect(errors.Cause(err)).To(Equal(ErrJobFormat))
+	})
+
+	It("doesn't keep a hold on the decoded buffer", func() {
+		buf := golden("plain.v1")
+		j := &Job{}
+		Expect(j.UnmarshalBinary(buf)).To(Succeed())
+		for i := range buf {
+			buf[i] = 0
+		}
+		Expect(j.Body()).To(Equal([]byte("hello")))
+	})
+})
+
+func benchJob(bodySize int) *Job {
+	j := NewJob("bench-job-id", time.Now(), bytes.Repeat([]byte("x"), bodySize))
+	j.SetOpts(1, time.Minute)
+	return j
+}
+
+func BenchmarkJobEncode(b *testing.B) {
+	for _, size := range []int{16, 1024} {
+		j := benchJob(size)
+		b.Run(fmt.Sprintf("binary_%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := j.MarshalBinary(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("gob_%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := gobEncodeJob(j); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkJobDecode(b *testing.B) {
+	for _, size := range []int{16, 1024} {
+		j := benchJob(size)
+		bin, err := j.MarshalBinary()
+		if err != nil {
+			b.Fatal(err)
+		}
+		gobbed, err := gobEncodeJob(j)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for name, buf := range map[string][]byte{"binary": bin, "gob": gobbed} {
+			buf := buf
+			b.Run(fmt.Sprintf("%s_%d", name, size), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(buf)))
+				for i := 0; i < b.N; i++ {
+					if err := new(Job).UnmarshalBinary(buf); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
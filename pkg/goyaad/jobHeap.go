@@ -0,0 +1,84 @@
+package goyaad
+
+// jobEntry is a job in a jobHeap. The trigger time is kept inline so that ordering doesn't chase pointers.
+type jobEntry struct {
+	at  int64 // Trigger time in unix nanoseconds
+	job *Job
+}
+
+// jobHeap is a min heap of jobs ordered by trigger time. Unlike PriorityQueue it doesn't box
+// jobs into interfaces or wrap them in items, which saves an allocation per job.
+type jobHeap []jobEntry
+
+// Len returns the number of jobs in the heap
+func (h jobHeap) Len() int { return len(h) }
+
+// push adds j to the heap
+func (h *jobHeap) push(j *Job) {
+	*h = append(*h, jobEntry{at: j.triggerAt, job: j})
+	h.up(len(*h) - 1)
+}
+
+// peek returns the job with the closest trigger time without removing it, or nil
+func (h jobHeap) peek() *Job {
+	if len(h) == 0 {
+		return nil
+	}
+	return h[0].job
+}
+
+// pop removes and returns the job with the closest trigger time, or nil
+func (h *jobHeap) pop() *Job {
+	if len(*h) == 0 {
+		return nil
+	}
+	return h.remove(0)
+}
+
+// remove removes and returns the job at index i
+func (h *jobHeap) remove(i int) *Job {
+	old := *h
+	n := len(old) - 1
+	j := old[i].job
+	if n != i {
+		old[i] = old[n]
+		if !h.down(i, n) {
+			h.up(i)
+		}
+	}
+	old[n] = jobEntry{}
+	*h = old[:n]
+	return j
+}
+
+func (h jobHeap) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if h[parent].at <= h[i].at {
+			break
+		}
+		h[parent], h[i] = h[i], h[parent]
+		i = parent
+	}
+}
+
+// down sifts the entry at i down within the first n entries and returns true if it moved
+func (h jobHeap) down(i0, n int) bool {
+	i := i0
+	for {
+		left := 2*i + 1
+		if left >= n || left < 0 {
+			break
+		}
+		child := left
+		if right := left + 1; right < n && h[right].at < h[left].at {
+			child = right
+		}
+		if h[i].at <= h[child].at {
+			break
+		}
+		h[i], h[child] = h[child], h[i]
+		i = child
+	}
+	return i > i0
+}
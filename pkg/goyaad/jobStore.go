@@ -0,0 +1,192 @@
+package goyaad
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+// asJobStore returns the persister as a job store, nil if it only takes snapshots
+func asJobStore(p persistence.Persister) persistence.JobStore {
+	s, ok := p.(persistence.JobStore)
+	if !ok {
+		return nil
+	}
+	return s
+}
+
+// storeJob keeps the job store in step with a change to j, if the hub keeps its jobs in one
+func (h *Hub) storeJob(kind persistence.RecordKind, j *Job) error {
+	if h.jobStore == nil {
+		return nil
+	}
+	switch kind {
+	case persistence.RecordAdd, persistence.RecordReschedule:
+		data, err := j.MarshalBinary()
+		if err != nil {
+			return errors.Wrap(err, "Hub: cannot encode job for the job store")
+		}
+		return h.jobStore.PutJob(j.id, j.TriggerAt(), data)
+	case persistence.RecordCancel, persistence.RecordConsume:
+		if err := h.jobStore.DeleteJob(j.id); err != nil {
+			return err
+		}
+		// A fired job takes its deliveries to consumer groups along
+		return h.jobStore.DeleteState(persistence.RecordDeliver, j.id)
+	}
+	return nil
+}
+
+// storeState keeps a batch, consumer group or delivery record in the job store, if the hub keeps its jobs in one.
+// Failures are logged since the change happened already.
+func (h *Hub) storeState(r persistence.Record) {
+	if h.jobStore == nil {
+		return
+	}
+	if err := h.jobStore.PutState(r); err != nil {
+		go metrics.Incr("hub.jobstore.error")
+		logrus.WithError(err).WithField("id", r.ID).Errorf("Hub: cannot store %s", r.Kind)
+	}
+}
+
+// dropState drops a batch or consumer group from the job store, if the hub keeps its jobs in one
+func (h *Hub) dropState(kind persistence.RecordKind, id string) {
+	if h.jobStore == nil {
+		return
+	}
+	if err := h.jobStore.DeleteState(kind, id); err != nil {
+		go metrics.Incr("hub.jobstore.error")
+		logrus.WithError(err).WithField("id", id).Errorf("Hub: cannot drop %s from the job store", kind)
+	}
+}
+
+// syncJobStore stands in for a snapshot when the hub keeps its jobs in a job store:
+// the store has every change already, batches and consumer groups included, so it is only synced and the WAL is dropped.
+func (h *Hub) syncJobStore(report func(error)) CheckpointStats {
+	start := time.Now()
+	stats := CheckpointStats{}
+	if r, ok := h.persister.(persistence.SnapshotReporter); ok {
+		stats.Path = r.SnapshotPath()
+	}
+	if err := h.jobStore.Sync(); err != nil {
+		go metrics.Incr("hub.checkpoint.error")
+		report(err)
+		return stats
+	}
+	if h.wal != nil {
+		if err := h.wal.Reset(); err != nil {
+			logrus.WithError(err).Error("Hub:Checkpoint cannot reset the WAL")
+		}
+	}
+	stats.Jobs = h.PendingJobsCount()
+	stats.Duration = time.Since(start)
+	atomic.StoreInt64(&h.checkpointAt, time.Now().UnixNano())
+
+	logrus.WithFields(logrus.Fields{
+		"path":     stats.Path,
+		"jobs":     stats.Jobs,
+		"duration": stats.Duration,
+	}).Info("Hub: job store synced")
+	go metrics.Incr("hub.checkpoint.ok")
+	go metrics.Time("hub.checkpoint.duration", start)
+	return stats
+}
+
+// closeJobStore closes the job store, if the hub keeps its jobs in one
+func (h *Hub) closeJobStore() {
+	c, ok := h.jobStore.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		logrus.WithError(err).Error("Hub: cannot close the job store")
+	}
+}
+
+// storedBodies leaves the bodies a hub spills in the job store it keeps its jobs in:
+// every body is stored there already, so spilling only drops it from memory
+type storedBodies struct {
+	jobs persistence.JobStore
+}
+
+func (s *storedBodies) put(id string, body []byte) (*bodyRef, error) {
+	return &bodyRef{store: s, len: len(body), id: id}, nil
+}
+
+// get reads the stored job back and returns its body
+func (s *storedBodies) get(ref *bodyRef) ([]byte, error) {
+	data, err := s.jobs.GetJob(ref.id)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errors.Errorf("Hub: job %s is gone from the job store", ref.id)
+	}
+	j := new(Job)
+	if err := j.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return j.body, nil
+}
+
+// scan reads back the bodies of the jobs that trigger in [from, to) with a single range scan, by job id
+func (s *storedBodies) scan(from, to time.Time) (map[string][]byte, error) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	records, err := s.jobs.Scan(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	bodies := map[string][]byte{}
+	for res := range records {
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		j := new(Job)
+		if err := j.UnmarshalBinary(res.Record.Data); err != nil {
+			return nil, err
+		}
+		bodies[j.id] = j.body
+	}
+	return bodies, nil
+}
+
+// The job store owns the bodies, there is nothing to count or clean up
+func (s *storedBodies) retain(ref *bodyRef)  {}
+func (s *storedBodies) release(ref *bodyRef) {}
+func (s *storedBodies) diskSize() int64      { return 0 }
+func (s *storedBodies) close() error         { return nil }
+
+// scanSpoke reads the bodies of s left in the job store back with a range scan of the spoke,
+// nil if it has none there. Must be called with s unlocked.
+func (h *Hub) scanSpoke(s *Spoke) map[string][]byte {
+	sb, ok := h.store.(*storedBodies)
+	if !ok {
+		return nil
+	}
+	s.Lock()
+	spilled := false
+	for _, e := range s.jobQueue {
+		if e.job.ref != nil {
+			spilled = true
+			break
+		}
+	}
+	s.Unlock()
+	if !spilled {
+		return nil
+	}
+	bodies, err := sb.scan(s.start, s.end)
+	if err != nil {
+		logrus.WithError(err).Error("Hub: cannot scan the job store for a spoke")
+		go metrics.Incr("hub.storage.pagein.error")
+		return nil
+	}
+	return bodies
+}
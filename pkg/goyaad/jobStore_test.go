@@ -0,0 +1,156 @@
+package goyaad_test
+
+import (
+	"os"
+	"path"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test job stores", func() {
+	storeDir := path.Join(os.TempDir(), "goyaadjobstoretest")
+
+	newHub := func(restore bool) *Hub {
+		h := NewHub(&HubOpts{
+			SpokeSpan:      time.Second,
+			Persister:      persistence.NewKVPersister(storeDir, &persistence.KVOpts{}),
+			AttemptRestore: restore,
+		})
+		Eventually(h.Ready()).Should(BeClosed())
+		return h
+	}
+
+	BeforeEach(func() {
+		Expect(os.RemoveAll(storeDir)).To(Succeed())
+	})
+
+	It("keeps every change without persisting on stop", func() {
+		h := newHub(false)
+		Expect(h.AddJob(NewJob("due", time.Now().Add(-time.Second), nil))).To(Succeed())
+		Expect(h.AddJob(NewJob("cancel", time.Now().Add(time.Hour), nil))).To(Succeed())
+		Expect(h.AddJob(NewJob("keep", time.Now().Add(time.Hour), []byte("body")))).To(Succeed())
+		Expect(h.CancelJob("cancel")).To(Succeed())
+		Expect(h.Next().ID()).To(Equal("due"))
+		h.Stop(false)
+
+		restored := newHub(true)
+		Expect(restored.PendingJobsCount()).To(Equal(1))
+		j, err := restored.FindJob("keep")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.Body()).To(Equal([]byte("body")))
+
+		// Checkpoints only sync the store
+		stats, err := restored.Checkpoint()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.Path).To(Equal(path.Join(storeDir, "kv", "jobs.db")))
+		Expect(stats.Jobs).To(Equal(1))
+		restored.Stop(true)
+
+		again := newHub(true)
+		Expect(again.PendingJobsCount()).To(Equal(1))
+		again.Stop(false)
+	})
+
+	It("keeps batches and consumer groups past a checkpoint that drops the WAL", func() {
+		walHub := func() *Hub {
+			wal, err := persistence.OpenWAL(storeDir, persistence.SyncAlways, 0)
+			Expect(err).NotTo(HaveOccurred())
+			h := NewHub(&HubOpts{
+				SpokeSpan: time.Second,
+				Persister: persistence.NewKVPersister(storeDir, &persistence.KVOpts{}),
+				WAL:       wal,
+			})
+			Eventually(h.Ready()).Should(BeClosed())
+			return h
+		}
+		h := walHub()
+		h.AddGroup("billing")
+		h.AddGroup("audit")
+		Expect(h.AddJob(NewJob("fired", time.Now().Add(-time.Second), nil))).To(Succeed())
+		j, err := h.NextFor("billing")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.ID()).To(Equal("fired"))
+		id := h.OpenBatch()
+		for _, jid := range []string{"first", "second"} {
+			j := NewJob(jid, time.Now().Add(time.Hour), nil)
+			j.SetBatch(id)
+			Expect(h.AddJob(j)).To(Succeed())
+		}
+		Expect(h.CancelJob("first")).To(Succeed())
+		Expect(h.SealBatch(id, NewJob("callback", time.Now(), nil))).To(Succeed())
+		_, err = h.Checkpoint()
+		Expect(err).NotTo(HaveOccurred())
+		h.Stop(false)
+
+		restored := walHub()
+		Expect(restored.Groups()).To(Equal([]string{"audit", "billing"}))
+		j, err = restored.NextFor("billing")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j).To(BeNil())
+		j, err = restored.NextFor("audit")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.ID()).To(Equal("fired"))
+		p, err := restored.BatchProgress(id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p).To(Equal(BatchProgress{ID: id, Total: 2, Pending: 1, Done: 1, Sealed: true}))
+		restored.Stop(false)
+	})
+
+	It("restores the stored jobs even when not asked to", func() {
+		h := newHub(false)
+		Expect(h.AddJob(NewJob("old", time.Now().Add(time.Hour), nil))).To(Succeed())
+		h.Stop(false)
+
+		restored := newHub(false)
+		Expect(restored.PendingJobsCount()).To(Equal(1))
+		restored.Stop(false)
+	})
+
+	It("leaves far spokes in the store and loads them back with range scans", func() {
+		start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+		clock := NewManualClock(start)
+		lazyHub := func() *Hub {
+			h := NewHub(&HubOpts{
+				SpokeSpan:    time.Minute,
+				Persister:    persistence.NewKVPersister(storeDir, &persistence.KVOpts{}),
+				StorageMode:  StorageLazy,
+				SpillHorizon: time.Hour,
+				Clock:        clock,
+			})
+			Eventually(h.Ready()).Should(BeClosed())
+			return h
+		}
+		h := lazyHub()
+		Expect(h.AddJob(NewJob("near", start.Add(time.Minute), []byte("near")))).To(Succeed())
+		for _, id := range []string{"far-1", "far-2"} {
+			Expect(h.AddJob(NewJob(id, start.Add(2*time.Hour), []byte(id)))).To(Succeed())
+		}
+		Expect(h.Stats().SpilledJobs).To(Equal(int64(2)))
+		Expect(h.Stats().BodyBytes).To(Equal(int64(len("near"))))
+		j, err := h.FindJob("far-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.Body()).To(Equal([]byte("far-1")))
+		h.Stop(false)
+
+		// Restored far spokes stay in the store
+		h = lazyHub()
+		Expect(h.PendingJobsCount()).To(Equal(3))
+		Expect(h.Stats().SpilledJobs).To(Equal(int64(2)))
+
+		clock.Advance(2*time.Hour - time.Second)
+		h.Tier()
+		Expect(h.Stats().SpilledJobs).To(BeZero())
+		clock.Advance(time.Second)
+		ids := map[string]string{}
+		for j := h.Next(); j != nil; j = h.Next() {
+			ids[j.ID()] = string(j.Body())
+		}
+		Expect(ids).To(Equal(map[string]string{"near": "near", "far-1": "far-1", "far-2": "far-2"}))
+		h.Stop(false)
+	})
+})
@@ -2,6 +2,7 @@ package goyaad_test
 
 import (
 	"container/heap"
+	"context"
 	"os"
 	"path"
 	"time"
@@ -66,14 +67,33 @@ var _ = Describe("Test jobs", func() {
 			Expect(j.TriggerAt().Unix()).To(Equal(jj.TriggerAt().Unix()))
 		})
 
+		It("serde keeps batch and delivery windows", func() {
+			w, err := ParseWindow("Mon-Fri 08:00-21:00 Europe/Berlin")
+			Expect(err).To(BeNil())
+			j := NewJobAutoID(time.Now(), []byte("This is a test job"))
+			j.SetBatch("batch")
+			j.SetWindows([]Window{w})
+			encoded, err := j.GobEncode()
+			Expect(err).To(BeNil())
+
+			jj := &Job{}
+			Expect(jj.GobDecode(encoded)).To(BeNil())
+			Expect(jj.BatchID()).To(Equal("batch"))
+			Expect(jj.Windows()).To(HaveLen(1))
+			Expect(jj.Windows()[0].String()).To(Equal(w.String()))
+		})
+
 		It("use a persister to save a job", func() {
 			j := NewJobAutoID(time.Now(), []byte("This is a test job"))
 			persistenceTestDir := path.Join(os.TempDir(), "goyaadtest")
 			p := persistence.NewJournalPersister(persistenceTestDir)
 			Expect(p.ResetDataDir()).To(BeNil())
 
-			err := p.Persist(j)
+			r, err := j.Record()
 			Expect(err).NotTo(HaveOccurred())
+			Expect(r.ID).To(Equal(j.ID()))
+			Expect(r.TriggerAt).To(Equal(j.TriggerAt()))
+			Expect(p.Write(context.Background(), r)).To(Succeed())
 		})
 	})
 })
@@ -0,0 +1,124 @@
+package goyaad
+
+import (
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrRestoring is returned to clients while the hub is still restoring jobs from disk
+var ErrRestoring = errors.New("hub is restoring")
+
+// ErrRestoreFailed is returned for snapshots asked of a hub whose restore failed:
+// the snapshot would replace the persisted jobs the restore didn't bring back
+var ErrRestoreFailed = errors.New("hub restore failed, not replacing the persisted jobs")
+
+// errRestoreStopped is returned by a restore cut short by Stop
+var errRestoreStopped = errors.New("restore stopped")
+
+// lifecycle owns the background goroutines of a hub and tells when its restore is done
+type lifecycle struct {
+	ready    chan struct{} // Closed once the restore is done
+	restored bool          // False if the restore was cut short, only read after ready is closed
+	err      error         // Why the restore failed, only read after ready is closed
+	stop     chan struct{} // Closed to stop background goroutines
+	stopOnce *sync.Once
+	wg       *sync.WaitGroup
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		ready:    make(chan struct{}),
+		stop:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+		wg:       &sync.WaitGroup{},
+	}
+}
+
+// run starts f in a goroutine that shutdown waits for
+func (l *lifecycle) run(f func()) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		f()
+	}()
+}
+
+// restore runs f in the background and closes ready once it returns
+func (l *lifecycle) restore(name string, f func() error) {
+	l.run(func() {
+		defer close(l.ready)
+		logrus.Infof("%s: Entering restore mode", name)
+		err := f()
+		l.restored = err != errRestoreStopped
+		l.err = err
+		if err != nil {
+			logrus.Errorf("%s: Restore error %s", name, err)
+		}
+		logrus.Infof("%s: Initial restore finished. Resuming", name)
+	})
+}
+
+// skipRestore marks a hub that doesn't restore as ready
+func (l *lifecycle) skipRestore() {
+	l.restored = true
+	close(l.ready)
+}
+
+// isReady returns true once the restore is done
+func (l *lifecycle) isReady() bool {
+	select {
+	case <-l.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// persistErr returns ErrRestoreFailed once the restore failed, unless all it missed was a snapshot,
+// like on the first start. Must be called once ready is closed.
+func (l *lifecycle) persistErr() error {
+	if l.err == nil || l.err == errRestoreStopped || os.IsNotExist(errors.Cause(l.err)) {
+		return nil
+	}
+	return ErrRestoreFailed
+}
+
+// stopping returns true once shutdown was called
+func (l *lifecycle) stopping() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops the background goroutines and waits for them to return.
+// It returns true if the restore ran to the end.
+func (l *lifecycle) shutdown() bool {
+	l.stopOnce.Do(func() { close(l.stop) })
+	l.wg.Wait()
+	return l.restored
+}
+
+// Ready returns a channel that is closed once the hub finished restoring jobs from disk.
+// Hubs that don't restore are ready right away.
+func (h *Hub) Ready() <-chan struct{} {
+	return h.life.ready
+}
+
+// IsReady returns true once the hub finished restoring jobs from disk
+func (h *Hub) IsReady() bool {
+	return h.life.isReady()
+}
+
+// RestoreErr returns why the restore failed once the hub is ready, nil if it didn't
+func (h *Hub) RestoreErr() error {
+	if !h.life.isReady() {
+		return nil
+	}
+	return h.life.err
+}
@@ -0,0 +1,96 @@
+package goyaad_test
+
+import (
+	"path"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test hub lifecycle", func() {
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+	})
+
+	persistJobs := func(count int) {
+		h := NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persister})
+		for i := 0; i < count; i++ {
+			Expect(h.AddJob(NewJobAutoID(time.Now().Add(time.Hour), []byte("restore me")))).To(BeNil())
+		}
+		h.Stop(true)
+	}
+
+	It("is ready right away without a restore and stops its goroutines", func(done Done) {
+		defer close(done)
+
+		h := NewHub(&HubOpts{
+			SpokeSpan:    time.Second,
+			MaxSpokeSpan: time.Hour,
+			StorageMode:  StorageLazy,
+			StorageDir:   path.Join(dataDir, "segments"),
+			Persister:    persister,
+		})
+		Expect(h.IsReady()).To(BeTrue())
+		Expect(h.Ready()).To(BeClosed())
+		Expect(h.Stats().Restoring).To(BeFalse())
+
+		h.Stop(false)
+		// Stopping twice is fine
+		h.Stop(false)
+	}, 1)
+
+	It("becomes ready once the restore is done", func() {
+		persistJobs(100)
+
+		h := NewHub(&HubOpts{
+			SpokeSpan:      time.Second,
+			Persister:      persistence.NewJournalPersister(dataDir),
+			AttemptRestore: true,
+		})
+		Eventually(h.Ready()).Should(BeClosed())
+		Expect(h.IsReady()).To(BeTrue())
+		Expect(h.Stats().Restoring).To(BeFalse())
+		Expect(h.PendingJobsCount()).To(Equal(100))
+		h.Stop(false)
+	})
+
+	It("keeps persisted jobs when stopped during a restore", func() {
+		persistJobs(2000)
+
+		h := NewHub(&HubOpts{
+			SpokeSpan:      time.Second,
+			Persister:      persistence.NewJournalPersister(dataDir),
+			AttemptRestore: true,
+		})
+		// Either the restore is cut short and nothing is persisted, or it finished and all jobs are
+		h.Stop(true)
+		Expect(h.Ready()).To(BeClosed())
+
+		restored := NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persistence.NewJournalPersister(dataDir)})
+		Expect(restored.Restore()).To(BeNil())
+		Expect(restored.PendingJobsCount()).To(Equal(2000))
+	})
+
+	It("restores sharded hubs before they are ready", func() {
+		persistJobs(100)
+
+		sh, err := NewShardedHub(&ShardedHubOpts{
+			Shards: 4,
+			HubOpts: HubOpts{
+				SpokeSpan:      time.Second,
+				Persister:      persistence.NewJournalPersister(dataDir),
+				AttemptRestore: true,
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(sh.Ready()).Should(BeClosed())
+		Expect(sh.IsReady()).To(BeTrue())
+		Expect(sh.PendingJobsCount()).To(Equal(100))
+		sh.Stop(false)
+	})
+})
@@ -0,0 +1,132 @@
+package goyaad_test
+
+import (
+	"container/heap"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/goyaad"
+)
+
+const (
+	memBenchJobs     = 100000
+	memBenchBodySize = 100
+)
+
+// baselineJob is the job of the baseline tree: a time.Time trigger and no options
+type baselineJob struct {
+	id        string
+	triggerAt time.Time
+	body      []byte
+
+	pri int32
+	ttr time.Duration
+}
+
+// baselineItem is the priority queue Item the baseline spokes held jobs in, boxed in an interface
+type baselineItem struct {
+	value    interface{}
+	priority time.Time
+	index    int
+}
+
+// baselineQueue is the baseline spoke job queue, a PriorityQueue of items
+type baselineQueue []*baselineItem
+
+func (pq baselineQueue) Len() int           { return len(pq) }
+func (pq baselineQueue) Less(i, j int) bool { return pq[i].priority.Before(pq[j].priority) }
+func (pq baselineQueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+	pq[i].index = i
+	pq[j].index = j
+}
+
+func (pq *baselineQueue) Push(x interface{}) {
+	item := x.(*baselineItem)
+	item.index = len(*pq)
+	*pq = append(*pq, item)
+}
+
+func (pq *baselineQueue) Pop() interface{} {
+	old := *pq
+	item := old[len(old)-1]
+	*pq = old[:len(old)-1]
+	return item
+}
+
+func memBenchBody() []byte {
+	b := make([]byte, memBenchBodySize)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// heapInUse returns the bytes of live heap objects after a full collection
+func heapInUse() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// benchMemory reports the heap bytes each pending job costs, body included
+func benchMemory(b *testing.B, fill func(at time.Time) interface{}) {
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.ErrorLevel)
+	defer logrus.SetLevel(level)
+
+	at := time.Now().Add(time.Hour)
+	var perJob float64
+	for n := 0; n < b.N; n++ {
+		before := heapInUse()
+		held := fill(at)
+		// Let metrics goroutines spawned while filling finish
+		time.Sleep(100 * time.Millisecond)
+		perJob = float64(heapInUse()-before) / memBenchJobs
+		runtime.KeepAlive(held)
+		if h, ok := held.(*goyaad.Hub); ok {
+			h.Stop(false)
+		}
+	}
+	b.ReportMetric(perJob, "bytes/job")
+	b.ReportMetric(perJob-memBenchBodySize, "overhead/job")
+}
+
+func BenchmarkJobMemory(b *testing.B) {
+	// Before: the baseline spoke path, an id in the spoke's sync.Map and an item in its queue per job
+	b.Run("Baseline", func(b *testing.B) {
+		benchMemory(b, func(at time.Time) interface{} {
+			jobMap := &sync.Map{}
+			queue := &baselineQueue{}
+			heap.Init(queue)
+			for i := 0; i < memBenchJobs; i++ {
+				trigger := at.Add(time.Duration(i) * time.Millisecond)
+				j := &baselineJob{id: fmt.Sprintf("%d", i), triggerAt: trigger, body: memBenchBody()}
+				jobMap.Store(j.id, true)
+				heap.Push(queue, &baselineItem{value: j, priority: j.triggerAt})
+			}
+			return []interface{}{jobMap, queue}
+		})
+	})
+
+	// After: jobs added to a hub
+	for _, arena := range []int{0, 64 << 10} {
+		b.Run(fmt.Sprintf("Hub_Arena_%d", arena), func(b *testing.B) {
+			benchMemory(b, func(at time.Time) interface{} {
+				h := goyaad.NewHub(&goyaad.HubOpts{SpokeSpan: time.Minute, BodyArenaSize: arena})
+				for i := 0; i < memBenchJobs; i++ {
+					trigger := at.Add(time.Duration(i) * time.Millisecond)
+					if err := h.AddJob(goyaad.NewJob(fmt.Sprintf("%d", i), trigger, memBenchBody())); err != nil {
+						b.Fatal(err)
+					}
+				}
+				return h
+			})
+		})
+	}
+}
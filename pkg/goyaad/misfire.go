@@ -0,0 +1,166 @@
+package goyaad
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+)
+
+// MisfirePolicy decides what happens to a job delivered later than its misfire threshold,
+// like the jobs that came due while the server was down
+type MisfirePolicy int
+
+const (
+	// MisfireDefault leaves the decision to the hub. Hubs without a policy fire late jobs.
+	MisfireDefault MisfirePolicy = iota
+	// MisfireFire delivers late jobs anyway
+	MisfireFire
+	// MisfireSkip drops late jobs
+	MisfireSkip
+	// MisfireLatest drops late jobs while a later job with the same key is due too,
+	// so that only the latest of them fires. Jobs without a key always fire.
+	MisfireLatest
+)
+
+var misfirePolicies = map[string]MisfirePolicy{
+	"fire":   MisfireFire,
+	"skip":   MisfireSkip,
+	"latest": MisfireLatest,
+}
+
+func (p MisfirePolicy) String() string {
+	for name, policy := range misfirePolicies {
+		if policy == p {
+			return name
+		}
+	}
+	return "default"
+}
+
+// Misfire is a misfire policy and the lateness it starts to apply at
+type Misfire struct {
+	Policy MisfirePolicy
+	After  time.Duration // Jobs delivered at most this late are never misfires
+}
+
+// ParseMisfire parses a policy with an optional threshold like "fire", "skip:10m" or "latest:1h".
+// Skipping needs a threshold.
+func ParseMisfire(s string) (Misfire, error) {
+	parts := strings.SplitN(s, ":", 2)
+	p, ok := misfirePolicies[strings.ToLower(parts[0])]
+	if !ok {
+		return Misfire{}, errors.Errorf("Unknown misfire policy %q", s)
+	}
+	m := Misfire{Policy: p}
+	if len(parts) == 2 {
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d < 0 {
+			return Misfire{}, errors.Errorf("Invalid misfire threshold %q", s)
+		}
+		m.After = d
+	}
+	if m.Policy == MisfireSkip && m.After == 0 {
+		return Misfire{}, errors.Errorf("Misfire policy %q needs a threshold like skip:10m", s)
+	}
+	return m, nil
+}
+
+func (m Misfire) String() string {
+	if m.After == 0 {
+		return m.Policy.String()
+	}
+	return m.Policy.String() + ":" + m.After.String()
+}
+
+// keyIndex tracks the trigger times of pending keyed jobs by job id, by key
+type keyIndex struct {
+	jobs map[string]map[string]int64
+	lock *sync.Mutex
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{jobs: make(map[string]map[string]int64), lock: &sync.Mutex{}}
+}
+
+func (k *keyIndex) add(j *Job) {
+	key := j.Key()
+	if key == "" {
+		return
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.jobs[key] == nil {
+		k.jobs[key] = make(map[string]int64)
+	}
+	k.jobs[key][j.id] = j.triggerAt
+}
+
+func (k *keyIndex) remove(j *Job) {
+	key := j.Key()
+	if key == "" {
+		return
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	delete(k.jobs[key], j.id)
+	if len(k.jobs[key]) == 0 {
+		delete(k.jobs, key)
+	}
+}
+
+// due returns true if another pending job with the key of j is due at now
+func (k *keyIndex) due(j *Job, now time.Time) bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for id, at := range k.jobs[j.Key()] {
+		if id != j.id && at <= now.UnixNano() {
+			return true
+		}
+	}
+	return false
+}
+
+// misfireOf returns the misfire policy that applies to j
+func (h *Hub) misfireOf(j *Job) Misfire {
+	if m := j.Misfire(); m.Policy != MisfireDefault {
+		return m
+	}
+	return h.misfire
+}
+
+// misfired returns true if j is too late at now and must not be delivered.
+// Batch callbacks always fire so that batches finish.
+func (h *Hub) misfired(j *Job, now time.Time) bool {
+	if j.IsBatchCallback() {
+		return false
+	}
+	m := h.misfireOf(j)
+	if now.Sub(j.TriggerAt()) <= m.After {
+		return false
+	}
+	switch m.Policy {
+	case MisfireSkip:
+		return true
+	case MisfireLatest:
+		return j.Key() != "" && h.keys.due(j, now)
+	default:
+		return false
+	}
+}
+
+// skipMisfire records that j was dropped because it was too late
+func (h *Hub) skipMisfire(j *Job, now time.Time) {
+	atomic.AddUint64(&h.misfiredCount, 1)
+	logrus.WithFields(logrus.Fields{
+		"jobID":   j.id,
+		"dueAt":   j.TriggerAt(),
+		"late":    now.Sub(j.TriggerAt()),
+		"misfire": h.misfireOf(j),
+	}).Debug("Hub: skipped a job that misfired")
+	go metrics.Incr("hub.job.misfire.skipped")
+}
@@ -0,0 +1,121 @@
+package goyaad_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test misfire policies", func() {
+	var clock *ManualClock
+	var start time.Time
+
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+		start = time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+		clock = NewManualClock(start)
+	})
+
+	newHub := func(m Misfire) *Hub {
+		return NewHub(&HubOpts{SpokeSpan: time.Minute, Persister: persister, Clock: clock, Misfire: m})
+	}
+
+	drain := func(h *Hub) []string {
+		ids := []string{}
+		for j := h.Next(); j != nil; j = h.Next() {
+			ids = append(ids, j.ID())
+		}
+		return ids
+	}
+
+	It("parses policies and thresholds", func() {
+		m, err := ParseMisfire("skip:10m")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m).To(Equal(Misfire{Policy: MisfireSkip, After: 10 * time.Minute}))
+		Expect(m.String()).To(Equal("skip:10m0s"))
+
+		m, err = ParseMisfire("latest")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m).To(Equal(Misfire{Policy: MisfireLatest}))
+
+		for _, bad := range []string{"", "never", "skip", "skip:soon", "latest:-1m"} {
+			_, err = ParseMisfire(bad)
+			Expect(err).To(HaveOccurred(), bad)
+		}
+	})
+
+	It("skips jobs delivered later than the threshold", func() {
+		h := newHub(Misfire{Policy: MisfireSkip, After: 10 * time.Minute})
+		late := NewJob("late", start.Add(time.Minute), nil)
+		onTime := NewJob("on-time", start.Add(15*time.Minute), nil)
+		fireAnyway := NewJob("fire-anyway", start.Add(time.Minute), nil)
+		fireAnyway.SetMisfire(Misfire{Policy: MisfireFire})
+		for _, j := range []*Job{late, onTime, fireAnyway} {
+			Expect(h.AddJob(j)).To(BeNil())
+		}
+
+		clock.Set(start.Add(15*time.Minute + time.Second))
+		Expect(drain(h)).To(Equal([]string{"fire-anyway", "on-time"}))
+		Expect(h.Stats().MisfiredJobs).To(Equal(uint64(1)))
+		Expect(h.PendingJobsCount()).To(BeZero())
+	})
+
+	It("fires only the latest of the late jobs with the same key", func() {
+		h := newHub(Misfire{Policy: MisfireLatest})
+		for i := 1; i <= 3; i++ {
+			j := NewJobAutoID(start.Add(time.Duration(i)*time.Hour), []byte("report"))
+			j.SetKey("hourly-report")
+			Expect(h.AddJob(j)).To(BeNil())
+		}
+		unkeyed := NewJob("unkeyed", start.Add(90*time.Minute), nil)
+		Expect(h.AddJob(unkeyed)).To(BeNil())
+		next := NewJob("next-run", start.Add(5*time.Hour), nil)
+		next.SetKey("hourly-report")
+		Expect(h.AddJob(next)).To(BeNil())
+
+		clock.Set(start.Add(4 * time.Hour))
+		fired := []*Job{}
+		for j := h.Next(); j != nil; j = h.Next() {
+			fired = append(fired, j)
+		}
+		Expect(fired).To(HaveLen(2))
+		Expect(fired[0].ID()).To(Equal("unkeyed"))
+		Expect(fired[1].TriggerAt()).To(BeTemporally("==", start.Add(3*time.Hour)))
+		Expect(h.Stats().MisfiredJobs).To(Equal(uint64(2)))
+
+		// The next run isn't due yet, so it doesn't make the ones before it misfire
+		clock.Set(start.Add(5 * time.Hour))
+		Expect(drain(h)).To(Equal([]string{"next-run"}))
+	})
+
+	It("drops jobs that misfired while the server was down on restore", func() {
+		h := newHub(Misfire{})
+		skip := NewJob("skip", start.Add(time.Minute), nil)
+		skip.SetMisfire(Misfire{Policy: MisfireSkip, After: 10 * time.Minute})
+		keep := NewJob("keep", start.Add(time.Minute), nil)
+		keep.SetKey("keep")
+		for _, j := range []*Job{skip, keep} {
+			Expect(h.AddJob(j)).To(BeNil())
+		}
+		h.Stop(true)
+
+		clock.Set(start.Add(time.Hour))
+		restored := NewHub(&HubOpts{
+			SpokeSpan: time.Minute,
+			Persister: persistence.NewJournalPersister(dataDir),
+			Clock:     clock,
+		})
+		Expect(restored.Restore()).To(BeNil())
+		Expect(restored.PendingJobsCount()).To(Equal(1))
+		Expect(restored.Stats().MisfiredJobs).To(Equal(uint64(1)))
+
+		j := restored.Next()
+		Expect(j.ID()).To(Equal("keep"))
+		Expect(j.Key()).To(Equal("keep"))
+	})
+})
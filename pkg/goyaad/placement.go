@@ -0,0 +1,53 @@
+package goyaad
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fractional part of the golden ratio - consecutive multiples of it are evenly distributed over [0, 1)
+var goldenRatioFrac = (math.Sqrt(5) - 1) / 2
+
+var spreadCtr uint64
+
+// nextSpreadFraction returns the next value of a low discrepancy sequence in [0, 1)
+// so that any run of spread jobs covers its window evenly, whatever the run's size
+func nextSpreadFraction() float64 {
+	n := atomic.AddUint64(&spreadCtr, 1)
+	_, frac := math.Modf(float64(n) * goldenRatioFrac)
+	return frac
+}
+
+// placeJob resolves the jitter and spread options of a job into a concrete trigger time
+// so that the job lands in the correct spoke. The options are cleared once applied.
+func placeJob(j *Job) {
+	o := j.opts
+	if o == nil || (o.jitter <= 0 && o.spread <= 0) {
+		return
+	}
+	requested := j.TriggerAt()
+
+	if o.spread > 0 {
+		j.triggerAt += int64(nextSpreadFraction() * float64(o.spread))
+	}
+	if o.jitter > 0 {
+		j.triggerAt += rand.Int63n(int64(2*o.jitter)+1) - int64(o.jitter)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"jobID":     j.id,
+		"requested": requested,
+		"triggerAt": j.TriggerAt(),
+		"jitter":    o.jitter,
+		"spread":    o.spread,
+	}).Trace("Placed job")
+
+	o.jitter = 0
+	o.spread = 0
+	if o.batchID == "" && !o.batchCallback && o.windows == nil && o.windowMoves == 0 {
+		j.opts = nil
+	}
+}
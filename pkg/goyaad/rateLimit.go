@@ -0,0 +1,66 @@
+package goyaad
+
+import (
+	"time"
+)
+
+// tokenBucket limits the rate at which the hub hands out ready jobs.
+// It is not safe for concurrent use - the hub guards it with its lock.
+type tokenBucket struct {
+	rate   float64 // tokens added per second
+	burst  float64 // max tokens the bucket can hold
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket that refills at rate tokens per second.
+// Burst is at least 1 so that a job can always be delivered eventually.
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// refill adds the tokens accumulated since the last refill
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last)
+	if elapsed <= 0 {
+		return
+	}
+	b.last = now
+	b.tokens += elapsed.Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// ready returns true if a token is available at the given time
+func (b *tokenBucket) ready(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+// untilReady returns how long until a token is available, 0 if one is available now
+func (b *tokenBucket) untilReady(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take uses up a token
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+// available returns the whole tokens left in the bucket
+func (b *tokenBucket) available() int {
+	return int(b.tokens)
+}
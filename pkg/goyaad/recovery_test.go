@@ -0,0 +1,125 @@
+package goyaad_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test corruption tolerant recovery", func() {
+	recoveryDir := path.Join(os.TempDir(), "goyaadrecoverytest")
+	snapshotPath := path.Join(recoveryDir, "journal", "jobs.snapshot")
+
+	// The golden snapshot has 1000 records of about 1KB, 31 of them start in its second journal block
+	copyGolden := func(corrupt bool) {
+		wd, _ := os.Getwd()
+		buf, err := ioutil.ReadFile(path.Join(wd, "../../testdata/persist_golden/journal/jobs.snapshot"))
+		Expect(err).NotTo(HaveOccurred())
+		if corrupt {
+			// In the payload of the chunk that ends the record spanning the first two blocks
+			buf[32*1024+10] ^= 0xff
+		}
+		Expect(os.MkdirAll(path.Dir(snapshotPath), 0774)).To(Succeed())
+		Expect(ioutil.WriteFile(snapshotPath, buf, 0644)).To(Succeed())
+	}
+
+	restore := func(mode persistence.RecoveryMode) *Hub {
+		h := NewHub(&HubOpts{
+			SpokeSpan:      time.Nanosecond * 3000,
+			Persister:      persistence.NewJournalPersisterWithOpts(recoveryDir, &persistence.JournalOpts{Recovery: mode}),
+			AttemptRestore: true,
+		})
+		Eventually(h.Ready(), 10).Should(BeClosed())
+		return h
+	}
+
+	BeforeEach(func() {
+		Expect(os.RemoveAll(recoveryDir)).To(Succeed())
+	})
+
+	It("restores all records of an intact snapshot", func() {
+		copyGolden(false)
+		h := restore(persistence.RecoverSkip)
+		Expect(h.RestoreErr()).NotTo(HaveOccurred())
+		Expect(h.Stats().Recovery).To(Equal(persistence.RecoveryStats{Recovered: 1000}))
+		h.Stop(false)
+	})
+
+	It("fails a strict restore of a corrupt snapshot", func() {
+		copyGolden(true)
+		h := restore(persistence.RecoverStrict)
+		Expect(errors.Cause(h.RestoreErr())).To(Equal(persistence.ErrCorruptSnapshot))
+		Expect(h.PendingJobsCount()).To(BeZero())
+		h.Stop(false)
+	})
+
+	It("skips the corrupt records and resyncs at the next block", func() {
+		copyGolden(true)
+		h := restore(persistence.RecoverSkip)
+		Expect(h.RestoreErr()).NotTo(HaveOccurred())
+		Expect(h.PendingJobsCount()).To(Equal(968))
+		// The record cut short plus the 31 starting in the corrupt block
+		Expect(h.Stats().Recovery).To(Equal(persistence.RecoveryStats{Recovered: 968, Skipped: 32}))
+		_, err := os.Stat(snapshotPath + ".quarantine")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		h.Stop(false)
+	})
+
+	It("copies the corrupt records to a quarantine file", func() {
+		copyGolden(true)
+		h := restore(persistence.RecoverQuarantine)
+		Expect(h.RestoreErr()).NotTo(HaveOccurred())
+		Expect(h.PendingJobsCount()).To(Equal(968))
+		// The record cut short and the rest of the corrupt block
+		Expect(h.Stats().Recovery).To(Equal(persistence.RecoveryStats{
+			Recovered:   968,
+			Skipped:     32,
+			Quarantined: 2,
+			Quarantine:  snapshotPath + ".quarantine",
+		}))
+		buf, err := ioutil.ReadFile(snapshotPath + ".quarantine")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(buf)).To(HavePrefix("--- offset: "))
+		h.Stop(false)
+	})
+
+	Context("with a record that isn't a job", func() {
+		BeforeEach(func() {
+			ctx := context.Background()
+			p := persistence.NewJournalPersister(recoveryDir)
+			r, err := NewJob("good", time.Now().Add(time.Hour), nil).Record()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Write(ctx, r)).To(Succeed())
+			Expect(p.Write(ctx, persistence.Record{Kind: persistence.RecordAdd, ID: "raw", Data: []byte("not a job")})).To(Succeed())
+			Expect(p.Commit(ctx)).To(Succeed())
+		})
+
+		It("fails a strict restore", func() {
+			h := restore(persistence.RecoverStrict)
+			Expect(h.RestoreErr()).To(HaveOccurred())
+			Expect(h.Stats().Recovery).To(Equal(persistence.RecoveryStats{Recovered: 1, Skipped: 1}))
+			h.Stop(false)
+		})
+
+		It("quarantines it", func() {
+			h := restore(persistence.RecoverQuarantine)
+			rs := h.Stats().Recovery
+			Expect(rs.Recovered).To(Equal(1))
+			Expect(rs.Skipped).To(Equal(1))
+			Expect(rs.Quarantined).To(Equal(1))
+			buf, err := ioutil.ReadFile(rs.Quarantine)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf)).To(ContainSubstring("not a job"))
+			h.Stop(false)
+		})
+	})
+})
@@ -0,0 +1,186 @@
+package goyaad
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Segments are rotated once they grow past this size
+const defaultSegmentSize = 64 << 20
+
+// bodyStore keeps the job bodies a hub spilled out of memory
+type bodyStore interface {
+	put(id string, body []byte) (*bodyRef, error)
+	get(ref *bodyRef) ([]byte, error)
+	retain(ref *bodyRef)
+	release(ref *bodyRef)
+	diskSize() int64
+	close() error
+}
+
+// bodyRef locates a spilled job body in its store
+type bodyRef struct {
+	store bodyStore
+	seg   int
+	off   int64
+	len   int
+	id    string // Of the job, for bodies left in a job store
+}
+
+type segment struct {
+	f    *os.File
+	live int // Bodies in this segment that are still referenced
+}
+
+// segmentStore keeps job bodies in append only segment files on disk.
+// A segment file is deleted once none of the bodies written to it are referenced anymore.
+type segmentStore struct {
+	dir     string
+	maxSize int64
+
+	segs       map[int]*segment
+	activeID   int
+	activeSize int64
+	size       int64 // Bytes across all segment files
+
+	lock *sync.Mutex
+}
+
+// newSegmentStore creates a store in a new directory under dir so that stores never share files
+func newSegmentStore(dir string, maxSize int64) (*segmentStore, error) {
+	dir = filepath.Join(dir, "segments-"+uuid.NewV4().String())
+	if err := os.MkdirAll(dir, 0774); err != nil {
+		return nil, errors.Wrap(err, "SegmentStore: cannot create segment dir")
+	}
+	s := &segmentStore{
+		dir:     dir,
+		maxSize: maxSize,
+		segs:    make(map[int]*segment),
+		lock:    &sync.Mutex{},
+	}
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	logrus.Infof("SegmentStore: storing job bodies in %s", dir)
+	return s, nil
+}
+
+func (s *segmentStore) segmentPath(id int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%06d.seg", id))
+}
+
+// rotate starts a new active segment. Must be called with the store locked.
+func (s *segmentStore) rotate() error {
+	id := s.activeID + 1
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0664)
+	if err != nil {
+		return errors.Wrap(err, "SegmentStore: cannot create segment")
+	}
+	old := s.activeID
+	s.segs[id] = &segment{f: f}
+	s.activeID = id
+	s.activeSize = 0
+	s.removeIfDead(old)
+	return nil
+}
+
+// put appends a body to the active segment
+func (s *segmentStore) put(id string, body []byte) (*bodyRef, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.activeSize > 0 && s.activeSize+int64(len(body)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	seg := s.segs[s.activeID]
+	if _, err := seg.f.WriteAt(body, s.activeSize); err != nil {
+		return nil, errors.Wrap(err, "SegmentStore: cannot write body")
+	}
+	ref := &bodyRef{store: s, seg: s.activeID, off: s.activeSize, len: len(body)}
+	seg.live++
+	s.activeSize += int64(len(body))
+	s.size += int64(len(body))
+	return ref, nil
+}
+
+// get reads back a body
+func (s *segmentStore) get(ref *bodyRef) ([]byte, error) {
+	s.lock.Lock()
+	seg, ok := s.segs[ref.seg]
+	s.lock.Unlock()
+	if !ok {
+		return nil, errors.Errorf("SegmentStore: segment %d is gone", ref.seg)
+	}
+
+	body := make([]byte, ref.len)
+	if _, err := seg.f.ReadAt(body, ref.off); err != nil {
+		return nil, errors.Wrap(err, "SegmentStore: cannot read body")
+	}
+	return body, nil
+}
+
+// retain adds a reference to a body so that its segment stays until the reference is released
+func (s *segmentStore) retain(ref *bodyRef) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if seg, ok := s.segs[ref.seg]; ok {
+		seg.live++
+	}
+}
+
+// release drops a reference to a body, deleting its segment if nothing else in it is referenced
+func (s *segmentStore) release(ref *bodyRef) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seg, ok := s.segs[ref.seg]
+	if !ok {
+		return
+	}
+	seg.live--
+	s.removeIfDead(ref.seg)
+}
+
+// removeIfDead deletes an inactive segment without live bodies. Must be called with the store locked.
+func (s *segmentStore) removeIfDead(id int) {
+	seg, ok := s.segs[id]
+	if !ok || id == s.activeID || seg.live > 0 {
+		return
+	}
+	delete(s.segs, id)
+	if st, err := seg.f.Stat(); err == nil {
+		s.size -= st.Size()
+	}
+	seg.f.Close()
+	if err := os.Remove(s.segmentPath(id)); err != nil {
+		logrus.WithError(err).Error("SegmentStore: cannot remove segment")
+	}
+}
+
+// diskSize returns the bytes used by segment files
+func (s *segmentStore) diskSize() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size
+}
+
+// close deletes all segments. Bodies still on disk are lost.
+func (s *segmentStore) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, seg := range s.segs {
+		seg.f.Close()
+	}
+	s.segs = make(map[int]*segment)
+	return os.RemoveAll(s.dir)
+}
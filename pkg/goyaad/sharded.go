@@ -0,0 +1,438 @@
+package goyaad
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+// ShardedHubOpts define customizations for ShardedHub initialization
+type ShardedHubOpts struct {
+	HubOpts
+	Shards int // Number of independent hubs to partition jobs across
+}
+
+// ShardedHub partitions jobs across independent hubs by job id so that adds, reads
+// and cancels on different shards don't contend on a single hub lock.
+//
+// Next hands out the earliest ready job across all shards. Concurrent readers can still
+// see jobs slightly out of trigger order - by at most the time between looking at a
+// shard's earliest job and taking it.
+//
+// Rate limits are split evenly across the shards while memory limits apply to all shards together.
+// Batches and consumer groups are not supported on a sharded hub, reading for a consumer group fails
+// with ErrGroupNotFound. The latest misfire
+// policy only sees the jobs with the same key on the same shard. Sharded hubs don't keep a WAL or write checkpoints.
+type ShardedHub struct {
+	shards    []*Hub
+	persister persistence.Persister
+	backup    persistence.Backup
+
+	admission        *Admission   // memory used by the jobs of all shards
+	sharedAdmissions []*Admission // limits shared with other hubs
+
+	waiters *waitSignal // wakes up readers blocked in NextWait, shared by all shards
+	life    *lifecycle  // the restore across all shards
+}
+
+// ErrShardedPersistence is returned for sharded hubs asked to keep a WAL, periodic checkpoints
+// or a job store: sharded hubs only write snapshots, on stop or when asked to
+var ErrShardedPersistence = errors.New("sharded hubs only persist snapshots")
+
+// NewShardedHub creates a hub made of opts.Shards independent hubs.
+// It fails with ErrShardedPersistence for options the shards can't keep.
+func NewShardedHub(opts *ShardedHubOpts) (*ShardedHub, error) {
+	switch {
+	case opts.WAL != nil:
+		return nil, errors.Wrap(ErrShardedPersistence, "no WAL")
+	case opts.CheckpointInterval > 0 || opts.CheckpointSize > 0:
+		return nil, errors.Wrap(ErrShardedPersistence, "no periodic checkpoints")
+	case asJobStore(opts.Persister) != nil:
+		return nil, errors.Wrap(ErrShardedPersistence, "no job store")
+	}
+	n := opts.Shards
+	if n < 1 {
+		n = 1
+	}
+
+	shared := &sharedPersister{Persister: opts.Persister, lock: &sync.Mutex{}}
+	shardOpts := opts.HubOpts
+	shardOpts.Persister = shared
+	shardOpts.Backup = nil
+	shardOpts.AttemptRestore = false
+
+	admission := NewAdmission(opts.MaxJobs, opts.MaxBytes)
+	shardOpts.MaxJobs, shardOpts.MaxBytes = 0, 0
+	shardOpts.SharedAdmissions = append(append([]*Admission{}, opts.SharedAdmissions...), admission)
+	shardOpts.waiters = newWaitSignal()
+	if shardOpts.RateLimit > 0 {
+		shardOpts.RateLimit = opts.RateLimit / float64(n)
+		shardOpts.RateBurst = int(math.Ceil(float64(opts.RateBurst) / float64(n)))
+	}
+
+	sh := &ShardedHub{
+		shards:           make([]*Hub, n),
+		persister:        opts.Persister,
+		backup:           opts.Backup,
+		admission:        admission,
+		sharedAdmissions: opts.SharedAdmissions,
+		waiters:          shardOpts.waiters,
+		life:             newLifecycle(),
+	}
+	for i := range sh.shards {
+		sh.shards[i] = NewHub(&shardOpts)
+	}
+	logrus.WithField("shards", n).Info("Created sharded hub")
+
+	describeSnapshots(opts.Persister, opts.SpokeSpan)
+	if opts.AttemptRestore {
+		sh.life.restore("ShardedHub", sh.Restore)
+	} else {
+		sh.life.skipRestore()
+	}
+
+	return sh, nil
+}
+
+// ResumeDelivery hands out jobs of all shards again after a clock jump paused delivery
+func (sh *ShardedHub) ResumeDelivery() {
+	for _, s := range sh.shards {
+		s.ResumeDelivery()
+	}
+}
+
+// Ready returns a channel that is closed once the sharded hub finished restoring jobs from disk
+func (sh *ShardedHub) Ready() <-chan struct{} {
+	return sh.life.ready
+}
+
+// IsReady returns true once the sharded hub finished restoring jobs from disk
+func (sh *ShardedHub) IsReady() bool {
+	return sh.life.isReady()
+}
+
+// RestoreErr returns why the restore failed once the sharded hub is ready, nil if it didn't
+func (sh *ShardedHub) RestoreErr() error {
+	if !sh.life.isReady() {
+		return nil
+	}
+	return sh.life.err
+}
+
+// Now returns the time on the clock of the shards
+func (sh *ShardedHub) Now() time.Time {
+	return sh.shards[0].Now()
+}
+
+// SetClockOffset moves the clock of all shards to offset from their base clock and returns the new time.
+// Only sharded hubs that run on an OffsetClock can be offset.
+func (sh *ShardedHub) SetClockOffset(offset time.Duration) (time.Time, error) {
+	var now time.Time
+	for _, s := range sh.shards {
+		var err error
+		if now, err = s.SetClockOffset(offset); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return now, nil
+}
+
+// shardFor returns the shard that owns the job with the given id
+func (sh *ShardedHub) shardFor(jobID string) *Hub {
+	f := fnv.New32a()
+	f.Write([]byte(jobID))
+	return sh.shards[f.Sum32()%uint32(len(sh.shards))]
+}
+
+// AddJob to the shard that owns the job
+func (sh *ShardedHub) AddJob(j *Job) error {
+	return sh.shardFor(j.id).AddJob(j)
+}
+
+// CancelJob cancels a job if found. Calls are noop for unknown jobs
+func (sh *ShardedHub) CancelJob(jobID string) error {
+	return sh.shardFor(jobID).CancelJob(jobID)
+}
+
+// FindJob returns the pending job with the given id
+func (sh *ShardedHub) FindJob(jobID string) (*Job, error) {
+	return sh.shardFor(jobID).FindJob(jobID)
+}
+
+type shardCandidate struct {
+	shard     *Hub
+	triggerAt time.Time
+}
+
+// Next returns the earliest ready job across all shards or nil
+func (sh *ShardedHub) Next() *Job {
+	defer metrics.Time("shardedhub.next.search.duration", time.Now())
+
+	candidates := make([]shardCandidate, 0, len(sh.shards))
+	for _, s := range sh.shards {
+		if t, ok := s.peek(); ok {
+			candidates = append(candidates, shardCandidate{s, t})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].triggerAt.Before(candidates[j].triggerAt)
+	})
+
+	// A candidate can be gone by the time we get to it - taken by another reader,
+	// throttled or moved to its next delivery window. Fall back to the next shard.
+	for _, c := range candidates {
+		if j := c.shard.Next(); j != nil {
+			return j
+		}
+	}
+	return nil
+}
+
+// NextFor returns the next ready job like Next. Sharded hubs have no consumer groups,
+// reading for one fails with ErrGroupNotFound.
+func (sh *ShardedHub) NextFor(group string) (*Job, error) {
+	if group != "" {
+		return nil, ErrGroupNotFound
+	}
+	return sh.Next(), nil
+}
+
+// NextWait returns the earliest ready job across all shards, blocking until one is ready or ctx is done.
+// It returns ctx.Err() if ctx is done first.
+func (sh *ShardedHub) NextWait(ctx context.Context) (*Job, error) {
+	return sh.NextForWait(ctx, "")
+}
+
+// NextForWait works like NextWait, sharded hubs have no consumer groups
+func (sh *ShardedHub) NextForWait(ctx context.Context, group string) (*Job, error) {
+	if group != "" {
+		return nil, ErrGroupNotFound
+	}
+	for {
+		// Subscribe before looking so that a job added to any shard in between wakes us up
+		wake := sh.waiters.wait()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if j := sh.Next(); j != nil {
+			return j, nil
+		}
+
+		go metrics.Incr("shardedhub.next.wait")
+		d := maxWaitInterval
+		for _, s := range sh.shards {
+			if until := s.untilNextJob(); until < d {
+				d = until
+			}
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-wake:
+			t.Stop()
+		case <-t.C:
+		}
+	}
+}
+
+// PendingJobsCount return the number of jobs currently pending across all shards
+func (sh *ShardedHub) PendingJobsCount() int {
+	count := 0
+	for _, s := range sh.shards {
+		count += s.PendingJobsCount()
+	}
+	return count
+}
+
+// Stats returns a point in time view of all shards added together
+func (sh *ShardedHub) Stats() HubStats {
+	stats := HubStats{}
+	sizes := []spokeSize{}
+	for _, s := range sh.shards {
+		sizes = append(sizes, s.lockedSpokeSizes()...)
+		ss := s.Stats()
+		stats.PendingJobs += ss.PendingJobs
+		stats.ReadyBacklog += ss.ReadyBacklog
+		stats.CurrentSpokeJobs += ss.CurrentSpokeJobs
+		stats.Spokes += ss.Spokes
+		stats.RemovedJobs += ss.RemovedJobs
+		stats.RateLimit += ss.RateLimit
+		stats.RateBurst += ss.RateBurst
+		stats.RateTokens += ss.RateTokens
+		stats.Throttled = stats.Throttled || ss.Throttled
+		stats.ThrottledCount += ss.ThrottledCount
+		stats.MisfiredJobs += ss.MisfiredJobs
+		// Every shard sees the same jumps
+		if ss.ClockJumps > stats.ClockJumps {
+			stats.ClockJumps = ss.ClockJumps
+		}
+		stats.DeliveryPaused = stats.DeliveryPaused || ss.DeliveryPaused
+		stats.BodyBytes += ss.BodyBytes
+		stats.SpilledJobs += ss.SpilledJobs
+		stats.SpillBytes += ss.SpillBytes
+	}
+	stats.SpokeJobs = newSpokeDistribution(sizes)
+	stats.Restoring = !sh.life.isReady()
+	stats.Memory = sh.admission.Usage()
+	for _, a := range sh.sharedAdmissions {
+		stats.SharedMemory = append(stats.SharedMemory, a.Usage())
+	}
+	return stats
+}
+
+// Stop the sharded hub gracefully and if persist is true, then persist all jobs to disk for later recovery.
+// Like Hub.Stop, nothing is persisted if the restore didn't finish or failed.
+func (sh *ShardedHub) Stop(persist bool) {
+	restored := sh.life.shutdown()
+	for _, s := range sh.shards {
+		s.life.shutdown()
+	}
+	if persist && !restored {
+		logrus.Warn("ShardedHub:Stop restore didn't finish, leaving persisted jobs as they are")
+		persist = false
+	}
+	if err := sh.life.persistErr(); persist && err != nil {
+		logrus.WithError(sh.life.err).Warn("ShardedHub:Stop restore failed, leaving persisted jobs as they are")
+		persist = false
+	}
+	if persist {
+		logrus.Infof("ShardedHub:Stop Starting persistence for pid: %d", os.Getpid())
+		errC := sh.Persist()
+		errCount := 0
+		for range errC {
+			errCount++
+		}
+		logrus.Infof("ShardedHub:Stop Finished persistence with %d errors", errCount)
+	}
+	for _, s := range sh.shards {
+		s.closeStore()
+	}
+	logrus.Infof("ShardedHub:Stop stopped")
+}
+
+// Persist saves the jobs of all shards to the same persister
+func (sh *ShardedHub) Persist() chan error {
+	ec := make(chan error)
+	wg := &sync.WaitGroup{}
+	wg.Add(len(sh.shards))
+
+	var errCount int32
+	for _, s := range sh.shards {
+		go func(s *Hub) {
+			defer wg.Done()
+			for e := range s.Persist() {
+				atomic.AddInt32(&errCount, 1)
+				ec <- e
+			}
+		}(s)
+	}
+
+	go func() {
+		defer close(ec)
+		wg.Wait()
+		// Shards skip the commit - it only happens once all shards are saved
+		ctx := context.Background()
+		if err := sh.persister.Commit(ctx); err != nil {
+			ec <- err
+			return
+		}
+		r, ok := sh.persister.(persistence.SnapshotReporter)
+		if !ok || atomic.LoadInt32(&errCount) > 0 {
+			return
+		}
+		if err := backupSnapshot(ctx, sh.backup, r.SnapshotPath()); err != nil {
+			ec <- err
+		}
+	}()
+
+	return ec
+}
+
+// Checkpoint writes a snapshot of all shards right away and backs it up, like Persist
+func (sh *ShardedHub) Checkpoint() (CheckpointStats, error) {
+	if sh.persister == nil {
+		return CheckpointStats{}, ErrNoPersister
+	}
+	if !sh.IsReady() {
+		// Half restored jobs would replace the snapshot they come from
+		return CheckpointStats{}, ErrRestoring
+	}
+	if err := sh.life.persistErr(); err != nil {
+		return CheckpointStats{}, err
+	}
+	start := time.Now()
+	var last error
+	errCount := 0
+	for err := range sh.Persist() {
+		errCount++
+		last = err
+	}
+	stats := CheckpointStats{Jobs: sh.PendingJobsCount(), Duration: time.Since(start)}
+	if r, ok := sh.persister.(persistence.SnapshotReporter); ok {
+		stats.Path = r.SnapshotPath()
+	}
+	if errCount > 0 {
+		return stats, errors.Wrapf(last, "ShardedHub:Checkpoint failed with %d errors", errCount)
+	}
+	return stats, nil
+}
+
+// Restore loads any jobs saved to disk and hands each one to the shard that owns it
+func (sh *ShardedHub) Restore() error {
+	add := func(j *Job) error {
+		return sh.shardFor(j.id).restoreJob(j)
+	}
+	cancel := func(id string) error {
+		return sh.shardFor(id).replayRecord(persistence.Record{Kind: persistence.RecordCancel, ID: id})
+	}
+	// Sharded hubs have no batches or consumer groups to put them back in, the restore fails rather than drop them
+	state := func(r persistence.Record) error {
+		return errors.Errorf("ShardedHub:Restore cannot restore %s %s, sharded hubs have no batches or consumer groups", r.Kind, r.ID)
+	}
+	counts, err := readRecords(sh.persister, sh.life, add, cancel, state)
+	if err != nil {
+		return err
+	}
+	checkManifest(sh.persister, sh.shards[0].spokeSpan)
+	logrus.Infof("ShardedHub:Restore recovered %d entries", counts.recovered)
+	if sh.life.stopping() {
+		return errRestoreStopped
+	}
+	recoveryStats(sh.persister)
+	for _, s := range sh.shards {
+		s.releaseSettledBatches()
+	}
+
+	return restoreErr(counts.decodeErrs, counts.addErrs)
+}
+
+// sharedPersister lets all shards of a sharded hub write to one persister.
+// Writes are serialized and committing is left to the sharded hub.
+type sharedPersister struct {
+	persistence.Persister
+	lock *sync.Mutex
+}
+
+// Write stores a record, one shard at a time
+func (p *sharedPersister) Write(ctx context.Context, r persistence.Record) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.Persister.Write(ctx, r)
+}
+
+// Commit is a noop - the sharded hub commits once all shards are persisted
+func (p *sharedPersister) Commit(ctx context.Context) error {
+	return nil
+}
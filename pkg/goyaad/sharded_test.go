@@ -0,0 +1,136 @@
+package goyaad_test
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test sharded hub", func() {
+	var sh *ShardedHub
+	var clock *ManualClock
+
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+		clock = NewManualClock(time.Now())
+		var err error
+		sh, err = NewShardedHub(&ShardedHubOpts{
+			HubOpts: HubOpts{SpokeSpan: time.Millisecond * 5, Persister: persister, AttemptRestore: false, Clock: clock},
+			Shards:  4,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("hands out ready jobs in trigger order across shards", func() {
+		now := clock.Now()
+		jobs := []*Job{}
+		for i := 0; i < 200; i++ {
+			// Past and near future jobs, added out of order
+			j := NewJobAutoID(now.Add(time.Duration(i-100)*time.Millisecond/10), nil)
+			jobs = append(jobs, j)
+		}
+		for _, i := range rand.Perm(len(jobs)) {
+			Expect(sh.AddJob(jobs[i])).To(BeNil())
+		}
+		Expect(sh.PendingJobsCount()).To(Equal(200))
+
+		clock.Advance(15 * time.Millisecond)
+		for _, j := range jobs {
+			Expect(sh.Next().ID()).To(Equal(j.ID()))
+		}
+		Expect(sh.Next()).To(BeNil())
+		Expect(sh.PendingJobsCount()).To(Equal(0))
+	})
+
+	It("wakes up blocked readers for jobs added to any shard", func(done Done) {
+		defer close(done)
+
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(20 * time.Millisecond)
+			Expect(sh.AddJob(NewJob("late", clock.Now(), nil))).To(BeNil())
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		j, err := sh.NextWait(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.ID()).To(Equal("late"))
+
+		_, err = sh.NextForWait(ctx, "billing")
+		Expect(err).To(Equal(ErrGroupNotFound))
+	}, 1)
+
+	It("finds and cancels jobs on their shard", func() {
+		j := NewJobAutoID(time.Now().Add(time.Hour), nil)
+		Expect(sh.AddJob(j)).To(BeNil())
+
+		found, err := sh.FindJob(j.ID())
+		Expect(err).To(BeNil())
+		Expect(found.ID()).To(Equal(j.ID()))
+
+		Expect(sh.CancelJob(j.ID())).To(BeNil())
+		_, err = sh.FindJob(j.ID())
+		Expect(err).To(Equal(ErrJobNotFound))
+		Expect(sh.Stats().RemovedJobs).To(Equal(uint64(1)))
+	})
+
+	It("persists all shards and restores them", func(done Done) {
+		defer close(done)
+
+		for i := 0; i < 500; i++ {
+			triggerAt := time.Now().Add(time.Duration(rand.Intn(10000)-2000) * time.Millisecond)
+			Expect(sh.AddJob(NewJobAutoID(triggerAt, nil))).To(BeNil())
+		}
+		for e := range sh.Persist() {
+			Fail("Persist failed due to error: " + e.Error())
+		}
+
+		restored, err := NewShardedHub(&ShardedHubOpts{
+			HubOpts: HubOpts{SpokeSpan: time.Millisecond * 5, Persister: persister, AttemptRestore: false},
+			Shards:  3,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restored.Restore()).To(BeNil())
+		Expect(restored.PendingJobsCount()).To(Equal(500))
+	}, 15)
+
+	It("refuses a WAL, periodic checkpoints and job stores", func() {
+		wal, err := persistence.OpenWAL(dataDir, persistence.SyncNever, 0)
+		Expect(err).NotTo(HaveOccurred())
+		defer wal.Close()
+		for _, opts := range []HubOpts{
+			{Persister: persister, WAL: wal},
+			{Persister: persister, CheckpointInterval: time.Minute},
+			{Persister: persistence.NewKVPersister(dataDir, &persistence.KVOpts{})},
+		} {
+			_, err := NewShardedHub(&ShardedHubOpts{HubOpts: opts, Shards: 2})
+			Expect(errors.Cause(err)).To(Equal(ErrShardedPersistence))
+		}
+	})
+
+	It("fails to restore a snapshot with batches rather than drop them", func() {
+		h := NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persistence.NewJournalPersister(dataDir)})
+		Eventually(h.Ready()).Should(BeClosed())
+		j := NewJob("member", time.Now().Add(time.Hour), nil)
+		j.SetBatch(h.OpenBatch())
+		Expect(h.AddJob(j)).To(BeNil())
+		h.Stop(true)
+
+		restored, err := NewShardedHub(&ShardedHubOpts{
+			HubOpts: HubOpts{SpokeSpan: time.Second, Persister: persistence.NewJournalPersister(dataDir)},
+			Shards:  2,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restored.Restore()).NotTo(BeNil())
+		restored.Stop(false)
+	})
+})
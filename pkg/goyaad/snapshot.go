@@ -0,0 +1,123 @@
+package goyaad
+
+import (
+	"time"
+
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+// spokeView holds the jobs of a spoke as they were when a snapshot froze the spoke
+type spokeView struct {
+	jobs []*Job // Pinned copies, set once the spoke was preserved
+}
+
+// snapshot is a point in time view of the jobs of a hub. Spokes are frozen instead of copied when
+// the snapshot is taken, and only copied once they are about to change or once the snapshot gets to them.
+type snapshot struct {
+	spokes []*Spoke
+	views  []*spokeView
+	extra  []*Job               // Pinned copies of the jobs that aren't in any spoke
+	state  []persistence.Record // Batches and consumer groups, written before the jobs
+	cut    int                  // First WAL segment the snapshot doesn't cover
+	paused time.Duration
+}
+
+// preserve hands a copy of the jobs of s to the snapshot that froze s, before they change.
+// It is a noop for spokes that aren't frozen. Must be called with s locked.
+func (s *Spoke) preserve() {
+	if s.frozen == nil {
+		return
+	}
+	jobs := make([]*Job, 0, len(s.jobQueue))
+	for _, e := range s.jobQueue {
+		jobs = append(jobs, pinJob(e.job))
+	}
+	s.frozen.jobs = jobs
+	s.frozen = nil
+}
+
+// freeze takes a snapshot of the hub and cuts the WAL at the same point. Changes in flight finish
+// first, so every change is either in the snapshot or after the cut. The hub is locked for as
+// long as it takes to freeze its spokes, not to copy their jobs.
+func (h *Hub) freeze() (*snapshot, error) {
+	start := time.Now()
+	h.gate.Lock()
+	defer h.gate.Unlock()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	snap := &snapshot{}
+	if h.wal != nil {
+		cut, err := h.wal.Rotate()
+		if err != nil {
+			return nil, err
+		}
+		snap.cut = cut
+	}
+
+	freeze := func(s *Spoke) {
+		v := &spokeView{}
+		s.Lock()
+		s.frozen = v
+		s.Unlock()
+		snap.spokes = append(snap.spokes, s)
+		snap.views = append(snap.views, v)
+	}
+	freeze(h.pastSpoke)
+	for _, s := range h.spokeMap {
+		freeze(s)
+	}
+	for _, j := range h.groupBacklog() {
+		snap.extra = append(snap.extra, pinJob(j))
+	}
+	for _, c := range h.heldBatchCallbacks() {
+		snap.extra = append(snap.extra, pinJob(c))
+	}
+	snap.state = append(h.batchRecords(), h.groupRecords()...)
+	snap.paused = time.Since(start)
+	return snap, nil
+}
+
+// each hands the jobs of the snapshot to f, spoke by spoke, and lets go of them after.
+// Spokes that didn't change since the snapshot was taken are copied now.
+func (h *Hub) each(snap *snapshot, f func([]*Job)) {
+	for i, s := range snap.spokes {
+		v := snap.views[i]
+		h.lock.Lock()
+		s.Lock()
+		if s.frozen == v {
+			s.preserve()
+		}
+		s.Unlock()
+		h.lock.Unlock()
+
+		f(v.jobs)
+		unpinJobs(v.jobs)
+		v.jobs = nil
+	}
+	f(snap.extra)
+	unpinJobs(snap.extra)
+	snap.extra = nil
+}
+
+// pinJob returns a copy of j that stays readable after j changes or leaves the hub
+func pinJob(j *Job) *Job {
+	c := *j
+	if j.opts != nil {
+		opts := *j.opts
+		c.opts = &opts
+	}
+	if c.ref != nil {
+		c.ref.store.retain(c.ref)
+	}
+	return &c
+}
+
+// unpinJobs lets go of the bodies on disk that pinned copies kept
+func unpinJobs(jobs []*Job) {
+	for _, j := range jobs {
+		if j.ref != nil {
+			j.ref.store.release(j.ref)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package goyaad_test
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+// recordingBackup records the snapshots it is asked to back up
+type recordingBackup struct {
+	snapshots []string
+	err       error
+}
+
+func (b *recordingBackup) Backup(ctx context.Context, snapshot string) error {
+	b.snapshots = append(b.snapshots, snapshot)
+	return b.err
+}
+
+// heldPersister holds the first job it is given until released
+type heldPersister struct {
+	*persistence.JournalPersister
+	once    sync.Once
+	held    chan struct{}
+	release chan struct{}
+}
+
+func newHeldPersister() *heldPersister {
+	return &heldPersister{
+		JournalPersister: persistence.NewJournalPersister(dataDir).(*persistence.JournalPersister),
+		held:             make(chan struct{}),
+		release:          make(chan struct{}),
+	}
+}
+
+func (p *heldPersister) Write(ctx context.Context, r persistence.Record) error {
+	p.once.Do(func() {
+		close(p.held)
+		<-p.release
+	})
+	return p.JournalPersister.Write(ctx, r)
+}
+
+var _ = Describe("Test online snapshots", func() {
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+	})
+
+	It("writes the jobs as they were when it started while the hub keeps going", func(done Done) {
+		defer close(done)
+
+		p := newHeldPersister()
+		h := NewHub(&HubOpts{SpokeSpan: time.Second, Persister: p})
+		Expect(h.AddJob(NewJob("due", time.Now().Add(-time.Second), nil))).To(BeNil())
+		Expect(h.AddJob(NewJob("keep", time.Now().Add(time.Hour), []byte("body")))).To(BeNil())
+		Expect(h.AddJob(NewJob("cancel", time.Now().Add(time.Hour), nil))).To(BeNil())
+
+		statsC := make(chan CheckpointStats)
+		go func() {
+			defer GinkgoRecover()
+			stats, err := h.Checkpoint()
+			Expect(err).NotTo(HaveOccurred())
+			statsC <- stats
+		}()
+
+		// The snapshot is being written, the hub doesn't wait for it
+		<-p.held
+		Expect(h.AddJob(NewJob("new", time.Now().Add(time.Hour), nil))).To(BeNil())
+		Expect(h.CancelJob("cancel")).To(BeNil())
+		Expect(h.Next().ID()).To(Equal("due"))
+		close(p.release)
+
+		stats := <-statsC
+		Expect(stats.Jobs).To(Equal(3))
+		Expect(stats.Path).To(HavePrefix(path.Join(dataDir, "journal", "jobs-")))
+		Expect(h.PendingJobsCount()).To(Equal(2))
+		h.Stop(false)
+
+		restored := NewHub(&HubOpts{
+			SpokeSpan:      time.Second,
+			Persister:      persistence.NewJournalPersister(dataDir),
+			AttemptRestore: true,
+		})
+		Eventually(restored.Ready()).Should(BeClosed())
+		Expect(restored.PendingJobsCount()).To(Equal(3))
+		for _, id := range []string{"due", "keep", "cancel"} {
+			_, err := restored.FindJob(id)
+			Expect(err).NotTo(HaveOccurred(), id)
+		}
+		_, err := restored.FindJob("new")
+		Expect(err).To(Equal(ErrJobNotFound))
+		j, err := restored.FindJob("keep")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.Body()).To(Equal([]byte("body")))
+		restored.Stop(false)
+	}, 5)
+
+	It("backs up the snapshot written on stop", func() {
+		b := &recordingBackup{}
+		h := NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persister, Backup: b})
+		Expect(h.AddJob(NewJob("a", time.Now().Add(time.Hour), nil))).To(BeNil())
+		h.Stop(true)
+		Expect(b.snapshots).To(HaveLen(1))
+		Expect(b.snapshots[0]).To(Equal(persister.(persistence.SnapshotReporter).SnapshotPath()))
+
+		// Not after a failed snapshot
+		b.err = errors.New("unreachable")
+		h = NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persister, Backup: b})
+		for e := range h.Persist() {
+			Expect(e).To(Equal(b.err))
+		}
+		Expect(b.snapshots).To(HaveLen(2))
+		h.Stop(false)
+	})
+
+	It("restores without the jobs a snapshot cancels", func() {
+		ctx := context.Background()
+		for _, id := range []string{"a", "b"} {
+			r, err := NewJob(id, time.Now().Add(time.Hour), nil).Record()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(persister.Write(ctx, r)).To(Succeed())
+		}
+		Expect(persister.Write(ctx, persistence.Record{Kind: persistence.RecordCancel, ID: "a"})).To(Succeed())
+		Expect(persister.Write(ctx, persistence.Record{Kind: persistence.RecordCheckpoint, TriggerAt: time.Now()})).To(Succeed())
+		Expect(persister.Commit(ctx)).To(Succeed())
+
+		h := NewHub(&HubOpts{SpokeSpan: time.Second, Persister: persistence.NewJournalPersister(dataDir), AttemptRestore: true})
+		Eventually(h.Ready()).Should(BeClosed())
+		Expect(h.RestoreErr()).NotTo(HaveOccurred())
+		Expect(h.PendingJobsCount()).To(Equal(1))
+		_, err := h.FindJob("b")
+		Expect(err).NotTo(HaveOccurred())
+		h.Stop(false)
+	})
+
+	It("refuses snapshots without a persister", func() {
+		h := NewHub(&HubOpts{SpokeSpan: time.Second})
+		_, err := h.Checkpoint()
+		Expect(err).To(MatchError(ContainSubstring(ErrNoPersister.Error())))
+		h.Stop(false)
+	})
+})
@@ -1,7 +1,7 @@
 package goyaad
 
 import (
-	"container/heap"
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -16,8 +16,11 @@ import (
 type Spoke struct {
 	id uuid.UUID
 	SpokeBound
-	jobMap   *sync.Map     // Provides quicker lookup of jobs owned by this spoke
-	jobQueue PriorityQueue // Orders the jobs by trigger priority
+	jobMap   map[string]*Job // Provides quicker lookup of jobs owned by this spoke, guarded by lock
+	jobQueue jobHeap         // Orders the jobs by trigger time
+	arena    *bodyArena      // Packs job bodies into shared slabs if the hub asked for it
+	clock    Clock           // Decides when jobs are ready
+	frozen   *spokeView      // Snapshot waiting for the jobs as they were when it froze the spoke
 
 	lock *sync.Mutex
 }
@@ -35,14 +38,17 @@ func NewSpokeFromNow(duration time.Duration) *Spoke {
 	return NewSpoke(now, now.Add(duration))
 }
 
-// NewSpoke creates a new spoke to hold jobs
+// NewSpoke creates a new spoke to hold jobs on the system clock
 func NewSpoke(start, end time.Time) *Spoke {
-	jq := PriorityQueue{}
-	heap.Init(&jq)
+	return NewSpokeWithClock(start, end, SystemClock)
+}
+
+// NewSpokeWithClock creates a new spoke to hold jobs that become ready according to clock
+func NewSpokeWithClock(start, end time.Time, clock Clock) *Spoke {
 	return &Spoke{id: uuid.NewV4(),
-		jobMap:     &sync.Map{},
-		jobQueue:   jq,
+		jobMap:     make(map[string]*Job),
 		SpokeBound: SpokeBound{start, end},
+		clock:      clock,
 		lock:       &sync.Mutex{}}
 }
 
@@ -63,7 +69,7 @@ func (s *Spoke) Unlock() {
 
 // AsTemporalState returns the spoke's temporal classification at the point in time
 func (s *Spoke) AsTemporalState() TemporalState {
-	now := time.Now()
+	now := s.clock.Now()
 	switch {
 	case s.end.Before(now):
 		return Past
@@ -83,63 +89,100 @@ func (s *Spoke) AddJob(j *Job) error {
 	logrus.WithFields(
 		logrus.Fields{
 			"jobID":        j.id,
-			"jobTriggerAt": j.triggerAt.UnixNano(),
+			"jobTriggerAt": j.triggerAt,
 			"spokeID":      s.id,
 			"spokeStart":   s.start.UnixNano(),
 			"spokeEnd":     s.end.UnixNano(),
 		}).Trace("Accepting job")
-	s.jobMap.Store(j.id, true)
-	heap.Push(&s.jobQueue, j.AsPriorityItem())
+	s.preserve()
+	s.jobMap[j.id] = j
+	s.jobQueue.push(j)
 	return nil
 }
 
 // Next returns the next ready job
 func (s *Spoke) Next() *Job {
-	if s.jobQueue.Len() == 0 {
-		return nil
-	}
-	// Peek
-	i := s.jobQueue.AtIdx(0)
-	if i == nil {
+	j := s.jobQueue.peek()
+	if j == nil {
 		return nil
 	}
 
-	j := i.value.(*Job)
-	switch j.AsTemporalState() {
+	switch j.stateAt(s.clock.Now()) {
 	case Past, Current:
 		// pop from queue
-		s.jobMap.Delete(j.id)
-		heap.Pop(&s.jobQueue)
+		s.preserve()
+		delete(s.jobMap, j.id)
+		s.jobQueue.pop()
 		return j
 	default:
 		return nil
 	}
 }
 
+// peek returns the next ready job without removing it
+func (s *Spoke) peek() *Job {
+	j := s.jobQueue.peek()
+	if j == nil || j.stateAt(s.clock.Now()) == Future {
+		return nil
+	}
+	return j
+}
+
 // CancelJob will try to delete a job that hasn't been consumed yet
 func (s *Spoke) CancelJob(id string) error {
+	_, err := s.cancelJob(id)
+	return err
+}
+
+// cancelJob deletes a job that hasn't been consumed yet and returns it
+func (s *Spoke) cancelJob(id string) (*Job, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	if _, ok := s.jobMap.Load(id); ok {
-		s.jobMap.Delete(id)
+	if _, ok := s.jobMap[id]; ok {
+		s.preserve()
+		delete(s.jobMap, id)
 		// Also delete from pq
-		for i, j := range s.jobQueue {
-			if j.value.(*Job).id == id {
-				heap.Remove(&s.jobQueue, i)
-				return nil
+		for i, e := range s.jobQueue {
+			if e.job.id == id {
+				return s.jobQueue.remove(i), nil
 			}
 		}
 	}
-	return fmt.Errorf("Cannot find job to cancel")
+	return nil, fmt.Errorf("Cannot find job to cancel")
+}
+
+// moveJobsTo hands over all jobs of this spoke to dst regardless of dst's bounds
+// and returns the number of jobs moved. Both spokes must be locked by the caller.
+func (s *Spoke) moveJobsTo(dst *Spoke) int {
+	s.preserve()
+	dst.preserve()
+	moved := s.jobQueue.Len()
+	for _, e := range s.jobQueue {
+		dst.jobMap[e.job.id] = e.job
+		dst.jobQueue.push(e.job)
+	}
+	s.jobMap = make(map[string]*Job)
+	s.jobQueue = nil
+	return moved
 }
 
 // OwnsJob returns true if a job by given id is owned by this spoke
 func (s *Spoke) OwnsJob(id string) bool {
-	_, ok := s.jobMap.Load(id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.jobMap[id]
 	return ok
 }
 
+// FindJob returns the job with the given id if it is owned by this spoke
+func (s *Spoke) FindJob(id string) (*Job, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	j, ok := s.jobMap[id]
+	return j, ok
+}
+
 // PendingJobsLen returns the number of jobs remaining in this spoke
 func (s *Spoke) PendingJobsLen() int {
 	return s.jobQueue.Len()
@@ -156,13 +199,16 @@ func (s *Spoke) AsPriorityItem() *Item {
 }
 
 // Persist all jobs in this spoke
-func (s *Spoke) Persist(p persistence.Persister) chan error {
+func (s *Spoke) Persist(ctx context.Context, w persistence.Writer) chan error {
 	errC := make(chan error)
 	go func() {
 		defer close(errC)
 		var i = 0
 		for i = 0; i < s.jobQueue.Len(); i++ {
-			err := p.Persist(s.jobQueue.AtIdx(i).Value().(*Job))
+			r, err := s.jobQueue[i].job.Record()
+			if err == nil {
+				err = w.Write(ctx, r)
+			}
 			if err != nil {
 				errC <- err
 				continue
@@ -0,0 +1,312 @@
+package goyaad
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+)
+
+const (
+	// A spoke is at most 1/adaptiveSpanRatio as wide as it is far from now
+	adaptiveSpanRatio = 4
+	// Default job limit for a spoke before it is split
+	defaultMaxSpokeJobs = 10000
+)
+
+// SpokeDistribution describes how jobs are spread over the spokes of a hub
+type SpokeDistribution struct {
+	Min     int           // Fewest jobs in a spoke
+	P50     int           // Median jobs per spoke
+	P90     int           // 90th percentile of jobs per spoke
+	P99     int           // 99th percentile of jobs per spoke
+	Max     int           // Most jobs in a spoke
+	MinSpan time.Duration // Narrowest spoke
+	MaxSpan time.Duration // Widest spoke
+}
+
+type spokeSize struct {
+	jobs int
+	span time.Duration
+}
+
+func newSpokeDistribution(sizes []spokeSize) SpokeDistribution {
+	d := SpokeDistribution{}
+	if len(sizes) == 0 {
+		return d
+	}
+
+	jobs := make([]int, len(sizes))
+	d.MinSpan, d.MaxSpan = sizes[0].span, sizes[0].span
+	for i, s := range sizes {
+		jobs[i] = s.jobs
+		if s.span < d.MinSpan {
+			d.MinSpan = s.span
+		}
+		if s.span > d.MaxSpan {
+			d.MaxSpan = s.span
+		}
+	}
+	sort.Ints(jobs)
+	percentile := func(p int) int {
+		return jobs[(len(jobs)-1)*p/100]
+	}
+	d.Min, d.P50, d.P90, d.P99, d.Max = jobs[0], percentile(50), percentile(90), percentile(99), jobs[len(jobs)-1]
+	return d
+}
+
+// spokeSizes returns the size of every spoke, excluding the past spoke.
+// Must be called with the hub locked.
+func (h *Hub) spokeSizes() []spokeSize {
+	sizes := make([]spokeSize, 0, len(h.spokeMap))
+	for b, s := range h.spokeMap {
+		sizes = append(sizes, spokeSize{s.PendingJobsLen(), b.end.Sub(b.start)})
+	}
+	return sizes
+}
+
+// lockedSpokeSizes returns the size of every spoke, excluding the past spoke
+func (h *Hub) lockedSpokeSizes() []spokeSize {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.spokeSizes()
+}
+
+// adaptive returns true if the hub picks spoke spans based on distance and density
+func (h *Hub) adaptive() bool {
+	return h.maxSpokeSpan > h.spokeSpan
+}
+
+// spanFor returns the spoke span for jobs the given distance away from now.
+// Spans double from SpokeSpan as jobs get further away, up to MaxSpokeSpan.
+func (h *Hub) spanFor(distance time.Duration) time.Duration {
+	span := h.spokeSpan
+	for span*2 <= h.maxSpokeSpan && span*2*adaptiveSpanRatio <= distance {
+		span *= 2
+	}
+	return span
+}
+
+// spokeFor returns the spoke that should take j or, if there is none, the bounds for a new one.
+// Must be called with the hub locked.
+func (h *Hub) spokeFor(j *Job) (SpokeBound, *Spoke, bool) {
+	if !h.adaptive() {
+		jobBound := j.AsBound(h.spokeSpan)
+		candidate, ok := h.spokeMap[jobBound]
+		return jobBound, candidate, ok
+	}
+
+	// First spoke that starts after the job
+	i := sort.Search(len(h.spokeIndex), func(i int) bool {
+		return h.spokeIndex[i].start.UnixNano() > j.triggerAt
+	})
+	if i > 0 && h.spokeIndex[i-1].ContainsJob(j) {
+		return h.spokeIndex[i-1].SpokeBound, h.spokeIndex[i-1], true
+	}
+
+	span := h.spanFor(j.TriggerAt().Sub(h.clock.Now()))
+	b := SpokeBound{start: j.TriggerAt().Truncate(span)}
+	b.end = b.start.Add(span)
+	// Clip to the neighbours so that spokes never overlap
+	if i > 0 && h.spokeIndex[i-1].end.After(b.start) {
+		b.start = h.spokeIndex[i-1].end
+	}
+	if i < len(h.spokeIndex) && h.spokeIndex[i].start.Before(b.end) {
+		b.end = h.spokeIndex[i].start
+	}
+	return b, nil, false
+}
+
+// indexSpoke adds s to the ordered spoke index. Must be called with the hub locked.
+func (h *Hub) indexSpoke(s *Spoke) {
+	if !h.adaptive() {
+		return
+	}
+	i := sort.Search(len(h.spokeIndex), func(i int) bool {
+		return h.spokeIndex[i].start.After(s.start)
+	})
+	h.spokeIndex = append(h.spokeIndex, nil)
+	copy(h.spokeIndex[i+1:], h.spokeIndex[i:])
+	h.spokeIndex[i] = s
+}
+
+// forgetSpoke drops s from the spoke lookups. Must be called with the hub locked.
+func (h *Hub) forgetSpoke(s *Spoke) {
+	delete(h.spokeMap, s.SpokeBound)
+	if !h.adaptive() {
+		return
+	}
+	i := sort.Search(len(h.spokeIndex), func(i int) bool {
+		return !h.spokeIndex[i].start.Before(s.start)
+	})
+	if i < len(h.spokeIndex) && h.spokeIndex[i] == s {
+		h.spokeIndex = append(h.spokeIndex[:i], h.spokeIndex[i+1:]...)
+	}
+}
+
+// rebalanceable returns true if s can be split or merged - spokes that are or are
+// about to become current are left alone. Must be called with the hub locked.
+func (h *Hub) rebalanceable(s *Spoke) bool {
+	return s != h.currentSpoke && s.AsTemporalState() == Future
+}
+
+// splitIfFull splits s if it grew past the job limit. Must be called with the hub locked.
+func (h *Hub) splitIfFull(s *Spoke) {
+	if !h.adaptive() || s.PendingJobsLen() <= h.maxSpokeJobs || !h.rebalanceable(s) {
+		return
+	}
+	pieces := h.split(s, s.end.Sub(s.start))
+	if len(pieces) == 1 {
+		// Already as narrow as spokes get
+		return
+	}
+	h.replaceSpokes([]*Spoke{s}, pieces)
+	logrus.Debugf("Split full spoke %s into %d spokes", s.ID(), len(pieces))
+	go metrics.Incr("hub.spoke.split")
+}
+
+// split halves s until every piece is at most maxSpan wide and holds at most the job limit,
+// or can't be split any further. Empty pieces are dropped.
+func (h *Hub) split(s *Spoke, maxSpan time.Duration) []*Spoke {
+	span := s.end.Sub(s.start)
+	if s.PendingJobsLen() == 0 {
+		return nil
+	}
+	if (span <= maxSpan && s.PendingJobsLen() <= h.maxSpokeJobs) || span/2 < h.spokeSpan {
+		return []*Spoke{s}
+	}
+
+	mid := s.start.Add(span / 2)
+	left, right := h.newSpoke(s.start, mid), h.newSpoke(mid, s.end)
+	s.Lock()
+	// The jobs live on in the pieces
+	s.preserve()
+	for _, e := range s.jobQueue {
+		j := e.job
+		if left.ContainsJob(j) {
+			left.AddJob(j)
+		} else {
+			right.AddJob(j)
+		}
+	}
+	s.Unlock()
+	return append(h.split(left, maxSpan), h.split(right, maxSpan)...)
+}
+
+// merge moves the jobs of a and b into a new spoke covering both
+func merge(a, b *Spoke) *Spoke {
+	m := NewSpokeWithClock(a.start, b.end, a.clock)
+	a.Lock()
+	a.moveJobsTo(m)
+	a.Unlock()
+	b.Lock()
+	b.moveJobsTo(m)
+	b.Unlock()
+	return m
+}
+
+// replaceSpokes swaps the old spokes for the pieces they were split or merged into.
+// Must be called with the hub locked.
+func (h *Hub) replaceSpokes(old, pieces []*Spoke) {
+	for _, s := range old {
+		h.forgetSpoke(s)
+	}
+	for _, s := range pieces {
+		h.spokeMap[s.SpokeBound] = s
+		h.indexSpoke(s)
+	}
+	h.rebuildSpokeQueue()
+}
+
+// rebuildSpokeQueue refills the spoke queue from the spoke index. Must be called with the hub locked.
+func (h *Hub) rebuildSpokeQueue() {
+	spokes := make(PriorityQueue, 0, len(h.spokeIndex))
+	for _, s := range h.spokeIndex {
+		if s != h.currentSpoke {
+			spokes = append(spokes, s.AsPriorityItem())
+		}
+	}
+	*h.spokes = spokes
+	heap.Init(h.spokes)
+}
+
+// Rebalance adapts future spokes to how far away and how full they are: spokes too wide for their
+// distance from now or over the job limit are split, adjacent sparse spokes are merged and empty
+// spokes are dropped. It is a noop unless the hub has adaptive spoke spans.
+func (h *Hub) Rebalance() {
+	if !h.adaptive() {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := h.clock.Now()
+	splits, merges, dropped := 0, 0, 0
+	spokes := make([]*Spoke, 0, len(h.spokeIndex))
+	for _, s := range h.spokeIndex {
+		if !h.rebalanceable(s) {
+			spokes = append(spokes, s)
+			continue
+		}
+		pieces := h.split(s, h.spanFor(s.start.Sub(now)))
+		switch {
+		case len(pieces) == 0:
+			dropped++
+		case len(pieces) > 1:
+			splits++
+		}
+		spokes = append(spokes, pieces...)
+	}
+
+	merged := make([]*Spoke, 0, len(spokes))
+	for _, s := range spokes {
+		if n := len(merged); n > 0 {
+			prev := merged[n-1]
+			if h.rebalanceable(prev) && h.rebalanceable(s) &&
+				prev.PendingJobsLen()+s.PendingJobsLen() <= h.maxSpokeJobs/2 &&
+				s.end.Sub(prev.start) <= h.spanFor(prev.start.Sub(now)) {
+				merged[n-1] = merge(prev, s)
+				merges++
+				continue
+			}
+		}
+		merged = append(merged, s)
+	}
+
+	if splits+merges+dropped == 0 {
+		return
+	}
+	h.spokeIndex = merged
+	h.spokeMap = make(map[SpokeBound]*Spoke, len(merged))
+	for _, s := range merged {
+		h.spokeMap[s.SpokeBound] = s
+	}
+	h.rebuildSpokeQueue()
+	logrus.WithFields(logrus.Fields{
+		"splits":  splits,
+		"merges":  merges,
+		"dropped": dropped,
+		"spokes":  len(h.spokeIndex),
+	}).Debug("Hub: rebalanced spokes")
+	go metrics.Incr("hub.spoke.rebalance")
+}
+
+// rebalancer rebalances the spokes of an adaptive hub periodically until the hub is stopped
+func (h *Hub) rebalancer() {
+	interval := h.spokeSpan
+	if interval < time.Second {
+		interval = time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.life.stop:
+			return
+		case <-t.C:
+			h.Rebalance()
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package goyaad_test
+
+import (
+	"math/rand"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test adaptive spokes", func() {
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+	})
+
+	newHub := func(minSpan, maxSpan time.Duration, maxJobs int) *Hub {
+		return NewHub(&HubOpts{
+			SpokeSpan:      minSpan,
+			MaxSpokeSpan:   maxSpan,
+			MaxSpokeJobs:   maxJobs,
+			Persister:      persister,
+			AttemptRestore: false})
+	}
+
+	It("uses wide spokes far in the future", func() {
+		h := newHub(time.Second, time.Hour, 0)
+		start := time.Now().Add(10 * time.Hour)
+		for i := 0; i < 100; i++ {
+			Expect(h.AddJob(NewJobAutoID(start.Add(time.Duration(i)*36*time.Second), nil))).To(BeNil())
+		}
+
+		stats := h.Stats()
+		Expect(stats.PendingJobs).To(Equal(100))
+		Expect(stats.Spokes).To(BeNumerically("<=", 3))
+		Expect(stats.SpokeJobs.MaxSpan).To(BeNumerically(">", 30*time.Minute))
+		Expect(stats.SpokeJobs.Max).To(BeNumerically(">=", 34))
+	})
+
+	It("splits spokes that grow past the job limit", func() {
+		h := newHub(time.Millisecond, time.Hour, 50)
+		start := time.Now().Add(10 * time.Minute)
+		for i := 0; i < 500; i++ {
+			Expect(h.AddJob(NewJobAutoID(start.Add(time.Duration(rand.Intn(60000))*time.Millisecond), nil))).To(BeNil())
+		}
+
+		stats := h.Stats()
+		Expect(stats.PendingJobs).To(Equal(500))
+		Expect(stats.Spokes).To(BeNumerically(">=", 10))
+		Expect(stats.SpokeJobs.Max).To(BeNumerically("<=", 50))
+		Expect(stats.SpokeJobs.MinSpan).To(BeNumerically(">=", time.Millisecond))
+	})
+
+	It("merges sparse neighbours and drops empty spokes", func() {
+		h := newHub(time.Millisecond, time.Hour, 20)
+		start := time.Now().Add(10 * time.Minute)
+		jobs := []*Job{}
+		for i := 0; i < 400; i++ {
+			j := NewJobAutoID(start.Add(time.Duration(i)*100*time.Millisecond), nil)
+			Expect(h.AddJob(j)).To(BeNil())
+			jobs = append(jobs, j)
+		}
+		before := h.Stats().Spokes
+		Expect(before).To(BeNumerically(">=", 20))
+
+		for i, j := range jobs {
+			if i%40 != 0 {
+				Expect(h.CancelJob(j.ID())).To(BeNil())
+			}
+		}
+		h.Rebalance()
+
+		stats := h.Stats()
+		Expect(stats.PendingJobs).To(Equal(10))
+		Expect(stats.Spokes).To(BeNumerically("<", before/4))
+		Expect(stats.SpokeJobs.Min).To(BeNumerically(">", 0))
+	})
+
+	It("keeps delivery order while spokes split and merge", func(done Done) {
+		defer close(done)
+
+		h := newHub(time.Millisecond, 100*time.Millisecond, 20)
+		start := time.Now().Add(50 * time.Millisecond)
+		for i := 0; i < 500; i++ {
+			Expect(h.AddJob(NewJobAutoID(start.Add(time.Duration(rand.Intn(300000))*time.Microsecond), nil))).To(BeNil())
+		}
+
+		var last time.Time
+		for received := 0; received < 500; {
+			if rand.Intn(10) == 0 {
+				h.Rebalance()
+			}
+			j := h.Next()
+			if j == nil {
+				continue
+			}
+			Expect(j.TriggerAt().Before(last)).To(BeFalse())
+			last = j.TriggerAt()
+			received++
+		}
+		Expect(h.PendingJobsCount()).To(Equal(0))
+	}, 5)
+})
@@ -25,7 +25,7 @@ func (sb *SpokeBound) Contains(o *SpokeBound) bool {
 
 // ContainsJob returns true if this job is bounded by this spoke
 func (sb *SpokeBound) ContainsJob(j *Job) bool {
-	return sb.start.Sub(j.triggerAt) <= 0 && sb.end.After(j.triggerAt)
+	return sb.start.UnixNano() <= j.triggerAt && j.triggerAt < sb.end.UnixNano()
 }
 
 // IsReady returns true if SpokeBound started in the past
@@ -36,5 +36,10 @@ func (sb *SpokeBound) IsReady() bool {
 
 // IsExpired returns true if SpokeBound ended in the past
 func (sb *SpokeBound) IsExpired() bool {
-	return time.Now().After(sb.end)
+	return sb.expiredAt(time.Now())
+}
+
+// expiredAt returns true if SpokeBound ended before now
+func (sb *SpokeBound) expiredAt(now time.Time) bool {
+	return now.After(sb.end)
 }
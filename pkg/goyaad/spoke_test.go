@@ -2,6 +2,7 @@ package goyaad_test
 
 import (
 	"container/heap"
+	"context"
 	"math/rand"
 	"os"
 	"path"
@@ -67,7 +68,8 @@ var _ = Describe("Test spokes", func() {
 		})
 
 		It("walks spoke with jobs", func() {
-			s := NewSpokeFromNow(time.Hour * 1)
+			clock := NewManualClock(time.Now())
+			s := NewSpokeWithClock(clock.Now(), clock.Now().Add(time.Hour), clock)
 
 			for i := 0; i < 10; i++ {
 				j := NewJobAutoID(s.Start().Add(time.Nanosecond*time.Duration(rand.Intn(900))), nil)
@@ -76,7 +78,7 @@ var _ = Describe("Test spokes", func() {
 			Expect(s.PendingJobsLen()).To(Equal(10))
 
 			// Wait for all jobs to be ready
-			time.Sleep(time.Second * 1)
+			clock.Advance(time.Second)
 
 			jobs := []*Job{}
 			for s.PendingJobsLen() > 0 {
@@ -91,7 +93,8 @@ var _ = Describe("Test spokes", func() {
 		})
 
 		It("repeated walks spoke with jobs as they expire", func() {
-			s := NewSpokeFromNow(time.Hour * 1)
+			clock := NewManualClock(time.Now())
+			s := NewSpokeWithClock(clock.Now(), clock.Now().Add(time.Hour), clock)
 
 			// Add some jobs < 1 sec triggerAt
 			for i := 0; i < 10; i++ {
@@ -106,8 +109,8 @@ var _ = Describe("Test spokes", func() {
 			}
 			Expect(s.PendingJobsLen()).To(Equal(20))
 
-			// Wait for all jobs to be ready
-			time.Sleep(time.Second)
+			// Wait for the first jobs to be ready
+			clock.Advance(time.Second)
 
 			jobs := []*Job{}
 			for s.PendingJobsLen() > 10 {
@@ -171,7 +174,7 @@ var _ = Describe("Test spokes", func() {
 			p := persistence.NewJournalPersister(persistenceTestDir)
 			Expect(p.ResetDataDir()).To(BeNil())
 
-			errC := s.Persist(p)
+			errC := s.Persist(context.Background(), p)
 			Eventually(errC).ShouldNot(Receive())
 		})
 	})
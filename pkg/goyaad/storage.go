@@ -0,0 +1,293 @@
+package goyaad
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+)
+
+// StorageMode decides where a hub keeps job bodies
+type StorageMode int
+
+const (
+	// StorageInMemory keeps every job body in memory
+	StorageInMemory StorageMode = iota
+	// StorageLazy spills the bodies of far future spokes and of big ready backlogs to disk
+	// and pages them back in as their spoke approaches current
+	StorageLazy
+	// StorageMapped keeps every job body on disk and reads it back when the job is delivered
+	StorageMapped
+)
+
+// Default distance beyond which lazy storage spills spokes to disk
+const defaultSpillHorizon = time.Hour
+
+var storageModes = map[string]StorageMode{
+	"memory": StorageInMemory,
+	"lazy":   StorageLazy,
+	"mapped": StorageMapped,
+}
+
+// ParseStorageMode parses "memory", "lazy" or "mapped"
+func ParseStorageMode(s string) (StorageMode, error) {
+	m, ok := storageModes[strings.ToLower(s)]
+	if !ok {
+		return StorageInMemory, errors.Errorf("Unknown storage mode %q", s)
+	}
+	return m, nil
+}
+
+func (m StorageMode) String() string {
+	for name, mode := range storageModes {
+		if mode == m {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// spill moves the body of j to disk. Returns false if the body stays in memory.
+func (h *Hub) spill(j *Job) bool {
+	if h.store == nil || j.ref != nil || len(j.body) == 0 {
+		return false
+	}
+	ref, err := h.store.put(j.id, j.body)
+	if err != nil {
+		logrus.WithError(err).WithField("jobID", j.id).Error("Hub: cannot spill job body, keeping it in memory")
+		go metrics.Incr("hub.storage.spill.error")
+		return false
+	}
+	h.account(0, -int64(len(j.body)))
+	atomic.AddInt64(&h.spilledJobs, 1)
+	j.body, j.ref = nil, ref
+	return true
+}
+
+// pageIn reads the body of a spilled job back into memory. Returns false if it can't be read.
+func (h *Hub) pageIn(j *Job) bool {
+	if j.ref == nil {
+		return true
+	}
+	body, err := j.ref.store.get(j.ref)
+	if err != nil {
+		logrus.WithError(err).WithField("jobID", j.id).Error("Hub: cannot page in job body")
+		go metrics.Incr("hub.storage.pagein.error")
+		return false
+	}
+	h.dropRef(j)
+	j.body = body
+	h.account(0, int64(len(body)))
+	return true
+}
+
+// pageInFrom pages in the body of a spilled job, taking it from bodies read ahead if it is there
+func (h *Hub) pageInFrom(j *Job, bodies map[string][]byte) bool {
+	body, ok := bodies[j.id]
+	if !ok || j.ref == nil {
+		return h.pageIn(j)
+	}
+	h.dropRef(j)
+	j.body = body
+	h.account(0, int64(len(body)))
+	return true
+}
+
+// dropRef forgets the on-disk body of j
+func (h *Hub) dropRef(j *Job) {
+	j.ref.store.release(j.ref)
+	j.ref = nil
+	atomic.AddInt64(&h.spilledJobs, -1)
+}
+
+// admit accounts for a job that was just added to spoke s and spills it if the storage mode says so.
+// Jobs that were reserved room for take it. Bodies that stay in memory are packed into the spoke's arena, if any.
+// Must be called with s locked.
+func (h *Hub) admit(j *Job, s *Spoke, reserved bool) {
+	if reserved {
+		h.claim(j)
+	} else {
+		h.account(1, int64(len(j.body)))
+	}
+	h.keys.add(j)
+	switch h.storageMode {
+	case StorageMapped:
+		h.spill(j)
+	case StorageLazy:
+		if s != h.pastSpoke && s.start.Sub(h.clock.Now()) > h.spillHorizon {
+			h.spill(j)
+		}
+	}
+	h.packBody(j, s)
+}
+
+// checkout pages in the body of a job that is leaving the hub to be delivered
+func (h *Hub) checkout(j *Job) {
+	h.keys.remove(j)
+	if j.ref != nil && !h.pageIn(j) {
+		// Deliver the job without its body rather than keep a job we can't read
+		h.dropRef(j)
+		h.account(-1, 0)
+		return
+	}
+	h.account(-1, -int64(len(j.body)))
+}
+
+// discard accounts for a job that is leaving the hub without being delivered
+func (h *Hub) discard(j *Job) {
+	h.keys.remove(j)
+	if j.ref != nil {
+		h.dropRef(j)
+		h.account(-1, 0)
+		return
+	}
+	h.account(-1, -int64(len(j.body)))
+}
+
+// spokeBodyBytes returns the bytes of job bodies s holds in memory. Must be called with s locked.
+func spokeBodyBytes(s *Spoke) int64 {
+	var n int64
+	for _, e := range s.jobQueue {
+		n += int64(len(e.job.body))
+	}
+	return n
+}
+
+func (h *Hub) tierInterval() time.Duration {
+	if h.spokeSpan < time.Second {
+		return time.Second
+	}
+	return h.spokeSpan
+}
+
+// Tier moves job bodies between memory and disk for lazy storage: bodies of spokes about to become
+// current are paged in, with a range scan of the spoke if they are in a job store, spokes beyond the spill horizon are spilled, the furthest spokes are spilled
+// while bodies in memory exceed the memory budget and the latest ready jobs are spilled while the
+// past spoke exceeds its budget. It is a noop for other storage modes.
+func (h *Hub) Tier() {
+	if h.storageMode != StorageLazy || h.store == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := h.clock.Now()
+	lead := 2 * h.tierInterval()
+	pagedIn, spilled := 0, 0
+
+	spokes := make([]*Spoke, 0, len(h.spokeMap))
+	for _, s := range h.spokeMap {
+		spokes = append(spokes, s)
+	}
+	// Furthest first
+	sort.Slice(spokes, func(i, k int) bool {
+		return spokes[i].start.After(spokes[k].start)
+	})
+
+	for _, s := range spokes {
+		distance := s.start.Sub(now)
+		var bodies map[string][]byte
+		if distance <= lead {
+			bodies = h.scanSpoke(s)
+		}
+		s.Lock()
+		for _, e := range s.jobQueue {
+			j := e.job
+			switch {
+			case distance <= lead && j.ref != nil:
+				s.preserve()
+				if h.pageInFrom(j, bodies) {
+					pagedIn++
+				}
+			case distance > h.spillHorizon && j.ref == nil:
+				s.preserve()
+				if h.spill(j) {
+					spilled++
+				}
+			}
+		}
+		s.Unlock()
+	}
+
+	if h.memoryBudget > 0 {
+		for _, s := range spokes {
+			if atomic.LoadInt64(&h.bodyBytes) <= h.memoryBudget || s.start.Sub(now) <= lead {
+				break
+			}
+			s.Lock()
+			for _, e := range s.jobQueue {
+				if e.job.ref != nil {
+					continue
+				}
+				s.preserve()
+				if h.spill(e.job) {
+					spilled++
+				}
+			}
+			s.Unlock()
+		}
+	}
+
+	if h.pastSpokeBudget > 0 {
+		h.pastSpoke.Lock()
+		if inMem := spokeBodyBytes(h.pastSpoke); inMem > h.pastSpokeBudget {
+			h.pastSpoke.preserve()
+			// Keep the jobs that will be delivered first in memory
+			jobs := make([]*Job, 0, h.pastSpoke.jobQueue.Len())
+			for _, e := range h.pastSpoke.jobQueue {
+				jobs = append(jobs, e.job)
+			}
+			sort.Slice(jobs, func(i, k int) bool {
+				return jobs[i].triggerAt > jobs[k].triggerAt
+			})
+			for _, j := range jobs {
+				if inMem <= h.pastSpokeBudget {
+					break
+				}
+				n := int64(len(j.body))
+				if h.spill(j) {
+					inMem -= n
+					spilled++
+				}
+			}
+		}
+		h.pastSpoke.Unlock()
+	}
+
+	if pagedIn+spilled > 0 {
+		logrus.WithFields(logrus.Fields{
+			"pagedIn": pagedIn,
+			"spilled": spilled,
+		}).Debug("Hub: tiered job bodies")
+		go metrics.Gauge("hub.storage.pagedin", float64(pagedIn))
+		go metrics.Gauge("hub.storage.spilled", float64(spilled))
+	}
+}
+
+// tierer tiers the job bodies of a lazy storage hub periodically until the hub is stopped
+func (h *Hub) tierer() {
+	t := time.NewTicker(h.tierInterval())
+	defer t.Stop()
+	for {
+		select {
+		case <-h.life.stop:
+			return
+		case <-t.C:
+			h.Tier()
+		}
+	}
+}
+
+// closeStore deletes the segment files of the hub, if any
+func (h *Hub) closeStore() {
+	if h.store == nil {
+		return
+	}
+	if err := h.store.close(); err != nil {
+		logrus.WithError(err).Error("Hub: cannot remove segment files")
+	}
+}
@@ -0,0 +1,176 @@
+package goyaad_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test tiered storage", func() {
+	storageDir := path.Join(os.TempDir(), "goyaadtest-segments")
+
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(storageDir)
+	})
+
+	newHub := func(opts HubOpts) *Hub {
+		opts.SpokeSpan = time.Millisecond * 10
+		opts.Persister = persister
+		opts.StorageDir = storageDir
+		return NewHub(&opts)
+	}
+
+	body := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d", i%10)), 50)
+	}
+
+	It("parses storage modes", func() {
+		for name, mode := range map[string]StorageMode{"memory": StorageInMemory, "Lazy": StorageLazy, "mapped": StorageMapped} {
+			m, err := ParseStorageMode(name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m).To(Equal(mode))
+		}
+		_, err := ParseStorageMode("tape")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("keeps bodies in memory by default", func() {
+		h := newHub(HubOpts{})
+		Expect(h.AddJob(NewJobAutoID(time.Now().Add(2*time.Hour), body(1)))).To(BeNil())
+		stats := h.Stats()
+		Expect(stats.BodyBytes).To(Equal(int64(50)))
+		Expect(stats.SpilledJobs).To(BeZero())
+	})
+
+	It("spills spokes beyond the horizon and still persists their bodies", func(done Done) {
+		defer close(done)
+
+		h := newHub(HubOpts{StorageMode: StorageLazy, SpillHorizon: time.Hour})
+		jobs := []*Job{}
+		for i := 0; i < 10; i++ {
+			j := NewJobAutoID(time.Now().Add(2*time.Hour+time.Duration(i)*time.Minute), body(i))
+			Expect(h.AddJob(j)).To(BeNil())
+			jobs = append(jobs, j)
+		}
+		near := NewJobAutoID(time.Now().Add(time.Minute), body(42))
+		Expect(h.AddJob(near)).To(BeNil())
+
+		stats := h.Stats()
+		Expect(stats.SpilledJobs).To(Equal(int64(10)))
+		Expect(stats.BodyBytes).To(Equal(int64(50)))
+		Expect(stats.SpillBytes).To(Equal(int64(500)))
+
+		found, err := h.FindJob(jobs[3].ID())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found.Body()).To(Equal(body(3)))
+
+		for e := range h.Persist() {
+			Fail("Persist failed due to error: " + e.Error())
+		}
+		restored := newHub(HubOpts{})
+		Expect(restored.Restore()).To(BeNil())
+		Expect(restored.PendingJobsCount()).To(Equal(11))
+		found, err = restored.FindJob(jobs[7].ID())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found.Body()).To(Equal(body(7)))
+	}, 5)
+
+	It("pages bodies back in as their spoke gets close", func() {
+		h := newHub(HubOpts{StorageMode: StorageLazy, SpillHorizon: time.Second})
+		j := NewJobAutoID(time.Now().Add(1500*time.Millisecond), body(1))
+		Expect(h.AddJob(j)).To(BeNil())
+		Expect(h.Stats().SpilledJobs).To(Equal(int64(1)))
+
+		h.Tier()
+		stats := h.Stats()
+		Expect(stats.SpilledJobs).To(BeZero())
+		Expect(stats.BodyBytes).To(Equal(int64(50)))
+	})
+
+	It("spills the furthest spokes to stay within the memory budget", func() {
+		h := newHub(HubOpts{StorageMode: StorageLazy, SpillHorizon: time.Hour, MemoryBudget: 100})
+		for i := 0; i < 10; i++ {
+			Expect(h.AddJob(NewJobAutoID(time.Now().Add(time.Duration(10+i)*time.Minute), body(i)))).To(BeNil())
+		}
+		Expect(h.Stats().BodyBytes).To(Equal(int64(500)))
+
+		h.Tier()
+		stats := h.Stats()
+		Expect(stats.BodyBytes).To(Equal(int64(100)))
+		Expect(stats.SpilledJobs).To(Equal(int64(8)))
+	})
+
+	It("spills a ready backlog over its budget and delivers it in order", func() {
+		h := newHub(HubOpts{StorageMode: StorageLazy, PastSpokeBudget: 100})
+		jobs := []*Job{}
+		for i := 0; i < 10; i++ {
+			j := NewJobAutoID(time.Now().Add(-time.Duration(10-i)*time.Second), body(i))
+			Expect(h.AddJob(j)).To(BeNil())
+			jobs = append(jobs, j)
+		}
+
+		h.Tier()
+		stats := h.Stats()
+		Expect(stats.BodyBytes).To(Equal(int64(100)))
+		Expect(stats.SpilledJobs).To(Equal(int64(8)))
+
+		for i, j := range jobs {
+			next := h.Next()
+			Expect(next.ID()).To(Equal(j.ID()))
+			Expect(next.Body()).To(Equal(body(i)))
+		}
+		stats = h.Stats()
+		Expect(stats.BodyBytes).To(BeZero())
+		Expect(stats.SpilledJobs).To(BeZero())
+	})
+
+	It("packs small bodies into spoke arenas without mixing them up", func() {
+		h := newHub(HubOpts{BodyArenaSize: 256})
+		jobs := []*Job{}
+		for i := 0; i < 10; i++ {
+			j := NewJobAutoID(time.Now().Add(-time.Duration(10-i)*time.Millisecond), body(i))
+			Expect(h.AddJob(j)).To(BeNil())
+			jobs = append(jobs, j)
+		}
+		big := NewJobAutoID(time.Now(), bytes.Repeat([]byte("x"), 100))
+		Expect(h.AddJob(big)).To(BeNil())
+		Expect(h.Stats().BodyBytes).To(Equal(int64(600)))
+
+		for i := range jobs {
+			next := h.Next()
+			Expect(next.Body()).To(Equal(body(i)))
+			// Appending to a packed body must not overwrite its neighbour
+			_ = append(next.Body(), 'z')
+		}
+		Expect(h.Next().Body()).To(Equal(big.Body()))
+	})
+
+	It("keeps every body on disk in mapped mode", func() {
+		h := newHub(HubOpts{StorageMode: StorageMapped})
+		ready := NewJobAutoID(time.Now().Add(-time.Second), body(1))
+		later := NewJobAutoID(time.Now().Add(time.Hour), body(2))
+		Expect(h.AddJob(ready)).To(BeNil())
+		Expect(h.AddJob(later)).To(BeNil())
+		Expect(h.Stats().SpilledJobs).To(Equal(int64(2)))
+		Expect(h.Stats().BodyBytes).To(BeZero())
+
+		Expect(h.Next().Body()).To(Equal(body(1)))
+		Expect(h.CancelJob(later.ID())).To(BeNil())
+		stats := h.Stats()
+		Expect(stats.SpilledJobs).To(BeZero())
+		Expect(stats.BodyBytes).To(BeZero())
+	})
+})
@@ -0,0 +1,137 @@
+package goyaad
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+)
+
+// Longest a blocked NextWait sleeps before looking at the hub again. It bounds how late a waiter
+// notices jobs made ready by something the hub isn't told about, like a manual clock moving.
+const maxWaitInterval = time.Second
+
+// Shortest a blocked NextWait sleeps so that waiters racing each other for ready jobs don't spin
+const minWaitInterval = time.Millisecond
+
+// waitSignal wakes up the readers blocked in NextWait when the hub changes
+type waitSignal struct {
+	c    chan struct{} // Closed on the next broadcast, nil while nobody waits
+	lock *sync.Mutex
+}
+
+func newWaitSignal() *waitSignal {
+	return &waitSignal{lock: &sync.Mutex{}}
+}
+
+// wait returns a channel that is closed on the next broadcast
+func (w *waitSignal) wait() <-chan struct{} {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.c == nil {
+		w.c = make(chan struct{})
+	}
+	return w.c
+}
+
+// broadcast wakes up everybody waiting
+func (w *waitSignal) broadcast() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.c != nil {
+		close(w.c)
+		w.c = nil
+	}
+}
+
+// AddJobCtx works like AddJob but doesn't add the job if ctx is already done
+func (h *Hub) AddJobCtx(ctx context.Context, j *Job) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return h.AddJob(j)
+}
+
+// CancelJobCtx works like CancelJob but doesn't cancel the job if ctx is already done
+func (h *Hub) CancelJobCtx(ctx context.Context, jobID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return h.CancelJob(jobID)
+}
+
+// NextWait returns the next ready job, blocking until one is ready or ctx is done.
+// It returns ctx.Err() if ctx is done first.
+func (h *Hub) NextWait(ctx context.Context) (*Job, error) {
+	return h.NextForWait(ctx, "")
+}
+
+// NextForWait works like NextWait for the given consumer group
+func (h *Hub) NextForWait(ctx context.Context, group string) (*Job, error) {
+	for {
+		// Subscribe before looking so that a job added in between wakes us up
+		wake := h.waiters.wait()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		j, err := h.NextFor(group)
+		if j != nil || err != nil {
+			return j, err
+		}
+
+		go metrics.Incr("hub.next.wait")
+		t := time.NewTimer(h.untilNextJob())
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-wake:
+			t.Stop()
+		case <-t.C:
+		}
+	}
+}
+
+// untilNextJob returns how long until the hub may have a job ready to hand out,
+// between minWaitInterval and maxWaitInterval
+func (h *Hub) untilNextJob() time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.paused {
+		// Resuming delivery wakes waiters up
+		return maxWaitInterval
+	}
+	now := h.clock.Now()
+	d := maxWaitInterval
+	earliest := func(at time.Time) {
+		if until := at.Sub(now); until < d {
+			d = until
+		}
+	}
+
+	h.pastSpoke.Lock()
+	backlog := h.pastSpoke.PendingJobsLen()
+	h.pastSpoke.Unlock()
+	if h.limiter != nil && h.throttled {
+		earliest(now.Add(h.limiter.untilReady(now)))
+	} else if backlog > 0 {
+		earliest(now)
+	}
+	if h.currentSpoke != nil {
+		h.currentSpoke.Lock()
+		if j := h.currentSpoke.jobQueue.peek(); j != nil {
+			earliest(j.TriggerAt())
+		}
+		h.currentSpoke.Unlock()
+	}
+	if h.spokes.Len() > 0 {
+		earliest(h.spokes.AtIdx(0).value.(*Spoke).start)
+	}
+
+	if d < minWaitInterval {
+		return minWaitInterval
+	}
+	return d
+}
@@ -0,0 +1,90 @@
+package goyaad_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test waiting for jobs", func() {
+	var h *Hub
+
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+		h = NewHub(&HubOpts{SpokeSpan: time.Millisecond * 10, Persister: persister})
+	})
+
+	It("blocks until the next job is ready", func(done Done) {
+		defer close(done)
+
+		j := NewJobAutoID(time.Now().Add(50*time.Millisecond), nil)
+		Expect(h.AddJob(j)).To(BeNil())
+
+		next, err := h.NextWait(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(next.ID()).To(Equal(j.ID()))
+		Expect(time.Now()).To(BeTemporally(">=", j.TriggerAt()))
+	}, 1)
+
+	It("wakes up as soon as a ready job is added", func(done Done) {
+		defer close(done)
+
+		j := NewJobAutoID(time.Now(), nil)
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(20 * time.Millisecond)
+			Expect(h.AddJob(j)).To(BeNil())
+		}()
+
+		start := time.Now()
+		next, err := h.NextWait(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(next.ID()).To(Equal(j.ID()))
+		// Well before the longest a waiter sleeps without being woken up
+		Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+	}, 1)
+
+	It("gives up when the context is done", func(done Done) {
+		defer close(done)
+
+		Expect(h.AddJob(NewJobAutoID(time.Now().Add(time.Hour), nil))).To(BeNil())
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+		defer cancel()
+
+		next, err := h.NextWait(ctx)
+		Expect(next).To(BeNil())
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Expect(h.PendingJobsCount()).To(Equal(1))
+	}, 1)
+
+	It("waits for the jobs of a consumer group", func(done Done) {
+		defer close(done)
+
+		h.AddGroup("billing")
+		j := NewJobAutoID(time.Now().Add(20*time.Millisecond), nil)
+		Expect(h.AddJob(j)).To(BeNil())
+
+		_, err := h.NextForWait(context.Background(), "unknown")
+		Expect(err).To(Equal(ErrGroupNotFound))
+		next, err := h.NextForWait(context.Background(), "billing")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(next.ID()).To(Equal(j.ID()))
+	}, 1)
+
+	It("doesn't add or cancel jobs once the context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		j := NewJobAutoID(time.Now().Add(time.Hour), nil)
+		Expect(h.AddJobCtx(ctx, j)).To(BeNil())
+
+		cancel()
+		Expect(h.CancelJobCtx(ctx, j.ID())).To(Equal(context.Canceled))
+		Expect(h.AddJobCtx(ctx, NewJobAutoID(time.Now(), nil))).To(Equal(context.Canceled))
+		Expect(h.PendingJobsCount()).To(Equal(1))
+	})
+})
@@ -0,0 +1,159 @@
+package goyaad
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+// logWAL records a change to j in the job store and the write-ahead log, if the hub keeps them
+func (h *Hub) logWAL(kind persistence.RecordKind, j *Job) error {
+	if err := h.storeJob(kind, j); err != nil {
+		go metrics.Incr("hub.jobstore.error")
+		return err
+	}
+	if h.wal == nil {
+		return nil
+	}
+	r := persistence.Record{Kind: kind, ID: j.id}
+	switch kind {
+	case persistence.RecordAdd:
+		var err error
+		if r, err = j.Record(); err != nil {
+			return errors.Wrap(err, "Hub: cannot encode job for the WAL")
+		}
+	case persistence.RecordReschedule:
+		r.TriggerAt = j.TriggerAt()
+	}
+	if err := h.wal.Append(r); err != nil {
+		go metrics.Incr("hub.wal.error")
+		return err
+	}
+	return nil
+}
+
+// logChange records a change that already happened. Failures are logged since there is nothing to undo.
+func (h *Hub) logChange(kind persistence.RecordKind, j *Job) {
+	if err := h.logWAL(kind, j); err != nil {
+		logrus.WithError(err).WithField("jobID", j.id).Error("Hub: cannot record change")
+	}
+}
+
+// logRecord records a change to the batches or consumer groups in the WAL, if the hub keeps one.
+// Failures are logged since the change happened already.
+func (h *Hub) logRecord(r persistence.Record) {
+	if h.wal == nil {
+		return
+	}
+	if err := h.wal.Append(r); err != nil {
+		go metrics.Incr("hub.wal.error")
+		logrus.WithError(err).WithField("id", r.ID).Errorf("Hub: cannot record %s", r.Kind)
+	}
+}
+
+// finish records that j left the hub for good and settles its batch
+func (h *Hub) finish(j *Job) {
+	h.logChange(persistence.RecordConsume, j)
+	h.settleBatch(j)
+}
+
+// removeJob takes the job with the given id out of its spoke, nil if the hub doesn't hold it.
+// If keepBody is true, the body of the job is paged back in so that it can be added again.
+func (h *Hub) removeJob(jobID string, keepBody bool) *Job {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, err := h.FindOwnerSpoke(jobID)
+	if err != nil {
+		return nil
+	}
+	j, _ := s.cancelJob(jobID)
+	switch {
+	case j == nil:
+	case keepBody:
+		h.checkout(j)
+	default:
+		h.discard(j)
+	}
+	return j
+}
+
+// forgetHeldCallback drops the held back callback job with the given id along with its batch
+func (h *Hub) forgetHeldCallback(jobID string) {
+	h.batchLock.Lock()
+	defer h.batchLock.Unlock()
+
+	for id, b := range h.batches {
+		if b.callback != nil && b.callback.id == jobID {
+			delete(h.batches, id)
+			return
+		}
+	}
+}
+
+// replayWAL applies the changes recorded since the last snapshot on top of the restored jobs
+func (h *Hub) replayWAL() error {
+	recs, err := h.wal.Replay()
+	if err != nil {
+		return err
+	}
+
+	applied, errCount := 0, 0
+	for r := range recs {
+		if err := h.replayRecord(r); err != nil {
+			errCount++
+			logrus.WithError(err).WithField("jobID", r.ID).Error("Hub: cannot replay WAL record")
+			continue
+		}
+		applied++
+	}
+	logrus.Infof("Hub:Restore replayed %d WAL records", applied)
+	if errCount > 0 {
+		return errors.Errorf("Hub:Restore encountered %d errors replaying the WAL", errCount)
+	}
+	return nil
+}
+
+func (h *Hub) replayRecord(r persistence.Record) error {
+	switch r.Kind {
+	case persistence.RecordAdd:
+		if _, err := h.FindJob(r.ID); err == nil {
+			// The snapshot already has it, like when the hub stopped before the WAL was reset
+			return nil
+		}
+		j := new(Job)
+		if err := j.UnmarshalBinary(r.Data); err != nil {
+			return err
+		}
+		return h.restoreJob(j)
+	case persistence.RecordCancel, persistence.RecordConsume:
+		if j := h.removeJob(r.ID, false); j != nil {
+			h.settleBatch(j)
+			return nil
+		}
+		if j := h.dropFromGroups(r.ID); j != nil {
+			h.settleBatch(j)
+			return nil
+		}
+		h.forgetHeldCallback(r.ID)
+		return nil
+	case persistence.RecordReschedule:
+		if r.TriggerAt.IsZero() {
+			return errors.New("Hub: WAL reschedule record has no trigger time")
+		}
+		j := h.removeJob(r.ID, true)
+		if j == nil {
+			return nil
+		}
+		j.triggerAt = r.TriggerAt.UnixNano()
+		return h.addJob(j)
+	case persistence.RecordBatch:
+		return h.restoreBatchRecord(r, false)
+	case persistence.RecordGroup:
+		return h.restoreGroupRecord(r)
+	case persistence.RecordDeliver:
+		return h.replayDelivery(string(r.Data), r.ID)
+	}
+	return errors.Errorf("Hub: unexpected %s record in the WAL", r.Kind)
+}
@@ -0,0 +1,180 @@
+package goyaad_test
+
+import (
+	"os"
+	"path"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test hub write-ahead log", func() {
+	var clock *ManualClock
+	var start time.Time
+
+	BeforeEach(func() {
+		persister = persistence.NewJournalPersister(dataDir)
+		Expect(persister.ResetDataDir()).To(BeNil())
+		Expect(os.RemoveAll(path.Join(dataDir, "wal"))).To(BeNil())
+		start = time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+		clock = NewManualClock(start)
+	})
+
+	newHub := func(restore bool) *Hub {
+		wal, err := persistence.OpenWAL(dataDir, persistence.SyncAlways, 0)
+		Expect(err).NotTo(HaveOccurred())
+		h := NewHub(&HubOpts{
+			SpokeSpan:      time.Minute,
+			Persister:      persistence.NewJournalPersister(dataDir),
+			AttemptRestore: restore,
+			Clock:          clock,
+			ForwardJump:    JumpShift,
+			BackwardJump:   JumpShift,
+			WAL:            wal,
+		})
+		Eventually(h.Ready()).Should(BeClosed())
+		return h
+	}
+
+	It("recovers the changes since the last snapshot after a crash", func() {
+		h := newHub(false)
+		for _, id := range []string{"snapshot-keep", "snapshot-cancel"} {
+			Expect(h.AddJob(NewJob(id, start.Add(time.Hour), nil))).To(BeNil())
+		}
+		h.Stop(true)
+
+		h = newHub(true)
+		Expect(h.PendingJobsCount()).To(Equal(2))
+		Expect(h.CancelJob("snapshot-cancel")).To(BeNil())
+		Expect(h.AddJob(NewJob("consumed", start.Add(-time.Minute), nil))).To(BeNil())
+		Expect(h.AddJob(NewJob("wal-keep", start.Add(2*time.Hour), []byte("body")))).To(BeNil())
+		Expect(h.Next().ID()).To(Equal("consumed"))
+		// Crash - no Stop, the snapshot only has the first two jobs
+
+		h = newHub(true)
+		Expect(h.PendingJobsCount()).To(Equal(2))
+		j, err := h.FindJob("wal-keep")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.Body()).To(Equal([]byte("body")))
+		_, err = h.FindJob("snapshot-keep")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(h.Next()).To(BeNil())
+		h.Stop(true)
+	})
+
+	It("replays the WAL even when not asked to restore", func() {
+		h := newHub(false)
+		Expect(h.AddJob(NewJob("a", start.Add(time.Hour), nil))).To(BeNil())
+		Expect(h.AddJob(NewJob("b", start.Add(time.Hour), nil))).To(BeNil())
+		// Crash before any snapshot was written
+
+		h = newHub(false)
+		Expect(h.RestoreErr()).NotTo(HaveOccurred())
+		Expect(h.PendingJobsCount()).To(Equal(2))
+		h.Stop(false)
+	})
+
+	It("recovers batch progress since the last snapshot", func() {
+		h := newHub(false)
+		id := h.OpenBatch()
+		for _, jid := range []string{"first", "second"} {
+			j := NewJob(jid, start.Add(-time.Minute), nil)
+			j.SetBatch(id)
+			Expect(h.AddJob(j)).To(BeNil())
+		}
+		h.Stop(true)
+
+		h = newHub(true)
+		j := NewJob("third", start.Add(time.Hour), nil)
+		j.SetBatch(id)
+		Expect(h.AddJob(j)).To(BeNil())
+		Expect(h.Next()).NotTo(BeNil())
+		empty := h.OpenBatch()
+		// Crash - the snapshot only has the batch with two members
+
+		h = newHub(true)
+		p, err := h.BatchProgress(id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Total).To(Equal(3))
+		Expect(p.Done).To(Equal(1))
+		_, err = h.BatchProgress(empty)
+		Expect(err).NotTo(HaveOccurred())
+		h.Stop(false)
+	})
+
+	It("recovers consumer groups added and removed since the last snapshot", func() {
+		h := newHub(false)
+		h.AddGroup("billing")
+		h.AddGroup("audit")
+		Expect(h.AddJob(NewJob("fired", start.Add(-time.Minute), nil))).To(BeNil())
+		j, err := h.NextFor("billing")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.ID()).To(Equal("fired"))
+		h.Stop(true)
+
+		h = newHub(true)
+		Expect(h.PendingJobsCount()).To(Equal(1))
+		h.AddGroup("notifications")
+		Expect(h.RemoveGroup("audit")).To(BeNil())
+		// Crash - audit was the last group waiting for the fired job
+
+		h = newHub(true)
+		Expect(h.Groups()).To(Equal([]string{"billing", "notifications"}))
+		Expect(h.PendingJobsCount()).To(Equal(0))
+		h.Stop(false)
+	})
+
+	It("doesn't deliver a job again to a group that consumed it before a crash", func() {
+		h := newHub(false)
+		h.AddGroup("billing")
+		h.AddGroup("audit")
+		Expect(h.AddJob(NewJob("snapshot", start.Add(-time.Minute), nil))).To(BeNil())
+		j, err := h.NextFor("billing")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.ID()).To(Equal("snapshot"))
+		Expect(h.AddJob(NewJob("wal", start.Add(-time.Minute), nil))).To(BeNil())
+		h.Stop(true)
+
+		h = newHub(true)
+		j, err = h.NextFor("audit")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.ID()).To(Equal("snapshot"))
+		j, err = h.NextFor("billing")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.ID()).To(Equal("wal"))
+		// Crash - the snapshot has billing and audit still waiting for a job each
+
+		h = newHub(true)
+		j, err = h.NextFor("billing")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j).To(BeNil())
+		j, err = h.NextFor("audit")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.ID()).To(Equal("wal"))
+		Expect(h.PendingJobsCount()).To(Equal(0))
+		h.Stop(false)
+	})
+
+	It("recovers schedules moved by a clock jump", func() {
+		h := newHub(false)
+		Expect(h.AddJob(NewJob("sooner", start.Add(time.Hour), nil))).To(BeNil())
+		h.Stop(true)
+
+		h = newHub(true)
+		Expect(h.AddJob(NewJob("later", start.Add(time.Hour), nil))).To(BeNil())
+		h.HandleClockJump(-30 * time.Minute)
+		// Crash
+
+		h = newHub(true)
+		for _, id := range []string{"sooner", "later"} {
+			j, err := h.FindJob(id)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(j.TriggerAt()).To(BeTemporally("==", start.Add(30*time.Minute)))
+		}
+		h.Stop(false)
+	})
+})
@@ -0,0 +1,246 @@
+package goyaad
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const day = time.Hour * 24
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a recurring range of wall clock time during which jobs may be delivered,
+// for example weekdays 08:00-21:00 in Europe/Berlin.
+// A window whose end is before its start wraps past midnight into the next day.
+type Window struct {
+	Days     []time.Weekday // Days the window opens on, every day if empty
+	Start    time.Duration  // Wall clock offset from midnight when the window opens
+	End      time.Duration  // Wall clock offset from midnight when the window closes (exclusive)
+	Location *time.Location // Time zone of the wall clock, UTC if nil
+}
+
+// ParseWindow parses a window like "Mon-Fri 08:00-21:00 Europe/Berlin".
+// Days ("Mon-Fri", "Sat,Sun" or "*") and the time zone are optional.
+func ParseWindow(s string) (Window, error) {
+	w := Window{Location: time.UTC}
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 3 {
+		return w, errors.Errorf("Window: cannot parse %q", s)
+	}
+
+	// Time range is the only field that always contains a ':'
+	idx := -1
+	for i, f := range fields {
+		if strings.Contains(f, ":") {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 || idx > 1 {
+		return w, errors.Errorf("Window: missing time range in %q", s)
+	}
+
+	var err error
+	if idx == 1 {
+		w.Days, err = parseDays(fields[0])
+		if err != nil {
+			return w, err
+		}
+	}
+	w.Start, w.End, err = parseTimeRange(fields[idx])
+	if err != nil {
+		return w, err
+	}
+	if w.Start == w.End {
+		return w, errors.Errorf("Window: empty time range in %q", s)
+	}
+	if len(fields) > idx+1 {
+		w.Location, err = time.LoadLocation(fields[idx+1])
+		if err != nil {
+			return w, errors.Wrapf(err, "Window: unknown time zone in %q", s)
+		}
+	}
+	return w, nil
+}
+
+// ParseWindows parses a ';' separated list of windows
+func ParseWindows(s string) ([]Window, error) {
+	windows := []Window{}
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		w, err := ParseWindow(part)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseDays(s string) ([]time.Weekday, error) {
+	if s == "*" {
+		return nil, nil
+	}
+	days := []time.Weekday{}
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := weekdays[strings.ToLower(bounds[0])]
+		if !ok {
+			return nil, errors.Errorf("Window: unknown day %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, ok = weekdays[strings.ToLower(bounds[1])]
+			if !ok {
+				return nil, errors.Errorf("Window: unknown day %q", bounds[1])
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days = append(days, d)
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseTimeRange(s string) (time.Duration, time.Duration, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, errors.Errorf("Window: cannot parse time range %q", s)
+	}
+	start, err := parseClock(bounds[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(bounds[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil {
+		return 0, errors.Wrapf(err, "Window: cannot parse time %q", s)
+	}
+	if h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, errors.Errorf("Window: time out of range %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+func (w Window) location() *time.Location {
+	if w.Location == nil {
+		return time.UTC
+	}
+	return w.Location
+}
+
+func (w Window) opensOn(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, wd := range w.Days {
+		if wd == d {
+			return true
+		}
+	}
+	return false
+}
+
+// wallClock returns the offset of t from midnight as read on a wall clock,
+// which is not the elapsed time on days with a DST change
+func wallClock(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second +
+		time.Duration(t.Nanosecond())
+}
+
+// Contains returns true if the window is open at t
+func (w Window) Contains(t time.Time) bool {
+	lt := t.In(w.location())
+	clock := wallClock(lt)
+
+	if w.Start <= w.End {
+		return w.opensOn(lt.Weekday()) && clock >= w.Start && clock < w.End
+	}
+	// Wraps past midnight - open late on an open day or early on the day after
+	if w.opensOn(lt.Weekday()) && clock >= w.Start {
+		return true
+	}
+	return w.opensOn((lt.Weekday()+6)%7) && clock < w.End
+}
+
+// NextStart returns the first time at or after t when the window opens
+func (w Window) NextStart(t time.Time) time.Time {
+	loc := w.location()
+	lt := t.In(loc)
+	for d := 0; d <= 7; d++ {
+		// time.Date normalizes the day overflow and DST gaps
+		c := time.Date(lt.Year(), lt.Month(), lt.Day()+d, 0, 0, 0, 0, loc)
+		start := time.Date(c.Year(), c.Month(), c.Day(), 0, 0, 0, int(w.Start), loc)
+		if !start.Before(t) && w.opensOn(c.Weekday()) {
+			return start
+		}
+	}
+	// Only reachable for windows without days - open every day anyway
+	return t.Add(day)
+}
+
+// String formats the window the way ParseWindow reads it
+func (w Window) String() string {
+	days := "*"
+	if len(w.Days) > 0 {
+		names := make([]string, len(w.Days))
+		for i, d := range w.Days {
+			names[i] = d.String()[:3]
+		}
+		days = strings.Join(names, ",")
+	}
+	return fmt.Sprintf("%s %02d:%02d-%02d:%02d %s", days,
+		int(w.Start/time.Hour), int(w.Start%time.Hour/time.Minute),
+		int(w.End/time.Hour), int(w.End%time.Hour/time.Minute),
+		w.location())
+}
+
+// inWindows returns true if t falls in any of the windows or if there are none
+func inWindows(windows []Window, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextWindowStart returns the earliest time at or after t when any of the windows opens
+func nextWindowStart(windows []Window, t time.Time) time.Time {
+	var next time.Time
+	for i, w := range windows {
+		s := w.NextStart(t)
+		if i == 0 || s.Before(next) {
+			next = s
+		}
+	}
+	return next
+}
@@ -0,0 +1,139 @@
+package goyaad_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test delivery windows", func() {
+	var berlin *time.Location
+
+	BeforeEach(func() {
+		var err error
+		berlin, err = time.LoadLocation("Europe/Berlin")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Context("Parsing", func() {
+		It("parses windows with and without days and zones", func() {
+			w, err := ParseWindow("Mon-Fri 08:00-21:00 Europe/Berlin")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.Days).To(Equal([]time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}))
+			Expect(w.Start).To(Equal(8 * time.Hour))
+			Expect(w.End).To(Equal(21 * time.Hour))
+			Expect(w.Location.String()).To(Equal("Europe/Berlin"))
+			Expect(w.String()).To(Equal("Mon,Tue,Wed,Thu,Fri 08:00-21:00 Europe/Berlin"))
+
+			again, err := ParseWindow(w.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again.String()).To(Equal(w.String()))
+
+			w, err = ParseWindow("22:00-06:00")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.Days).To(BeEmpty())
+			Expect(w.Location).To(Equal(time.UTC))
+
+			windows, err := ParseWindows("Sat,Sun 10:00-12:00; Mon-Fri 08:00-21:00")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(windows).To(HaveLen(2))
+		})
+
+		It("rejects malformed windows", func() {
+			for _, s := range []string{"", "Mon-Fri", "Funday 08:00-21:00", "08:00", "25:00-26:00", "08:00-08:00", "08:00-21:00 Nowhere/Land"} {
+				_, err := ParseWindow(s)
+				Expect(err).To(HaveOccurred(), s)
+			}
+		})
+	})
+
+	Context("Time math", func() {
+		It("contains times within the window only on open days", func() {
+			w, _ := ParseWindow("Mon-Fri 08:00-21:00 Europe/Berlin")
+			Expect(w.Contains(time.Date(2026, 10, 19, 8, 0, 0, 0, berlin))).To(BeTrue())   // Monday
+			Expect(w.Contains(time.Date(2026, 10, 19, 21, 0, 0, 0, berlin))).To(BeFalse()) // end is exclusive
+			Expect(w.Contains(time.Date(2026, 10, 19, 7, 59, 0, 0, berlin))).To(BeFalse())
+			Expect(w.Contains(time.Date(2026, 10, 24, 12, 0, 0, 0, berlin))).To(BeFalse()) // Saturday
+		})
+
+		It("handles windows that wrap past midnight", func() {
+			w, _ := ParseWindow("Fri 22:00-06:00 UTC")
+			Expect(w.Contains(time.Date(2026, 10, 23, 23, 0, 0, 0, time.UTC))).To(BeTrue()) // Friday night
+			Expect(w.Contains(time.Date(2026, 10, 24, 5, 0, 0, 0, time.UTC))).To(BeTrue())  // Saturday morning
+			Expect(w.Contains(time.Date(2026, 10, 25, 5, 0, 0, 0, time.UTC))).To(BeFalse()) // Sunday morning
+		})
+
+		It("finds the next window start across the spring DST change", func() {
+			// Clocks go from 02:00 CET to 03:00 CEST on Sunday, March 29th 2026
+			w, _ := ParseWindow("Mon-Fri 08:00-21:00 Europe/Berlin")
+			due := time.Date(2026, 3, 27, 21, 30, 0, 0, berlin) // Friday night, CET
+			next := w.NextStart(due)
+			Expect(next).To(BeTemporally("==", time.Date(2026, 3, 30, 6, 0, 0, 0, time.UTC)))
+			Expect(w.Contains(next)).To(BeTrue())
+
+			// A daily window that opens right after the gap
+			w, _ = ParseWindow("03:00-04:00 Europe/Berlin")
+			next = w.NextStart(time.Date(2026, 3, 29, 0, 30, 0, 0, berlin))
+			Expect(next).To(BeTemporally("==", time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC)))
+			Expect(w.Contains(next)).To(BeTrue())
+		})
+
+		It("finds the next window start across the autumn DST change", func() {
+			// Clocks go from 03:00 CEST back to 02:00 CET on Sunday, October 25th 2026
+			w, _ := ParseWindow("Mon-Fri 08:00-21:00 Europe/Berlin")
+			due := time.Date(2026, 10, 23, 21, 30, 0, 0, berlin) // Friday night, CEST
+			next := w.NextStart(due)
+			Expect(next).To(BeTemporally("==", time.Date(2026, 10, 26, 7, 0, 0, 0, time.UTC)))
+			Expect(w.Contains(next)).To(BeTrue())
+
+			// The repeated hour is inside a window that spans it
+			w, _ = ParseWindow("01:00-04:00 Europe/Berlin")
+			Expect(w.Contains(time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC))).To(BeTrue()) // 02:30 CEST
+			Expect(w.Contains(time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC))).To(BeTrue()) // 02:30 CET
+		})
+	})
+
+	Context("Hub delivery", func() {
+		It("moves jobs that come due outside their windows to the next window start", func() {
+			p := persistence.NewJournalPersister(dataDir)
+			Expect(p.ResetDataDir()).To(BeNil())
+			h := NewHub(&HubOpts{SpokeSpan: time.Minute, Persister: p, AttemptRestore: false})
+
+			now := time.Now()
+			closed := Window{
+				Start:    wallClockOf(now.Add(time.Hour)),
+				End:      wallClockOf(now.Add(2 * time.Hour)),
+				Location: time.UTC,
+			}
+			if closed.Start > closed.End {
+				// Don't let the test depend on the time of day
+				closed.Start, closed.End = wallClockOf(now.Add(-2*time.Hour)), wallClockOf(now.Add(-time.Hour))
+			}
+
+			j := NewJobAutoID(now.Add(-time.Second), []byte("quiet hours"))
+			j.SetWindows([]Window{closed})
+			Expect(h.AddJob(j)).To(BeNil())
+			open := NewJobAutoID(now.Add(-time.Millisecond), []byte("no windows"))
+			Expect(h.AddJob(open)).To(BeNil())
+
+			Expect(h.Next().ID()).To(Equal(open.ID()))
+			Expect(h.Next()).To(BeNil())
+			Expect(h.PendingJobsCount()).To(Equal(1))
+
+			moved, err := h.FindJob(j.ID())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(moved.WindowMoves()).To(Equal(int32(1)))
+			Expect(moved.TriggerAt().After(now)).To(BeTrue())
+			Expect(closed.Contains(moved.TriggerAt())).To(BeTrue())
+		})
+	})
+})
+
+func wallClockOf(t time.Time) time.Duration {
+	t = t.UTC()
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+}
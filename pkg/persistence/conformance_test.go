@@ -0,0 +1,179 @@
+package persistence_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	"github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+// writeSnapshot writes the jobs and commits them as one snapshot
+func writeSnapshot(w persistence.Writer, jobs ...*goyaad.Job) {
+	ctx := context.Background()
+	for _, j := range jobs {
+		r, err := j.Record()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w.Write(ctx, r)).To(Succeed())
+	}
+	Expect(w.Commit(ctx)).To(Succeed())
+}
+
+// readRecords reads back all records, none of them may be an error
+func readRecords(r persistence.Reader) []persistence.Record {
+	resC, err := r.Read(context.Background())
+	Expect(err).NotTo(HaveOccurred())
+	records := []persistence.Record{}
+	for res := range resC {
+		Expect(res.Err).NotTo(HaveOccurred())
+		records = append(records, res.Record)
+	}
+	return records
+}
+
+// readIDs reads back the ids of the jobs added, in order
+func readIDs(r persistence.Reader) []string {
+	ids := []string{}
+	for _, rec := range readRecords(r) {
+		if rec.Kind != persistence.RecordAdd {
+			continue
+		}
+		j := goyaad.Job{}
+		Expect(j.GobDecode(rec.Data)).To(Succeed())
+		ids = append(ids, j.ID())
+	}
+	return ids
+}
+
+// persisterConformance is the behaviour every Persister has to have
+func persisterConformance(name string, newPersister func(dataDir string) persistence.Persister) {
+	Describe(name+" conformance", func() {
+		dataDir := path.Join(os.TempDir(), "goyaadconformance")
+		ctx := context.Background()
+		var p persistence.Persister
+
+		BeforeEach(func() {
+			Expect(os.RemoveAll(dataDir)).To(Succeed())
+			p = newPersister(dataDir)
+		})
+
+		// liveJobs reads back the jobs that are still live once the cancels are applied
+		liveJobs := func(p persistence.Persister) map[string]*goyaad.Job {
+			jobs := map[string]*goyaad.Job{}
+			for _, r := range readRecords(p) {
+				switch r.Kind {
+				case persistence.RecordAdd:
+					j := &goyaad.Job{}
+					Expect(j.GobDecode(r.Data)).To(Succeed())
+					Expect(r.TriggerAt.UnixNano()).To(Equal(j.TriggerAt().UnixNano()))
+					jobs[j.ID()] = j
+				case persistence.RecordCancel:
+					delete(jobs, r.ID)
+				}
+			}
+			return jobs
+		}
+
+		persist := func(ids ...string) {
+			jobs := []*goyaad.Job{}
+			for _, id := range ids {
+				jobs = append(jobs, goyaad.NewJob(id, time.Now().Add(time.Minute), []byte("body-"+id)))
+			}
+			writeSnapshot(p, jobs...)
+		}
+
+		It("has nothing to read before anything is persisted", func() {
+			_, err := p.Read(ctx)
+			Expect(os.IsNotExist(errors.Cause(err))).To(BeTrue())
+		})
+
+		It("reads back the persisted jobs", func() {
+			persist("a", "b", "c")
+			jobs := liveJobs(newPersister(dataDir))
+			Expect(jobs).To(HaveLen(3))
+			for _, id := range []string{"a", "b", "c"} {
+				Expect(jobs[id].Body()).To(Equal([]byte("body-" + id)))
+			}
+		})
+
+		It("reads back an empty snapshot", func() {
+			persist("a")
+			persist()
+			Expect(liveJobs(newPersister(dataDir))).To(BeEmpty())
+		})
+
+		It("replaces the last snapshot with a newer one", func() {
+			persist("a", "b")
+			persist("b", "c")
+			jobs := liveJobs(newPersister(dataDir))
+			Expect(jobs).To(HaveLen(2))
+			Expect(jobs).To(HaveKey("b"))
+			Expect(jobs).To(HaveKey("c"))
+		})
+
+		It("takes back jobs cancelled in the same snapshot", func() {
+			for _, id := range []string{"a", "b"} {
+				r, err := goyaad.NewJob(id, time.Now(), nil).Record()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(p.Write(ctx, r)).To(Succeed())
+			}
+			Expect(p.Write(ctx, persistence.Record{Kind: persistence.RecordCancel, ID: "a"})).To(Succeed())
+			Expect(p.Write(ctx, persistence.Record{Kind: persistence.RecordCheckpoint, TriggerAt: time.Now()})).To(Succeed())
+			Expect(p.Commit(ctx)).To(Succeed())
+
+			jobs := liveJobs(newPersister(dataDir))
+			Expect(jobs).To(HaveLen(1))
+			Expect(jobs).To(HaveKey("b"))
+		})
+
+		It("stops reading once the context is done", func() {
+			ids := []string{}
+			for i := 0; i < 100; i++ {
+				ids = append(ids, fmt.Sprintf("job-%03d", i))
+			}
+			persist(ids...)
+
+			readCtx, cancel := context.WithCancel(ctx)
+			resC, err := newPersister(dataDir).Read(readCtx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect((<-resC).Err).NotTo(HaveOccurred())
+			cancel()
+			rest := 0
+			for range resC {
+				rest++
+			}
+			Expect(rest).To(BeNumerically("<", 99))
+		})
+
+		It("refuses writes once the context is done", func() {
+			done, cancel := context.WithCancel(ctx)
+			cancel()
+			r, err := goyaad.NewJob("a", time.Now(), nil).Record()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Write(done, r)).To(Equal(context.Canceled))
+		})
+
+		It("forgets everything on reset", func() {
+			persist("a")
+			Expect(p.ResetDataDir()).To(Succeed())
+			_, err := newPersister(dataDir).Read(ctx)
+			Expect(os.IsNotExist(errors.Cause(err))).To(BeTrue())
+		})
+	})
+}
+
+var _ = Describe("Test persister conformance", func() {
+	persisterConformance("JournalPersister", func(dataDir string) persistence.Persister {
+		return persistence.NewJournalPersister(dataDir)
+	})
+	persisterConformance("KVPersister", func(dataDir string) persistence.Persister {
+		return persistence.NewKVPersister(dataDir, &persistence.KVOpts{})
+	})
+})
@@ -1,147 +1,422 @@
 package persistence
 
 import (
-	"encoding/gob"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb/journal"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
 )
 
+// DefaultSnapshotsKept is how many snapshots a journal persister keeps unless told otherwise
+const DefaultSnapshotsKept = 3
+
+// Snapshots are named after the time they were started at, so that names sort oldest first
+const snapshotTimeFormat = "20060102T150405.000000000Z"
+
+// legacySnapshot is where snapshots were written before they were rotated. It sorts before any rotated one.
+const legacySnapshot = "jobs.snapshot"
+
+// JournalOpts configure a journal persister
+type JournalOpts struct {
+	Keep     int          // Snapshots kept, DefaultSnapshotsKept if not set
+	Manifest ManifestMode // What restores do with snapshots that don't match their manifest
+	Recovery RecoveryMode // What restores do with corrupt records
+	// If set, Read only reads this snapshot, like one fetched from a backup
+	RestoreFrom string
+	// The WAL replayed on top of the snapshot read, if any. Read only falls back
+	// to an older snapshot while the WAL still has the changes made since.
+	WAL *WAL
+}
+
 // JournalPersister saves data in an embedded Journal store
 type JournalPersister struct {
-	stream   chan gob.GobEncoder // Internal stream so that all writes are ordered
-	dataDir  string
-	s3Bucket string
-	writer   *journal.Writer
+	dataDir   string
+	writer    *journal.Writer
+	keep      int          // Snapshots kept, older ones are removed once a new one is complete
+	mode      ManifestMode // What Read does with snapshots that don't match their manifest
+	spokeSpan time.Duration
+	file      *os.File // Snapshot being written, renamed to its final name on Commit
+	sum       hash.Hash
+	manifest  Manifest  // Of the snapshot being written
+	recovered *Manifest // Of the snapshot the last Read was from
+	last      string    // Last completed snapshot
+
+	restoreFrom  string
+	wal          *WAL
+	recoveryMode RecoveryMode
+	recovery     *recovery // Of the snapshot the last Read was from
+	recoveryLock *sync.Mutex
 
 	finalize chan struct{}
 }
 
-// NewJournalPersister initializes a Journal backed persister
-func NewJournalPersister(dataDir string, s3Bucket string) Persister {
+// NewJournalPersister initializes a Journal backed persister with the default options
+func NewJournalPersister(dataDir string) Persister {
+	return NewJournalPersisterWithOpts(dataDir, &JournalOpts{})
+}
+
+// NewJournalPersisterWithOpts initializes a Journal backed persister
+func NewJournalPersisterWithOpts(dataDir string, opts *JournalOpts) Persister {
+	keep := opts.Keep
+	if keep < 1 {
+		keep = DefaultSnapshotsKept
+	}
 	lp := &JournalPersister{
-		stream:   make(chan gob.GobEncoder, 10),
-		dataDir:  dataDir,
-		s3Bucket: s3Bucket,
-		writer:   nil, // lazy init writer
-		finalize: make(chan struct{}, 1),
+		dataDir: dataDir,
+		keep:    keep,
+		mode:    opts.Manifest,
+		writer:  nil, // lazy init writer
+
+		restoreFrom:  opts.RestoreFrom,
+		wal:          opts.WAL,
+		recoveryMode: opts.Recovery,
+		recoveryLock: &sync.Mutex{},
+		finalize:     make(chan struct{}, 1),
 	}
 
-	logrus.Infof("Created Journal persister with datadir: %s", dataDir)
+	logrus.Infof("Created Journal persister with datadir: %s keeping %d snapshots", dataDir, keep)
 	return lp
 }
 
+// Describe sets the spoke span recorded in the manifests of the snapshots that follow
+func (lp *JournalPersister) Describe(spokeSpan time.Duration) {
+	lp.spokeSpan = spokeSpan
+}
+
+// RecoveredManifest returns the manifest of the snapshot the last Read was from, nil if it had none
+func (lp *JournalPersister) RecoveredManifest() *Manifest {
+	return lp.recovered
+}
+
 // ResetDataDir tells persister to *delete* everything in the datadir
 func (lp *JournalPersister) ResetDataDir() error {
 	// Currently, only reset namespaces
-	p := lp.getPath()
+	p := lp.getDir()
 	logrus.Warnf("JournalPersister:ResetDataDir resetting base path: %s", p)
-	if _, err := os.Stat(p); !os.IsNotExist(err) {
-		return os.Remove(p)
+	snapshots, err := lp.snapshots()
+	if err != nil {
+		return err
 	}
-
+	others, err := filepath.Glob(path.Join(p, "jobs*.snapshot.*"))
+	if err != nil {
+		return err
+	}
+	for _, f := range append(snapshots, others...) {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	lp.last = ""
 	return nil
 }
 
-// Finalize tells persister that it can finalize and close writes
-// It is an error to send new items to persist once Finalize has been called
-func (lp *JournalPersister) Finalize() {
-	logrus.Info("JournalPersister:Finalize finalizing persister")
+// Commit completes the snapshot being written and closes it.
+// The finished snapshot is added to the kept ones, even if it is empty, and the oldest are removed.
+// Records written after Commit go to a new snapshot.
+func (lp *JournalPersister) Commit(ctx context.Context) error {
+	logrus.Info("JournalPersister:Commit committing snapshot")
+
+	// An empty snapshot still has to replace the last one
+	if lp.writer == nil {
+		if err := lp.open(); err != nil {
+			return err
+		}
+	}
 
 	// close db
-	if lp.writer != nil {
-		logrus.Info("JournalPersister:Finalize closing writer db")
-		err := lp.writer.Flush()
-		if err != nil {
-			logrus.Error("JournalPersister:Finalize error flushing journal", err)
+	logrus.Info("JournalPersister:Commit closing writer db")
+	err := ctx.Err()
+	if err == nil {
+		err = lp.writer.Flush()
+	}
+	if err != nil {
+		logrus.Error("JournalPersister:Commit error flushing journal", err)
+	}
+	if cerr := lp.writer.Close(); cerr != nil && err == nil {
+		logrus.Error("JournalPersister:Commit error finalizing writer", cerr)
+		err = cerr
+	}
+	if err == nil {
+		err = lp.file.Sync()
+	}
+	lp.file.Close()
+	tmp := lp.file.Name()
+	final := strings.TrimSuffix(tmp, ".tmp")
+	if err == nil {
+		// The manifest goes first, a snapshot is never complete without one
+		lp.manifest.Checksum = hex.EncodeToString(lp.sum.Sum(nil))
+		lp.manifest.SpokeSpan = lp.spokeSpan
+		err = writeManifest(final, &lp.manifest)
+	}
+	if err == nil {
+		err = os.Rename(tmp, final)
+	}
+	if err == nil {
+		err = syncDir(lp.getDir())
+	}
+	lp.writer, lp.file = nil, nil
+	if err != nil {
+		os.Remove(tmp)
+		err = errors.Wrap(err, "JournalPersister:Commit snapshot not completed")
+		logrus.Error(err)
+		return err
+	}
+	lp.last = final
+	lp.prune()
+	logrus.Info("JournalPersister:Commit done")
+	return nil
+}
+
+// prune removes the snapshots older than the kept ones
+func (lp *JournalPersister) prune() {
+	snapshots, err := lp.snapshots()
+	if err != nil {
+		logrus.WithError(err).Error("JournalPersister:prune cannot list snapshots")
+		return
+	}
+	for len(snapshots) > lp.keep {
+		logrus.WithField("File", snapshots[0]).Info("JournalPersister:prune removing old snapshot")
+		if err := os.Remove(snapshots[0]); err != nil {
+			logrus.WithError(err).Error("JournalPersister:prune cannot remove snapshot")
 		}
-		err = lp.writer.Close()
-		if err != nil {
-			logrus.Error("JournalPersister:Finalize error finalizing writer", err)
+		os.Remove(manifestPath(snapshots[0]))
+		os.Remove(quarantinePath(snapshots[0]))
+		snapshots = snapshots[1:]
+	}
+	// Left behind by snapshots that never completed
+	temps, _ := filepath.Glob(path.Join(lp.getDir(), "jobs-*.tmp"))
+	for _, f := range temps {
+		os.Remove(f)
+	}
+	manifests, _ := filepath.Glob(path.Join(lp.getDir(), "jobs-*.snapshot.manifest"))
+	for _, m := range manifests {
+		if _, err := os.Stat(strings.TrimSuffix(m, ".manifest")); os.IsNotExist(err) {
+			os.Remove(m)
 		}
-		logrus.Info("JournalPersister:Finalize closed writer db")
 	}
-	logrus.Info("JournalPersister:Finalize done")
 }
 
-func (lp *JournalPersister) UploadToS3() {
-	if lp.s3Bucket == "" {
-		logrus.Info("JournalPersister:Not Uploading to S3")
-		return
+// snapshots returns the completed snapshots, oldest first
+func (lp *JournalPersister) snapshots() ([]string, error) {
+	dir := lp.getDir()
+	rotated, err := filepath.Glob(path.Join(dir, "jobs-*.snapshot"))
+	if err != nil {
+		return nil, err
 	}
+	sort.Strings(rotated)
+	legacy := path.Join(dir, legacySnapshot)
+	if _, err := os.Stat(legacy); err == nil {
+		rotated = append([]string{legacy}, rotated...)
+	}
+	return rotated, nil
+}
+
+// SnapshotPath returns where Commit put the last snapshot
+func (lp *JournalPersister) SnapshotPath() string {
+	return lp.last
+}
 
-	p := lp.getPath()
-	sess := session.Must(session.NewSession())
+// Write adds a record to the snapshot being written
+func (lp *JournalPersister) Write(ctx context.Context, r Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	logrus.Debug("JournalPersister:Write writing a record")
+	return lp.write(r)
+}
 
-	svc := s3.New(sess)
+// Read reads back the newest snapshot that is intact and emits its records.
+// Strict recovery fails if the newest snapshot is corrupt. Otherwise corrupt records are
+// dropped from it, and a newest snapshot that can't be read at all is skipped in favour of
+// an older one, as long as no WAL is kept or it still has the changes made since.
+// Snapshots written before records were typed are read as job adds.
+func (lp *JournalPersister) Read(ctx context.Context) (<-chan RecordResult, error) {
+	lp.recoveryLock.Lock()
+	lp.recovery = nil
+	lp.recoveryLock.Unlock()
 
-	_, err := svc.PutObject(&s3.PutObjectInput{
-		Body:   aws.ReadSeekCloser(strings.NewReader(p)),
-		Bucket: aws.String(lp.s3Bucket),
-		Key:    aws.String(fmt.Sprintf("jobs-%v.snapshot", time.Now().Unix())),
-	})
+	snapshots, err := lp.snapshots()
 	if err != nil {
-		logrus.Errorf("Persisting to S3 failed: %v", err)
+		return nil, errors.Wrap(err, "Failed to list persistence files")
+	}
+	if lp.restoreFrom != "" {
+		snapshots = []string{lp.restoreFrom}
 	}
+	var newest error // Why the newest snapshot was skipped
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		filePath := snapshots[i]
+		if newest != nil {
+			if err := lp.canFallBack(filePath); err != nil {
+				logrus.WithError(err).WithField("File", filePath).Error("JournalPersister:Read cannot fall back to an older snapshot")
+				break
+			}
+		}
+		m, err := lp.validateSnapshot(filePath)
+		if errors.Cause(err) == ErrCorruptSnapshot && lp.recoveryMode != RecoverStrict {
+			logrus.WithError(err).WithField("File", filePath).Warn("JournalPersister:Read dropping the corrupt records of the snapshot")
+			if m, err = readManifest(filePath); err == nil && m != nil {
+				err = m.checkVersion()
+			}
+			if err == nil {
+				lp.recovered = m
+				return lp.recoverFrom(ctx, filePath, m)
+			}
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("File", filePath).Error("JournalPersister:Read skipping corrupt snapshot")
+			go metrics.Incr("persister.snapshot.corrupt")
+			if newest == nil {
+				newest = errors.Wrapf(err, "Snapshot %s is corrupt", filePath)
+			}
+			if lp.recoveryMode == RecoverStrict {
+				// An older snapshot would silently restore jobs as they were before
+				break
+			}
+			continue
+		}
+		lp.recovered = m
+		return lp.recoverFrom(ctx, filePath, m)
+	}
+	if newest == nil {
+		newest = os.ErrNotExist
+	}
+	err = errors.Wrapf(newest, "Failed to find an intact persistence file in %s", lp.getDir())
+	logrus.Errorf("JournalPersister:Read %s", err)
+	return nil, err
 }
 
-// Persist stores an entry to disk
-func (lp *JournalPersister) Persist(enc gob.GobEncoder) error {
-	logrus.Debug("JournalPersister:Persist persisting an entry")
-	return lp.write(enc)
+// canFallBack returns why the snapshot at filePath can't stand in for a newer one:
+// the changes made since are lost unless the WAL still has them
+func (lp *JournalPersister) canFallBack(filePath string) error {
+	if lp.wal == nil {
+		return nil
+	}
+	m, err := readManifest(filePath)
+	if err != nil {
+		return err
+	}
+	if m == nil || !lp.wal.Covers(m.WALSegment) {
+		return errors.New("the WAL no longer has the changes made since the snapshot")
+	}
+	return nil
 }
 
-// PersistStream listens to the input channel and persists entries to disk
-func (lp *JournalPersister) PersistStream(encC chan gob.GobEncoder) chan error {
-	errC := make(chan error)
-	go func() {
-		defer close(errC)
-		for e := range encC {
-			logrus.Debug("JournalPersister:PersistStream persisting an entry")
+// validateSnapshot reads the whole snapshot, checks every record and verifies the snapshot against its manifest.
+// Permissive persisters only warn about a mismatch. Returns the manifest, nil for snapshots that predate them.
+func (lp *JournalPersister) validateSnapshot(filePath string) (*Manifest, error) {
+	m, err := readManifest(filePath)
+	if err != nil {
+		return nil, err
+	}
+	got, err := scanSnapshot(filePath, m.legacy())
+	if err != nil {
+		return nil, err
+	}
+	if m == nil && path.Base(filePath) == legacySnapshot {
+		logrus.WithField("File", filePath).Info("JournalPersister:Read snapshot predates manifests, not verified")
+		return nil, nil
+	}
+	if m == nil {
+		err = errors.Wrap(ErrManifestMismatch, "manifest missing")
+	} else {
+		err = m.verify(got)
+	}
+	if err == nil {
+		return m, nil
+	}
+	if lp.mode != ManifestPermissive {
+		return nil, err
+	}
+	logrus.WithError(err).WithField("File", filePath).Warn("JournalPersister:Read restoring a snapshot that doesn't match its manifest")
+	go metrics.Incr("persister.snapshot.mismatch")
+	return m, nil
+}
 
-			if err := lp.write(e); err != nil {
-				errC <- err
-				continue
-			}
+// scanSnapshot reads the whole snapshot, checks every record and describes what it found.
+// Every record of a legacy snapshot is a job.
+func scanSnapshot(filePath string, legacy bool) (*Manifest, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	got := &Manifest{}
+	sum := sha256.New()
+	r := journal.NewReader(f, nil, true, true)
+	for {
+		j, err := r.Next()
+		if err == io.EOF {
+			got.Checksum = hex.EncodeToString(sum.Sum(nil))
+			return got, nil
 		}
-	}()
-	return errC
+		if err != nil {
+			return nil, errors.Wrap(ErrCorruptSnapshot, err.Error())
+		}
+		buf, err := ioutil.ReadAll(j)
+		if err != nil {
+			return nil, errors.Wrap(ErrCorruptSnapshot, err.Error())
+		}
+		sum.Write(buf)
+		got.Records++
+		if legacy || (len(buf) > 0 && RecordKind(buf[0]) == RecordAdd) {
+			got.Jobs++
+		}
+		got.Bytes += int64(len(buf))
+	}
 }
 
-// Recover reads back persisted data and emits entries
-func (lp *JournalPersister) Recover() (chan []byte, error) {
-	bufC := make(chan []byte)
+// recoverFrom streams the records of the given snapshot, skipping corrupt regions at journal block boundaries.
+// The manifest, if any, tells how many records were lost in them and how the records are laid out.
+func (lp *JournalPersister) recoverFrom(ctx context.Context, filePath string, m *Manifest) (<-chan RecordResult, error) {
+	resC := make(chan RecordResult)
 
-	filePath := lp.getPath()
-	logrus.WithField("File", filePath).Infof("JournalPersister:Recover starting recovery")
+	logrus.WithField("File", filePath).Infof("JournalPersister:Read starting recovery")
 	f, err := os.Open(filePath)
 	if err != nil {
 		err = errors.Wrap(err, "Failed to open peristence file")
-		logrus.Errorf("JournalPersister:Recover %s", err)
+		logrus.Errorf("JournalPersister:Read %s", err)
 		return nil, err
 	}
-	r := journal.NewReader(f, nil, false, true)
-	if err != nil {
-		err = errors.Wrap(err, "Failed to open peristence journal reader")
-		logrus.Errorf("JournalPersister:Recover %s", err)
-		return nil, err
+	rec := &recovery{mode: lp.recoveryMode, quarantine: quarantinePath(filePath), tap: &blockTap{r: f}}
+	if rec.mode == RecoverQuarantine {
+		// Only what this recovery drops
+		os.Remove(rec.quarantine)
 	}
+	lp.recoveryLock.Lock()
+	lp.recovery = rec
+	lp.recoveryLock.Unlock()
+	r := journal.NewReader(rec.tap, lp, false, true)
+	legacy := m.legacy()
 
-	logrus.Info("JournalPersister:Recover streaming items for recovery")
+	logrus.Info("JournalPersister:Read streaming items for recovery")
 	go func() {
-		defer close(bufC)
+		defer close(resC)
+		defer f.Close()
 
+		emit := func(res RecordResult) bool {
+			select {
+			case resC <- res:
+				return true
+			case <-ctx.Done():
+				logrus.WithError(ctx.Err()).Warn("JournalPersister:Read recovery stream stopped")
+				return false
+			}
+		}
 		for {
 			j, err := r.Next()
 			if err == io.EOF {
@@ -149,36 +424,54 @@ func (lp *JournalPersister) Recover() (chan []byte, error) {
 			}
 			if err != nil {
 				err = errors.Wrap(err, "Failed to fetch next journal reader")
-				logrus.Errorf("JournalPersister:Recover %s", err)
-				break
+				logrus.Errorf("JournalPersister:Read %s", err)
+				emit(RecordResult{Err: err})
+				return
 			}
 			buf, err := ioutil.ReadAll(j)
+			lp.recoveryLock.Lock()
+			rec.seen++
 			if err != nil {
-				logrus.Tracef("JournalPersister:Recover error reading from journal %s", err)
+				logrus.WithError(err).Warn("JournalPersister:Read dropping a record cut short by a corrupt region")
+				rec.cut++
+				rec.keep(buf, err, -1)
+				lp.recoveryLock.Unlock()
 				continue
 			}
-			bufC <- buf
+			res := RecordResult{Record: legacyRecord(buf)}
+			if !legacy {
+				res.Record, res.Err = decodeRecord(buf)
+			}
+			switch {
+			case res.Err != nil:
+				// Handed out as an error and dropped
+				rec.emitted++
+				rec.rejected++
+				rec.keep(buf, res.Err, -1)
+			case res.Record.Kind == RecordAdd:
+				rec.emitted++
+			}
+			lp.recoveryLock.Unlock()
+			if !emit(res) {
+				return
+			}
 		}
-		logrus.Infof("JournalPersister:Recover finished recovery stream")
+		lp.recoveryLock.Lock()
+		rec.settle(m)
+		lp.recoveryLock.Unlock()
+		logrus.Infof("JournalPersister:Read finished recovery stream")
 	}()
 
-	return bufC, nil
+	return resC, nil
 }
 
-func (lp *JournalPersister) write(enc gob.GobEncoder) error {
+func (lp *JournalPersister) write(r Record) error {
 
 	// lazy init writer
 	if lp.writer == nil {
-		var err error
-		filePath := lp.getPath()
-		logrus.WithField("File", filePath).Infof("JournalPersister:writer starting persistence")
-		f, err := os.Create(filePath)
-		if err != nil {
-			err = errors.Wrap(err, "JournalPersister:writer Failed to open peristence file")
-			logrus.Error(err)
+		if err := lp.open(); err != nil {
 			return err
 		}
-		lp.writer = journal.NewWriter(f)
 	}
 
 	w, err := lp.writer.Next()
@@ -188,22 +481,56 @@ func (lp *JournalPersister) write(enc gob.GobEncoder) error {
 		return err
 	}
 
-	buf, err := enc.GobEncode()
+	buf := r.encode()
+	_, err = w.Write(buf)
 	if err != nil {
+		err = errors.Wrap(err, "JournalPersister:writer failed to persist entry")
+		logrus.Error(err)
 		return err
 	}
-	_, err = w.Write(buf)
+	lp.sum.Write(buf)
+	lp.manifest.Records++
+	switch r.Kind {
+	case RecordAdd:
+		lp.manifest.Jobs++
+	case RecordCheckpoint:
+		lp.manifest.WALSegment = r.WALSegment()
+	}
+	lp.manifest.Bytes += int64(len(buf))
+	return nil
+}
+
+// open starts a new timestamped snapshot under a temporary name, so that it is only picked up once complete
+func (lp *JournalPersister) open() error {
+	name := fmt.Sprintf("jobs-%s.snapshot.tmp", time.Now().UTC().Format(snapshotTimeFormat))
+	filePath := path.Join(lp.getDir(), name)
+	logrus.WithField("File", filePath).Infof("JournalPersister:writer starting persistence")
+	f, err := os.Create(filePath)
 	if err != nil {
-		err = errors.Wrap(err, "JournalPersister:writer failed to persist entry")
+		err = errors.Wrap(err, "JournalPersister:writer Failed to open peristence file")
 		logrus.Error(err)
 		return err
 	}
+	lp.file = f
+	lp.writer = journal.NewWriter(f)
+	lp.sum = sha256.New()
+	lp.manifest = Manifest{Version: ManifestVersion, CreatedAt: time.Now()}
 	return nil
 }
 
-// getPathForNamespace returns the canonical path where data for the given namespace will be persisted
-func (lp *JournalPersister) getPath() string {
+// getDir returns the directory the snapshots are kept in
+func (lp *JournalPersister) getDir() string {
 	p := path.Join(lp.dataDir, "journal")
 	os.MkdirAll(p, os.ModeDir|0774)
-	return path.Join(p, "jobs.snapshot")
+	return p
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
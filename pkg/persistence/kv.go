@@ -0,0 +1,495 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+)
+
+// Store record layout: crc, length, then op, key length, key and value. The crc covers
+// everything after the length.
+const (
+	kvHeaderSize = 8
+	kvOpPut      = 1
+	kvOpDelete   = 2
+)
+
+// Stores with more dead bytes than this, and more dead than live ones, are compacted on Sync
+const kvCompactMinBytes = 1024 * 1024
+
+// ErrCorruptStore is returned when a kv store has bad records before its end
+var ErrCorruptStore = errors.New("kv store is corrupt")
+
+// errKVShort is a record cut short by the end of the file
+var errKVShort = errors.New("KVStore: short record")
+
+// Values read per lock in a scan
+const kvScanBatch = 256
+
+// kvEntry is where the value of a key is in the store file
+type kvEntry struct {
+	off    int64 // Of the value
+	size   int   // Of the value
+	record int   // Size of the whole record
+}
+
+// kvStore is an embedded ordered key-value store. Puts and deletes are appended to a single
+// file and an in-memory ordered index of the keys points at the values on disk.
+// The file is rewritten with only the live values once it is mostly dead records.
+type kvStore struct {
+	path     string
+	sync     SyncPolicy
+	interval time.Duration
+
+	f     *os.File
+	size  int64 // End of the file, where the next record goes
+	dead  int64 // Bytes of records that were overwritten or deleted
+	index *kvIndex
+	dirty bool // Records were written since the last fsync
+	lock  *sync.RWMutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// openKVStore opens the store kept in the file at p, creating it if needed.
+// A torn record at the end, like the last one written before a crash, is cut off;
+// bad records before the end fail the open with ErrCorruptStore.
+func openKVStore(p string, policy SyncPolicy, interval time.Duration) (*kvStore, error) {
+	if err := os.MkdirAll(path.Dir(p), os.ModeDir|0774); err != nil {
+		return nil, errors.Wrap(err, "KVStore: cannot create store dir")
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0664)
+	if err != nil {
+		return nil, errors.Wrap(err, "KVStore: cannot open store")
+	}
+	s := &kvStore{
+		path:     p,
+		sync:     policy,
+		interval: interval,
+		f:        f,
+		index:    newKVIndex(),
+		lock:     &sync.RWMutex{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if s.sync == SyncInterval {
+		go s.syncer()
+	} else {
+		close(s.done)
+	}
+	return s, nil
+}
+
+// load rebuilds the index from the records in the file. A bad record is only cut off when it is
+// the torn tail of the file: cut short, the last record or followed by nothing but zeros.
+// Bad records with more records after them fail the load.
+func (s *kvStore) load() error {
+	st, err := s.f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "KVStore: cannot stat store")
+	}
+	r := bufio.NewReader(s.f)
+	var off int64
+	for {
+		rec, err := readKVRecord(r, st.Size()-off)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			torn := err == errKVShort || off+int64(rec.size) == st.Size()
+			if !torn {
+				if torn, err = s.zeroFrom(off); err != nil {
+					return err
+				}
+			}
+			if !torn {
+				go metrics.Incr("persister.kv.corrupt")
+				return errors.Wrapf(ErrCorruptStore, "%s at offset %d of %s", err, off, s.path)
+			}
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"file":   s.path,
+				"offset": off,
+				"bytes":  st.Size() - off,
+			}).Warn("KVStore: cutting off a torn record at the end of the store")
+			go metrics.Incr("persister.kv.torn")
+			if err := s.f.Truncate(off); err != nil {
+				return errors.Wrap(err, "KVStore: cannot cut off torn record")
+			}
+			break
+		}
+		switch rec.op {
+		case kvOpPut:
+			s.set(rec.key, kvEntry{off: off + int64(rec.valueAt), size: len(rec.value), record: rec.size})
+		case kvOpDelete:
+			s.unset(rec.key)
+			s.dead += int64(rec.size)
+		}
+		off += int64(rec.size)
+	}
+	s.size = off
+	return nil
+}
+
+// zeroFrom tells if the file holds nothing but zeros from off on, like space
+// a crash left allocated but never written
+func (s *kvStore) zeroFrom(off int64) (bool, error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := s.f.ReadAt(buf, off)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		off += int64(n)
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, errors.Wrap(err, "KVStore: cannot read store")
+		}
+	}
+}
+
+type kvRecord struct {
+	op      byte
+	key     string
+	value   []byte
+	valueAt int // Offset of the value in the record
+	size    int
+}
+
+func encodeKVRecord(op byte, key string, value []byte) []byte {
+	buf := make([]byte, kvHeaderSize+1+binary.MaxVarintLen64+len(key)+len(value))
+	buf[kvHeaderSize] = op
+	n := kvHeaderSize + 1
+	n += binary.PutUvarint(buf[n:], uint64(len(key)))
+	n += copy(buf[n:], key)
+	n += copy(buf[n:], value)
+	buf = buf[:n]
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(n-kvHeaderSize))
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[kvHeaderSize:]))
+	return buf
+}
+
+// readKVRecord reads the next record, with remaining bytes left in the file. Records that
+// would run past the end of the file are errKVShort. The size of a record that was read
+// whole is set even if it turns out bad.
+func readKVRecord(r io.Reader, remaining int64) (kvRecord, error) {
+	header := make([]byte, kvHeaderSize)
+	if n, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF && n == 0 {
+			return kvRecord{}, io.EOF
+		}
+		return kvRecord{}, errKVShort
+	}
+	size := int64(binary.LittleEndian.Uint32(header[4:8]))
+	if size > remaining-kvHeaderSize {
+		return kvRecord{}, errKVShort
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return kvRecord{}, errKVShort
+	}
+	rec := kvRecord{size: kvHeaderSize + len(body)}
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(header[0:4]) {
+		return rec, errors.New("KVStore: record checksum mismatch")
+	}
+	// An op and at least a key length
+	if len(body) < 2 {
+		return rec, errors.New("KVStore: record is too short")
+	}
+	keyLen, n := binary.Uvarint(body[1:])
+	if n <= 0 || uint64(len(body)-1-n) < keyLen {
+		return rec, errors.New("KVStore: record has a bad key length")
+	}
+	start := 1 + n
+	end := start + int(keyLen)
+	rec.op = body[0]
+	rec.key = string(body[start:end])
+	rec.value = body[end:]
+	rec.valueAt = kvHeaderSize + end
+	return rec, nil
+}
+
+// set points key at e in the index. Must be called with the store locked.
+func (s *kvStore) set(key string, e kvEntry) {
+	if old, ok := s.index.set(key, e); ok {
+		s.dead += int64(old.record)
+	}
+}
+
+// unset drops key from the index. Must be called with the store locked.
+func (s *kvStore) unset(key string) bool {
+	old, ok := s.index.remove(key)
+	if !ok {
+		return false
+	}
+	s.dead += int64(old.record)
+	return true
+}
+
+// append writes a record at the end of the file. Must be called with the store locked.
+func (s *kvStore) append(buf []byte) error {
+	if s.f == nil {
+		return errors.New("KVStore: closed")
+	}
+	if _, err := s.f.WriteAt(buf, s.size); err != nil {
+		return errors.Wrap(err, "KVStore: cannot write record")
+	}
+	s.size += int64(len(buf))
+	if s.sync == SyncAlways {
+		return errors.Wrap(s.f.Sync(), "KVStore: cannot sync record")
+	}
+	s.dirty = true
+	return nil
+}
+
+// Put stores value under key
+func (s *kvStore) Put(key string, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buf := encodeKVRecord(kvOpPut, key, value)
+	at := s.size
+	if err := s.append(buf); err != nil {
+		return err
+	}
+	s.set(key, kvEntry{off: at + int64(len(buf)-len(value)), size: len(value), record: len(buf)})
+	return nil
+}
+
+// Delete removes key, it is a noop for keys the store doesn't have
+func (s *kvStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.index.get(key); !ok {
+		return nil
+	}
+	buf := encodeKVRecord(kvOpDelete, key, nil)
+	if err := s.append(buf); err != nil {
+		return err
+	}
+	s.unset(key)
+	s.dead += int64(len(buf))
+	return nil
+}
+
+// Get returns the value stored under key, nil if there is none
+func (s *kvStore) Get(key string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	e, ok := s.index.get(key)
+	if !ok {
+		return nil, nil
+	}
+	return s.read(e)
+}
+
+// read reads a value from the file. Must be called with the store locked.
+func (s *kvStore) read(e kvEntry) ([]byte, error) {
+	if s.f == nil {
+		return nil, errors.New("KVStore: closed")
+	}
+	buf := make([]byte, e.size)
+	if _, err := s.f.ReadAt(buf, e.off); err != nil {
+		return nil, errors.Wrap(err, "KVStore: cannot read value")
+	}
+	return buf, nil
+}
+
+// Keys returns the keys in [start, limit), in order. An empty limit means no upper bound.
+func (s *kvStore) Keys(start, limit string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := []string{}
+	for n := s.index.seek(start); n != nil && (limit == "" || n.key < limit); n = n.next[0] {
+		keys = append(keys, n.key)
+	}
+	return keys
+}
+
+// Scan calls fn with the keys in [start, limit) and their values, in order, until fn returns false.
+// An empty limit means no upper bound. Values are read a batch at a time, the store isn't locked while fn runs.
+func (s *kvStore) Scan(start, limit string, fn func(key string, value []byte) bool) error {
+	for {
+		keys, values, err := s.scanBatch(start, limit)
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			if !fn(keys[i], values[i]) {
+				return nil
+			}
+		}
+		if len(keys) < kvScanBatch {
+			return nil
+		}
+		// Right after the last key
+		start = keys[len(keys)-1] + "\x00"
+	}
+}
+
+func (s *kvStore) scanBatch(start, limit string) ([]string, [][]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := []string{}
+	values := [][]byte{}
+	for n := s.index.seek(start); n != nil && len(keys) < kvScanBatch; n = n.next[0] {
+		if limit != "" && n.key >= limit {
+			break
+		}
+		v, err := s.read(n.entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, n.key)
+		values = append(values, v)
+	}
+	return keys, values, nil
+}
+
+// Len returns the number of keys in the store
+func (s *kvStore) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.index.len
+}
+
+// Sync fsyncs the store and compacts it if it is mostly dead records
+func (s *kvStore) Sync() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.f == nil {
+		return errors.New("KVStore: closed")
+	}
+	if err := s.f.Sync(); err != nil {
+		return errors.Wrap(err, "KVStore: cannot sync")
+	}
+	s.dirty = false
+	if s.dead > kvCompactMinBytes && s.dead > s.size-s.dead {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact rewrites the store with only its live records, through a temp file.
+// Must be called with the store locked.
+func (s *kvStore) compact() error {
+	start := time.Now()
+	tmp, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return errors.Wrap(err, "KVStore: cannot create compacted store")
+	}
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "KVStore: cannot compact")
+	}
+
+	w := bufio.NewWriter(tmp)
+	// Where the values go in the compacted store, in key order
+	moved := make([]kvEntry, 0, s.index.len)
+	var off int64
+	for n := s.index.seek(""); n != nil; n = n.next[0] {
+		v, err := s.read(n.entry)
+		if err != nil {
+			return fail(err)
+		}
+		buf := encodeKVRecord(kvOpPut, n.key, v)
+		if _, err := w.Write(buf); err != nil {
+			return fail(err)
+		}
+		moved = append(moved, kvEntry{off: off + int64(len(buf)-len(v)), size: len(v), record: len(buf)})
+		off += int64(len(buf))
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fail(err)
+	}
+	if err := syncDir(path.Dir(s.path)); err != nil {
+		logrus.WithError(err).Warn("KVStore: cannot sync store dir")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"file":     s.path,
+		"before":   s.size,
+		"after":    off,
+		"duration": time.Since(start),
+	}).Info("KVStore: compacted")
+	go metrics.Incr("persister.kv.compact")
+	s.f.Close()
+	s.f = tmp
+	i := 0
+	for n := s.index.seek(""); n != nil; n = n.next[0] {
+		n.entry = moved[i]
+		i++
+	}
+	s.size = off
+	s.dead = 0
+	return nil
+}
+
+// syncer fsyncs written records every interval until the store is closed
+func (s *kvStore) syncer() {
+	defer close(s.done)
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			s.lock.Lock()
+			if s.dirty && s.f != nil {
+				if err := s.f.Sync(); err != nil {
+					logrus.WithError(err).Error("KVStore: cannot sync records")
+					go metrics.Incr("persister.kv.sync.error")
+				}
+				s.dirty = false
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// Close syncs and closes the store
+func (s *kvStore) Close() error {
+	s.lock.Lock()
+	if s.f == nil {
+		s.lock.Unlock()
+		return nil
+	}
+	close(s.stop)
+	err := s.f.Sync()
+	s.f.Close()
+	s.f = nil
+	s.lock.Unlock()
+
+	<-s.done
+	return err
+}
@@ -0,0 +1,111 @@
+package persistence
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Levels of the index skiplist, enough for far more keys than a store holds
+const kvIndexMaxLevel = 24
+
+// kvIndex is the ordered index of a kvStore: a skiplist from keys to where their values are,
+// so that keys are added and removed in O(log n) and ranges are walked in order
+type kvIndex struct {
+	head  *kvNode
+	level int // Levels in use
+	len   int
+	rnd   *rand.Rand
+}
+
+type kvNode struct {
+	key   string
+	entry kvEntry
+	next  []*kvNode // Following node on each level
+}
+
+func newKVIndex() *kvIndex {
+	return &kvIndex{
+		head:  &kvNode{next: make([]*kvNode, kvIndexMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// randomLevel picks how many levels a new node is linked on, each one half as likely as the one below
+func (x *kvIndex) randomLevel() int {
+	l := 1
+	for l < kvIndexMaxLevel && x.rnd.Int63()&1 == 0 {
+		l++
+	}
+	return l
+}
+
+// path fills prev with the last node before key on each level and returns the first node at or after key
+func (x *kvIndex) path(key string, prev []*kvNode) *kvNode {
+	n := x.head
+	for l := x.level - 1; l >= 0; l-- {
+		for n.next[l] != nil && n.next[l].key < key {
+			n = n.next[l]
+		}
+		if prev != nil {
+			prev[l] = n
+		}
+	}
+	return n.next[0]
+}
+
+// get returns where the value of key is
+func (x *kvIndex) get(key string) (kvEntry, bool) {
+	n := x.path(key, nil)
+	if n == nil || n.key != key {
+		return kvEntry{}, false
+	}
+	return n.entry, true
+}
+
+// set points key at e and returns the entry it replaced, if any
+func (x *kvIndex) set(key string, e kvEntry) (kvEntry, bool) {
+	prev := make([]*kvNode, kvIndexMaxLevel)
+	n := x.path(key, prev)
+	if n != nil && n.key == key {
+		old := n.entry
+		n.entry = e
+		return old, true
+	}
+	level := x.randomLevel()
+	for l := x.level; l < level; l++ {
+		prev[l] = x.head
+	}
+	if level > x.level {
+		x.level = level
+	}
+	n = &kvNode{key: key, entry: e, next: make([]*kvNode, level)}
+	for l := 0; l < level; l++ {
+		n.next[l] = prev[l].next[l]
+		prev[l].next[l] = n
+	}
+	x.len++
+	return kvEntry{}, false
+}
+
+// remove drops key and returns the entry it pointed at, if any
+func (x *kvIndex) remove(key string) (kvEntry, bool) {
+	prev := make([]*kvNode, kvIndexMaxLevel)
+	n := x.path(key, prev)
+	if n == nil || n.key != key {
+		return kvEntry{}, false
+	}
+	for l := 0; l < len(n.next); l++ {
+		prev[l].next[l] = n.next[l]
+	}
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+	x.len--
+	return n.entry, true
+}
+
+// seek returns the first node at or after key, nil if there is none. Walk on with node.next[0].
+func (x *kvIndex) seek(key string) *kvNode {
+	return x.path(key, nil)
+}
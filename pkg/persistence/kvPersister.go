@@ -0,0 +1,424 @@
+package persistence
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNotKeyed is returned when KVPersister is given a job record without an id
+var ErrNotKeyed = errors.New("record has no id to be keyed by")
+
+// KVOpts configure a KVPersister
+type KVOpts struct {
+	Sync         SyncPolicy    // When puts and deletes are synced to disk
+	SyncInterval time.Duration // For SyncInterval
+}
+
+// KVPersister keeps jobs in an embedded ordered key-value store, keyed by trigger time and id.
+// It stores snapshots like other persisters, and jobs one by one as a JobStore.
+// Batches, consumer groups and deliveries are kept in a second store, keyed by kind and id.
+type KVPersister struct {
+	dataDir      string
+	opts         KVOpts
+	store        *kvStore
+	state        *kvStore
+	ids          map[string]string   // Job id to its key
+	written      map[string]struct{} // Keys of the snapshot being written, nil outside of one
+	writtenState map[string]struct{} // State keys of the snapshot being written, nil outside of one
+	lock         *sync.Mutex
+}
+
+// NewKVPersister initializes a key-value store backed persister
+func NewKVPersister(dataDir string, opts *KVOpts) Persister {
+	return &KVPersister{
+		dataDir: dataDir,
+		opts:    *opts,
+		lock:    &sync.Mutex{},
+	}
+}
+
+// kvKey orders jobs by trigger time, then id
+func kvKey(triggerAt time.Time, id string) string {
+	buf := make([]byte, 8, 8+len(id))
+	// Flipping the sign bit sorts times before 1970 first
+	binary.BigEndian.PutUint64(buf, uint64(triggerAt.UnixNano())^(1<<63))
+	return string(append(buf, id...))
+}
+
+// stateKey orders state records by kind, then id. Deliveries are keyed by job, then group.
+func stateKey(r Record) string {
+	key := string([]byte{byte(r.Kind)}) + r.ID
+	if r.Kind == RecordDeliver {
+		key += "\x00" + string(r.Data)
+	}
+	return key
+}
+
+func (p *KVPersister) storePath() string {
+	return path.Join(p.dataDir, "kv", "jobs.db")
+}
+
+func (p *KVPersister) statePath() string {
+	return path.Join(p.dataDir, "kv", "state.db")
+}
+
+// open opens the store on first use. Must be called with the persister locked.
+func (p *KVPersister) open() error {
+	if p.store != nil {
+		return nil
+	}
+	s, err := openKVStore(p.storePath(), p.opts.Sync, p.opts.SyncInterval)
+	if err != nil {
+		return err
+	}
+	st, err := openKVStore(p.statePath(), p.opts.Sync, p.opts.SyncInterval)
+	if err != nil {
+		s.Close()
+		return err
+	}
+	p.store = s
+	p.state = st
+	p.ids = map[string]string{}
+	for _, k := range s.Keys("", "") {
+		p.ids[k[8:]] = k
+	}
+	logrus.WithFields(logrus.Fields{
+		"file":  p.storePath(),
+		"jobs":  len(p.ids),
+		"state": st.Len(),
+	}).Info("KVPersister: opened store")
+	return nil
+}
+
+// put stores a job, replacing the one with the same id. Must be called with the persister locked.
+func (p *KVPersister) put(id string, triggerAt time.Time, data []byte) error {
+	if err := p.open(); err != nil {
+		return err
+	}
+	key := kvKey(triggerAt, id)
+	if old, ok := p.ids[id]; ok && old != key {
+		if err := p.store.Delete(old); err != nil {
+			return err
+		}
+	}
+	if err := p.store.Put(key, data); err != nil {
+		return err
+	}
+	p.ids[id] = key
+	if p.written != nil {
+		p.written[key] = struct{}{}
+	}
+	return nil
+}
+
+// ResetDataDir deletes the store
+func (p *KVPersister) ResetDataDir() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	logrus.Warnf("KVPersister:ResetDataDir resetting store: %s", p.storePath())
+	if p.store != nil {
+		p.store.Close()
+		p.state.Close()
+		p.store = nil
+		p.state = nil
+	}
+	p.written = nil
+	p.writtenState = nil
+	if err := os.RemoveAll(path.Dir(p.storePath())); err != nil {
+		return errors.Wrap(err, "KVPersister: cannot remove store")
+	}
+	return nil
+}
+
+// Write applies a record of a snapshot to the store: adds, batches and groups are stored and cancels deleted.
+// Checkpoints need nothing, Commit ends the snapshot.
+func (p *KVPersister) Write(ctx context.Context, r Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.written == nil {
+		p.written = map[string]struct{}{}
+	}
+	switch r.Kind {
+	case RecordAdd:
+		if r.ID == "" {
+			return ErrNotKeyed
+		}
+		return p.put(r.ID, r.TriggerAt, r.Data)
+	case RecordCancel:
+		if key, ok := p.ids[r.ID]; ok {
+			delete(p.written, key)
+		}
+		return p.delete(r.ID)
+	case RecordBatch, RecordGroup:
+		if err := p.putState(r); err != nil {
+			return err
+		}
+		if p.writtenState == nil {
+			p.writtenState = map[string]struct{}{}
+		}
+		p.writtenState[stateKey(r)] = struct{}{}
+	}
+	return nil
+}
+
+// Commit completes the snapshot being written: jobs and state that weren't written since the last
+// Commit are deleted, so that the store holds exactly the snapshot
+func (p *KVPersister) Commit(ctx context.Context) error {
+	logrus.Info("KVPersister:Commit committing snapshot")
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.open(); err != nil {
+		return err
+	}
+	for id, key := range p.ids {
+		if _, ok := p.written[key]; ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := p.store.Delete(key); err != nil {
+			return err
+		}
+		delete(p.ids, id)
+	}
+	for _, key := range p.state.Keys("", "") {
+		if _, ok := p.writtenState[key]; ok {
+			continue
+		}
+		if err := p.state.Delete(key); err != nil {
+			return err
+		}
+	}
+	p.written = nil
+	p.writtenState = nil
+	if err := p.state.Sync(); err != nil {
+		return err
+	}
+	return p.store.Sync()
+}
+
+// Sync flushes the stored jobs and state to disk and compacts the stores that are mostly deleted records
+func (p *KVPersister) Sync() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.open(); err != nil {
+		return err
+	}
+	if err := p.state.Sync(); err != nil {
+		return err
+	}
+	return p.store.Sync()
+}
+
+// Read emits the stored batches, consumer groups and deliveries, then the stored jobs in trigger order
+func (p *KVPersister) Read(ctx context.Context) (<-chan RecordResult, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.store == nil {
+		if _, err := os.Stat(p.storePath()); err != nil {
+			return nil, errors.Wrapf(err, "Failed to find a store in %s", p.dataDir)
+		}
+	}
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+	return p.scan(ctx, "", "", true), nil
+}
+
+// scan streams the jobs with keys in [start, limit) in the background, after the state records if withState is set
+func (p *KVPersister) scan(ctx context.Context, start, limit string, withState bool) <-chan RecordResult {
+	s, st := p.store, p.state
+	resC := make(chan RecordResult)
+	go func() {
+		defer close(resC)
+		emit := func(r Record) bool {
+			select {
+			case resC <- RecordResult{Record: r}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		var err error
+		if withState {
+			err = st.Scan("", "", func(key string, value []byte) bool {
+				return emit(stateRecordOf(key, value))
+			})
+		}
+		count := 0
+		if err == nil && ctx.Err() == nil {
+			err = s.Scan(start, limit, func(key string, value []byte) bool {
+				count++
+				return emit(kvRecordOf(key, value))
+			})
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			logrus.WithError(err).Error("KVPersister: scan stopped")
+			select {
+			case resC <- RecordResult{Err: err}:
+			case <-ctx.Done():
+			}
+		}
+		logrus.Debugf("KVPersister: scanned %d jobs", count)
+	}()
+	return resC
+}
+
+// stateRecordOf returns the state record stored under key
+func stateRecordOf(key string, value []byte) Record {
+	r := Record{Kind: RecordKind(key[0]), ID: key[1:], Data: value}
+	if r.Kind == RecordDeliver {
+		if i := strings.IndexByte(r.ID, 0); i >= 0 {
+			r.ID = r.ID[:i]
+		}
+	}
+	return r
+}
+
+// kvRecordOf returns the job stored under key
+func kvRecordOf(key string, value []byte) Record {
+	at := int64(binary.BigEndian.Uint64([]byte(key[:8])) ^ (1 << 63))
+	return Record{Kind: RecordAdd, ID: key[8:], TriggerAt: time.Unix(0, at), Data: value}
+}
+
+// PutJob stores a job, replacing the one with the same id like after a reschedule
+func (p *KVPersister) PutJob(id string, triggerAt time.Time, data []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.put(id, triggerAt, data)
+}
+
+// DeleteJob removes a job, it is a noop for unknown jobs
+func (p *KVPersister) DeleteJob(id string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.delete(id)
+}
+
+// GetJob returns the job stored under id, nil if there is none
+func (p *KVPersister) GetJob(id string) ([]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+	key, ok := p.ids[id]
+	if !ok {
+		return nil, nil
+	}
+	return p.store.Get(key)
+}
+
+// delete removes a job. Must be called with the persister locked.
+func (p *KVPersister) delete(id string) error {
+	if err := p.open(); err != nil {
+		return err
+	}
+	key, ok := p.ids[id]
+	if !ok {
+		return nil
+	}
+	if err := p.store.Delete(key); err != nil {
+		return err
+	}
+	delete(p.ids, id)
+	return nil
+}
+
+// Scan emits the jobs that trigger in [from, to), in trigger order
+func (p *KVPersister) Scan(ctx context.Context, from, to time.Time) (<-chan RecordResult, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+	return p.scan(ctx, kvKey(from, ""), kvKey(to, ""), false), nil
+}
+
+// PutState stores a batch, consumer group or delivery record
+func (p *KVPersister) PutState(r Record) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.putState(r)
+}
+
+// putState stores a state record. Must be called with the persister locked.
+func (p *KVPersister) putState(r Record) error {
+	switch r.Kind {
+	case RecordBatch, RecordGroup, RecordDeliver:
+	default:
+		return errors.Errorf("KVPersister: %s records aren't state", r.Kind)
+	}
+	if r.ID == "" {
+		return ErrNotKeyed
+	}
+	if err := p.open(); err != nil {
+		return err
+	}
+	return p.state.Put(stateKey(r), r.Data)
+}
+
+// DeleteState drops a batch or consumer group, or all the deliveries of a job. It is a noop for unknown ids.
+func (p *KVPersister) DeleteState(kind RecordKind, id string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.open(); err != nil {
+		return err
+	}
+	key := string([]byte{byte(kind)}) + id
+	if kind != RecordDeliver {
+		return p.state.Delete(key)
+	}
+	// Every group the job was delivered to, up to the next byte after the separator
+	for _, k := range p.state.Keys(key+"\x00", key+"\x01") {
+		if err := p.state.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SnapshotPath returns where the store is
+func (p *KVPersister) SnapshotPath() string {
+	return p.storePath()
+}
+
+// Close closes the store
+func (p *KVPersister) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.store == nil {
+		return nil
+	}
+	err := p.store.Close()
+	if serr := p.state.Close(); err == nil {
+		err = serr
+	}
+	p.store = nil
+	p.state = nil
+	return err
+}
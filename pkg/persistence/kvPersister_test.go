@@ -0,0 +1,223 @@
+package persistence_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test kv persister", func() {
+	dataDir := path.Join(os.TempDir(), "goyaadkvtest")
+	storePath := path.Join(dataDir, "kv", "jobs.db")
+	base := time.Now().Truncate(time.Second)
+	var p persistence.Persister
+	var store persistence.JobStore
+
+	BeforeEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		p = persistence.NewKVPersister(dataDir, &persistence.KVOpts{})
+		store = p.(persistence.JobStore)
+	})
+
+	AfterEach(func() {
+		p.(*persistence.KVPersister).Close()
+	})
+
+	put := func(id string, at time.Time) {
+		j := goyaad.NewJob(id, at, []byte("body-"+id))
+		data, err := j.GobEncode()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.PutJob(id, at, data)).To(Succeed())
+	}
+
+	ctx := context.Background()
+
+	ids := func(resC <-chan persistence.RecordResult, err error) []string {
+		Expect(err).NotTo(HaveOccurred())
+		ids := []string{}
+		for res := range resC {
+			Expect(res.Err).NotTo(HaveOccurred())
+			j := goyaad.Job{}
+			Expect(j.GobDecode(res.Record.Data)).To(Succeed())
+			Expect(res.Record.ID).To(Equal(j.ID()))
+			ids = append(ids, j.ID())
+		}
+		return ids
+	}
+
+	reopen := func() persistence.Persister {
+		Expect(p.(*persistence.KVPersister).Close()).To(Succeed())
+		p = persistence.NewKVPersister(dataDir, &persistence.KVOpts{})
+		store = p.(persistence.JobStore)
+		return p
+	}
+
+	It("keeps puts and deletes without a snapshot", func() {
+		put("a", base.Add(time.Minute))
+		put("b", base.Add(time.Second))
+		put("c", base.Add(time.Hour))
+		Expect(store.DeleteJob("c")).To(Succeed())
+		Expect(store.DeleteJob("unknown")).To(Succeed())
+
+		// In trigger order
+		Expect(ids(reopen().Read(ctx))).To(Equal([]string{"b", "a"}))
+	})
+
+	It("moves rescheduled jobs", func() {
+		put("a", base.Add(time.Minute))
+		put("b", base.Add(time.Second))
+		put("b", base.Add(time.Hour))
+		Expect(ids(reopen().Read(ctx))).To(Equal([]string{"a", "b"}))
+		Expect(store.DeleteJob("b")).To(Succeed())
+		Expect(ids(p.Read(ctx))).To(Equal([]string{"a"}))
+	})
+
+	It("scans ranges of trigger times", func() {
+		for i := 0; i < 600; i++ {
+			put(fmt.Sprintf("job-%03d", i), base.Add(time.Duration(i)*time.Second))
+		}
+		put("past", base.Add(-time.Hour))
+		got := ids(store.Scan(ctx, base.Add(100*time.Second), base.Add(400*time.Second)))
+		Expect(got).To(HaveLen(300))
+		Expect(got[0]).To(Equal("job-100"))
+		Expect(got[299]).To(Equal("job-399"))
+		Expect(ids(store.Scan(ctx, time.Unix(0, 0), base))).To(Equal([]string{"past"}))
+	})
+
+	It("keeps jobs in trigger order whatever order they come in", func() {
+		want := []string{}
+		for _, i := range rand.Perm(2000) {
+			id := fmt.Sprintf("job-%04d", i)
+			put(id, base.Add(time.Duration(i)*time.Millisecond))
+			if i%3 == 0 {
+				Expect(store.DeleteJob(id)).To(Succeed())
+			}
+		}
+		for i := 0; i < 2000; i++ {
+			if i%3 != 0 {
+				want = append(want, fmt.Sprintf("job-%04d", i))
+			}
+		}
+		Expect(ids(p.Read(ctx))).To(Equal(want))
+		Expect(ids(reopen().Read(ctx))).To(Equal(want))
+
+		data, err := store.GetJob("job-0001")
+		Expect(err).NotTo(HaveOccurred())
+		j := goyaad.Job{}
+		Expect(j.GobDecode(data)).To(Succeed())
+		Expect(j.Body()).To(Equal([]byte("body-job-0001")))
+		Expect(store.GetJob("job-0000")).To(BeNil())
+	})
+
+	It("reads stored batches, groups and deliveries back before the jobs", func() {
+		put("a", base)
+		Expect(store.PutState(persistence.Record{Kind: persistence.RecordGroup, ID: "billing", Data: []byte{1, 0}})).To(Succeed())
+		Expect(store.PutState(persistence.Record{Kind: persistence.RecordBatch, ID: "b1", Data: []byte{1, 0, 0}})).To(Succeed())
+		Expect(store.PutState(persistence.Record{Kind: persistence.RecordBatch, ID: "b1", Data: []byte{2, 1, 0}})).To(Succeed())
+		for _, g := range []string{"billing", "audit"} {
+			Expect(store.PutState(persistence.Record{Kind: persistence.RecordDeliver, ID: "a", Data: []byte(g)})).To(Succeed())
+		}
+		Expect(store.PutState(persistence.Record{Kind: persistence.RecordDeliver, ID: "ab", Data: []byte("billing")})).To(Succeed())
+		Expect(store.DeleteState(persistence.RecordDeliver, "a")).To(Succeed())
+		Expect(store.PutJob("x", base, nil)).To(Succeed())
+
+		resC, err := reopen().Read(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		records := []persistence.Record{}
+		for res := range resC {
+			Expect(res.Err).NotTo(HaveOccurred())
+			records = append(records, res.Record)
+		}
+		Expect(records).To(HaveLen(5))
+		Expect(records[0]).To(Equal(persistence.Record{Kind: persistence.RecordBatch, ID: "b1", Data: []byte{2, 1, 0}}))
+		Expect(records[1]).To(Equal(persistence.Record{Kind: persistence.RecordGroup, ID: "billing", Data: []byte{1, 0}}))
+		Expect(records[2]).To(Equal(persistence.Record{Kind: persistence.RecordDeliver, ID: "ab", Data: []byte("billing")}))
+		Expect(records[3].Kind).To(Equal(persistence.RecordAdd))
+		Expect(records[4].Kind).To(Equal(persistence.RecordAdd))
+	})
+
+	It("cuts off a torn record at the end", func() {
+		put("a", base)
+		put("b", base.Add(time.Second))
+		reopen()
+		f, err := os.OpenFile(storePath, os.O_WRONLY|os.O_APPEND, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.Write([]byte{1, 2, 3, 4, 200, 0, 0, 0, 1})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		Expect(ids(p.Read(ctx))).To(Equal([]string{"a", "b"}))
+		put("c", base.Add(time.Minute))
+		Expect(ids(reopen().Read(ctx))).To(Equal([]string{"a", "b", "c"}))
+	})
+
+	It("cuts off a zero-filled tail", func() {
+		put("a", base)
+		reopen()
+		f, err := os.OpenFile(storePath, os.O_WRONLY|os.O_APPEND, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.Write(make([]byte, 64))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		Expect(ids(p.Read(ctx))).To(Equal([]string{"a"}))
+		put("b", base.Add(time.Second))
+		Expect(ids(reopen().Read(ctx))).To(Equal([]string{"a", "b"}))
+	})
+
+	It("fails on a bad record before the end", func() {
+		put("a", base)
+		put("b", base.Add(time.Second))
+		reopen()
+		f, err := os.OpenFile(storePath, os.O_RDWR, 0)
+		Expect(err).NotTo(HaveOccurred())
+		// Into the value of the first record
+		_, err = f.WriteAt([]byte{0xff}, 30)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		_, err = p.Read(ctx)
+		Expect(errors.Cause(err)).To(Equal(persistence.ErrCorruptStore))
+		st, err := os.Stat(storePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st.Size()).To(BeNumerically(">", 30))
+	})
+
+	It("compacts a store that is mostly deleted jobs", func() {
+		body := bytes.Repeat([]byte("x"), 64*1024)
+		for i := 0; i < 40; i++ {
+			Expect(store.PutJob(fmt.Sprintf("job-%d", i), base, body)).To(Succeed())
+		}
+		for i := 1; i < 40; i++ {
+			Expect(store.DeleteJob(fmt.Sprintf("job-%d", i))).To(Succeed())
+		}
+		before, err := os.Stat(storePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.Sync()).To(Succeed())
+		after, err := os.Stat(storePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(after.Size()).To(BeNumerically("<", before.Size()/10))
+		Expect(store.GetJob("job-0")).To(Equal(body))
+
+		resC, err := reopen().Read(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect((<-resC).Record.Data).To(Equal(body))
+		Eventually(resC).Should(BeClosed())
+	})
+
+	It("refuses jobs it can't key", func() {
+		Expect(p.Write(ctx, persistence.Record{Kind: persistence.RecordAdd, Data: []byte("raw")})).To(Equal(persistence.ErrNotKeyed))
+	})
+})
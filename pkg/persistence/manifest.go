@@ -0,0 +1,129 @@
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestVersion is the snapshot format version written to manifests.
+// Version 1 snapshots hold encoded jobs, version 2 snapshots hold typed records.
+const ManifestVersion = 2
+
+// ErrManifestMismatch is returned when a snapshot doesn't match its manifest
+var ErrManifestMismatch = errors.New("snapshot doesn't match its manifest")
+
+// Manifest describes a snapshot so that restores can tell a complete snapshot from a truncated or foreign one
+type Manifest struct {
+	Version   int           `json:"version"`
+	CreatedAt time.Time     `json:"created_at"`
+	SpokeSpan time.Duration `json:"spoke_span"` // Of the hub the snapshot was taken from
+	Jobs      int           `json:"jobs"`
+	Records   int           `json:"records,omitempty"` // Jobs, cancels and checkpoints, since version 2
+	Bytes     int64         `json:"bytes"`
+	Checksum  string        `json:"checksum"` // sha256 of the records, in order
+	// First WAL segment the snapshot doesn't cover, 0 if it was taken without a WAL
+	WALSegment int `json:"wal_segment,omitempty"`
+}
+
+// ManifestMode picks what a restore does with a snapshot that doesn't match its manifest
+type ManifestMode int
+
+const (
+	// ManifestStrict treats the snapshot as corrupt
+	ManifestStrict ManifestMode = iota
+	// ManifestPermissive warns and restores the snapshot anyway
+	ManifestPermissive
+)
+
+// ParseManifestMode reads a manifest mode: "strict" or "permissive"
+func ParseManifestMode(s string) (ManifestMode, error) {
+	switch s {
+	case "strict":
+		return ManifestStrict, nil
+	case "permissive":
+		return ManifestPermissive, nil
+	}
+	return ManifestStrict, fmt.Errorf("unknown manifest mode: %s", s)
+}
+
+// verify returns why the snapshot described by got doesn't match m
+func (m *Manifest) verify(got *Manifest) error {
+	if err := m.checkVersion(); err != nil {
+		return err
+	}
+	if m.Jobs != got.Jobs || m.Bytes != got.Bytes {
+		return errors.Wrapf(ErrManifestMismatch, "%d jobs in %d bytes, the manifest has %d jobs in %d bytes",
+			got.Jobs, got.Bytes, m.Jobs, m.Bytes)
+	}
+	if m.Version >= 2 && m.Records != got.Records {
+		return errors.Wrapf(ErrManifestMismatch, "%d records, the manifest has %d records", got.Records, m.Records)
+	}
+	if m.Checksum != got.Checksum {
+		return errors.Wrapf(ErrManifestMismatch, "checksum %s, the manifest has %s", got.Checksum, m.Checksum)
+	}
+	return nil
+}
+
+// checkVersion returns an error if the snapshot was written in a format this server doesn't read
+func (m *Manifest) checkVersion() error {
+	if m.Version < 1 || m.Version > ManifestVersion {
+		return errors.Wrapf(ErrManifestMismatch, "format version %d, this server reads version %d", m.Version, ManifestVersion)
+	}
+	return nil
+}
+
+// legacy returns true for snapshots written before records were typed, including the ones without a manifest
+func (m *Manifest) legacy() bool {
+	return m == nil || m.Version < 2
+}
+
+// manifestPath returns where the manifest of the given snapshot is kept
+func manifestPath(snapshot string) string {
+	return snapshot + ".manifest"
+}
+
+// writeManifest writes the manifest of the given snapshot through a temp file
+func writeManifest(snapshot string, m *Manifest) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	p := manifestPath(snapshot)
+	f, err := os.Create(p + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// readManifest reads the manifest of the given snapshot, nil if it has none
+func readManifest(snapshot string) (*Manifest, error) {
+	buf, err := ioutil.ReadFile(manifestPath(snapshot))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, errors.Wrap(err, "unreadable manifest")
+	}
+	return m, nil
+}
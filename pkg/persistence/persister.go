@@ -1,15 +1,68 @@
 package persistence
 
-import "encoding/gob"
+import (
+	"context"
+	"time"
+)
 
-// Persister saves the data given to it to a durable data store like a disk, S3 buckets, durable streams etc
+// Writer writes snapshots: the records written until Commit make up a snapshot
+type Writer interface {
+	Write(ctx context.Context, r Record) error
+	// Commit completes the snapshot, it replaces the last one once it is durable.
+	// Records written after Commit go to a new snapshot.
+	Commit(ctx context.Context) error
+}
+
+// Reader reads back the records of the last complete snapshot. Errors that don't end the
+// stream come in line with the records. The stream stops early once ctx is done.
+type Reader interface {
+	Read(ctx context.Context) (<-chan RecordResult, error)
+}
+
+// Persister saves snapshots to a durable data store like a disk and reads them back
 type Persister interface {
+	Writer
+	Reader
 	ResetDataDir() error
+}
+
+// Backup copies a complete snapshot somewhere else, like S3
+type Backup interface {
+	Backup(ctx context.Context, snapshot string) error
+}
+
+// SnapshotReporter is implemented by persisters that can tell where Commit put the snapshot
+type SnapshotReporter interface {
+	SnapshotPath() string
+}
 
-	Persist(enc gob.GobEncoder) error
-	PersistStream(encC chan gob.GobEncoder) chan error
-	UploadToS3()
-	Finalize()
+// ManifestKeeper is implemented by persisters that write a manifest with each snapshot
+type ManifestKeeper interface {
+	Describe(spokeSpan time.Duration)
+	RecoveredManifest() *Manifest
+}
+
+// RecoveryReporter is implemented by persisters that count the records a recovery dropped
+// and take back the ones the restoring hub can't decode
+type RecoveryReporter interface {
+	Reject(buf []byte, reason error)
+	RecoveryStats() RecoveryStats
+}
 
-	Recover() (chan []byte, error)
+// JobStore is implemented by persisters that store jobs one by one. A hub keeps its jobs in the store
+// as they change, so that cancels and consumes are durable on their own and no snapshots are needed.
+type JobStore interface {
+	PutJob(id string, triggerAt time.Time, data []byte) error
+	DeleteJob(id string) error
+	// GetJob returns the job stored under id, nil if there is none
+	GetJob(id string) ([]byte, error)
+	// Sync flushes the stored jobs to disk, standing in for snapshots
+	Sync() error
+	// Scan emits the jobs that trigger in [from, to), in trigger order, like the jobs of a spoke
+	Scan(ctx context.Context, from, to time.Time) (<-chan RecordResult, error)
+	// PutState stores a batch, consumer group or delivery record, replacing the batch or group with the same id.
+	// Read emits the stored state records before the jobs.
+	PutState(r Record) error
+	// DeleteState drops the batch or consumer group with the given id, or all the deliveries of a job
+	DeleteState(kind RecordKind, id string) error
 }
@@ -1,13 +1,18 @@
 package persistence_test
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb/journal"
 
 	"github.com/urjitbhatia/goyaad/pkg/goyaad"
 	"github.com/urjitbhatia/goyaad/pkg/persistence"
@@ -27,11 +32,7 @@ var _ = Describe("Test persistence", func() {
 		})
 
 		It("properly resets data dir", func() {
-			j := goyaad.NewJobAutoID(time.Now(), testBody)
-			err := p.Persist(j)
-			Expect(err).To(BeNil())
-
-			p.Finalize()
+			writeSnapshot(p, goyaad.NewJobAutoID(time.Now(), testBody))
 
 			// reset
 			Expect(p.ResetDataDir()).To(BeNil())
@@ -45,29 +46,211 @@ var _ = Describe("Test persistence", func() {
 			defer close(done)
 
 			j := goyaad.NewJobAutoID(time.Now(), testBody)
-			err := p.Persist(j)
+			writeSnapshot(p, j)
+
+			// recovers a job
+			records := readRecords(p)
+			Expect(len(records)).To(Equal(1))
+			Expect(records[0].Kind).To(Equal(persistence.RecordAdd))
+			Expect(records[0].ID).To(Equal(j.ID()))
+			Expect(records[0].TriggerAt.UnixNano()).To(Equal(j.TriggerAt().UnixNano()))
+
+			job := goyaad.Job{}
+			Expect(job.GobDecode(records[0].Data)).To(BeNil())
+			Expect(job.Body()).To(Equal(j.Body()))
+			Expect(job.ID()).To(Equal(j.ID()))
+			Expect(job.TriggerAt().UnixNano()).To(Equal(j.TriggerAt().UnixNano()))
+		}, 5)
+
+		recoverIDs := readIDs
+
+		snapshot := func(p persistence.Persister, id string) string {
+			writeSnapshot(p, goyaad.NewJob(id, time.Now(), testBody))
+			return p.(persistence.SnapshotReporter).SnapshotPath()
+		}
+
+		It("keeps the last snapshots and recovers the newest", func() {
+			p = persistence.NewJournalPersisterWithOpts(persistenceTestDir, &persistence.JournalOpts{Keep: 2})
+			first := snapshot(p, "first")
+			second := snapshot(p, "second")
+			third := snapshot(p, "third")
+			Expect(second < third).To(BeTrue())
+
+			_, err := os.Stat(first)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			kept, err := filepath.Glob(path.Join(persistenceTestDir, "journal", "jobs-*"))
 			Expect(err).To(BeNil())
+			Expect(kept).To(ConsistOf(second, second+".manifest", third, third+".manifest"))
 
-			p.Finalize()
+			Expect(recoverIDs(p)).To(Equal([]string{"third"}))
+		})
 
-			// recovers a job
-			jobsChan, err := p.Recover()
+		It("fails on a corrupt newest snapshot in strict recovery", func() {
+			snapshot(p, "older")
+			newest := snapshot(p, "newest")
+
+			buf, err := ioutil.ReadFile(newest)
+			Expect(err).To(BeNil())
+			buf[len(buf)-1] ^= 0xff
+			Expect(ioutil.WriteFile(newest, buf, 0644)).To(BeNil())
+
+			_, err = p.Read(context.Background())
+			Expect(errors.Cause(err)).To(Equal(persistence.ErrCorruptSnapshot))
+			Expect(err.Error()).To(ContainSubstring(path.Base(newest)))
+		})
+
+		It("falls back to an older snapshot if the newest can't be read outside of strict recovery", func() {
+			snapshot(p, "older")
+			newest := snapshot(p, "newest")
+			Expect(ioutil.WriteFile(newest+".manifest", []byte("{"), 0644)).To(BeNil())
+
+			_, err := p.Read(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(path.Base(newest)))
+
+			skip := persistence.NewJournalPersisterWithOpts(persistenceTestDir, &persistence.JournalOpts{Recovery: persistence.RecoverSkip})
+			Expect(recoverIDs(skip)).To(Equal([]string{"older"}))
+		})
+
+		It("only falls back to an older snapshot while the WAL has the changes made since", func() {
+			walDir := path.Join(persistenceTestDir, "wal")
+			Expect(os.RemoveAll(walDir)).To(Succeed())
+			defer os.RemoveAll(walDir)
+			w, err := persistence.OpenWAL(persistenceTestDir, persistence.SyncNever, 0)
 			Expect(err).To(BeNil())
+			defer w.Close()
+			p = persistence.NewJournalPersisterWithOpts(persistenceTestDir, &persistence.JournalOpts{
+				Recovery: persistence.RecoverSkip,
+				WAL:      w,
+			})
 
-			// Wait for entries chan to close
-			jobs := []goyaad.Job{}
-			for buf := range jobsChan {
-				j := goyaad.Job{}
-				err = j.GobDecode(buf)
+			// snapshotAt writes a snapshot that covers the WAL up to its next segment
+			snapshotAt := func(id string) (string, int) {
+				cut, err := w.Rotate()
 				Expect(err).To(BeNil())
-				jobs = append(jobs, j)
+				r, err := goyaad.NewJob(id, time.Now(), testBody).Record()
+				Expect(err).To(BeNil())
+				ctx := context.Background()
+				Expect(p.Write(ctx, r)).To(Succeed())
+				Expect(p.Write(ctx, persistence.CheckpointRecord(time.Now(), cut))).To(Succeed())
+				Expect(p.Commit(ctx)).To(Succeed())
+				return p.(persistence.SnapshotReporter).SnapshotPath(), cut
 			}
+			snapshotAt("older")
+			newest, cut := snapshotAt("newest")
+			Expect(ioutil.WriteFile(newest+".manifest", []byte("{"), 0644)).To(BeNil())
 
-			Expect(len(jobs)).To(Equal(1))
-			job := jobs[0]
-			Expect(job.Body()).To(Equal(j.Body()))
-			Expect(job.ID()).To(Equal(j.ID()))
-			Expect(job.TriggerAt().UnixNano()).To(Equal(j.TriggerAt().UnixNano()))
-		}, 5)
+			Expect(recoverIDs(p)).To(Equal([]string{"older"}))
+
+			// The changes between both snapshots are gone once the WAL is truncated for the newest
+			Expect(w.Truncate(cut)).To(Succeed())
+			_, err = p.Read(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(path.Base(newest)))
+		})
+
+		It("recovers snapshots written before they were rotated", func() {
+			writeLegacySnapshot(path.Join(persistenceTestDir, "journal", "jobs.snapshot"), goyaad.NewJob("legacy", time.Now(), testBody))
+			Expect(recoverIDs(p)).To(Equal([]string{"legacy"}))
+
+			// Rotated snapshots are newer
+			snapshot(p, "rotated")
+			Expect(recoverIDs(p)).To(Equal([]string{"rotated"}))
+		})
+
+		It("reads the jobs of snapshots written before records were typed", func() {
+			j := goyaad.NewJob("legacy", time.Now(), testBody)
+			writeLegacySnapshot(path.Join(persistenceTestDir, "journal", "jobs.snapshot"), j, goyaad.NewJob("other", time.Now(), nil))
+			records := readRecords(p)
+			Expect(records).To(HaveLen(2))
+			Expect(records[0].Kind).To(Equal(persistence.RecordAdd))
+			buf, err := j.GobEncode()
+			Expect(err).To(BeNil())
+			Expect(records[0].Data).To(Equal(buf))
+			Expect(p.(persistence.ManifestKeeper).RecoveredManifest()).To(BeNil())
+		})
+
+		It("writes a manifest with each snapshot", func() {
+			p.(persistence.ManifestKeeper).Describe(5 * time.Second)
+			j := goyaad.NewJobAutoID(time.Now(), testBody)
+			writeSnapshot(p, j)
+			stat, err := os.Stat(p.(persistence.SnapshotReporter).SnapshotPath())
+			Expect(err).To(BeNil())
+
+			Expect(recoverIDs(p)).To(Equal([]string{j.ID()}))
+			m := p.(persistence.ManifestKeeper).RecoveredManifest()
+			Expect(m).NotTo(BeNil())
+			Expect(m.Version).To(Equal(persistence.ManifestVersion))
+			Expect(m.CreatedAt).To(BeTemporally("~", time.Now(), time.Minute))
+			Expect(m.SpokeSpan).To(Equal(5 * time.Second))
+			Expect(m.Jobs).To(Equal(1))
+			Expect(m.Records).To(Equal(1))
+			// Less the header of the journal chunk
+			Expect(m.Bytes).To(Equal(stat.Size() - 7))
+			Expect(m.Checksum).To(HaveLen(64))
+		})
+
+		Context("with a truncated snapshot", func() {
+			BeforeEach(func() {
+				first := goyaad.NewJob("first", time.Now(), testBody)
+				writeSnapshot(p, first)
+				alone, err := os.Stat(p.(persistence.SnapshotReporter).SnapshotPath())
+				Expect(err).To(BeNil())
+				Expect(p.ResetDataDir()).To(BeNil())
+				writeSnapshot(p, first, goyaad.NewJob("second", time.Now(), testBody))
+				snapshotPath := p.(persistence.SnapshotReporter).SnapshotPath()
+
+				// Cut right after the first record, the journal itself is still intact
+				Expect(os.Truncate(snapshotPath, alone.Size())).To(BeNil())
+			})
+
+			It("refuses it in strict mode", func() {
+				_, err := p.Read(context.Background())
+				Expect(errors.Cause(err)).To(Equal(persistence.ErrManifestMismatch))
+				Expect(err.Error()).To(ContainSubstring("1 jobs"))
+			})
+
+			It("restores it with a warning in permissive mode", func() {
+				p = persistence.NewJournalPersisterWithOpts(persistenceTestDir, &persistence.JournalOpts{
+					Manifest: persistence.ManifestPermissive,
+				})
+				Expect(recoverIDs(p)).To(Equal([]string{"first"}))
+			})
+		})
+
+		It("refuses snapshots of another format version", func() {
+			snapshotPath := snapshot(p, "future")
+			buf, err := ioutil.ReadFile(snapshotPath + ".manifest")
+			Expect(err).To(BeNil())
+			buf = []byte(strings.Replace(string(buf), `"version":2`, `"version":3`, 1))
+			Expect(ioutil.WriteFile(snapshotPath+".manifest", buf, 0644)).To(BeNil())
+
+			_, err = p.Read(context.Background())
+			Expect(errors.Cause(err)).To(Equal(persistence.ErrManifestMismatch))
+			Expect(err.Error()).To(ContainSubstring("format version 3"))
+		})
+
+		It("fails to recover without an intact snapshot", func() {
+			_, err := p.Read(context.Background())
+			Expect(os.IsNotExist(errors.Cause(err))).To(BeTrue())
+		})
 	})
 })
+
+// writeLegacySnapshot writes the jobs the way snapshots were written before records were typed
+func writeLegacySnapshot(filePath string, jobs ...*goyaad.Job) {
+	Expect(os.MkdirAll(path.Dir(filePath), 0774)).To(Succeed())
+	f, err := os.Create(filePath)
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+	w := journal.NewWriter(f)
+	for _, j := range jobs {
+		buf, err := j.GobEncode()
+		Expect(err).NotTo(HaveOccurred())
+		jw, err := w.Next()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = jw.Write(buf)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(w.Close()).To(Succeed())
+}
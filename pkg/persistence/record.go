@@ -0,0 +1,140 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RecordKind is what a persisted record describes
+type RecordKind byte
+
+const (
+	// RecordAdd holds a job, Data is the encoded job
+	RecordAdd RecordKind = iota + 1
+	// RecordCancel takes back a job written earlier in the same snapshot
+	RecordCancel
+	// RecordCheckpoint ends a snapshot, TriggerAt is when the jobs were as written
+	// and Data the first WAL segment the snapshot doesn't cover
+	RecordCheckpoint
+	// RecordConsume is a job that was handed out for good, only logged to the WAL
+	RecordConsume
+	// RecordReschedule moves a job to TriggerAt, only logged to the WAL
+	RecordReschedule
+	// RecordBatch holds the state of a batch of jobs, ID is the batch id and Data the encoded state
+	RecordBatch
+	// RecordGroup holds a consumer group, ID is the group name and Data the encoded group
+	RecordGroup
+	// RecordDeliver is a job one consumer group consumed while others still wait for it,
+	// ID is the job id and Data the group name. Only logged to the WAL.
+	RecordDeliver
+)
+
+func (k RecordKind) String() string {
+	switch k {
+	case RecordAdd:
+		return "add"
+	case RecordCancel:
+		return "cancel"
+	case RecordCheckpoint:
+		return "checkpoint"
+	case RecordConsume:
+		return "consume"
+	case RecordReschedule:
+		return "reschedule"
+	case RecordBatch:
+		return "batch"
+	case RecordGroup:
+		return "group"
+	case RecordDeliver:
+		return "deliver"
+	}
+	return "unknown"
+}
+
+// Record is an entry written to a persister and read back from it
+type Record struct {
+	Kind      RecordKind
+	ID        string    // Of the job, batch or group, empty for checkpoints
+	TriggerAt time.Time // Of the job, or when a checkpoint was taken
+	Data      []byte    // Encoded job for adds, encoded state for batches and groups
+}
+
+// CheckpointRecord ends a snapshot of the jobs as they were at the given time. walSegment is the
+// first WAL segment the snapshot doesn't cover, 0 if no WAL is kept.
+func CheckpointRecord(at time.Time, walSegment int) Record {
+	r := Record{Kind: RecordCheckpoint, TriggerAt: at}
+	if walSegment > 0 {
+		r.Data = make([]byte, binary.MaxVarintLen64)
+		r.Data = r.Data[:binary.PutUvarint(r.Data, uint64(walSegment))]
+	}
+	return r
+}
+
+// WALSegment returns the first WAL segment a checkpoint record doesn't cover, 0 if unknown
+func (r Record) WALSegment() int {
+	if r.Kind != RecordCheckpoint {
+		return 0
+	}
+	seg, n := binary.Uvarint(r.Data)
+	if n <= 0 {
+		return 0
+	}
+	return int(seg)
+}
+
+// RecordResult is a record read back from a persister, or why the next one couldn't be read
+type RecordResult struct {
+	Record Record
+	Err    error
+}
+
+// encode lays out a record as kind, trigger time, id length, id and data
+func (r Record) encode() []byte {
+	buf := make([]byte, 1+2*binary.MaxVarintLen64+len(r.ID)+len(r.Data))
+	buf[0] = byte(r.Kind)
+	n := 1
+	if !r.TriggerAt.IsZero() {
+		n += binary.PutVarint(buf[n:], r.TriggerAt.UnixNano())
+	} else {
+		n += binary.PutVarint(buf[n:], 0)
+	}
+	n += binary.PutUvarint(buf[n:], uint64(len(r.ID)))
+	n += copy(buf[n:], r.ID)
+	n += copy(buf[n:], r.Data)
+	return buf[:n]
+}
+
+func decodeRecord(buf []byte) (Record, error) {
+	if len(buf) < 3 {
+		return Record{}, errors.New("record too short")
+	}
+	r := Record{Kind: RecordKind(buf[0])}
+	if r.Kind < RecordAdd || r.Kind > RecordDeliver {
+		return Record{}, errors.Errorf("unknown record kind %d", buf[0])
+	}
+	at, n := binary.Varint(buf[1:])
+	if n <= 0 {
+		return Record{}, errors.New("record has a bad trigger time")
+	}
+	if at != 0 {
+		r.TriggerAt = time.Unix(0, at)
+	}
+	start := 1 + n
+	idLen, n := binary.Uvarint(buf[start:])
+	if n <= 0 || uint64(len(buf)-start-n) < idLen {
+		return Record{}, errors.New("record has a bad id length")
+	}
+	start += n
+	r.ID = string(buf[start : start+int(idLen)])
+	if data := buf[start+int(idLen):]; len(data) > 0 {
+		r.Data = data
+	}
+	return r, nil
+}
+
+// legacyRecord reads an entry of a snapshot written before records were typed: it is an encoded job
+func legacyRecord(buf []byte) Record {
+	return Record{Kind: RecordAdd, Data: buf}
+}
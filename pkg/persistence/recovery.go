@@ -0,0 +1,213 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb/journal"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+)
+
+// Journal wire format, see the journal package
+const (
+	journalBlockSize  = 32 * 1024
+	journalHeaderSize = 7
+)
+
+// ErrCorruptSnapshot is returned when a snapshot has records that can't be read back
+var ErrCorruptSnapshot = errors.New("snapshot is corrupt")
+
+// RecoveryMode picks what a restore does with corrupt records
+type RecoveryMode int
+
+const (
+	// RecoverStrict only restores an intact newest snapshot and fails on records that can't be decoded
+	RecoverStrict RecoveryMode = iota
+	// RecoverSkip restores the newest snapshot, dropping corrupt records and resyncing at the next journal block
+	RecoverSkip
+	// RecoverQuarantine restores like RecoverSkip and copies what it drops to a side file for inspection
+	RecoverQuarantine
+)
+
+// ParseRecoveryMode reads a recovery mode: "strict", "skip" or "quarantine"
+func ParseRecoveryMode(s string) (RecoveryMode, error) {
+	switch s {
+	case "strict":
+		return RecoverStrict, nil
+	case "skip":
+		return RecoverSkip, nil
+	case "quarantine":
+		return RecoverQuarantine, nil
+	}
+	return RecoverStrict, fmt.Errorf("unknown recovery mode: %s", s)
+}
+
+// RecoveryStats counts what happened to the records of the snapshot a restore read from
+type RecoveryStats struct {
+	Recovered   int    // Records handed out and not rejected
+	Skipped     int    // Records dropped, because they were corrupt or rejected
+	Quarantined int    // Entries copied to the quarantine file, out of the skipped records
+	Quarantine  string // Where the quarantine file is, if anything was quarantined
+}
+
+// recovery tracks the records of a snapshot being recovered. Rejects come from the
+// restoring hub while the snapshot is still streamed, so it is locked.
+type recovery struct {
+	mode       RecoveryMode
+	quarantine string // Path of the quarantine file
+	emitted    int    // Jobs handed out
+	seen       int    // Records whose start was read, handed out or not
+	rejected   int    // Jobs handed out and taken back
+	cut        int    // Records cut short by a corrupt region
+	dropped    int    // Records lost in corrupt regions
+	stats      RecoveryStats
+	tap        *blockTap
+}
+
+// quarantinePath returns where the records dropped from the given snapshot are copied to
+func quarantinePath(snapshot string) string {
+	return snapshot + ".quarantine"
+}
+
+// Reject takes back a recovered record the hub couldn't use
+func (lp *JournalPersister) Reject(buf []byte, reason error) {
+	lp.recoveryLock.Lock()
+	defer lp.recoveryLock.Unlock()
+	if lp.recovery == nil {
+		return
+	}
+	lp.recovery.rejected++
+	lp.recovery.keep(buf, reason, -1)
+}
+
+// RecoveryStats returns what happened to the records of the snapshot the last Read was from.
+// The counts are final once the recovered stream is drained.
+func (lp *JournalPersister) RecoveryStats() RecoveryStats {
+	lp.recoveryLock.Lock()
+	defer lp.recoveryLock.Unlock()
+	if lp.recovery == nil {
+		return RecoveryStats{}
+	}
+	r := lp.recovery
+	stats := r.stats
+	stats.Recovered = r.emitted - r.rejected
+	stats.Skipped = r.rejected + r.cut + r.dropped
+	return stats
+}
+
+// Drop is called by the journal reader for every corrupt region it skips
+func (lp *JournalPersister) Drop(err error) {
+	lp.recoveryLock.Lock()
+	defer lp.recoveryLock.Unlock()
+	r := lp.recovery
+	ce, ok := err.(*journal.ErrCorrupted)
+	if !ok || r == nil {
+		return
+	}
+	go metrics.Incr("persister.recover.corrupt")
+	if ce.Reason == "orphan chunk" {
+		// The rest of a record whose start was dropped or rejected already
+		logrus.WithError(err).Warn("JournalPersister:Read skipping orphan chunk")
+		return
+	}
+	raw, offset := r.tap.tail(ce.Size)
+	records := countRecords(raw)
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"offset":  offset,
+		"records": records,
+	}).Warn("JournalPersister:Read skipping corrupt region")
+	r.dropped += records
+	if len(raw) > 0 {
+		r.keep(raw, err, offset)
+	}
+}
+
+// keep copies what was dropped to the quarantine file in quarantine mode
+func (r *recovery) keep(buf []byte, reason error, offset int64) {
+	if r.mode != RecoverQuarantine {
+		return
+	}
+	f, err := os.OpenFile(r.quarantine, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		logrus.WithError(err).Error("JournalPersister:Read cannot open quarantine file")
+		return
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "--- offset: %d, reason: %s, bytes: %d\n", offset, reason, len(buf)); err != nil {
+		logrus.WithError(err).Error("JournalPersister:Read cannot write to quarantine file")
+		return
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		logrus.WithError(err).Error("JournalPersister:Read cannot write to quarantine file")
+		return
+	}
+	r.stats.Quarantined++
+	r.stats.Quarantine = r.quarantine
+}
+
+// settle counts the records lost in corrupt regions from the manifest, which knows them exactly
+func (r *recovery) settle(m *Manifest) {
+	if m == nil {
+		return
+	}
+	total := m.Jobs
+	if !m.legacy() {
+		total = m.Records
+	}
+	if lost := total - r.seen; lost >= 0 {
+		r.dropped = lost
+	}
+}
+
+// countRecords counts the records starting in a corrupt region of a journal block, as far as
+// its chunk headers can be read. Headers that can't be read before any record start count as one record.
+func countRecords(raw []byte) int {
+	records := 0
+	for i := 0; i+journalHeaderSize <= len(raw); {
+		length := int(binary.LittleEndian.Uint16(raw[i+4 : i+6]))
+		chunkType := raw[i+6]
+		if chunkType < 1 || chunkType > 4 || i+journalHeaderSize+length > len(raw) {
+			if records == 0 {
+				records = 1
+			}
+			break
+		}
+		// full or first chunk
+		if chunkType == 1 || chunkType == 2 {
+			records++
+		}
+		i += journalHeaderSize + length
+	}
+	return records
+}
+
+// blockTap keeps the journal block being read so that corrupt regions can be copied out of it.
+// The journal reads whole blocks at a time.
+type blockTap struct {
+	r     io.Reader
+	off   int64 // Bytes read so far
+	block []byte
+}
+
+func (t *blockTap) Read(p []byte) (int, error) {
+	if t.off%journalBlockSize == 0 {
+		t.block = t.block[:0]
+	}
+	n, err := t.r.Read(p)
+	t.block = append(t.block, p[:n]...)
+	t.off += int64(n)
+	return n, err
+}
+
+// tail returns the last size bytes of the current block and where they start in the file
+func (t *blockTap) tail(size int) ([]byte, int64) {
+	if size > len(t.block) {
+		size = len(t.block)
+	}
+	raw := append([]byte{}, t.block[len(t.block)-size:]...)
+	return raw, t.off - int64(size)
+}
@@ -0,0 +1,273 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+)
+
+// DefaultS3PartSize is the size of the parts snapshots are uploaded in, unless told otherwise
+const DefaultS3PartSize = 8 * 1024 * 1024
+
+// ErrNoS3Snapshot is returned when the bucket has no snapshot to restore from
+var ErrNoS3Snapshot = errors.New("no snapshot in s3")
+
+// S3Opts configure where snapshots are backed up
+type S3Opts struct {
+	Bucket    string
+	Prefix    string // Prepended to the snapshot names, like "goyaad/prod/"
+	Endpoint  string // S3 compatible endpoint, AWS if empty
+	Region    string // Region of the bucket, from the environment if empty
+	PathStyle bool   // Address the bucket in the path instead of the host name
+	Keep      int    // Snapshots kept in the bucket, older ones are deleted after an upload. 0 keeps all
+	PartSize  int64  // Size of the uploaded parts, DefaultS3PartSize if not set
+}
+
+// S3Backup uploads snapshots to S3 and fetches them back. It is a Backup hook.
+type S3Backup struct {
+	opts S3Opts
+	svc  *s3.S3
+}
+
+// NewS3Backup connects to the bucket the options point to
+func NewS3Backup(opts *S3Opts) (*S3Backup, error) {
+	cfg := aws.NewConfig().WithS3ForcePathStyle(opts.PathStyle)
+	if opts.Endpoint != "" {
+		cfg = cfg.WithEndpoint(opts.Endpoint)
+	}
+	if opts.Region != "" {
+		cfg = cfg.WithRegion(opts.Region)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "S3Backup cannot create a session")
+	}
+	b := &S3Backup{opts: *opts, svc: s3.New(sess)}
+	if b.opts.PartSize <= 0 {
+		b.opts.PartSize = DefaultS3PartSize
+	}
+	return b, nil
+}
+
+// Backup streams the snapshot and its manifest to the bucket, then deletes the snapshots past the kept ones
+func (b *S3Backup) Backup(ctx context.Context, snapshot string) error {
+	start := time.Now()
+	key := b.opts.Prefix + path.Base(snapshot)
+	if err := b.uploadFile(ctx, snapshot, key); err != nil {
+		go metrics.Incr("persister.s3.upload.error")
+		return err
+	}
+	if _, err := os.Stat(manifestPath(snapshot)); err == nil {
+		if err := b.uploadFile(ctx, manifestPath(snapshot), manifestPath(key)); err != nil {
+			go metrics.Incr("persister.s3.upload.error")
+			return err
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"bucket": b.opts.Bucket,
+		"key":    key,
+	}).Info("S3Backup: uploaded snapshot")
+	go metrics.Incr("persister.s3.upload.ok")
+	go metrics.Time("persister.s3.upload.duration", start)
+	return b.prune(ctx)
+}
+
+// uploadFile streams the file to the key in parts, aborting the upload if a part fails
+func (b *S3Backup) uploadFile(ctx context.Context, filePath, key string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	up, err := b.svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(b.opts.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "S3Backup cannot start uploading %s", key)
+	}
+
+	parts := []*s3.CompletedPart{}
+	buf := make([]byte, b.opts.PartSize)
+	for n := int64(1); ; n++ {
+		size, rerr := io.ReadFull(f, buf)
+		if rerr == io.EOF && n > 1 {
+			break
+		}
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			b.abort(key, up.UploadId)
+			return rerr
+		}
+		out, err := b.svc.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(b.opts.Bucket),
+			Key:        aws.String(key),
+			UploadId:   up.UploadId,
+			PartNumber: aws.Int64(n),
+			Body:       bytes.NewReader(buf[:size]),
+		})
+		if err != nil {
+			b.abort(key, up.UploadId)
+			return errors.Wrapf(err, "S3Backup cannot upload part %d of %s", n, key)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(n)})
+		if rerr != nil {
+			// Last part
+			break
+		}
+	}
+
+	_, err = b.svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.opts.Bucket),
+		Key:             aws.String(key),
+		UploadId:        up.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		b.abort(key, up.UploadId)
+		return errors.Wrapf(err, "S3Backup cannot complete uploading %s", key)
+	}
+	return nil
+}
+
+// abort drops the parts of an upload that failed, even if ctx is done
+func (b *S3Backup) abort(key string, uploadID *string) {
+	_, err := b.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(b.opts.Bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		logrus.WithError(err).WithField("key", key).Error("S3Backup cannot abort upload")
+	}
+}
+
+// Snapshots returns the names of the snapshots in the bucket, oldest first
+func (b *S3Backup) Snapshots(ctx context.Context) ([]string, error) {
+	names := []string{}
+	err := b.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.opts.Bucket),
+		Prefix: aws.String(b.opts.Prefix + "jobs-"),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(o.Key), b.opts.Prefix)
+			if strings.HasSuffix(name, ".snapshot") && !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "S3Backup cannot list snapshots")
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// prune deletes the snapshots past the kept ones, with their manifests
+func (b *S3Backup) prune(ctx context.Context) error {
+	if b.opts.Keep <= 0 {
+		return nil
+	}
+	names, err := b.Snapshots(ctx)
+	if err != nil {
+		return err
+	}
+	for len(names) > b.opts.Keep {
+		key := b.opts.Prefix + names[0]
+		for _, k := range []string{key, manifestPath(key)} {
+			if _, err := b.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(b.opts.Bucket),
+				Key:    aws.String(k),
+			}); err != nil {
+				return errors.Wrapf(err, "S3Backup cannot delete %s", k)
+			}
+		}
+		logrus.WithField("key", key).Info("S3Backup: deleted old snapshot")
+		names = names[1:]
+	}
+	return nil
+}
+
+// Download fetches the named snapshot, or the latest one if name is empty, with its manifest
+// into the journal of dataDir. It returns where the snapshot was put.
+func (b *S3Backup) Download(ctx context.Context, name, dataDir string) (string, error) {
+	if name == "" {
+		names, err := b.Snapshots(ctx)
+		if err != nil {
+			return "", err
+		}
+		if len(names) == 0 {
+			return "", errors.Wrapf(ErrNoS3Snapshot, "bucket %s prefix %q", b.opts.Bucket, b.opts.Prefix)
+		}
+		name = names[len(names)-1]
+	}
+	dir := path.Join(dataDir, "journal")
+	if err := os.MkdirAll(dir, os.ModeDir|0774); err != nil {
+		return "", err
+	}
+	snapshot := path.Join(dir, path.Base(name))
+	key := b.opts.Prefix + name
+	if err := b.downloadFile(ctx, manifestPath(key), manifestPath(snapshot)); err != nil && !isNotFound(err) {
+		return "", err
+	}
+	// The snapshot goes last, it is only picked up once it is complete
+	if err := b.downloadFile(ctx, key, snapshot); err != nil {
+		return "", err
+	}
+	logrus.WithFields(logrus.Fields{
+		"bucket": b.opts.Bucket,
+		"key":    key,
+		"file":   snapshot,
+	}).Info("S3Backup: downloaded snapshot")
+	return snapshot, nil
+}
+
+// downloadFile fetches the key into the file through a temp file
+func (b *S3Backup) downloadFile(ctx context.Context, key, filePath string) error {
+	out, err := b.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.opts.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "S3Backup cannot fetch %s", key)
+	}
+	defer out.Body.Close()
+
+	f, err := os.Create(filePath + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, out.Body)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// isNotFound returns true for errors about keys that don't exist
+func isNotFound(err error) bool {
+	if aerr, ok := errors.Cause(err).(interface{ Code() string }); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+	}
+	return false
+}
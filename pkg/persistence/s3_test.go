@@ -0,0 +1,272 @@
+package persistence_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	"github.com/urjitbhatia/goyaad/pkg/goyaad"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+// fakeS3 is an in-process S3 stand-in for path-style requests to a single bucket
+type fakeS3 struct {
+	sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	parts   map[string]int // Parts each completed upload came in
+	nextID  int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: map[string][]byte{},
+		uploads: map[string]map[int][]byte{},
+		parts:   map[string]int{},
+	}
+}
+
+func (f *fakeS3) keys() []string {
+	f.Lock()
+	defer f.Unlock()
+	keys := []string{}
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.HasPrefix(p, f.bucket) {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(p, f.bucket), "/")
+	q := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, q.Get("prefix"))
+	case r.Method == http.MethodPost && q["uploads"] != nil:
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>",
+			f.bucket, key, id)
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		f.uploads[q.Get("uploadId")][n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, q.Get("uploadId"), n))
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		parts := f.uploads[q.Get("uploadId")]
+		buf := []byte{}
+		for n := 1; n <= len(parts); n++ {
+			buf = append(buf, parts[n]...)
+		}
+		f.objects[key] = buf
+		f.parts[key] = len(parts)
+		delete(f.uploads, q.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key></CompleteMultipartUploadResult>", f.bucket, key)
+	case r.Method == http.MethodDelete && q.Get("uploadId") != "":
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet:
+		buf, ok := f.objects[key]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Write(buf)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key  string
+		Size int
+	}
+	res := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: f.bucket, Prefix: prefix}
+	for k, v := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			res.Contents = append(res.Contents, content{Key: k, Size: len(v)})
+		}
+	}
+	res.KeyCount = len(res.Contents)
+	xml.NewEncoder(w).Encode(res)
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+var _ = Describe("Test S3 backups", func() {
+	s3TestDir := path.Join(os.TempDir(), "goyaads3test")
+	var fake *fakeS3
+	var server *httptest.Server
+	var opts *persistence.S3Opts
+
+	BeforeEach(func() {
+		os.Setenv("AWS_ACCESS_KEY_ID", "fake")
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "fake")
+		fake = newFakeS3("backups")
+		server = httptest.NewServer(fake)
+		opts = &persistence.S3Opts{
+			Bucket:    "backups",
+			Prefix:    "goyaad/test/",
+			Endpoint:  server.URL,
+			Region:    "us-east-1",
+			PathStyle: true,
+			PartSize:  16 * 1024,
+		}
+		Expect(os.RemoveAll(s3TestDir)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// snapshot writes a snapshot of jobs with 1KB bodies and backs it up
+	snapshot := func(ids ...string) string {
+		p := persistence.NewJournalPersister(s3TestDir)
+		jobs := []*goyaad.Job{}
+		for _, id := range ids {
+			jobs = append(jobs, goyaad.NewJob(id, time.Now(), bytes.Repeat([]byte("x"), 1024)))
+		}
+		writeSnapshot(p, jobs...)
+		b, err := persistence.NewS3Backup(opts)
+		Expect(err).NotTo(HaveOccurred())
+		snapshotPath := p.(persistence.SnapshotReporter).SnapshotPath()
+		Expect(b.Backup(context.Background(), snapshotPath)).To(Succeed())
+		// Timestamped names need to differ
+		time.Sleep(time.Millisecond)
+		return snapshotPath
+	}
+
+	recoverIDs := readIDs
+
+	It("uploads the snapshot in parts with its manifest", func() {
+		ids := []string{}
+		for i := 0; i < 50; i++ {
+			ids = append(ids, fmt.Sprintf("job-%d", i))
+		}
+		local := snapshot(ids...)
+		key := "goyaad/test/" + path.Base(local)
+		Expect(fake.keys()).To(ConsistOf(key, key+".manifest"))
+		Expect(fake.parts[key]).To(BeNumerically(">", 1))
+
+		buf, err := ioutil.ReadFile(local)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.objects[key]).To(Equal(buf))
+	})
+
+	It("keeps the newest backups", func() {
+		opts.Keep = 2
+		snapshot("a")
+		second := snapshot("b")
+		third := snapshot("c")
+
+		b, err := persistence.NewS3Backup(opts)
+		Expect(err).NotTo(HaveOccurred())
+		names, err := b.Snapshots(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(Equal([]string{path.Base(second), path.Base(third)}))
+		Expect(fake.keys()).To(HaveLen(4))
+	})
+
+	It("restores from the latest or a named backup", func() {
+		first := snapshot("a")
+		snapshot("b")
+		Expect(os.RemoveAll(s3TestDir)).To(Succeed())
+
+		b, err := persistence.NewS3Backup(opts)
+		Expect(err).NotTo(HaveOccurred())
+		latest, err := b.Download(context.Background(), "", s3TestDir)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = os.Stat(latest + ".manifest")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recoverIDs(persistence.NewJournalPersisterWithOpts(s3TestDir, &persistence.JournalOpts{
+			RestoreFrom: latest,
+		}))).To(Equal([]string{"b"}))
+
+		// An older backup is restored even though a newer snapshot is in dataDir
+		named, err := b.Download(context.Background(), path.Base(first), s3TestDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recoverIDs(persistence.NewJournalPersisterWithOpts(s3TestDir, &persistence.JournalOpts{
+			RestoreFrom: named,
+		}))).To(Equal([]string{"a"}))
+	})
+
+	It("backs up every checkpoint of a hub", func() {
+		b, err := persistence.NewS3Backup(opts)
+		Expect(err).NotTo(HaveOccurred())
+		p := persistence.NewJournalPersister(s3TestDir)
+		h := goyaad.NewHub(&goyaad.HubOpts{SpokeSpan: time.Second, Persister: p, Backup: b})
+		defer h.Stop(false)
+
+		backups := func() []string {
+			names, err := b.Snapshots(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			return names
+		}
+		for i, id := range []string{"a", "b"} {
+			Expect(h.AddJob(goyaad.NewJob(id, time.Now().Add(time.Hour), nil))).To(BeNil())
+			stats, err := h.Checkpoint()
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(backups).Should(HaveLen(i + 1))
+			Expect(backups()[i]).To(Equal(path.Base(stats.Path)))
+			// Timestamped names need to differ
+			time.Sleep(time.Millisecond)
+		}
+
+		Expect(os.RemoveAll(s3TestDir)).To(Succeed())
+		latest, err := b.Download(context.Background(), "", s3TestDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recoverIDs(persistence.NewJournalPersisterWithOpts(s3TestDir, &persistence.JournalOpts{
+			RestoreFrom: latest,
+		}))).To(ConsistOf("a", "b"))
+	})
+
+	It("fails to restore from an empty bucket", func() {
+		b, err := persistence.NewS3Backup(opts)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = b.Download(context.Background(), "", s3TestDir)
+		Expect(errors.Cause(err)).To(Equal(persistence.ErrNoS3Snapshot))
+		_, err = b.Download(context.Background(), "jobs-missing.snapshot", s3TestDir)
+		Expect(err).To(HaveOccurred())
+	})
+})
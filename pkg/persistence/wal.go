@@ -0,0 +1,358 @@
+package persistence
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb/journal"
+	"github.com/urjitbhatia/goyaad/pkg/metrics"
+)
+
+// SyncPolicy decides when the WAL fsyncs its records to disk. Records are always handed
+// to the OS before Append returns, so only a machine crash can lose records that weren't synced.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs every record before Append returns
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs the records written in the last interval, in the background
+	SyncInterval
+	// SyncNever leaves syncing to the OS
+	SyncNever
+)
+
+// ParseSync parses "always", "never" or an interval like "100ms"
+func ParseSync(s string) (SyncPolicy, time.Duration, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return SyncAlways, 0, nil
+	case "never":
+		return SyncNever, 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return SyncAlways, 0, errors.Errorf("Invalid WAL sync policy %q", s)
+	}
+	return SyncInterval, d, nil
+}
+
+// WAL is a write-ahead log of the changes to a hub's jobs since its last snapshot, kept as records.
+// Every time it is opened it starts a new segment file, so that the records of earlier runs
+// can be replayed on top of the snapshot.
+type WAL struct {
+	dir      string
+	sync     SyncPolicy
+	interval time.Duration
+
+	segment int      // Sequence number of the segment being written
+	replay  []string // Segments left by earlier runs, oldest first
+	f       *os.File
+	w       *journal.Writer
+	dirty   bool // Records were written since the last fsync
+	lock    *sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenWAL opens the WAL kept in dataDir/wal and starts a new segment
+func OpenWAL(dataDir string, policy SyncPolicy, interval time.Duration) (*WAL, error) {
+	w := &WAL{
+		dir:      path.Join(dataDir, "wal"),
+		sync:     policy,
+		interval: interval,
+		lock:     &sync.Mutex{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := os.MkdirAll(w.dir, os.ModeDir|0774); err != nil {
+		return nil, errors.Wrap(err, "WAL: cannot create wal dir")
+	}
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	w.replay = segments
+	if n := len(segments); n > 0 {
+		w.segment = segmentSeq(segments[n-1])
+	}
+	if err := w.startSegment(); err != nil {
+		return nil, err
+	}
+
+	if w.sync == SyncInterval {
+		go w.syncer()
+	} else {
+		close(w.done)
+	}
+	logrus.WithFields(logrus.Fields{
+		"dir":      w.dir,
+		"segments": len(segments),
+		"sync":     w.syncString(),
+	}).Info("Opened WAL")
+	return w, nil
+}
+
+func (w *WAL) syncString() string {
+	switch w.sync {
+	case SyncAlways:
+		return "always"
+	case SyncNever:
+		return "never"
+	}
+	return w.interval.String()
+}
+
+// segments returns the paths of the segment files, oldest first
+func (w *WAL) segments() ([]string, error) {
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "WAL: cannot list segments")
+	}
+	segments := []string{}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "wal-") && strings.HasSuffix(f.Name(), ".log") {
+			segments = append(segments, path.Join(w.dir, f.Name()))
+		}
+	}
+	// Sequence numbers are zero padded, so names sort in order
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// segmentSeq returns the sequence number of the segment at p
+func segmentSeq(p string) int {
+	var seq int
+	fmt.Sscanf(path.Base(p), "wal-%d.log", &seq)
+	return seq
+}
+
+// startSegment starts writing to the next segment file. Must be called with the WAL locked or before it is shared.
+func (w *WAL) startSegment() error {
+	w.segment++
+	p := path.Join(w.dir, fmt.Sprintf("wal-%09d.log", w.segment))
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0664)
+	if err != nil {
+		return errors.Wrap(err, "WAL: cannot create segment")
+	}
+	w.f = f
+	w.w = journal.NewWriter(f)
+	w.dirty = false
+	return nil
+}
+
+// Append writes a record. It returns once the record is with the OS, and on disk if the WAL syncs always.
+func (w *WAL) Append(r Record) error {
+	defer metrics.Time("wal.append.duration", time.Now())
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.w == nil {
+		return errors.New("WAL: closed")
+	}
+	jw, err := w.w.Next()
+	if err != nil {
+		return errors.Wrap(err, "WAL: cannot start record")
+	}
+	if _, err = jw.Write(r.encode()); err != nil {
+		return errors.Wrap(err, "WAL: cannot write record")
+	}
+	if err = w.w.Flush(); err != nil {
+		return errors.Wrap(err, "WAL: cannot flush record")
+	}
+	if w.sync == SyncAlways {
+		if err = w.f.Sync(); err != nil {
+			return errors.Wrap(err, "WAL: cannot sync record")
+		}
+		return nil
+	}
+	w.dirty = true
+	return nil
+}
+
+// syncer fsyncs written records every interval until the WAL is closed
+func (w *WAL) syncer() {
+	defer close(w.done)
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-t.C:
+			w.lock.Lock()
+			if w.dirty && w.f != nil {
+				if err := w.f.Sync(); err != nil {
+					logrus.WithError(err).Error("WAL: cannot sync records")
+					go metrics.Incr("wal.sync.error")
+				}
+				w.dirty = false
+			}
+			w.lock.Unlock()
+		}
+	}
+}
+
+// Replay streams the records left by earlier runs, oldest first.
+// Records that are torn or corrupt, like the last one written before a crash, are skipped.
+func (w *WAL) Replay() (chan Record, error) {
+	recC := make(chan Record)
+	go func() {
+		defer close(recC)
+		count := 0
+		for _, p := range w.replay {
+			f, err := os.Open(p)
+			if err != nil {
+				logrus.WithError(err).WithField("segment", p).Error("WAL: cannot open segment for replay")
+				continue
+			}
+			r := journal.NewReader(f, nil, false, true)
+			for {
+				jr, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					logrus.WithError(err).WithField("segment", p).Warn("WAL: stopped replaying a corrupt segment")
+					break
+				}
+				buf, err := ioutil.ReadAll(jr)
+				if err != nil {
+					logrus.WithError(err).WithField("segment", p).Warn("WAL: skipped a torn record")
+					continue
+				}
+				rec, err := decodeRecord(buf)
+				if err != nil {
+					logrus.WithError(err).WithField("segment", p).Warn("WAL: skipped a bad record")
+					continue
+				}
+				recC <- rec
+				count++
+			}
+			f.Close()
+		}
+		logrus.Infof("WAL: replayed %d records", count)
+	}()
+	return recC, nil
+}
+
+// Reset drops all records, like after a snapshot made them redundant, and starts a new segment
+func (w *WAL) Reset() error {
+	cut, err := w.Rotate()
+	if err != nil {
+		return err
+	}
+	return w.Truncate(cut)
+}
+
+// Rotate starts a new segment and returns its sequence number. Records appended from now on
+// go to the new segment, so a snapshot taken right after covers every segment before it.
+func (w *WAL) Rotate() (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.w == nil {
+		return 0, errors.New("WAL: closed")
+	}
+	w.w.Close()
+	err := w.f.Sync()
+	w.f.Close()
+	if err != nil {
+		return 0, errors.Wrap(err, "WAL: cannot sync segment")
+	}
+	if err := w.startSegment(); err != nil {
+		return 0, err
+	}
+	return w.segment, nil
+}
+
+// Truncate removes the segments before cut, like the ones a snapshot covers
+func (w *WAL) Truncate(cut int) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, p := range segments {
+		if segmentSeq(p) >= cut {
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			return errors.Wrap(err, "WAL: cannot remove segment")
+		}
+		removed++
+	}
+	replay := []string{}
+	for _, p := range w.replay {
+		if segmentSeq(p) >= cut {
+			replay = append(replay, p)
+		}
+	}
+	w.replay = replay
+	logrus.WithField("segments", removed).Info("WAL: truncated")
+	return nil
+}
+
+// Covers returns true if the WAL still has every segment from the given one on,
+// like the changes made since a snapshot that cut the WAL there
+func (w *WAL) Covers(segment int) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if segment <= 0 {
+		return false
+	}
+	segments, err := w.segments()
+	if err != nil || len(segments) == 0 {
+		return false
+	}
+	return segmentSeq(segments[0]) <= segment
+}
+
+// Size returns the bytes on disk of all segments
+func (w *WAL) Size() int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	segments, err := w.segments()
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, p := range segments {
+		if st, err := os.Stat(p); err == nil {
+			size += st.Size()
+		}
+	}
+	return size
+}
+
+// Close syncs and closes the WAL
+func (w *WAL) Close() error {
+	w.lock.Lock()
+	if w.w == nil {
+		w.lock.Unlock()
+		return nil
+	}
+	close(w.stop)
+	w.w.Close()
+	err := w.f.Sync()
+	w.f.Close()
+	w.w, w.f = nil, nil
+	w.lock.Unlock()
+
+	<-w.done
+	return err
+}
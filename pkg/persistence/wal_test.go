@@ -0,0 +1,91 @@
+package persistence_test
+
+import (
+	"os"
+	"path"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
+)
+
+var _ = Describe("Test write-ahead log", func() {
+	walTestDir := path.Join(os.TempDir(), "goyaadwaltest")
+
+	BeforeEach(func() {
+		Expect(os.RemoveAll(walTestDir)).To(BeNil())
+	})
+
+	replay := func(w *persistence.WAL) []persistence.Record {
+		recC, err := w.Replay()
+		Expect(err).To(BeNil())
+		recs := []persistence.Record{}
+		for r := range recC {
+			recs = append(recs, r)
+		}
+		return recs
+	}
+
+	It("parses sync policies", func() {
+		p, d, err := persistence.ParseSync("always")
+		Expect(err).To(BeNil())
+		Expect(p).To(Equal(persistence.SyncAlways))
+
+		p, d, err = persistence.ParseSync("100ms")
+		Expect(err).To(BeNil())
+		Expect(p).To(Equal(persistence.SyncInterval))
+		Expect(d).To(Equal(100 * time.Millisecond))
+
+		for _, bad := range []string{"", "sometimes", "-1s"} {
+			_, _, err = persistence.ParseSync(bad)
+			Expect(err).To(HaveOccurred(), bad)
+		}
+	})
+
+	It("replays the records of earlier runs in order", func() {
+		at := time.Unix(0, 1600000000123456789)
+		w, err := persistence.OpenWAL(walTestDir, persistence.SyncInterval, 10*time.Millisecond)
+		Expect(err).To(BeNil())
+		Expect(replay(w)).To(BeEmpty())
+		Expect(w.Append(persistence.Record{Kind: persistence.RecordAdd, ID: "a", Data: testBody})).To(BeNil())
+		Expect(w.Append(persistence.Record{Kind: persistence.RecordCancel, ID: "a"})).To(BeNil())
+		// Crash - the WAL is never closed
+
+		w, err = persistence.OpenWAL(walTestDir, persistence.SyncAlways, 0)
+		Expect(err).To(BeNil())
+		Expect(w.Append(persistence.Record{Kind: persistence.RecordConsume, ID: "b"})).To(BeNil())
+		Expect(w.Append(persistence.Record{Kind: persistence.RecordReschedule, ID: "c", TriggerAt: at})).To(BeNil())
+		Expect(w.Close()).To(BeNil())
+
+		w, err = persistence.OpenWAL(walTestDir, persistence.SyncNever, 0)
+		Expect(err).To(BeNil())
+		defer w.Close()
+		Expect(replay(w)).To(Equal([]persistence.Record{
+			{Kind: persistence.RecordAdd, ID: "a", Data: testBody},
+			{Kind: persistence.RecordCancel, ID: "a"},
+			{Kind: persistence.RecordConsume, ID: "b"},
+			{Kind: persistence.RecordReschedule, ID: "c", TriggerAt: at},
+		}))
+	})
+
+	It("drops all records on reset", func() {
+		w, err := persistence.OpenWAL(walTestDir, persistence.SyncAlways, 0)
+		Expect(err).To(BeNil())
+		Expect(w.Append(persistence.Record{Kind: persistence.RecordAdd, ID: "a"})).To(BeNil())
+		Expect(w.Close()).To(BeNil())
+
+		w, err = persistence.OpenWAL(walTestDir, persistence.SyncAlways, 0)
+		Expect(err).To(BeNil())
+		Expect(w.Reset()).To(BeNil())
+		Expect(replay(w)).To(BeEmpty())
+		Expect(w.Append(persistence.Record{Kind: persistence.RecordAdd, ID: "b"})).To(BeNil())
+		Expect(w.Close()).To(BeNil())
+
+		w, err = persistence.OpenWAL(walTestDir, persistence.SyncAlways, 0)
+		Expect(err).To(BeNil())
+		defer w.Close()
+		Expect(replay(w)).To(Equal([]persistence.Record{{Kind: persistence.RecordAdd, ID: "b"}}))
+	})
+})
@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"context"
 	"io"
 	"net"
 	"net/textproto"
@@ -9,7 +10,6 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/urjitbhatia/goyaad/pkg/goyaad"
 	"github.com/urjitbhatia/goyaad/pkg/metrics"
 )
 
@@ -21,25 +21,36 @@ var putJobCtr = "beanproto.putjob"
 var deleteJobCtr = "beanproto.deletejob"
 var reserveJobCtr = "beanproto.reservejob"
 var connectionsCtr = "beanproto.connections"
+var restoringCtr = "beanproto.restoring"
 
 const yamlFMT = "---\n%s"
 
 // ErrOutOfMem - The server cannot allocate enough memory for the job.
 // 	The client should try again later.
-var ErrOutOfMem errResponse = []byte(`OUT_OF_MEMORY\r\n`)
+var ErrOutOfMem errResponse = []byte("OUT_OF_MEMORY\r\n")
 
 // ErrInternal - This indicates a bug in the server. It should never happen.
-var ErrInternal errResponse = []byte(`INTERNAL_ERROR\r\n`)
+var ErrInternal errResponse = []byte("INTERNAL_ERROR\r\n")
 
 // ErrBadFormat - The client sent a command line that was not well-formed.
 //    This can happen if the line does not end with \r\n, if non-numeric
 //    characters occur where an integer is expected, if the wrong number of
 //    arguments are present, or if the command line is mal-formed in any other
 //    way.
-var ErrBadFormat errResponse = []byte(`BAD_FORMAT\r\n`)
+var ErrBadFormat errResponse = []byte("BAD_FORMAT\r\n")
 
 // ErrUnknownCmd - The client sent a command that the server does not know.
-var ErrUnknownCmd errResponse = []byte(`UNKNOWN_COMMAND\r\n`)
+var ErrUnknownCmd errResponse = []byte("UNKNOWN_COMMAND\r\n")
+
+// ErrRestoring - The server is still restoring jobs from disk and doesn't serve
+//    commands that touch jobs yet. The client should try again later.
+var ErrRestoring errResponse = []byte("RESTORING\r\n")
+
+// writeErr sends an error response to the client
+func (conn *Connection) writeErr(resp errResponse) {
+	conn.W.Write(resp)
+	conn.W.Flush()
+}
 
 // Server is a yaad server
 type Server struct {
@@ -52,13 +63,39 @@ type Server struct {
 // Connection implements a yaad + beanstalkd protocol server
 type Connection struct {
 	*textproto.Conn
+	nc          net.Conn
 	srv         BeanstalkdSrv
 	defaultTube Tube
 	id          int
 }
 
+// watchHangup returns a context that is cancelled if the client hangs up while a command blocks.
+// The connection must not be read from until stop is called.
+func (conn *Connection) watchHangup() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Clients wait for the response, so a read only returns early if they hang up.
+		// Peek doesn't consume commands sent ahead of the response.
+		if _, err := conn.R.Peek(1); err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				logrus.WithField("connection", conn.id).Debug("Client hung up during a blocking command")
+				cancel()
+			}
+		}
+	}()
+	return ctx, func() {
+		// Unblock the peek
+		conn.nc.SetReadDeadline(time.Now())
+		<-done
+		conn.nc.SetReadDeadline(time.Time{})
+		cancel()
+	}
+}
+
 // ServeBeanstalkd returns a pointer to a new yaad server
-func ServeBeanstalkd(hub *goyaad.Hub, addr string) io.Closer {
+func ServeBeanstalkd(hub Hub, addr string) io.Closer {
 	s := &Server{
 		srv:   NewSrvYaad(hub),
 		stop:  make(chan struct{}),
@@ -137,6 +174,7 @@ func (s *Server) ListenAndServe(protocol, address string) error {
 		// multiple connections may be served concurrently.
 		go s.serve(&Connection{
 			Conn:        textproto.NewConn(conn),
+			nc:          conn,
 			srv:         s.srv,
 			defaultTube: tube,
 			id:          connectionID})
@@ -171,6 +209,15 @@ func (s *Server) serve(conn *Connection) {
 		cmd := parts[0]
 
 		logrus.Debugf("Serving cmd: %s", cmd)
+		if touchesJobs(cmd) && !conn.defaultTube.ready() {
+			if cmd == put {
+				// Skip the job body
+				conn.ReadLineBytes()
+			}
+			go metrics.Incr(restoringCtr)
+			conn.writeErr(ErrRestoring)
+			continue
+		}
 		switch cmd {
 		case listTubes:
 			listTubesCmd(conn)
@@ -178,6 +225,12 @@ func (s *Server) serve(conn *Connection) {
 			listTubeUsedCmd(conn)
 		case pauseTube:
 			pauseTubeCmd(conn, parts[1:])
+		case stats:
+			statsCmd(conn)
+		case statsTube:
+			statsTubeCmd(conn, parts[1:])
+		case statsJob:
+			statsJobCmd(conn, parts[1:])
 		case put:
 			go metrics.Incr(putJobCtr)
 			body, err := conn.ReadLineBytes()
@@ -187,13 +240,23 @@ func (s *Server) serve(conn *Connection) {
 			putCmd(conn, parts[1:], body)
 		case reserve:
 			go metrics.Incr(reserveJobCtr)
-			reserveCmd(conn, "0")
+			reserveCmd(conn, "0", parts[1:])
 		case reserveWithTimeout:
 			go metrics.Incr(reserveJobCtr)
-			reserveCmd(conn, parts[1])
+			reserveCmd(conn, parts[1], parts[2:])
 		case deleteJob:
 			go metrics.Incr(deleteJobCtr)
 			deleteJobCmd(conn, parts[1:])
+		case addGroup:
+			addGroupCmd(conn, parts[1:])
+		case removeGroup:
+			removeGroupCmd(conn, parts[1:])
+		case timeTravel:
+			timeTravelCmd(conn, parts[1:])
+		case resume:
+			resumeCmd(conn)
+		case snapshot:
+			snapshotCmd(conn)
 		default:
 			// Echo cmd by default
 			conn.Writer.PrintfLine("%s", line)
@@ -4,9 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/goyaad"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -16,6 +18,9 @@ const (
 	listTubeUsed    string = "list-tube-used"
 	listTubeWatched string = "list-tube-watched"
 	pauseTube       string = "pause-tube"
+	statsTube       string = "stats-tube"
+	stats           string = "stats"
+	statsJob        string = "stats-job"
 	// producer commands
 	put string = "put"
 
@@ -23,6 +28,13 @@ const (
 	reserve            string = "reserve"
 	reserveWithTimeout string = "reserve-with-timeout"
 	deleteJob          string = "delete"
+
+	// yaad extensions
+	addGroup    string = "add-group"
+	removeGroup string = "remove-group"
+	timeTravel  string = "time-travel"
+	resume      string = "resume-delivery"
+	snapshot    string = "snapshot"
 )
 
 func listTubesCmd(conn *Connection) {
@@ -37,6 +49,64 @@ func listTubeUsedCmd(conn *Connection) {
 	conn.Writer.PrintfLine("USING foo")
 }
 
+// touchesJobs returns true for the commands that aren't served while the server restores jobs
+func touchesJobs(cmd string) bool {
+	switch cmd {
+	case put, reserve, reserveWithTimeout, deleteJob, statsJob, addGroup, removeGroup, timeTravel, snapshot:
+		return true
+	}
+	return false
+}
+
+// statsCmd reports the stats of the default tube
+func statsCmd(conn *Connection) {
+	writeYAML(conn, conn.defaultTube.stats())
+}
+
+func statsTubeCmd(conn *Connection, args []string) {
+	if len(args) != 1 {
+		conn.writeErr(ErrBadFormat)
+		return
+	}
+	t, err := conn.srv.getTube(args[0])
+	if err != nil {
+		conn.PrintfLine("NOT_FOUND")
+		return
+	}
+	writeYAML(conn, t.stats())
+}
+
+// writeYAML sends v as a yaml document in an OK response
+func writeYAML(conn *Connection, v interface{}) {
+	yml, err := yaml.Marshal(v)
+	if err != nil {
+		logrus.WithError(err).Error("protocol failed to marshal yaml response")
+		conn.writeErr(ErrInternal)
+		return
+	}
+	body := fmt.Sprintf(yamlFMT, yml)
+	conn.PrintfLine("OK %d", len(body))
+	conn.PrintfLine("%s", body)
+}
+
+func statsJobCmd(conn *Connection, args []string) {
+	if len(args) != 1 {
+		conn.writeErr(ErrBadFormat)
+		return
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		conn.writeErr(ErrBadFormat)
+		return
+	}
+	s, err := conn.defaultTube.statsJob(id)
+	if err != nil {
+		conn.PrintfLine("NOT_FOUND")
+		return
+	}
+	writeYAML(conn, s)
+}
+
 func pauseTubeCmd(conn *Connection, args []string) error {
 	if len(args) != 2 {
 		return errors.New("Pause tube missing args")
@@ -58,20 +128,99 @@ func pauseTubeCmd(conn *Connection, args []string) error {
 	return nil
 }
 
+// putCmd stores a job: put <pri> <delay> <ttr> <bytes> [jitter=<dur>] [spread=<dur>] [window=<window>]...
+// [key=<key>] [misfire=<policy>[:<threshold>]]
+// Durations take seconds or a golang duration string. Windows use '_' instead of spaces,
+// like window=Mon-Fri_08:00-21:00_Europe/Berlin, and can be repeated
 func putCmd(conn *Connection, args []string, body []byte) error {
 	logrus.Debugf("protocol putting job with args: %s", args)
+	if len(args) < 3 {
+		conn.writeErr(ErrBadFormat)
+		return nil
+	}
 	pri, _ := strconv.ParseInt(args[0], 10, 32)
 	delay, _ := strconv.Atoi(args[1])
 	ttr, _ := strconv.Atoi(args[2])
-	id, _ := conn.defaultTube.put(delay, int32(pri), body, ttr)
+	var ext []string
+	if len(args) > 4 {
+		ext = args[4:]
+	}
+	opts, err := parsePutOpts(ext)
+	if err != nil {
+		logrus.WithError(err).Debug("protocol bad put extension arguments")
+		conn.writeErr(ErrBadFormat)
+		return nil
+	}
+	id, err := conn.defaultTube.put(delay, int32(pri), body, ttr, opts)
+	switch err {
+	case nil:
+	case goyaad.ErrOutOfMemory:
+		conn.writeErr(ErrOutOfMem)
+		return nil
+	default:
+		logrus.WithError(err).Error("protocol failed to put job")
+		conn.writeErr(ErrInternal)
+		return nil
+	}
 
 	conn.PrintfLine("INSERTED %s", id)
 
 	return nil
 }
 
-func reserveCmd(conn *Connection, timeoutSec string) {
-	j := conn.defaultTube.reserve(timeoutSec)
+// parsePutOpts reads key=value put extension arguments
+func parsePutOpts(args []string) (putOpts, error) {
+	opts := putOpts{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return opts, fmt.Errorf("malformed put argument: %s", arg)
+		}
+		var err error
+		switch kv[0] {
+		case "jitter":
+			opts.jitter, err = parseDuration(kv[1])
+		case "spread":
+			opts.spread, err = parseDuration(kv[1])
+		case "window":
+			var w goyaad.Window
+			w, err = goyaad.ParseWindow(strings.Replace(kv[1], "_", " ", -1))
+			opts.windows = append(opts.windows, w)
+		case "key":
+			opts.key = kv[1]
+		case "misfire":
+			opts.misfire, err = goyaad.ParseMisfire(kv[1])
+		default:
+			return opts, fmt.Errorf("unknown put argument: %s", kv[0])
+		}
+		if err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// parseDuration reads whole seconds, like the rest of the protocol, or a golang duration string
+func parseDuration(s string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(s); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// reserveCmd reserves a job. An optional group name reads for that consumer group
+func reserveCmd(conn *Connection, timeoutSec string, args []string) {
+	group := ""
+	if len(args) > 0 {
+		group = args[0]
+	}
+	ctx, stop := conn.watchHangup()
+	j, err := conn.defaultTube.reserve(ctx, timeoutSec, group)
+	stop()
+	if err != nil {
+		conn.PrintfLine("NOT_FOUND")
+		return
+	}
 	if j != nil {
 		conn.PrintfLine("RESERVED %s %d", j.id, j.size)
 		conn.W.Write(j.body)
@@ -82,6 +231,73 @@ func reserveCmd(conn *Connection, timeoutSec string) {
 	conn.PrintfLine("TIMED_OUT")
 }
 
+func addGroupCmd(conn *Connection, args []string) {
+	if len(args) != 1 {
+		conn.writeErr(ErrBadFormat)
+		return
+	}
+	if err := conn.defaultTube.addGroup(args[0]); err != nil {
+		conn.writeErr(ErrUnknownCmd)
+		return
+	}
+	conn.PrintfLine("ADDED")
+}
+
+func removeGroupCmd(conn *Connection, args []string) {
+	if len(args) != 1 {
+		conn.writeErr(ErrBadFormat)
+		return
+	}
+	switch err := conn.defaultTube.removeGroup(args[0]); err {
+	case nil:
+	case ErrNotSupported:
+		conn.writeErr(ErrUnknownCmd)
+		return
+	default:
+		conn.PrintfLine("NOT_FOUND")
+		return
+	}
+	conn.PrintfLine("REMOVED")
+}
+
+// timeTravelCmd offsets the server clock: time-travel <offset>. The offset takes seconds or a golang
+// duration string, can be negative and replaces the previous offset, so time-travel 0 returns to real time.
+// Only staging servers know this command.
+func timeTravelCmd(conn *Connection, args []string) {
+	if len(args) != 1 {
+		conn.writeErr(ErrBadFormat)
+		return
+	}
+	offset, err := parseDuration(args[0])
+	if err != nil {
+		conn.writeErr(ErrBadFormat)
+		return
+	}
+	now, err := conn.defaultTube.timeTravel(offset)
+	if err != nil {
+		conn.writeErr(ErrUnknownCmd)
+		return
+	}
+	conn.PrintfLine("TRAVELED %s", now.Format(time.RFC3339Nano))
+}
+
+// resumeCmd hands out jobs again after a clock jump paused delivery
+func resumeCmd(conn *Connection) {
+	conn.defaultTube.resumeDelivery()
+	conn.PrintfLine("RESUMED")
+}
+
+// snapshotCmd writes a snapshot of all jobs right away and reports where it went and how long it took
+func snapshotCmd(conn *Connection) {
+	s, err := conn.defaultTube.snapshot()
+	if err != nil {
+		logrus.WithError(err).Error("protocol failed to snapshot")
+		conn.writeErr(ErrInternal)
+		return
+	}
+	writeYAML(conn, s)
+}
+
 func deleteJobCmd(conn *Connection, args []string) {
 	id, _ := strconv.Atoi(args[0])
 	err := conn.defaultTube.deleteJob(id)
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/urjitbhatia/goyaad/pkg/goyaad"
+)
+
+// ErrNotSupported is returned for calls the hub behind the server can't serve, like batches on a sharded hub
+var ErrNotSupported = errors.New("not supported by this hub")
+
+// Hub is the hub the servers serve jobs from, a goyaad.Hub or a goyaad.ShardedHub
+type Hub interface {
+	Ready() <-chan struct{}
+	IsReady() bool
+	RestoreErr() error
+	Now() time.Time
+	AddJob(j *goyaad.Job) error
+	CancelJob(jobID string) error
+	FindJob(jobID string) (*goyaad.Job, error)
+	NextFor(group string) (*goyaad.Job, error)
+	NextForWait(ctx context.Context, group string) (*goyaad.Job, error)
+	Stats() goyaad.HubStats
+	SetClockOffset(offset time.Duration) (time.Time, error)
+	Checkpoint() (goyaad.CheckpointStats, error)
+	ResumeDelivery()
+	Stop(persist bool)
+}
+
+// batchHub is a hub that groups jobs in batches
+type batchHub interface {
+	OpenBatch() string
+	SealBatch(batchID string, callback *goyaad.Job) error
+	BatchProgress(batchID string) (goyaad.BatchProgress, error)
+}
+
+// groupHub is a hub that delivers every job to each of its consumer groups
+type groupHub interface {
+	AddGroup(name string)
+	RemoveGroup(name string) error
+}
+
+var _ Hub = (*goyaad.Hub)(nil)
+var _ Hub = (*goyaad.ShardedHub)(nil)
+var _ batchHub = (*goyaad.Hub)(nil)
+var _ groupHub = (*goyaad.Hub)(nil)
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/goyaad"
 )
 
 // ErrClientDisconnected means a client was used while it was disconnected from the remote server
@@ -29,13 +30,38 @@ func (c *RPCClient) Connect(addr string) error {
 	return nil
 }
 
+// serverErrs are the errors the server can send that clients may want to check for
+var serverErrs = []error{
+	goyaad.ErrOutOfMemory,
+	goyaad.ErrBatchNotFound,
+	goyaad.ErrBatchSealed,
+	goyaad.ErrGroupNotFound,
+	goyaad.ErrJobNotFound,
+	goyaad.ErrClockNotAdjustable,
+	goyaad.ErrRestoring,
+}
+
+// call invokes a server method and turns the errors the server sent back into
+// the goyaad errors they started as, like goyaad.ErrOutOfMemory
+func (c *RPCClient) call(method string, args interface{}, reply interface{}) error {
+	err := c.client.Call(method, args, reply)
+	if se, ok := err.(rpc.ServerError); ok {
+		for _, e := range serverErrs {
+			if string(se) == e.Error() {
+				return e
+			}
+		}
+	}
+	return err
+}
+
 // PutWithID saves a job with Yaad against a given id.
 func (c *RPCClient) PutWithID(id string, body []byte, delay time.Duration) error {
 	if c.client == nil {
 		return ErrClientDisconnected
 	}
 	job := &RPCJob{ID: id, Body: body, Delay: delay}
-	return c.client.Call("RPCServer.PutWithID", job, &id)
+	return c.call("RPCServer.PutWithID", job, &id)
 }
 
 // Put saves a job with Yaad and returns the auto-generated job id
@@ -45,17 +71,84 @@ func (c *RPCClient) Put(body []byte, delay time.Duration) (string, error) {
 	}
 	job := &RPCJob{ID: "", Body: body, Delay: delay}
 	var id string
-	err := c.client.Call("RPCServer.PutWithID", job, &id)
+	err := c.call("RPCServer.PutWithID", job, &id)
+	return id, err
+}
+
+// PutScheduled saves a job with Yaad and returns its id and the trigger time Yaad chose for it.
+// Jitter and spread are optional (zero) and let Yaad pick the trigger time around the delay
+func (c *RPCClient) PutScheduled(body []byte, delay, jitter, spread time.Duration) (string, time.Time, error) {
+	if c.client == nil {
+		return "", time.Time{}, ErrClientDisconnected
+	}
+	job := &RPCJob{Body: body, Delay: delay, Jitter: jitter, Spread: spread}
+	var reply RPCPutReply
+	err := c.call("RPCServer.PutScheduled", job, &reply)
+	return reply.ID, reply.TriggerAt, err
+}
+
+// PutInWindows saves a job that may only be delivered during the given windows and returns its id.
+// Windows look like "Mon-Fri 08:00-21:00 Europe/Berlin", see goyaad.ParseWindow
+func (c *RPCClient) PutInWindows(body []byte, delay time.Duration, windows []string) (string, error) {
+	if c.client == nil {
+		return "", ErrClientDisconnected
+	}
+	job := &RPCJob{Body: body, Delay: delay, Windows: windows}
+	var id string
+	err := c.call("RPCServer.PutWithID", job, &id)
+	return id, err
+}
+
+// OpenBatch starts a new batch and returns its id
+func (c *RPCClient) OpenBatch() (string, error) {
+	if c.client == nil {
+		return "", ErrClientDisconnected
+	}
+	var batchID string
+	err := c.call("RPCServer.OpenBatch", 0, &batchID)
+	return batchID, err
+}
+
+// PutInBatch saves a job as a member of the given batch and returns the auto-generated job id
+func (c *RPCClient) PutInBatch(batchID string, body []byte, delay time.Duration) (string, error) {
+	if c.client == nil {
+		return "", ErrClientDisconnected
+	}
+	job := &RPCJob{ID: "", Body: body, Delay: delay, BatchID: batchID}
+	var id string
+	err := c.call("RPCServer.PutWithID", job, &id)
+	return id, err
+}
+
+// SealBatch registers the callback job of a batch and returns the callback job id.
+// The callback is ready once every job in the batch is consumed or cancelled (and its delay passed)
+func (c *RPCClient) SealBatch(batchID string, body []byte, delay time.Duration) (string, error) {
+	if c.client == nil {
+		return "", ErrClientDisconnected
+	}
+	seal := &RPCBatchSeal{BatchID: batchID, Callback: RPCJob{Body: body, Delay: delay}}
+	var id string
+	err := c.call("RPCServer.SealBatch", seal, &id)
 	return id, err
 }
 
+// BatchProgress returns the progress of the given batch
+func (c *RPCClient) BatchProgress(batchID string) (goyaad.BatchProgress, error) {
+	var p goyaad.BatchProgress
+	if c.client == nil {
+		return p, ErrClientDisconnected
+	}
+	err := c.call("RPCServer.BatchProgress", batchID, &p)
+	return p, err
+}
+
 // Cancel deletes a job identified by the given id. Calls to cancel are idempotent
 func (c *RPCClient) Cancel(id string) error {
 	if c.client == nil {
 		return ErrClientDisconnected
 	}
 	var ignoredReply int8
-	return c.client.Call("RPCServer.Cancel", id, &ignoredReply)
+	return c.call("RPCServer.Cancel", id, &ignoredReply)
 }
 
 // Next wait at-most timeout duration to return a ready job body from Yaad
@@ -65,7 +158,38 @@ func (c *RPCClient) Next(timeout time.Duration) (string, []byte, error) {
 		return "", nil, ErrClientDisconnected
 	}
 	var job RPCJob
-	err := c.client.Call("RPCServer.Next", timeout, &job)
+	err := c.call("RPCServer.Next", timeout, &job)
+	if err != nil {
+		return "", nil, err
+	}
+	return job.ID, job.Body, nil
+}
+
+// AddGroup registers a consumer group. Jobs that fire from now on are delivered once to every group
+func (c *RPCClient) AddGroup(name string) error {
+	if c.client == nil {
+		return ErrClientDisconnected
+	}
+	var ignoredReply int8
+	return c.call("RPCServer.AddGroup", name, &ignoredReply)
+}
+
+// RemoveGroup unregisters a consumer group
+func (c *RPCClient) RemoveGroup(name string) error {
+	if c.client == nil {
+		return ErrClientDisconnected
+	}
+	var ignoredReply int8
+	return c.call("RPCServer.RemoveGroup", name, &ignoredReply)
+}
+
+// NextFor works like Next but reads the jobs fired for the given consumer group
+func (c *RPCClient) NextFor(group string, timeout time.Duration) (string, []byte, error) {
+	if c.client == nil {
+		return "", nil, ErrClientDisconnected
+	}
+	var job RPCJob
+	err := c.call("RPCServer.NextFor", RPCNextArgs{Group: group, Timeout: timeout}, &job)
 	if err != nil {
 		return "", nil, err
 	}
@@ -80,13 +204,53 @@ func (c *RPCClient) Close() error {
 	return nil
 }
 
+// Stats returns the current hub stats, including the delivery throttle state
+func (c *RPCClient) Stats() (goyaad.HubStats, error) {
+	var stats goyaad.HubStats
+	if c.client == nil {
+		return stats, ErrClientDisconnected
+	}
+	err := c.call("RPCServer.Stats", 0, &stats)
+	return stats, err
+}
+
+// TimeTravel offsets the server clock, replacing any previous offset, and returns the new server time.
+// Servers that aren't staging servers return goyaad.ErrClockNotAdjustable
+func (c *RPCClient) TimeTravel(offset time.Duration) (time.Time, error) {
+	var now time.Time
+	if c.client == nil {
+		return now, ErrClientDisconnected
+	}
+	err := c.call("RPCServer.TimeTravel", offset, &now)
+	return now, err
+}
+
+// Snapshot makes the server write a snapshot of all jobs right away and returns where it went and how long it took
+func (c *RPCClient) Snapshot() (goyaad.CheckpointStats, error) {
+	var stats goyaad.CheckpointStats
+	if c.client == nil {
+		return stats, ErrClientDisconnected
+	}
+	err := c.call("RPCServer.Snapshot", 0, &stats)
+	return stats, err
+}
+
+// ResumeDelivery makes the server hand out jobs again after a clock jump paused delivery
+func (c *RPCClient) ResumeDelivery() error {
+	if c.client == nil {
+		return ErrClientDisconnected
+	}
+	var ignoredReply int8
+	return c.call("RPCServer.ResumeDelivery", 0, &ignoredReply)
+}
+
 // Ping the server and check connectivity
 func (c *RPCClient) Ping() error {
 	if c.client == nil {
 		return ErrClientDisconnected
 	}
 	var pong string
-	err := c.client.Call("RPCServer.Ping", 0, &pong)
+	err := c.call("RPCServer.Ping", 0, &pong)
 	if err != nil {
 		return err
 	}
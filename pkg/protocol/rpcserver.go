@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"context"
 	"io"
 	"net"
 	"net/rpc"
@@ -16,36 +17,196 @@ var ErrTimeout = errors.New("No new jobs available in given timeout")
 
 // RPCServer exposes a Yaad hub backed RPC endpoint
 type RPCServer struct {
-	hub *goyaad.Hub
+	hub Hub
+	ctx context.Context // Cancelled when the client hangs up
 }
 
 // RPCJob is a light wrapper struct representing job data on the wire without extra metadata that is stored internally
 type RPCJob struct {
-	Body  []byte
-	ID    string
-	Delay time.Duration
+	Body    []byte
+	ID      string
+	Delay   time.Duration
+	BatchID string        // Optional batch this job belongs to
+	Jitter  time.Duration // Optional, trigger anywhere within +/- Jitter of the delay
+	Spread  time.Duration // Optional, trigger anywhere within [Delay, Delay+Spread)
+	Windows []string      // Optional delivery windows like "Mon-Fri 08:00-21:00 Europe/Berlin"
+	Key     string        // Optional key grouping jobs for the latest misfire policy
+	Misfire string        // Optional misfire policy like "skip:10m" or "latest"
 }
 
-func newRPCServer(hub *goyaad.Hub) *RPCServer {
-	return &RPCServer{hub: hub}
+// RPCPutReply reports the id and the trigger time the hub chose for a job
+type RPCPutReply struct {
+	ID        string
+	TriggerAt time.Time
+}
+
+// RPCNextArgs asks for the next job of a consumer group
+type RPCNextArgs struct {
+	Group   string
+	Timeout time.Duration
+}
+
+// RPCBatchSeal carries the callback job that seals a batch
+type RPCBatchSeal struct {
+	BatchID  string
+	Callback RPCJob
+}
+
+func newRPCServer(ctx context.Context, hub Hub) *RPCServer {
+	return &RPCServer{hub: hub, ctx: ctx}
+}
+
+// batches returns the hub if it groups jobs in batches, ErrNotSupported if it doesn't
+func (r *RPCServer) batches() (batchHub, error) {
+	b, ok := r.hub.(batchHub)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return b, nil
+}
+
+// groups returns the hub if it has consumer groups, ErrNotSupported if it doesn't
+func (r *RPCServer) groups() (groupHub, error) {
+	g, ok := r.hub.(groupHub)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return g, nil
+}
+
+// checkReady returns goyaad.ErrRestoring while the hub is still restoring jobs from disk
+func (r *RPCServer) checkReady() error {
+	if !r.hub.IsReady() {
+		return goyaad.ErrRestoring
+	}
+	return nil
 }
 
 // PutWithID accepts a new job and stores it in a Hub, reply is ignored
 func (r *RPCServer) PutWithID(job RPCJob, id *string) error {
+	if err := r.checkReady(); err != nil {
+		return err
+	}
+	j, err := r.newJobFromRPC(job)
+	if err != nil {
+		return err
+	}
+	if job.ID == "" {
+		*id = j.ID()
+	}
+	return r.hub.AddJob(j)
+}
+
+// PutScheduled accepts a new job and sets the reply to its id and the trigger time the hub chose
+func (r *RPCServer) PutScheduled(job RPCJob, reply *RPCPutReply) error {
+	if err := r.checkReady(); err != nil {
+		return err
+	}
+	j, err := r.newJobFromRPC(job)
+	if err != nil {
+		return err
+	}
+	if err := r.hub.AddJob(j); err != nil {
+		return err
+	}
+	reply.ID = j.ID()
+	reply.TriggerAt = j.TriggerAt()
+	return nil
+}
+
+// newJobFromRPC creates a hub job from its wire representation
+func (r *RPCServer) newJobFromRPC(job RPCJob) (*goyaad.Job, error) {
 	var j *goyaad.Job
 	if job.ID == "" {
 		// need to generate an id
-		j = goyaad.NewJobAutoID(time.Now().Add(job.Delay), job.Body)
-		*id = j.ID()
+		j = goyaad.NewJobAutoID(r.hub.Now().Add(job.Delay), job.Body)
 	} else {
-		j = goyaad.NewJob(job.ID, time.Now().Add(job.Delay), job.Body)
+		j = goyaad.NewJob(job.ID, r.hub.Now().Add(job.Delay), job.Body)
 	}
-	return r.hub.AddJob(j)
+	if job.BatchID != "" {
+		j.SetBatch(job.BatchID)
+	}
+	j.SetJitter(job.Jitter)
+	j.SetSpread(job.Spread)
+	if len(job.Windows) > 0 {
+		windows := make([]goyaad.Window, len(job.Windows))
+		for i, w := range job.Windows {
+			var err error
+			if windows[i], err = goyaad.ParseWindow(w); err != nil {
+				return nil, err
+			}
+		}
+		j.SetWindows(windows)
+	}
+	if job.Key != "" {
+		j.SetKey(job.Key)
+	}
+	if job.Misfire != "" {
+		m, err := goyaad.ParseMisfire(job.Misfire)
+		if err != nil {
+			return nil, err
+		}
+		j.SetMisfire(m)
+	}
+	return j, nil
+}
+
+// OpenBatch starts a new batch and sets its id as the reply
+func (r *RPCServer) OpenBatch(ignore int8, batchID *string) error {
+	if err := r.checkReady(); err != nil {
+		return err
+	}
+	b, err := r.batches()
+	if err != nil {
+		return err
+	}
+	*batchID = b.OpenBatch()
+	return nil
+}
+
+// SealBatch registers the callback job of a batch and sets the callback job id as the reply.
+// The callback becomes ready once all jobs in the batch have been consumed or cancelled
+func (r *RPCServer) SealBatch(seal RPCBatchSeal, id *string) error {
+	if err := r.checkReady(); err != nil {
+		return err
+	}
+	b, err := r.batches()
+	if err != nil {
+		return err
+	}
+	var j *goyaad.Job
+	if seal.Callback.ID == "" {
+		j = goyaad.NewJobAutoID(r.hub.Now().Add(seal.Callback.Delay), seal.Callback.Body)
+	} else {
+		j = goyaad.NewJob(seal.Callback.ID, r.hub.Now().Add(seal.Callback.Delay), seal.Callback.Body)
+	}
+	*id = j.ID()
+	return b.SealBatch(seal.BatchID, j)
+}
+
+// BatchProgress sets the reply to the current progress of the given batch
+func (r *RPCServer) BatchProgress(batchID string, progress *goyaad.BatchProgress) error {
+	if err := r.checkReady(); err != nil {
+		return err
+	}
+	b, err := r.batches()
+	if err != nil {
+		return err
+	}
+	p, err := b.BatchProgress(batchID)
+	if err != nil {
+		return err
+	}
+	*progress = p
+	return nil
 }
 
 // Cancel deletes the job pointed to by the id, reply is ignored
 // If the job doesn't exist, no error is returned so calls to Cancel are idempotent
 func (r *RPCServer) Cancel(id string, ignoredReply *int8) error {
+	if err := r.checkReady(); err != nil {
+		return err
+	}
 	return r.hub.CancelJob(id)
 }
 
@@ -53,31 +214,108 @@ func (r *RPCServer) Cancel(id string, ignoredReply *int8) error {
 // If not job is ready yet, this call will wait (block) for the given duration and keep searching
 // for ready jobs. If no job is ready by the end of the timeout, ErrTimeout is returned
 func (r *RPCServer) Next(timeout time.Duration, job *RPCJob) error {
+	return r.NextFor(RPCNextArgs{Timeout: timeout}, job)
+}
+
+// NextFor works like Next but reads the jobs fired for the given consumer group
+func (r *RPCServer) NextFor(args RPCNextArgs, job *RPCJob) error {
+	if err := r.checkReady(); err != nil {
+		return err
+	}
 	// try once
-	if j := r.hub.Next(); j != nil {
+	j, err := r.hub.NextFor(args.Group)
+	if err != nil {
+		return err
+	}
+	if j != nil {
 		job.Body = j.Body()
 		job.ID = j.ID()
 		return nil
 	}
 	// if we couldn't find a ready job and timeout was set to 0
-	if timeout.Seconds() == 0 {
+	if args.Timeout.Seconds() == 0 {
 		return ErrTimeout
 	}
 
-	waitTill := time.Now().Add(timeout)
-	// wait for timeout and keep trying
-	logrus.Debugf("waiting for reserve timeout: %v now: %v till: %v ", timeout, time.Now(), waitTill)
-	for waitTill.After(time.Now()) {
-		if j := r.hub.Next(); j != nil {
-			job.Body = j.Body()
-			job.ID = j.ID()
-			return nil
-		}
-		time.Sleep(time.Millisecond * 200)
-		logrus.Debug("waiting for reserve finished sleep for total timeout: ", timeout)
+	// wait for timeout or until the client hangs up
+	logrus.Debugf("waiting for reserve timeout: %v", args.Timeout)
+	ctx, cancel := context.WithTimeout(r.ctx, args.Timeout)
+	defer cancel()
+	j, err = r.hub.NextForWait(ctx, args.Group)
+	switch err {
+	case nil:
+		job.Body = j.Body()
+		job.ID = j.ID()
+		return nil
+	case context.DeadlineExceeded:
+		return ErrTimeout
+	default:
+		return err
+	}
+}
+
+// AddGroup registers a consumer group, reply is ignored
+func (r *RPCServer) AddGroup(name string, ignoredReply *int8) error {
+	if err := r.checkReady(); err != nil {
+		return err
+	}
+	g, err := r.groups()
+	if err != nil {
+		return err
+	}
+	g.AddGroup(name)
+	return nil
+}
+
+// RemoveGroup unregisters a consumer group, reply is ignored
+func (r *RPCServer) RemoveGroup(name string, ignoredReply *int8) error {
+	if err := r.checkReady(); err != nil {
+		return err
 	}
+	g, err := r.groups()
+	if err != nil {
+		return err
+	}
+	return g.RemoveGroup(name)
+}
 
-	return ErrTimeout
+// Stats sets the reply to the current hub stats
+func (r *RPCServer) Stats(ignore int8, stats *goyaad.HubStats) error {
+	*stats = r.hub.Stats()
+	return nil
+}
+
+// TimeTravel offsets the hub clock and sets the reply to the new time on it.
+// Only staging servers, whose hubs run on an offset clock, accept it
+func (r *RPCServer) TimeTravel(offset time.Duration, now *time.Time) error {
+	if err := r.checkReady(); err != nil {
+		return err
+	}
+	t, err := r.hub.SetClockOffset(offset)
+	if err != nil {
+		return err
+	}
+	*now = t
+	return nil
+}
+
+// Snapshot writes a snapshot of all jobs right away and sets the reply to where it went and how long it took
+func (r *RPCServer) Snapshot(ignore int8, stats *goyaad.CheckpointStats) error {
+	if err := r.checkReady(); err != nil {
+		return err
+	}
+	s, err := r.hub.Checkpoint()
+	if err != nil {
+		return err
+	}
+	*stats = s
+	return nil
+}
+
+// ResumeDelivery hands out jobs again after a clock jump paused delivery, reply is ignored
+func (r *RPCServer) ResumeDelivery(ignore int8, ignoredReply *int8) error {
+	r.hub.ResumeDelivery()
+	return nil
 }
 
 // Ping the server, sets "pong" as the reply
@@ -89,10 +327,7 @@ func (r *RPCServer) Ping(ignore int8, pong *string) error {
 }
 
 // ServeRPC starts serving hub over rpc
-func ServeRPC(hub *goyaad.Hub, addr string) (io.Closer, error) {
-	srv := newRPCServer(hub)
-	rpcSrv := rpc.NewServer()
-	rpcSrv.Register(srv)
+func ServeRPC(hub Hub, addr string) (io.Closer, error) {
 	l, e := net.Listen("tcp", addr)
 	if e != nil {
 		return nil, e
@@ -104,8 +339,32 @@ func ServeRPC(hub *goyaad.Hub, addr string) (io.Closer, error) {
 				logrus.Errorf("Cannot handle client connection %s", err)
 				return
 			}
-			go rpcSrv.ServeConn(conn)
+			go serveRPCConn(hub, conn)
 		}
 	}()
 	return l, nil
 }
+
+// serveRPCConn serves a single client. Calls blocked waiting for jobs stop once the client hangs up.
+func serveRPCConn(hub Hub, conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rpcSrv := rpc.NewServer()
+	rpcSrv.Register(newRPCServer(ctx, hub))
+	rpcSrv.ServeConn(&hangupConn{Conn: conn, hangup: cancel})
+}
+
+// hangupConn calls hangup once reading from the client fails. The rpc server keeps reading
+// the next request while calls run, so this notices clients that went away mid call.
+type hangupConn struct {
+	net.Conn
+	hangup context.CancelFunc
+}
+
+func (c *hangupConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.hangup()
+	}
+	return n, err
+}
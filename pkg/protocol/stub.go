@@ -1,12 +1,14 @@
 package protocol
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/goyaad"
 )
 
 //SrvStub implements a stub beanstalkd instance
@@ -33,6 +35,15 @@ type Job struct {
 	size  int
 }
 
+// putOpts are the yaad extension arguments of a put
+type putOpts struct {
+	jitter  time.Duration   // Trigger anywhere within +/- jitter of the delay
+	spread  time.Duration   // Trigger anywhere within [delay, delay+spread)
+	windows []goyaad.Window // Allowed delivery windows
+	key     string          // Groups jobs for the latest misfire policy
+	misfire goyaad.Misfire  // What happens if the job is delivered late
+}
+
 // BeanstalkdSrv implements the beanstalkd server responsibilities
 type BeanstalkdSrv interface {
 	listTubes() []string
@@ -43,9 +54,17 @@ type BeanstalkdSrv interface {
 // Tube is a beanstalkd tube
 type Tube interface {
 	pauseTube(delay time.Duration) error
-	put(delay int, pri int32, body []byte, ttr int) (string, error)
-	reserve(timeoutSec string) *Job
+	put(delay int, pri int32, body []byte, ttr int, opts putOpts) (string, error)
+	reserve(ctx context.Context, timeoutSec string, group string) (*Job, error)
 	deleteJob(id int) error
+	addGroup(name string) error
+	removeGroup(name string) error
+	timeTravel(offset time.Duration) (time.Time, error)
+	resumeDelivery()
+	ready() bool
+	stats() map[string]interface{}
+	statsJob(id int) (map[string]interface{}, error)
+	snapshot() (map[string]interface{}, error)
 	stop(persist bool)
 }
 
@@ -98,7 +117,7 @@ func (t *TubeStub) pauseTube(delay time.Duration) error {
 	return nil
 }
 
-func (t *TubeStub) put(delay int, pri int32, body []byte, ttr int) (string, error) {
+func (t *TubeStub) put(delay int, pri int32, body []byte, ttr int, opts putOpts) (string, error) {
 	logrus.Debug("Putting job in stub")
 	j := &Job{
 		id:    strconv.Itoa(t.jobIDCtr),
@@ -114,7 +133,7 @@ func (t *TubeStub) put(delay int, pri int32, body []byte, ttr int) (string, erro
 	return j.id, nil
 }
 
-func (t *TubeStub) reserve(timeoutSec string) *Job {
+func (t *TubeStub) reserve(ctx context.Context, timeoutSec string, group string) (*Job, error) {
 	// ts, err := strconv.Atoi(timeoutSec)
 	// if err != nil {
 	// 	return nil
@@ -122,12 +141,57 @@ func (t *TubeStub) reserve(timeoutSec string) *Job {
 	for k := range t.jobs {
 		j := t.jobs[k]
 		t.reserved[j.id] = j
-		return j
+		return j, nil
+	}
+
+	return nil, nil
+}
+
+func (t *TubeStub) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"name":               t.name,
+		"current-jobs-ready": len(t.jobs),
 	}
+}
+
+func (t *TubeStub) statsJob(id int) (map[string]interface{}, error) {
+	j, ok := t.jobs[strconv.Itoa(id)]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return map[string]interface{}{
+		"id":    j.id,
+		"tube":  t.name,
+		"pri":   j.pri,
+		"delay": int(j.delay.Seconds()),
+		"ttr":   int(j.ttr.Seconds()),
+	}, nil
+}
 
+func (t *TubeStub) addGroup(name string) error {
+	// noop
 	return nil
 }
 
+func (t *TubeStub) removeGroup(name string) error {
+	// noop
+	return nil
+}
+
+func (t *TubeStub) resumeDelivery() {}
+
+func (t *TubeStub) ready() bool {
+	return true
+}
+
+func (t *TubeStub) timeTravel(offset time.Duration) (time.Time, error) {
+	return time.Time{}, goyaad.ErrClockNotAdjustable
+}
+
+func (t *TubeStub) snapshot() (map[string]interface{}, error) {
+	return nil, goyaad.ErrNoPersister
+}
+
 func (t *TubeStub) deleteJob(id int) error {
 	sid := fmt.Sprintf("%d", id)
 	_, ok := t.jobs[sid]
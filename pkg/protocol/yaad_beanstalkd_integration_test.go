@@ -1,8 +1,13 @@
 package protocol_test
 
 import (
+	"io"
 	"net"
 	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kr/beanstalk"
@@ -11,6 +16,7 @@ import (
 	"github.com/urjitbhatia/goyaad/pkg/goyaad"
 	"github.com/urjitbhatia/goyaad/pkg/persistence"
 	"github.com/urjitbhatia/goyaad/pkg/protocol"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var _ = Describe("Test beanstalkd protocol:", func() {
@@ -100,6 +106,340 @@ var _ = Describe("Test beanstalkd protocol:", func() {
 			Expect(string(body)).To(Equal(hw))
 		})
 
+		It("Reserves a job for a consumer group", func(done Done) {
+			defer close(done)
+			c, err := net.Dial(proto, addr)
+			ExpectNoErr(err)
+			tc := textproto.NewConn(c)
+			defer tc.Close()
+
+			_, err = tc.Cmd("add-group billing")
+			ExpectNoErr(err)
+			resp, err := tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(Equal("ADDED"))
+
+			_, err = tc.Cmd("reserve-with-timeout 0 unknown")
+			ExpectNoErr(err)
+			resp, err = tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(Equal("NOT_FOUND"))
+
+			_, err = tc.Cmd("remove-group billing")
+			ExpectNoErr(err)
+			resp, err = tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(Equal("REMOVED"))
+		})
+
+		It("Reports tube stats", func(done Done) {
+			defer close(done)
+			stats, err := bconn.Stats()
+			ExpectNoErr(err)
+			Expect(stats).To(HaveKeyWithValue("name", "default"))
+			Expect(stats).To(HaveKey("current-jobs-backlog"))
+			Expect(stats).To(HaveKeyWithValue("throttled", "false"))
+
+			t := beanstalk.Tube{Conn: bconn, Name: "default"}
+			stats, err = t.Stats()
+			ExpectNoErr(err)
+			Expect(stats).To(HaveKeyWithValue("name", "default"))
+		})
+
+		It("Puts a job with a spread window and reports its trigger time", func(done Done) {
+			defer close(done)
+			c, err := net.Dial(proto, addr)
+			ExpectNoErr(err)
+			tc := textproto.NewConn(c)
+			defer tc.Close()
+
+			before := time.Now()
+			_, err = tc.Cmd("put 0 3600 1 5 spread=1h\r\nhello")
+			ExpectNoErr(err)
+			resp, err := tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(HavePrefix("INSERTED "))
+			id, err := strconv.ParseUint(strings.TrimPrefix(resp, "INSERTED "), 10, 64)
+			ExpectNoErr(err)
+
+			stats, err := bconn.StatsJob(id)
+			ExpectNoErr(err)
+			Expect(stats).To(HaveKeyWithValue("state", "delayed"))
+			triggerAt, err := time.Parse(time.RFC3339Nano, strings.Trim(stats["trigger-at"], `"`))
+			ExpectNoErr(err)
+			Expect(triggerAt).To(BeTemporally(">=", before.Add(time.Hour)))
+			Expect(triggerAt).To(BeTemporally("<", time.Now().Add(2*time.Hour)))
+
+			_, err = tc.Cmd("put 0 0 1 5 wobble=1h\r\nhello")
+			ExpectNoErr(err)
+			resp, err = tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(Equal("BAD_FORMAT"))
+		})
+
+		It("Resumes delivery", func(done Done) {
+			defer close(done)
+			c, err := net.Dial(proto, addr)
+			ExpectNoErr(err)
+			tc := textproto.NewConn(c)
+			defer tc.Close()
+
+			_, err = tc.Cmd("resume-delivery")
+			ExpectNoErr(err)
+			resp, err := tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(Equal("RESUMED"))
+
+			stats, err := bconn.Stats()
+			ExpectNoErr(err)
+			Expect(stats).To(HaveKeyWithValue("delivery-paused", "false"))
+		})
+
+		It("Puts keyed jobs with a misfire policy", func(done Done) {
+			defer close(done)
+			c, err := net.Dial(proto, addr)
+			ExpectNoErr(err)
+			tc := textproto.NewConn(c)
+			defer tc.Close()
+
+			_, err = tc.Cmd("put 0 3600 1 5 key=report misfire=latest:10m\r\nhello")
+			ExpectNoErr(err)
+			resp, err := tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(HavePrefix("INSERTED "))
+			id, err := strconv.ParseUint(strings.TrimPrefix(resp, "INSERTED "), 10, 64)
+			ExpectNoErr(err)
+			ExpectNoErr(bconn.Delete(id))
+
+			// Skipping needs a threshold
+			_, err = tc.Cmd("put 0 0 1 5 misfire=skip\r\nhello")
+			ExpectNoErr(err)
+			resp, err = tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(Equal("BAD_FORMAT"))
+		})
+
+		It("Rejects puts over the memory limits", func(done Done) {
+			defer close(done)
+			limitedAddr := ":9500"
+			hub := goyaad.NewHub(&goyaad.HubOpts{
+				Persister: persistence.NewJournalPersister(""),
+				SpokeSpan: time.Second * 5,
+				MaxJobs:   1})
+			srv := protocol.ServeBeanstalkd(hub, limitedAddr)
+			defer srv.Close()
+
+			var c *beanstalk.Conn
+			Eventually(func() (err error) {
+				c, err = beanstalk.Dial(proto, limitedAddr)
+				return err
+			}, "1s").Should(BeNil())
+			defer c.Close()
+
+			_, err := c.Put([]byte("hello"), 0, time.Hour, time.Second)
+			ExpectNoErr(err)
+			_, err = c.Put([]byte("hello"), 0, time.Hour, time.Second)
+			Expect(err).To(HaveOccurred())
+			Expect(err.(beanstalk.ConnError).Err).To(Equal(beanstalk.ErrOOM))
+
+			stats, err := c.Stats()
+			ExpectNoErr(err)
+			Expect(stats).To(HaveKeyWithValue("memory-jobs", "1"))
+			Expect(stats).To(HaveKeyWithValue("max-jobs", "1"))
+		}, 2)
+
+		It("Time travels on staging servers only", func(done Done) {
+			defer close(done)
+			stagingAddr := ":9501"
+			hub := goyaad.NewHub(&goyaad.HubOpts{
+				Persister: persistence.NewJournalPersister(""),
+				SpokeSpan: time.Second * 5,
+				Clock:     goyaad.NewOffsetClock(goyaad.SystemClock)})
+			srv := protocol.ServeBeanstalkd(hub, stagingAddr)
+			defer srv.Close()
+
+			var c net.Conn
+			Eventually(func() (err error) {
+				c, err = net.Dial(proto, stagingAddr)
+				return err
+			}, "1s").Should(BeNil())
+			tc := textproto.NewConn(c)
+			defer tc.Close()
+
+			_, err := tc.Cmd("put 0 172800 1 5\r\nhello")
+			ExpectNoErr(err)
+			resp, err := tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(HavePrefix("INSERTED "))
+
+			_, err = tc.Cmd("time-travel 49h")
+			ExpectNoErr(err)
+			resp, err = tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(HavePrefix("TRAVELED "))
+			now, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(resp, "TRAVELED "))
+			ExpectNoErr(err)
+			Expect(now).To(BeTemporally("~", time.Now().Add(49*time.Hour), time.Second))
+
+			_, err = tc.Cmd("reserve-with-timeout 0")
+			ExpectNoErr(err)
+			resp, err = tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(HavePrefix("RESERVED "))
+			body, err := tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(body).To(Equal("hello"))
+
+			// Servers that aren't staging servers don't know the command
+			other, err := net.Dial(proto, addr)
+			ExpectNoErr(err)
+			otc := textproto.NewConn(other)
+			defer otc.Close()
+			_, err = otc.Cmd("time-travel 1h")
+			ExpectNoErr(err)
+			resp, err = otc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(Equal("UNKNOWN_COMMAND"))
+		}, 2)
+
+		It("Writes a snapshot on demand", func(done Done) {
+			defer close(done)
+			snapshotAddr := ":9504"
+			dataDir := path.Join(os.TempDir(), "goyaadsnapshotcmd")
+			ExpectNoErr(os.RemoveAll(dataDir))
+			hub := goyaad.NewHub(&goyaad.HubOpts{
+				Persister: persistence.NewJournalPersister(dataDir),
+				SpokeSpan: time.Second * 5})
+			srv := protocol.ServeBeanstalkd(hub, snapshotAddr)
+			defer srv.Close()
+
+			var c net.Conn
+			Eventually(func() (err error) {
+				c, err = net.Dial(proto, snapshotAddr)
+				return err
+			}, "1s").Should(BeNil())
+			tc := textproto.NewConn(c)
+			defer tc.Close()
+
+			_, err := tc.Cmd("put 0 3600 1 5\r\nhello")
+			ExpectNoErr(err)
+			resp, err := tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(HavePrefix("INSERTED "))
+
+			_, err = tc.Cmd("snapshot")
+			ExpectNoErr(err)
+			resp, err = tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(HavePrefix("OK "))
+			size, err := strconv.Atoi(strings.TrimPrefix(resp, "OK "))
+			ExpectNoErr(err)
+			body := make([]byte, size)
+			_, err = io.ReadFull(tc.R, body)
+			ExpectNoErr(err)
+
+			stats := map[string]interface{}{}
+			ExpectNoErr(yaml.Unmarshal(body, &stats))
+			Expect(stats).To(HaveKeyWithValue("jobs", 1))
+			Expect(stats).To(HaveKey("paused"))
+			Expect(stats).To(HaveKey("duration"))
+			snapshotPath, ok := stats["path"].(string)
+			Expect(ok).To(BeTrue())
+			Expect(path.Dir(snapshotPath)).To(Equal(path.Join(dataDir, "journal")))
+			_, err = os.Stat(snapshotPath)
+			ExpectNoErr(err)
+		}, 2)
+
+		It("Stops waiting for a job once the client hangs up", func(done Done) {
+			defer close(done)
+			waitAddr := ":9502"
+			hub := goyaad.NewHub(&goyaad.HubOpts{
+				Persister: persistence.NewJournalPersister(""),
+				SpokeSpan: time.Second * 5})
+			srv := protocol.ServeBeanstalkd(hub, waitAddr)
+			defer srv.Close()
+
+			var c net.Conn
+			Eventually(func() (err error) {
+				c, err = net.Dial(proto, waitAddr)
+				return err
+			}, "1s").Should(BeNil())
+			tc := textproto.NewConn(c)
+			_, err := tc.Cmd("reserve-with-timeout 10")
+			ExpectNoErr(err)
+			time.Sleep(50 * time.Millisecond)
+			tc.Close()
+			time.Sleep(50 * time.Millisecond)
+
+			// Nobody is reserving anymore - the job must stay put
+			ExpectNoErr(hub.AddJob(goyaad.NewJobAutoID(time.Now(), []byte("hello"))))
+			time.Sleep(300 * time.Millisecond)
+			Expect(hub.PendingJobsCount()).To(Equal(1))
+
+			// A client that keeps waiting gets the next job as soon as it is put
+			live, err := beanstalk.Dial(proto, waitAddr)
+			ExpectNoErr(err)
+			defer live.Close()
+			_, _, err = live.Reserve(time.Second)
+			ExpectNoErr(err)
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				hub.AddJob(goyaad.NewJobAutoID(time.Now(), []byte("later")))
+			}()
+			start := time.Now()
+			_, body, err := live.Reserve(5 * time.Second)
+			ExpectNoErr(err)
+			Expect(body).To(Equal([]byte("later")))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		}, 3)
+
+		It("Answers restoring until the hub restored its jobs", func(done Done) {
+			defer close(done)
+			restoreAddr := ":9503"
+			persister := newHeldRestorePersister()
+			hub := goyaad.NewHub(&goyaad.HubOpts{
+				Persister:      persister,
+				AttemptRestore: true,
+				SpokeSpan:      time.Second * 5})
+			srv := protocol.ServeBeanstalkd(hub, restoreAddr)
+			defer srv.Close()
+
+			var c net.Conn
+			Eventually(func() (err error) {
+				c, err = net.Dial(proto, restoreAddr)
+				return err
+			}, "1s").Should(BeNil())
+			tc := textproto.NewConn(c)
+			defer tc.Close()
+
+			_, err := tc.Cmd("put 0 0 1 5\r\nhello")
+			ExpectNoErr(err)
+			resp, err := tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(Equal("RESTORING"))
+			_, err = tc.Cmd("reserve-with-timeout 0")
+			ExpectNoErr(err)
+			resp, err = tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(Equal("RESTORING"))
+
+			// Stats are served while restoring
+			bc, err := beanstalk.Dial(proto, restoreAddr)
+			ExpectNoErr(err)
+			defer bc.Close()
+			stats, err := bc.Stats()
+			ExpectNoErr(err)
+			Expect(stats["restoring"]).To(Equal("true"))
+
+			close(persister.release)
+			Eventually(hub.Ready()).Should(BeClosed())
+			_, err = tc.Cmd("put 0 0 1 5\r\nhello")
+			ExpectNoErr(err)
+			resp, err = tc.ReadLine()
+			ExpectNoErr(err)
+			Expect(resp).To(HavePrefix("INSERTED "))
+		}, 2)
+
 		It("Puts a job and then deletes it", func(done Done) {
 			defer close(done)
 			hw := "Hello world"
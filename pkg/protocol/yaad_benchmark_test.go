@@ -3,6 +3,7 @@ package protocol_test
 import (
 	"fmt"
 	"math/rand"
+	"runtime"
 	"testing"
 	"time"
 
@@ -77,6 +78,43 @@ func BenchmarkRPCJobPuts(b *testing.B) {
 	}
 }
 
+type jobHub interface {
+	AddJob(j *goyaad.Job) error
+	Next() *goyaad.Job
+	Stop(persist bool)
+}
+
+// benchHub adds a mix of ready and future jobs and reads ready jobs from many goroutines at once, then stops the hub
+func benchHub(b *testing.B, hub jobHub) {
+	defer hub.Stop(false)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			delay := time.Second * time.Duration(rand.Intn(100)-50)
+			err := hub.AddJob(goyaad.NewJobAutoID(time.Now().Add(delay), nil))
+			if err != nil {
+				b.Fatal("Error submitting job", err)
+			}
+			hub.Next()
+		}
+	})
+}
+
+func BenchmarkHubParallel(b *testing.B) {
+	benchHub(b, goyaad.NewHub(&opts))
+}
+
+func BenchmarkShardedHubParallel(b *testing.B) {
+	for _, shards := range []int{2, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("Shards_%d", shards), func(b *testing.B) {
+			sh, err := goyaad.NewShardedHub(&goyaad.ShardedHubOpts{HubOpts: opts, Shards: shards})
+			if err != nil {
+				b.Fatal(err)
+			}
+			benchHub(b, sh)
+		})
+	}
+}
+
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 func randStringBytes(n int) []byte {
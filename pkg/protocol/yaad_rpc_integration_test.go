@@ -98,6 +98,188 @@ var _ = Describe("Test rpc protocol:", func() {
 		Expect(string(body)).To(Equal(hw))
 	}, 20)
 
+	It("Releases a batch callback once the batch is consumed", func(done Done) {
+		defer close(done)
+		defer GinkgoRecover()
+
+		batchID, err := client.OpenBatch()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(batchID).ToNot(BeEmpty())
+
+		id, err := client.PutInBatch(batchID, []byte("member"), 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = client.PutInBatch("unknown", []byte("member"), 0)
+		Expect(err).To(HaveOccurred())
+
+		cid, err := client.SealBatch(batchID, []byte("callback"), 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		p, err := client.BatchProgress(batchID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Total).To(Equal(1))
+		Expect(p.Pending).To(Equal(1))
+		Expect(p.Sealed).To(BeTrue())
+
+		rid, _, err := client.Next(time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rid).To(Equal(id))
+
+		rid, body, err := client.Next(time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rid).To(Equal(cid))
+		Expect(string(body)).To(Equal("callback"))
+	}, 5)
+
+	It("Delivers a job to every consumer group", func(done Done) {
+		defer close(done)
+		defer GinkgoRecover()
+
+		Expect(client.AddGroup("billing")).NotTo(HaveOccurred())
+		Expect(client.AddGroup("audit")).NotTo(HaveOccurred())
+
+		id, err := client.Put([]byte("fanout"), 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, g := range []string{"billing", "audit"} {
+			rid, body, err := client.NextFor(g, time.Second)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rid).To(Equal(id))
+			Expect(string(body)).To(Equal("fanout"))
+		}
+
+		_, _, err = client.NextFor("billing", 0)
+		Expect(err).To(HaveOccurred())
+		_, _, err = client.NextFor("unknown", 0)
+		Expect(err).To(HaveOccurred())
+	}, 5)
+
+	It("Puts a jittered job and reports its trigger time", func(done Done) {
+		defer close(done)
+		defer GinkgoRecover()
+
+		before := time.Now()
+		id, triggerAt, err := client.PutScheduled([]byte("jitter"), time.Hour, time.Minute, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(id).ToNot(BeEmpty())
+		Expect(triggerAt).To(BeTemporally("~", before.Add(time.Hour), time.Minute+time.Second))
+	}, 5)
+
+	It("Returns a typed error for puts over the memory limits", func(done Done) {
+		defer close(done)
+		defer GinkgoRecover()
+
+		limitedAddr := ":9600"
+		limited, err := protocol.ServeRPC(goyaad.NewHub(&goyaad.HubOpts{
+			Persister: persistence.NewJournalPersister(""),
+			SpokeSpan: time.Second * 5,
+			MaxBytes:  1024}), limitedAddr)
+		Expect(err).NotTo(HaveOccurred())
+		defer limited.Close()
+		c := &protocol.RPCClient{}
+		Eventually(func() error { return c.Connect(limitedAddr) }, "1s").Should(BeNil())
+		defer c.Close()
+
+		_, err = c.Put(make([]byte, 512), time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = c.Put(make([]byte, 512), time.Hour)
+		Expect(err).To(Equal(goyaad.ErrOutOfMemory))
+
+		stats, err := c.Stats()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.Memory.Jobs).To(Equal(int64(1)))
+		Expect(stats.Memory.MaxBytes).To(Equal(int64(1024)))
+	}, 5)
+
+	It("Stops waiting for a job once the client hangs up", func(done Done) {
+		defer close(done)
+		defer GinkgoRecover()
+
+		waitAddr := ":9601"
+		hub := goyaad.NewHub(&goyaad.HubOpts{
+			Persister: persistence.NewJournalPersister(""),
+			SpokeSpan: time.Second * 5})
+		waitSrv, err := protocol.ServeRPC(hub, waitAddr)
+		Expect(err).NotTo(HaveOccurred())
+		defer waitSrv.Close()
+		c := &protocol.RPCClient{}
+		Eventually(func() error { return c.Connect(waitAddr) }, "1s").Should(BeNil())
+
+		go c.Next(10 * time.Second)
+		time.Sleep(50 * time.Millisecond)
+		c.Close()
+		time.Sleep(50 * time.Millisecond)
+
+		// Nobody is waiting anymore - the job must stay put
+		Expect(hub.AddJob(goyaad.NewJobAutoID(time.Now(), []byte("hello")))).To(BeNil())
+		time.Sleep(300 * time.Millisecond)
+		Expect(hub.PendingJobsCount()).To(Equal(1))
+	}, 2)
+
+	It("Refuses jobs until the hub restored its jobs", func(done Done) {
+		defer close(done)
+		defer GinkgoRecover()
+
+		restoreAddr := ":9602"
+		persister := newHeldRestorePersister()
+		hub := goyaad.NewHub(&goyaad.HubOpts{
+			Persister:      persister,
+			AttemptRestore: true,
+			SpokeSpan:      time.Second * 5})
+		restoreSrv, err := protocol.ServeRPC(hub, restoreAddr)
+		Expect(err).NotTo(HaveOccurred())
+		defer restoreSrv.Close()
+		c := &protocol.RPCClient{}
+		Eventually(func() error { return c.Connect(restoreAddr) }, "1s").Should(BeNil())
+		defer c.Close()
+
+		_, err = c.Put([]byte("hello"), 0)
+		Expect(err).To(Equal(goyaad.ErrRestoring))
+		_, _, err = c.Next(0)
+		Expect(err).To(Equal(goyaad.ErrRestoring))
+		stats, err := c.Stats()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.Restoring).To(BeTrue())
+
+		close(persister.release)
+		Eventually(hub.Ready()).Should(BeClosed())
+		_, err = c.Put([]byte("hello"), 0)
+		Expect(err).NotTo(HaveOccurred())
+	}, 2)
+
+	It("Serves a sharded hub", func(done Done) {
+		defer close(done)
+		defer GinkgoRecover()
+
+		sh, err := goyaad.NewShardedHub(&goyaad.ShardedHubOpts{
+			HubOpts: goyaad.HubOpts{Persister: persistence.NewJournalPersister(""), SpokeSpan: time.Second},
+			Shards:  4,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		addr := fmt.Sprintf(":%d", port)
+		port++
+		s, err := protocol.ServeRPC(sh, addr)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		c := &protocol.RPCClient{}
+		Eventually(func() error {
+			return c.Connect(addr)
+		}, "1s").Should(BeNil())
+
+		id, err := c.Put([]byte("sharded"), 200*time.Millisecond)
+		Expect(err).NotTo(HaveOccurred())
+		rid, body, err := c.Next(time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rid).To(Equal(id))
+		Expect(string(body)).To(Equal("sharded"))
+
+		_, err = c.OpenBatch()
+		Expect(err).To(MatchError(protocol.ErrNotSupported.Error()))
+		Expect(c.AddGroup("billing")).To(MatchError(protocol.ErrNotSupported.Error()))
+		_, _, err = c.NextFor("billing", 0)
+		Expect(err).To(MatchError(goyaad.ErrGroupNotFound.Error()))
+	}, 5)
+
 	It("Puts a job and then deletes it", func(done Done) {
 		defer close(done)
 		defer GinkgoRecover()
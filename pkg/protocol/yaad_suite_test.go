@@ -1,11 +1,13 @@
 package protocol_test
 
 import (
+	"context"
 	"log"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/sirupsen/logrus"
+	"github.com/urjitbhatia/goyaad/pkg/persistence"
 
 	"testing"
 )
@@ -19,3 +21,25 @@ func TestYaad(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "GoYaad Protocol Suite")
 }
+
+// heldRestorePersister holds hub restores back until release is closed
+type heldRestorePersister struct {
+	persistence.Persister
+	release chan struct{}
+}
+
+func newHeldRestorePersister() *heldRestorePersister {
+	return &heldRestorePersister{
+		Persister: persistence.NewJournalPersister(""),
+		release:   make(chan struct{}),
+	}
+}
+
+func (p *heldRestorePersister) Read(ctx context.Context) (<-chan persistence.RecordResult, error) {
+	c := make(chan persistence.RecordResult)
+	go func() {
+		<-p.release
+		close(c)
+	}()
+	return c, nil
+}
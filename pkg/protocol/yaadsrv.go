@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"context"
 	"strconv"
 	"time"
 
@@ -19,11 +20,11 @@ type TubeYaad struct {
 	paused   bool
 	jobIDCtr int
 	// Backed by a yaad hub
-	hub *goyaad.Hub
+	hub Hub
 }
 
 // NewSrvYaad returns a yaad BeanstalkdSrv
-func NewSrvYaad(hub *goyaad.Hub) BeanstalkdSrv {
+func NewSrvYaad(hub Hub) BeanstalkdSrv {
 	y := SrvYaad{make(map[string]Tube)}
 	t := &TubeYaad{
 		name:   "default",
@@ -67,9 +68,18 @@ func (t *TubeYaad) pauseTube(delay time.Duration) error {
 	return nil
 }
 
-func (t *TubeYaad) put(delay int, pri int32, body []byte, ttr int) (string, error) {
-	j := goyaad.NewJobAutoID(time.Now().Add(time.Second*time.Duration(delay)), body)
+func (t *TubeYaad) put(delay int, pri int32, body []byte, ttr int, opts putOpts) (string, error) {
+	j := goyaad.NewJobAutoID(t.hub.Now().Add(time.Second*time.Duration(delay)), body)
 	j.SetOpts(pri, time.Duration(ttr)*time.Second)
+	j.SetJitter(opts.jitter)
+	j.SetSpread(opts.spread)
+	j.SetWindows(opts.windows)
+	if opts.key != "" {
+		j.SetKey(opts.key)
+	}
+	if opts.misfire.Policy != goyaad.MisfireDefault {
+		j.SetMisfire(opts.misfire)
+	}
 
 	err := t.hub.AddJob(j)
 	if err != nil {
@@ -79,43 +89,154 @@ func (t *TubeYaad) put(delay int, pri int32, body []byte, ttr int) (string, erro
 	return j.ID(), nil
 }
 
-func (t *TubeYaad) reserve(timeoutSec string) *Job {
+// reserve waits up to timeoutSec for a job. Waiting stops early once ctx is done, like when the client hangs up.
+func (t *TubeYaad) reserve(ctx context.Context, timeoutSec string, group string) (*Job, error) {
 	ts, err := strconv.Atoi(timeoutSec)
 	if err != nil {
 		logrus.Errorf("Error parsing timeout: %s", err)
-		return nil
+		return nil, err
 	}
 
 	logrus.Debug("yaad srv reserve")
-	// try once
-	if j := t.hub.Next(); j != nil {
-		return &Job{
-			body: j.Body(),
-			id:   j.ID(),
-			size: len(j.Body()),
-		}
-	}
+	var j *goyaad.Job
 	if ts == 0 {
-		return nil
-	}
-
-	waitTill := time.Now().Add(time.Duration(ts) * time.Second)
-	// wait for timeout and keep trying
-	logrus.Debug("waiting for reserve: ", timeoutSec)
-	for waitTill.After(time.Now()) {
-		if j := t.hub.Next(); j != nil {
-			return &Job{
-				body: j.Body(),
-				id:   j.ID(),
-				size: len(j.Body()),
-			}
+		// try once
+		j, err = t.hub.NextFor(group)
+	} else {
+		logrus.Debug("waiting for reserve: ", timeoutSec)
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(ts)*time.Second)
+		j, err = t.hub.NextForWait(ctx, group)
+		cancel()
+		if err == context.DeadlineExceeded || err == context.Canceled {
+			err = nil
 		}
-		time.Sleep(time.Millisecond * 200)
 	}
-	logrus.Debug("yaad srv reserve done - no job found")
+	if err != nil {
+		return nil, err
+	}
+	if j == nil {
+		logrus.Debug("yaad srv reserve done - no job found")
+		return nil, nil
+	}
+	return &Job{
+		body: j.Body(),
+		id:   j.ID(),
+		size: len(j.Body()),
+	}, nil
+}
+
+func (t *TubeYaad) stats() map[string]interface{} {
+	s := t.hub.Stats()
+	stats := map[string]interface{}{
+		"name":                 t.name,
+		"current-jobs-pending": s.PendingJobs,
+		"current-jobs-backlog": s.ReadyBacklog,
+		"current-spokes":       s.Spokes,
+		"total-jobs-removed":   s.RemovedJobs,
+		"rate-limit":           s.RateLimit,
+		"rate-burst":           s.RateBurst,
+		"rate-tokens":          s.RateTokens,
+		"throttled":            s.Throttled,
+		"throttled-count":      s.ThrottledCount,
+		"spoke-jobs-min":       s.SpokeJobs.Min,
+		"spoke-jobs-p50":       s.SpokeJobs.P50,
+		"spoke-jobs-p90":       s.SpokeJobs.P90,
+		"spoke-jobs-p99":       s.SpokeJobs.P99,
+		"spoke-jobs-max":       s.SpokeJobs.Max,
+		"spoke-span-min":       s.SpokeJobs.MinSpan.String(),
+		"spoke-span-max":       s.SpokeJobs.MaxSpan.String(),
+		"body-bytes":           s.BodyBytes,
+		"spilled-jobs":         s.SpilledJobs,
+		"spill-bytes":          s.SpillBytes,
+		"memory-jobs":          s.Memory.Jobs,
+		"memory-bytes":         s.Memory.Bytes,
+		"max-jobs":             s.Memory.MaxJobs,
+		"max-bytes":            s.Memory.MaxBytes,
+		"now":                  s.Now.Format(time.RFC3339Nano),
+		"clock-offset":         s.ClockOffset.String(),
+		"restoring":            s.Restoring,
+		"misfired-jobs":        s.MisfiredJobs,
+		"clock-jumps":          s.ClockJumps,
+		"delivery-paused":      s.DeliveryPaused,
+	}
+	if len(s.SharedMemory) > 0 {
+		global := s.SharedMemory[0]
+		stats["global-memory-jobs"] = global.Jobs
+		stats["global-memory-bytes"] = global.Bytes
+		stats["global-max-jobs"] = global.MaxJobs
+		stats["global-max-bytes"] = global.MaxBytes
+	}
+	return stats
+}
+
+func (t *TubeYaad) statsJob(id int) (map[string]interface{}, error) {
+	j, err := t.hub.FindJob(strconv.Itoa(id))
+	if err != nil {
+		return nil, ErrJobNotFound
+	}
+	state := "delayed"
+	timeLeft := j.TriggerAt().Sub(t.hub.Now())
+	if timeLeft < 0 {
+		state = "ready"
+		timeLeft = 0
+	}
+	return map[string]interface{}{
+		"id":           j.ID(),
+		"tube":         t.name,
+		"state":        state,
+		"pri":          j.Pri(),
+		"ttr":          int(j.TTR().Seconds()),
+		"time-left":    int(timeLeft.Seconds()),
+		"trigger-at":   j.TriggerAt().Format(time.RFC3339Nano),
+		"window-moves": j.WindowMoves(),
+	}, nil
+}
+
+// snapshot writes a snapshot of the hub right away
+func (t *TubeYaad) snapshot() (map[string]interface{}, error) {
+	s, err := t.hub.Checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"path":     s.Path,
+		"jobs":     s.Jobs,
+		"bytes":    s.Bytes,
+		"paused":   s.Paused.String(),
+		"duration": s.Duration.String(),
+	}, nil
+}
+
+func (t *TubeYaad) resumeDelivery() {
+	t.hub.ResumeDelivery()
+}
+
+// ready returns false while the hub is still restoring jobs from disk
+func (t *TubeYaad) ready() bool {
+	return t.hub.IsReady()
+}
+
+func (t *TubeYaad) timeTravel(offset time.Duration) (time.Time, error) {
+	return t.hub.SetClockOffset(offset)
+}
+
+func (t *TubeYaad) addGroup(name string) error {
+	g, ok := t.hub.(groupHub)
+	if !ok {
+		return ErrNotSupported
+	}
+	g.AddGroup(name)
 	return nil
 }
 
+func (t *TubeYaad) removeGroup(name string) error {
+	g, ok := t.hub.(groupHub)
+	if !ok {
+		return ErrNotSupported
+	}
+	return g.RemoveGroup(name)
+}
+
 func (t *TubeYaad) deleteJob(id int) error {
 	strID := strconv.Itoa(id)
 	return t.hub.CancelJob(strID)